@@ -2,76 +2,151 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
 
+	"gitlab.com/asciishell/tfs-go-auction/internal/auction"
 	"gitlab.com/asciishell/tfs-go-auction/internal/auth"
 	"gitlab.com/asciishell/tfs-go-auction/internal/errs"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/internal/hub"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lockout"
 	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/internal/mailer"
+	"gitlab.com/asciishell/tfs-go-auction/internal/proxybid"
 	"gitlab.com/asciishell/tfs-go-auction/internal/services"
+	"gitlab.com/asciishell/tfs-go-auction/internal/session"
 	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
 	"gitlab.com/asciishell/tfs-go-auction/internal/template"
 	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
 	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
 )
 
 type AuctionHandler struct {
-	storage     *storage.Storage
-	logger      log.Logger
-	temps       template.Templates
-	wsClients   WSClients
-	priceTickCh chan lot.Lot
-	upgrader    websocket.Upgrader
+	storage    *storage.Storage
+	logger     log.Logger
+	temps      template.Templates
+	events     *event.Stream
+	upgrader   websocket.Upgrader
+	rates      *money.Rates
+	adminToken string
+	streams    *connLimiter
+	// tokens and denylist are set when access tokens are JWTs.
+	tokens   *jwt.Tokens
+	denylist *jwt.Denylist
+	mailer   mailer.Mailer
+	// requireVerified blocks bids of users with unverified emails.
+	requireVerified bool
+	passwordPolicy  user.PasswordPolicy
+	// totpIssuer names the service in authenticator apps.
+	totpIssuer string
+	// accounts and addresses delay and lock signin and 2FA attempts after failures, they are off when nil.
+	accounts  *lockout.Limiter
+	addresses *lockout.Limiter
 }
-type WSClients struct {
-	wsConn []*websocket.Conn
-	*sync.Mutex
+
+// connLimiter counts realtime connections (websockets and event streams) of every user.
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int
+	conns map[int]int
 }
 
-func (clients *WSClients) AddClient(h *AuctionHandler, conn *websocket.Conn) {
-	clients.Mutex.Lock()
-	clients.wsConn = append(clients.wsConn, conn)
-	clients.Mutex.Unlock()
-	h.logger.Infof("added client, total clients: %d\n", len(h.wsClients.wsConn))
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, conns: make(map[int]int)}
 }
 
-func (clients *WSClients) removeClientByID(h *AuctionHandler, id int) {
-	clients.Mutex.Lock()
-	clients.wsConn = append(clients.wsConn[:id], clients.wsConn[id+1:]...)
-	clients.Mutex.Unlock()
-	h.logger.Infof("removed client #%d, total clients %d\n", id, len(clients.wsConn))
+func (l *connLimiter) acquire(userID int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.conns[userID] >= l.max {
+		return false
+	}
+	l.conns[userID]++
+	return true
 }
 
-func (clients *WSClients) BroadcastMessage(h *AuctionHandler, message []byte) {
-	for i, c := range clients.wsConn {
-		err := c.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			h.logger.Infof("can't broadcast message: %+v\n", err)
-			clients.removeClientByID(h, i)
+func (l *connLimiter) release(userID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[userID]--; l.conns[userID] <= 0 {
+		delete(l.conns, userID)
+	}
+}
+
+// checkOrigin allows handshakes without Origin (not a browser) and from listed origins,
+// "*" allows any origin. Without a list only the same host is allowed.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if len(allowed) == 0 {
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+		for _, v := range allowed {
+			if v == "*" || strings.EqualFold(strings.TrimSuffix(v, "/"), origin) {
+				return true
+			}
 		}
+		return false
 	}
 }
 
 type key int
 
-const userKey key = 0
+const (
+	userKey    key = 0
+	sessionKey key = 1
+	// roleKey keeps the user.Role of the request user.
+	roleKey key = 2
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxMessageSize = 4096
+	sseHeartbeat     = 15 * time.Second
+	defaultStreams   = 5
+)
 
 func NewAuctionHandler(storage storage.Storage, logger *log.Logger, temps template.Templates) *AuctionHandler {
 	h := AuctionHandler{storage: &storage, logger: *logger, temps: temps}
-	h.priceTickCh = make(chan lot.Lot)
+	h.events = event.NewStream(hub.New(hub.DefaultQueueSize), event.NewLocalBus(), event.DefaultRetention, *logger)
+	h.rates = money.NewRates(money.DefaultCurrency)
 	h.upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    []string{auth.WSProtocol},
+		CheckOrigin:     checkOrigin(nil),
 	}
+	h.streams = newConnLimiter(defaultStreams)
+	h.mailer = mailer.NewMemory()
 	return &h
 }
 
@@ -85,7 +160,13 @@ func (h AuctionHandler) logInfo(r *http.Request, msg string, args ...interface{}
 
 func (h *AuctionHandler) Authenticator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sess, err := auth.HandleToken(r, h.storage)
+		var sess *session.Session
+		var err error
+		if h.tokens != nil {
+			sess, err = auth.HandleJWT(r, h.tokens, h.denylist)
+		} else {
+			sess, err = auth.HandleToken(r, h.storage)
+		}
 		if err != nil {
 			switch err {
 			case errs.ErrUnauthorized:
@@ -97,11 +178,88 @@ func (h *AuctionHandler) Authenticator(next http.Handler) http.Handler {
 			}
 			return
 		}
+		role, err := h.sessionRole(sess)
+		if err != nil {
+			if err == errs.ErrBanned {
+				http.Error(w, errs.NewErrorStr("Пользователь заблокирован").StringJSON(), http.StatusForbidden)
+				return
+			}
+			http.Error(w, errs.NewErrorStr("Пользователь не авторизован").StringJSON(), http.StatusUnauthorized)
+			return
+		}
 		ctx := context.WithValue(r.Context(), userKey, sess.UserID)
+		ctx = context.WithValue(ctx, sessionKey, sess)
+		ctx = context.WithValue(ctx, roleKey, role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// sessionRole returns the role of the session user. A JWT carries the role, for an opaque token the user
+// is loaded, so role changes and bans apply at once.
+func (h *AuctionHandler) sessionRole(sess *session.Session) (user.Role, error) {
+	if sess.Claims != nil {
+		return user.HighestRole(sess.Claims.Roles), nil
+	}
+	u, err := services.FindUserByID(sess.UserID, h.storage)
+	if err != nil {
+		return "", err
+	}
+	if u.Banned() {
+		return "", errs.ErrBanned
+	}
+	return u.UserRole(), nil
+}
+
+// RequireRole lets through requests of users with the role or a higher one, it follows Authenticator.
+// X-Admin-Token grants every role, so the first admin can be appointed.
+func (h *AuctionHandler) RequireRole(role user.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !h.hasRole(r, role) {
+				http.Error(w, errs.NewErrorStr("Запрещено").StringJSON(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (h *AuctionHandler) hasRole(r *http.Request, role user.Role) bool {
+	if current, ok := r.Context().Value(roleKey).(user.Role); ok && current.Has(role) {
+		return true
+	}
+	token := r.Header.Get("X-Admin-Token")
+	return h.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1
+}
+
+func parsePage(r *http.Request) (int, int, error) {
+	limit, offset := defaultPageLimit, 0
+	var err error
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("limit should be positive integer")
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset should be non-negative integer")
+		}
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, offset, nil
+}
+
+// parseDisplayCurrency reads ?display_currency=, empty currency means no conversion.
+func parseDisplayCurrency(r *http.Request) (money.Currency, error) {
+	c := money.Currency(strings.ToUpper(r.URL.Query().Get("display_currency")))
+	if c != "" && !c.Valid() {
+		return "", fmt.Errorf("display_currency should be an ISO 4217 code")
+	}
+	return c, nil
+}
+
 func (h *AuctionHandler) PostSignup(w http.ResponseWriter, r *http.Request) {
 	var userData user.User
 	err := json.NewDecoder(r.Body).Decode(&userData)
@@ -109,9 +267,14 @@ func (h *AuctionHandler) PostSignup(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errs.NewError(errors.Wrapf(err, "Неверные входные данные")).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	err = services.Registry(&userData, h.storage)
+	err = services.Registry(&userData, h.passwordPolicy, h.storage)
+	if _, ok := err.(user.PolicyError); ok {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
 	switch err {
 	case nil:
+		h.sendVerification(r, userData)
 		http.Error(w, "", http.StatusCreated)
 	case errs.ErrEmptyCredits:
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
@@ -126,222 +289,1475 @@ func (h *AuctionHandler) PostSignin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	sess, err := auth.Signin(userData.Email, userData.Password, h.storage)
-	if err != nil {
+	account := lockout.AccountKey(userData.Email)
+	if h.rejectAttempt(w, r, account) {
+		return
+	}
+	sess, challenge, err := auth.Signin(userData.Email, userData.Password, clientIP(r), r.UserAgent(), h.storage)
+	if err == errs.ErrWrongCredentials {
+		h.failAttempt(w, r, account)
 		http.Error(w, errs.NewError(errors.Wrapf(err, "Пользователь не авторизован")).StringJSON(), http.StatusUnauthorized)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{Name: "BearerToken", Value: sess.SessionID, Path: "/", Expires: sess.ValidUntil})
-	err = json.NewEncoder(w).Encode(sess)
+	if err == errs.ErrBanned {
+		http.Error(w, errs.NewErrorStr("Пользователь заблокирован").StringJSON(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write session"))
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
 		return
 	}
-
+	// Failures are kept until the code is checked, otherwise the password would reset failed codes.
+	if challenge != nil {
+		w.WriteHeader(http.StatusAccepted)
+		if err = json.NewEncoder(w).Encode(challenge); err != nil {
+			h.logError(r, errors.Wrap(err, "can't write challenge"))
+		}
+		return
+	}
+	h.resetAttempts(r, account)
+	h.writeSession(w, r, sess)
 }
 
-func (h *AuctionHandler) PutUser(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
+// PostSigninTwoFactor completes signin of a user with 2FA by the challenge and a TOTP or recovery code.
+func (h *AuctionHandler) PostSigninTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	if id != 0 && id != r.Context().Value(userKey).(int) {
-		http.Error(w, errs.NewErrorStr("Запрещено").StringJSON(), http.StatusForbidden)
+	if data.ChallengeToken == "" || data.Code == "" {
+		http.Error(w, errs.NewErrorStr("challenge_token and code should not be blank").StringJSON(), http.StatusBadRequest)
 		return
 	}
-	userData := user.User{ID: r.Context().Value(userKey).(int)}
-	err = (*h.storage).GetUser(&userData)
+	u, err := auth.CheckChallenge(data.ChallengeToken, h.storage)
 	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		http.Error(w, errs.NewError(errors.Wrapf(err, "Пользователь не авторизован")).StringJSON(), http.StatusUnauthorized)
 		return
 	}
-
-	var newUser user.User
-	err = json.NewDecoder(r.Body).Decode(&newUser)
-	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+	if h.rejectAttempt(w, r, lockout.UserKey(u.ID)) {
 		return
 	}
-	userData.Update(newUser)
-	err = json.NewEncoder(w).Encode(userData)
+	sess, err := auth.SigninTwoFactor(*u, data.ChallengeToken, data.Code, clientIP(r), r.UserAgent(), h.storage)
 	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write user"))
+		if err == errs.ErrWrongCode || err == user.ErrCodeUsed {
+			h.failAttempt(w, r, lockout.UserKey(u.ID))
+		}
+		http.Error(w, errs.NewError(errors.Wrapf(err, "Пользователь не авторизован")).StringJSON(), http.StatusUnauthorized)
 		return
 	}
+	h.resetAttempts(r, lockout.UserKey(u.ID), lockout.AccountKey(u.Email))
+	h.writeSession(w, r, sess)
 }
 
-func (h *AuctionHandler) GetUser(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
-		return
+type attemptLimit struct {
+	limiter *lockout.Limiter
+	key     string
+}
+
+func (h *AuctionHandler) attemptLimits(r *http.Request, key string) []attemptLimit {
+	return []attemptLimit{{limiter: h.accounts, key: key}, {limiter: h.addresses, key: lockout.AddressKey(clientIP(r))}}
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+}
+
+// rejectAttempt responds with 429 while attempts of the key or from the address are delayed after failures.
+func (h *AuctionHandler) rejectAttempt(w http.ResponseWriter, r *http.Request, key string) bool {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range h.attemptLimits(r, key) {
+		if l.limiter == nil {
+			continue
+		}
+		d, err := l.limiter.Wait(l.key, now)
+		if err != nil {
+			h.logError(r, err)
+			continue
+		}
+		if d > wait {
+			wait = d
+		}
 	}
-	if id == 0 {
-		id = r.Context().Value(userKey).(int)
+	if wait == 0 {
+		return false
 	}
-	usr, err := services.FindUserByID(id, h.storage)
-	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
-		return
+	setRetryAfter(w, wait)
+	http.Error(w, errs.NewErrorStr("слишком много неудачных попыток, повторите позже").StringJSON(), http.StatusTooManyRequests)
+	return true
+}
+
+// failAttempt counts a failure of the key and of the address, Retry-After tells when to try again.
+func (h *AuctionHandler) failAttempt(w http.ResponseWriter, r *http.Request, key string) {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range h.attemptLimits(r, key) {
+		if l.limiter == nil {
+			continue
+		}
+		d, err := l.limiter.Fail(l.key, now)
+		if err != nil {
+			h.logError(r, err)
+			continue
+		}
+		if d > wait {
+			wait = d
+		}
 	}
-	err = json.NewEncoder(w).Encode(usr)
-	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write user"))
+	if wait > 0 {
+		setRetryAfter(w, wait)
+	}
+}
+
+// resetAttempts forgets failures of the keys after a success, failures from the address are kept.
+func (h *AuctionHandler) resetAttempts(r *http.Request, keys ...string) {
+	if h.accounts == nil {
 		return
 	}
+	for _, key := range keys {
+		if err := h.accounts.Reset(key); err != nil {
+			h.logError(r, err)
+		}
+	}
 }
-func (h *AuctionHandler) GetLots(w http.ResponseWriter, r *http.Request) {
-	lotType := r.URL.Query().Get("status")
-	data, err := services.GetLots(lotType, *h.storage)
-	if err != nil {
+
+func (h *AuctionHandler) writeSession(w http.ResponseWriter, r *http.Request, sess session.Session) {
+	if err := h.issueAccessToken(&sess); err != nil {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
 		h.logError(r, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(data)
-	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write lots"))
-		return
+	setSessionCookies(w, sess)
+	if err := json.NewEncoder(w).Encode(sess); err != nil {
+		h.logError(r, errors.Wrap(err, "can't write session"))
 	}
 }
-func (h *AuctionHandler) PostLots(w http.ResponseWriter, r *http.Request) {
-	var lotData lot.Lot
-	err := json.NewDecoder(r.Body).Decode(&lotData)
+
+// issueAccessToken replaces the opaque access token of the session with a JWT with the user role in JWT mode.
+func (h *AuctionHandler) issueAccessToken(sess *session.Session) error {
+	if h.tokens == nil {
+		return nil
+	}
+	u, err := services.FindUserByID(sess.UserID, h.storage)
 	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return err
+	}
+	return auth.IssueJWT(sess, u.UserRole(), h.tokens)
+}
+
+const refreshCookiePath = "/v1/auction/token"
+
+func setSessionCookies(w http.ResponseWriter, sess session.Session) {
+	http.SetCookie(w, &http.Cookie{Name: "BearerToken", Value: sess.Token(), Path: "/", Expires: sess.ValidUntil})
+	http.SetCookie(w, &http.Cookie{Name: "RefreshToken", Value: sess.RefreshToken, Path: refreshCookiePath,
+		Expires: sess.RefreshUntil, HttpOnly: true})
+}
+
+// PostRefreshToken exchanges a refresh token from the body (JSON or OAuth2 form) or the RefreshToken cookie
+// for new tokens. The refresh token can be used once.
+func (h *AuctionHandler) PostRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		GrantType    string `json:"grant_type"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		data.GrantType = r.PostFormValue("grant_type")
+		data.RefreshToken = r.PostFormValue("refresh_token")
+	} else if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+			return
+		}
+	}
+	if data.GrantType != "" && data.GrantType != "refresh_token" {
+		http.Error(w, errs.NewErrorStr("grant_type should be refresh_token").StringJSON(), http.StatusBadRequest)
 		return
 	}
-	lotData.CreatorID = r.Context().Value(userKey).(int)
-	err = (*h.storage).AddLot(&lotData)
+	if cookie, err := r.Cookie("RefreshToken"); data.RefreshToken == "" && err == nil {
+		data.RefreshToken = cookie.Value
+	}
+	if data.RefreshToken == "" {
+		http.Error(w, errs.NewErrorStr("refresh_token should not be blank").StringJSON(), http.StatusBadRequest)
+		return
+	}
+	sess, err := services.RefreshSession(data.RefreshToken, clientIP(r), r.UserAgent(), *h.storage)
 	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		if err == session.ErrRefreshReused {
+			// In JWT mode issued access tokens of the family stay valid until they expire.
+			h.logInfo(r, "refresh token reuse, the session family is revoked")
+		}
+		http.Error(w, errs.NewError(errors.Wrapf(err, "Пользователь не авторизован")).StringJSON(), http.StatusUnauthorized)
 		return
 	}
-	err = json.NewEncoder(w).Encode(lotData)
+	h.writeSession(w, r, sess)
+}
+
+// reserveVisible reports whether the reserve price of the lot can be shown to the user of the request,
+// only the creator sees it.
+func reserveVisible(r *http.Request, l lot.Lot) bool {
+	viewer, ok := r.Context().Value(userKey).(int)
+	return ok && viewer == l.CreatorID
+}
+
+// clientIP returns the remote address without the port, it is taken from proxy headers only when
+// TRUST_PROXY_HEADERS is set.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// PostSignout revokes the session of the request and clears the cookie.
+func (h *AuctionHandler) PostSignout(w http.ResponseWriter, r *http.Request) {
+	sess := r.Context().Value(sessionKey).(*session.Session)
+	if err := h.signout(sess); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
 		return
 	}
+	http.SetCookie(w, &http.Cookie{Name: "BearerToken", Value: "", Path: "/", Expires: time.Unix(0, 0), MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: "RefreshToken", Value: "", Path: refreshCookiePath, Expires: time.Unix(0, 0), MaxAge: -1, HttpOnly: true})
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// signout deletes the session from storage. A session restored from a JWT is found by its public id,
+// the family may be already revoked, then only tokens are denied.
+func (h *AuctionHandler) signout(sess *session.Session) error {
+	if sess.Claims == nil {
+		return (*h.storage).DeleteSession(sess)
+	}
+	found, err := services.FindSession(sess.UserID, sess.PublicID(), *h.storage)
+	switch err {
+	case nil:
+		if err = (*h.storage).DeleteSession(&found); err != nil {
+			return err
+		}
+	case errs.ErrNotFound:
+	default:
+		return err
+	}
+	return h.denySession(*sess)
+}
 
+// denySession denies access tokens of the session family in JWT mode, opaque tokens are revoked with the session.
+func (h *AuctionHandler) denySession(sess session.Session) error {
+	if h.denylist == nil {
+		return nil
+	}
+	return h.denylist.RevokeSession(sess.PublicID(), session.AccessTokenLifeTime)
 }
-func (h *AuctionHandler) GetLot(w http.ResponseWriter, r *http.Request) {
+
+// GetUserSessions lists active sessions of the user, the current one is marked.
+func (h *AuctionHandler) GetUserSessions(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	lotData := lot.Lot{ID: id}
-	err = (*h.storage).GetLot(&lotData)
+	current := r.Context().Value(sessionKey).(*session.Session)
+	if id != 0 && id != current.UserID {
+		http.Error(w, errs.NewErrorStr("Запрещено").StringJSON(), http.StatusForbidden)
+		return
+	}
+	sessions, err := (*h.storage).GetSessions(current.UserID)
 	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(lotData)
+	result := make([]session.Info, 0, len(sessions))
+	for _, s := range sessions {
+		result = append(result, s.Info(s.PublicID() == current.PublicID()))
+	}
+	err = json.NewEncoder(w).Encode(result)
 	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write lot"))
+		h.logError(r, errors.Wrap(err, "can't write sessions"))
 		return
 	}
 }
-func (h *AuctionHandler) PutLot(w http.ResponseWriter, r *http.Request) {
-	// Лот в БД
+
+// DeleteUserSession revokes a session of the user by its public id.
+func (h *AuctionHandler) DeleteUserSession(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	lotData := lot.Lot{ID: id, Status: lot.Created.String()}
-	err = (*h.storage).GetLot(&lotData)
+	current := r.Context().Value(sessionKey).(*session.Session)
+	if id != 0 && id != current.UserID {
+		http.Error(w, errs.NewErrorStr("Запрещено").StringJSON(), http.StatusForbidden)
+		return
+	}
+	sess, err := services.FindSession(current.UserID, chi.URLParam(r, "session"), *h.storage)
 	if err != nil {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
 		return
 	}
-	if lotData.CreatorID != r.Context().Value(userKey) {
-		http.Error(w, errs.NewErrorStr("пользователь не соответствует создателю").StringJSON(), http.StatusNotFound)
+	if err = (*h.storage).DeleteSession(&sess); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
 		return
 	}
-	// Новый лот
-	var newLot lot.Lot
-	err = json.NewDecoder(r.Body).Decode(&newLot)
+	if err = h.denySession(sess); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// sendMail sends the message in background, so the response does not depend on the mail server
+// and does not tell whether an email is registered.
+func (h *AuctionHandler) sendMail(r *http.Request, m mailer.Message) {
+	go func() {
+		if err := h.mailer.Send(m); err != nil {
+			h.logError(r, err)
+		}
+	}()
+}
+
+func (h *AuctionHandler) sendVerification(r *http.Request, u user.User) {
+	token, err := services.IssueUserToken(u.ID, user.EmailVerification, user.EmailVerificationLifeTime, *h.storage)
 	if err != nil {
+		h.logError(r, err)
+		return
+	}
+	h.sendMail(r, mailer.Message{To: u.Email, Subject: "Подтверждение email",
+		Body: fmt.Sprintf("Код подтверждения email: %s\nКод действует %d ч.", token, int(user.EmailVerificationLifeTime.Hours()))})
+}
+
+// PostPasswordForgot sends a password reset token to the email, the response is the same for unknown emails.
+func (h *AuctionHandler) PostPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	newLot.ID = id
-	err = (*h.storage).UpdateLot(&newLot)
-	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+	if data.Email == "" {
+		http.Error(w, errs.NewErrorStr("email should not be blank").StringJSON(), http.StatusBadRequest)
 		return
 	}
-	err = json.NewEncoder(w).Encode(newLot)
-	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write lot"))
+	key := lockout.ResetKey(data.Email)
+	if h.rejectAttempt(w, r, key) {
 		return
 	}
+	// Every request is counted like a failure, so mails to an address and requests from a client are limited.
+	h.failAttempt(w, r, key)
+	// The user is looked up in background, so the response time doesn't tell whether the email is registered.
+	go h.sendPasswordReset(r, data.Email)
+	http.Error(w, "", http.StatusAccepted)
 }
-func (h *AuctionHandler) DeleteLot(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+
+func (h *AuctionHandler) sendPasswordReset(r *http.Request, email string) {
+	u := user.User{Email: email}
+	if err := (*h.storage).GetUser(&u); err != nil {
 		return
 	}
-	lotData := lot.Lot{ID: id, Status: lot.Created.String(), CreatorID: r.Context().Value(userKey).(int)}
-	err = (*h.storage).DeleteLot(&lotData)
+	token, err := services.IssueUserToken(u.ID, user.PasswordReset, user.PasswordResetLifeTime, *h.storage)
 	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		h.logError(r, err)
 		return
 	}
-	http.Error(w, "", http.StatusNoContent)
+	err = h.mailer.Send(mailer.Message{To: u.Email, Subject: "Сброс пароля",
+		Body: fmt.Sprintf("Код для сброса пароля: %s\nКод действует %d ч. Если вы не запрашивали сброс, проигнорируйте письмо.",
+			token, int(user.PasswordResetLifeTime.Hours()))})
+	if err != nil {
+		h.logError(r, err)
+	}
 }
 
-func (h *AuctionHandler) BuyLot(w http.ResponseWriter, r *http.Request) {
-	type BuyLot struct {
-		Price int
+// PostPasswordReset sets a new password by the token from the email and revokes all sessions of the user.
+func (h *AuctionHandler) PostPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
 	}
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	var price BuyLot
-	err = json.NewDecoder(r.Body).Decode(&price)
-	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+	if data.Token == "" || data.Password == "" {
+		http.Error(w, errs.NewErrorStr("token and password should not be blank").StringJSON(), http.StatusBadRequest)
 		return
 	}
-	newLot, err := (*h.storage).BuyLot(id, r.Context().Value(userKey).(int), price.Price)
+	userID, err := services.ResetPassword(data.Token, data.Password, h.passwordPolicy, *h.storage)
 	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusConflict)
+		http.Error(w, errs.NewError(errors.Wrap(err, "Невозможно сбросить пароль")).StringJSON(), http.StatusBadRequest)
 		return
 	}
-	h.priceTickCh <- newLot
-	err = json.NewEncoder(w).Encode(newLot)
-	if err != nil {
-		h.logError(r, errors.Wrap(err, "can't write lots"))
+	if err = h.revokeUserSessions(userID, ""); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
 		return
 	}
+	http.Error(w, "", http.StatusNoContent)
 }
-func (h *AuctionHandler) GetUserLots(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+// revokeUserSessions revokes sessions of the user except the one with the public id except.
+func (h *AuctionHandler) revokeUserSessions(userID int, except string) error {
+	sessions, err := (*h.storage).GetSessions(userID)
 	if err != nil {
-		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
-		return
+		return errors.Wrap(err, "can't get sessions")
+	}
+	for i := range sessions {
+		if except != "" && sessions[i].PublicID() == except {
+			continue
+		}
+		if err = (*h.storage).DeleteSession(&sessions[i]); err != nil {
+			return errors.Wrap(err, "can't revoke session")
+		}
+		if err = h.denySession(sessions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutUserPassword changes the password of the user of the request and revokes other sessions of the user.
+func (h *AuctionHandler) PutUserPassword(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	current := r.Context().Value(sessionKey).(*session.Session)
+	if id != 0 && id != current.UserID {
+		http.Error(w, errs.NewErrorStr("Запрещено").StringJSON(), http.StatusForbidden)
+		return
+	}
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	err = services.ChangePassword(current.UserID, data.CurrentPassword, data.NewPassword, h.passwordPolicy, *h.storage)
+	if _, ok := err.(user.PolicyError); ok {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	switch err {
+	case nil:
+	case errs.ErrWrongPassword:
+		http.Error(w, errs.NewError(errors.Wrap(err, "Запрещено")).StringJSON(), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	if err = h.revokeUserSessions(current.UserID, current.PublicID()); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// ownSession returns the session of the request when the id of the path is the user of the session or 0.
+func ownSession(w http.ResponseWriter, r *http.Request) (*session.Session, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return nil, false
+	}
+	current := r.Context().Value(sessionKey).(*session.Session)
+	if id != 0 && id != current.UserID {
+		http.Error(w, errs.NewErrorStr("Запрещено").StringJSON(), http.StatusForbidden)
+		return nil, false
+	}
+	return current, true
+}
+
+// twoFactorError writes the response of a failed 2FA operation and counts wrong codes.
+func (h *AuctionHandler) twoFactorError(w http.ResponseWriter, r *http.Request, userID int, err error) {
+	switch err {
+	case errs.ErrWrongCode, user.ErrCodeUsed:
+		h.failAttempt(w, r, lockout.UserKey(userID))
+		http.Error(w, errs.NewError(errors.Wrap(err, "Запрещено")).StringJSON(), http.StatusForbidden)
+	case errs.ErrTwoFactorEnabled, errs.ErrTwoFactorDisabled:
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusConflict)
+	default:
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+	}
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var data struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return "", false
+	}
+	if data.Code == "" {
+		http.Error(w, errs.NewErrorStr("code should not be blank").StringJSON(), http.StatusBadRequest)
+		return "", false
+	}
+	return data.Code, true
+}
+
+// PostUserTwoFactor starts 2FA enrollment: it returns a new TOTP secret for an authenticator app.
+// A repeated enrollment replaces the secret until a code is confirmed.
+func (h *AuctionHandler) PostUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	current, ok := ownSession(w, r)
+	if !ok {
+		return
+	}
+	secret, uri, err := services.EnrollTwoFactor(current.UserID, h.totpIssuer, *h.storage)
+	if err != nil {
+		h.twoFactorError(w, r, current.UserID, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}{Secret: secret, URI: uri})
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write secret"))
+	}
+}
+
+// PostUserTwoFactorConfirm enables 2FA with a code of the enrolled secret and returns recovery codes,
+// they are shown once.
+func (h *AuctionHandler) PostUserTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	current, ok := ownSession(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+	if h.rejectAttempt(w, r, lockout.UserKey(current.UserID)) {
+		return
+	}
+	codes, err := services.ConfirmTwoFactor(current.UserID, code, *h.storage)
+	if err != nil {
+		h.twoFactorError(w, r, current.UserID, err)
+		return
+	}
+	h.resetAttempts(r, lockout.UserKey(current.UserID))
+	err = json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes})
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write recovery codes"))
+	}
+}
+
+// DeleteUserTwoFactor disables 2FA with a TOTP or recovery code.
+func (h *AuctionHandler) DeleteUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	current, ok := ownSession(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeCode(w, r)
+	if !ok {
+		return
+	}
+	if h.rejectAttempt(w, r, lockout.UserKey(current.UserID)) {
+		return
+	}
+	if err := services.DisableTwoFactor(current.UserID, code, *h.storage); err != nil {
+		h.twoFactorError(w, r, current.UserID, err)
+		return
+	}
+	h.resetAttempts(r, lockout.UserKey(current.UserID))
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// PostEmailVerify verifies the email by the token sent after signup.
+func (h *AuctionHandler) PostEmailVerify(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if data.Token == "" {
+		http.Error(w, errs.NewErrorStr("token should not be blank").StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if _, err := services.VerifyEmail(data.Token, *h.storage); err != nil {
+		http.Error(w, errs.NewError(errors.Wrap(err, "Невозможно подтвердить email")).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// PostEmailVerifyResend sends a new verification token to the user of the request.
+func (h *AuctionHandler) PostEmailVerifyResend(w http.ResponseWriter, r *http.Request) {
+	u, err := services.FindUserByID(r.Context().Value(userKey).(int), h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	if u.EmailVerified() {
+		http.Error(w, errs.NewErrorStr("Email уже подтвержден").StringJSON(), http.StatusConflict)
+		return
+	}
+	h.sendVerification(r, *u)
+	http.Error(w, "", http.StatusAccepted)
+}
+
+// verifiedEmail writes 403 and returns false when bids of the user of the request are blocked.
+func (h *AuctionHandler) verifiedEmail(w http.ResponseWriter, r *http.Request) bool {
+	if !h.requireVerified {
+		return true
+	}
+	u, err := services.FindUserByID(r.Context().Value(userKey).(int), h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return false
+	}
+	if !u.EmailVerified() {
+		http.Error(w, errs.NewError(errors.Wrap(errs.ErrEmailNotVerified, "Запрещено")).StringJSON(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// GetJWKS publishes public keys which verify access tokens.
+func (h *AuctionHandler) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	if h.tokens == nil {
+		http.Error(w, errs.NewErrorStr("Токены доступа не являются JWT").StringJSON(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(h.tokens.KeyRing().JWKS()); err != nil {
+		h.logError(r, errors.Wrap(err, "can't write keys"))
+	}
+}
+
+func (h *AuctionHandler) PutUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if id != 0 && id != r.Context().Value(userKey).(int) {
+		http.Error(w, errs.NewErrorStr("Запрещено").StringJSON(), http.StatusForbidden)
+		return
+	}
+	userData := user.User{ID: r.Context().Value(userKey).(int)}
+	err = (*h.storage).GetUser(&userData)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+
+	var newUser user.User
+	err = json.NewDecoder(r.Body).Decode(&newUser)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	userData.Update(newUser)
+	err = json.NewEncoder(w).Encode(userData)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write user"))
+		return
+	}
+}
+
+func (h *AuctionHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if id == 0 {
+		id = r.Context().Value(userKey).(int)
+	}
+	usr, err := services.FindUserByID(id, h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	err = json.NewEncoder(w).Encode(usr)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write user"))
+		return
+	}
+}
+func (h *AuctionHandler) GetLots(w http.ResponseWriter, r *http.Request) {
+	lotType := r.URL.Query().Get("status")
+	currency, err := parseDisplayCurrency(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	data, err := services.GetLots(lotType, *h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	if currency != "" {
+		if err = services.ConvertLots(data, currency, h.rates); err != nil {
+			http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+			return
+		}
+	}
+	for i := range data {
+		data[i].ShowReserve = reserveVisible(r, data[i])
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lots"))
+		return
+	}
+}
+func (h *AuctionHandler) PostLots(w http.ResponseWriter, r *http.Request) {
+	var lotData lot.Lot
+	err := json.NewDecoder(r.Body).Decode(&lotData)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	lotData.CreatorID = r.Context().Value(userKey).(int)
+	lotData.Extensions = 0
+	lotData.Result = ""
+	if err = lotData.ResolveCurrency(); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if err = auction.Validate(lotData); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	err = (*h.storage).AddLot(&lotData)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	auction.Present(&lotData, time.Now())
+	lotData.ShowReserve = true
+	err = json.NewEncoder(w).Encode(lotData)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return
+	}
+
+}
+func (h *AuctionHandler) GetLot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	currency, err := parseDisplayCurrency(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	lotData := lot.Lot{ID: id}
+	err = (*h.storage).GetLot(&lotData)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	auction.Present(&lotData, time.Now())
+	if currency != "" {
+		if err = services.ConvertLot(&lotData, currency, h.rates); err != nil {
+			http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+			return
+		}
+	}
+	lotData.ShowReserve = reserveVisible(r, lotData)
+	err = json.NewEncoder(w).Encode(lotData)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return
+	}
+}
+func (h *AuctionHandler) PutLot(w http.ResponseWriter, r *http.Request) {
+	// Лот в БД
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	lotData := lot.Lot{ID: id, Status: lot.Created.String()}
+	err = (*h.storage).GetLot(&lotData)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	if lotData.CreatorID != r.Context().Value(userKey) {
+		http.Error(w, errs.NewErrorStr("пользователь не соответствует создателю").StringJSON(), http.StatusNotFound)
+		return
+	}
+	// Новый лот
+	var newLot lot.Lot
+	err = json.NewDecoder(r.Body).Decode(&newLot)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	newLot.ID = id
+	newLot.Extensions = 0
+	newLot.Result = ""
+	if newLot.StartAt != nil && newLot.EndAt.IsZero() {
+		newLot.EndAt = lotData.EndAt
+	}
+	if newLot.AuctionType == "" {
+		newLot.AuctionType = lotData.AuctionType
+	}
+	if newLot.ExtendWindow == 0 {
+		newLot.ExtendWindow = lotData.ExtendWindow
+	}
+	if newLot.ExtendDuration == 0 {
+		newLot.ExtendDuration = lotData.ExtendDuration
+	}
+	if newLot.MaxExtensions == 0 {
+		newLot.MaxExtensions = lotData.MaxExtensions
+	}
+	if newLot.Currency == "" {
+		newLot.Currency = lotData.Currency
+	}
+	if newLot.AuctionType == lot.Dutch {
+		if newLot.StartPrice == nil {
+			newLot.StartPrice = lotData.StartPrice
+		}
+		if newLot.DropInterval == 0 {
+			newLot.DropInterval = lotData.DropInterval
+		}
+		if newLot.MinPrice.IsZero() {
+			newLot.MinPrice = lotData.MinPrice
+		}
+	}
+	if err = newLot.ResolveCurrency(); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if err = auction.Validate(newLot); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	err = (*h.storage).UpdateLot(&newLot)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	auction.Present(&newLot, time.Now())
+	h.publishLot(newLot, event.LotUpdated)
+	newLot.ShowReserve = true
+	err = json.NewEncoder(w).Encode(newLot)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return
+	}
+}
+func (h *AuctionHandler) DeleteLot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	lotData := lot.Lot{ID: id, Status: lot.Created.String(), CreatorID: r.Context().Value(userKey).(int)}
+	err = (*h.storage).DeleteLot(&lotData)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	if err = h.events.PublishDeleted(lotData.ID, lotData.CreatorID); err != nil {
+		h.logError(r, err)
+	}
+	http.Error(w, "", http.StatusNoContent)
+}
+
+func (h *AuctionHandler) BuyLot(w http.ResponseWriter, r *http.Request) {
+	type BuyLot struct {
+		Price money.Money `json:"price"`
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	var price BuyLot
+	err = json.NewDecoder(r.Body).Decode(&price)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if !h.verifiedEmail(w, r) {
+		return
+	}
+	var published []event.Event
+	newLot, err := (*h.storage).BuyLot(id, r.Context().Value(userKey).(int), price.Price, h.notifyBid(&published, bidEvents))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusConflict)
+		return
+	}
+	h.events.Hooks(published...)
+	auction.Present(&newLot, time.Now())
+	err = json.NewEncoder(w).Encode(newLot)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lots"))
+		return
+	}
+}
+func (h *AuctionHandler) BuyNow(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if !h.verifiedEmail(w, r) {
+		return
+	}
+	var published []event.Event
+	newLot, err := (*h.storage).BuyNow(id, r.Context().Value(userKey).(int), h.notifyBid(&published, func(lot.Lot) []event.Type {
+		return []event.Type{event.BidPlaced, event.LotFinished}
+	}))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusConflict)
+		return
+	}
+	h.events.Hooks(published...)
+	auction.Present(&newLot, time.Now())
+	err = json.NewEncoder(w).Encode(newLot)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return
+	}
+}
+func (h *AuctionHandler) SetMaxBid(w http.ResponseWriter, r *http.Request) {
+	type MaxBid struct {
+		MaxPrice money.Money `json:"max_price"`
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	var maxBid MaxBid
+	err = json.NewDecoder(r.Body).Decode(&maxBid)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if !h.verifiedEmail(w, r) {
+		return
+	}
+	oldLot := lot.Lot{ID: id}
+	if err = (*h.storage).GetLot(&oldLot); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	proxy := proxybid.ProxyBid{LotID: id, UserID: r.Context().Value(userKey).(int), MaxPrice: maxBid.MaxPrice}
+	var published []event.Event
+	newLot, err := (*h.storage).SetMaxBid(&proxy, h.notifyBid(&published, func(l lot.Lot) []event.Type {
+		if reflect.DeepEqual(oldLot.BuyPrice, l.BuyPrice) && reflect.DeepEqual(oldLot.BuyerID, l.BuyerID) {
+			return nil
+		}
+		return bidEvents(l)
+	}))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusConflict)
+		return
+	}
+	h.events.Hooks(published...)
+	auction.Present(&newLot, time.Now())
+	err = json.NewEncoder(w).Encode(newLot)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return
+	}
+}
+func (h *AuctionHandler) PublishLot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	newLot, err := (*h.storage).PublishLot(id, r.Context().Value(userKey).(int))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusConflict)
+		return
+	}
+	auction.Present(&newLot, time.Now())
+	h.publishLot(newLot, event.LotUpdated)
+	newLot.ShowReserve = true
+	err = json.NewEncoder(w).Encode(newLot)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return
+	}
+}
+func (h *AuctionHandler) GetUserLots(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if id == 0 {
+		id = r.Context().Value(userKey).(int)
+	}
+	lotType := strings.ToLower(r.URL.Query().Get("type"))
+	lots, err := services.GetUserLots(id, lotType, *h.storage)
+	if err != nil || len(lots) == 0 {
+		http.Error(w, errs.NewErrorStr("no data").StringJSON(), http.StatusNotFound)
+		return
+	}
+	for i := range lots {
+		lots[i].ShowReserve = reserveVisible(r, lots[i])
+	}
+	err = json.NewEncoder(w).Encode(lots)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write lot"))
+		return
+	}
+}
+func (h *AuctionHandler) GetLotBids(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	lotData := lot.Lot{ID: id}
+	if err = (*h.storage).GetLot(&lotData); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	bids, err := services.GetLotBids(lotData, r.Context().Value(userKey).(int), limit, offset, *h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(bids)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write bids"))
+		return
+	}
+}
+func (h *AuctionHandler) GetUserBids(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
 	}
 	if id == 0 {
 		id = r.Context().Value(userKey).(int)
 	}
-	lotType := strings.ToLower(r.URL.Query().Get("type"))
-	lots, err := services.GetUserLots(id, lotType, *h.storage)
-	if err != nil || len(lots) == 0 {
-		http.Error(w, errs.NewErrorStr("no data").StringJSON(), http.StatusNotFound)
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	bids, err := services.GetUserBids(id, r.Context().Value(userKey).(int), limit, offset, *h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(bids)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write bids"))
+		return
+	}
+}
+func (h *AuctionHandler) GetRates(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(h.rates.Table())
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write rates"))
+		return
+	}
+}
+
+// PostUserUnlock forgets failed signin and 2FA attempts of the user, the route requires the admin role.
+func (h *AuctionHandler) PostUserUnlock(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	u, err := services.FindUserByID(id, h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	if err = services.UnlockUser(*u, *h.storage); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	h.logInfo(r, "user %d unlocked", id)
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// GetUsers lists users with ?q= in the email or the name, every user without it.
+func (h *AuctionHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	users, err := (*h.storage).FindUsers(strings.TrimSpace(r.URL.Query().Get("q")), limit, offset)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(users); err != nil {
+		h.logError(r, errors.Wrap(err, "can't write users"))
+	}
+}
+
+// targetUser finds the user of the path, admins can't act on themselves so they keep access.
+func (h *AuctionHandler) targetUser(w http.ResponseWriter, r *http.Request) (*user.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return nil, false
+	}
+	if id == r.Context().Value(userKey).(int) {
+		http.Error(w, errs.NewErrorStr("нельзя применить к своей учетной записи").StringJSON(), http.StatusBadRequest)
+		return nil, false
+	}
+	u, err := services.FindUserByID(id, h.storage)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+// PutUserRole sets the role of the user. Access tokens carry the role in JWT mode, so sessions of the
+// user are revoked there.
+func (h *AuctionHandler) PutUserRole(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	role, err := user.ParseRole(data.Role)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	u, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+	if err = (*h.storage).SetRole(u.ID, role); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	if h.tokens != nil && u.UserRole() != role {
+		if err = h.revokeUserSessions(u.ID, ""); err != nil {
+			h.logError(r, err)
+		}
+	}
+	h.logInfo(r, "user %d got role %s", u.ID, role)
+	u.Role = role
+	if err = json.NewEncoder(w).Encode(u); err != nil {
+		h.logError(r, errors.Wrap(err, "can't write user"))
+	}
+}
+
+// PostUserBan bans the user and revokes all sessions of the user.
+func (h *AuctionHandler) PostUserBan(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if err := (*h.storage).SetBanned(u.ID, &now); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(lots)
+	if err := h.revokeUserSessions(u.ID, ""); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	h.logInfo(r, "user %d banned", u.ID)
+	http.Error(w, "", http.StatusNoContent)
+}
+
+func (h *AuctionHandler) DeleteUserBan(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+	if err := (*h.storage).SetBanned(u.ID, nil); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	h.logInfo(r, "user %d unbanned", u.ID)
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// DeleteUserSessions revokes all sessions of the user.
+func (h *AuctionHandler) DeleteUserSessions(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+	if err := h.revokeUserSessions(u.ID, ""); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	h.logInfo(r, "sessions of user %d revoked", u.ID)
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// FinishLot finishes a created or active lot of any user before its end.
+func (h *AuctionHandler) FinishLot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	l, err := (*h.storage).FinishLot(id)
 	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	h.logInfo(r, "lot %d finished", id)
+	auction.Present(&l, time.Now())
+	h.publishLot(l, event.LotFinished)
+	if err = json.NewEncoder(w).Encode(l); err != nil {
 		h.logError(r, errors.Wrap(err, "can't write lot"))
+	}
+}
+
+// DeleteAnyLot deletes a lot of any user in any status.
+func (h *AuctionHandler) DeleteAnyLot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	lotData := lot.Lot{ID: id}
+	if err = (*h.storage).GetLot(&lotData); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	if err = (*h.storage).DeleteLot(&lot.Lot{ID: id}); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	h.logInfo(r, "lot %d deleted", id)
+	if err = h.events.PublishDeleted(lotData.ID, lotData.CreatorID); err != nil {
+		h.logError(r, err)
+	}
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// PutRates replaces the rate table, the route requires the admin role.
+func (h *AuctionHandler) PutRates(w http.ResponseWriter, r *http.Request) {
+	var table money.RatesTable
+	err := json.NewDecoder(r.Body).Decode(&table)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if err = h.rates.Set(table); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	h.logInfo(r, "rates updated, base %s", table.Base)
+	err = json.NewEncoder(w).Encode(h.rates.Table())
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write rates"))
+		return
+	}
+}
+
+// PostWebhook registers an endpoint of the user, the secret is generated if it is not set
+// and is shown only in this response.
+func (h *AuctionHandler) PostWebhook(w http.ResponseWriter, r *http.Request) {
+	var data webhook.Webhook
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	hook := webhook.Webhook{UserID: r.Context().Value(userKey).(int), URL: data.URL, Secret: data.Secret, Events: data.Events, Active: true}
+	if err = hook.Check(); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if hook.Secret == "" {
+		if hook.Secret, err = webhook.GenerateSecret(); err != nil {
+			http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+			h.logError(r, err)
+			return
+		}
+	}
+	if err = (*h.storage).AddWebhook(&hook); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	err = json.NewEncoder(w).Encode(hook)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write webhook"))
+		return
+	}
+}
+
+func (h *AuctionHandler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := (*h.storage).GetWebhooks(webhook.Webhook{UserID: r.Context().Value(userKey).(int)})
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	err = json.NewEncoder(w).Encode(hooks)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write webhooks"))
+		return
+	}
+}
+
+// ownWebhook finds the webhook from the url among webhooks of the user and returns the status code on error.
+func (h *AuctionHandler) ownWebhook(r *http.Request) (webhook.Webhook, int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return webhook.Webhook{}, http.StatusBadRequest, err
+	}
+	hook := webhook.Webhook{ID: id, UserID: r.Context().Value(userKey).(int)}
+	if err = (*h.storage).GetWebhook(&hook); err != nil {
+		return webhook.Webhook{}, http.StatusNotFound, fmt.Errorf("webhook not found")
+	}
+	return hook, http.StatusOK, nil
+}
+
+func (h *AuctionHandler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, code, err := h.ownWebhook(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), code)
+		return
+	}
+	hook.Secret = ""
+	err = json.NewEncoder(w).Encode(hook)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write webhook"))
+		return
+	}
+}
+
+// PutWebhook changes the url, events or active flag, enabling a disabled webhook resets its failures.
+func (h *AuctionHandler) PutWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, code, err := h.ownWebhook(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), code)
+		return
+	}
+	var data struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if data.URL != nil {
+		hook.URL = *data.URL
+	}
+	if data.Events != nil {
+		hook.Events = data.Events
+	}
+	if data.Active != nil && *data.Active != hook.Active {
+		hook.Active = *data.Active
+		if hook.Active {
+			hook.Failures = 0
+			hook.DisabledAt = nil
+		} else {
+			now := time.Now()
+			hook.DisabledAt = &now
+		}
+	}
+	if err = hook.Check(); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	if err = (*h.storage).UpdateWebhook(&hook); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	hook.Secret = ""
+	err = json.NewEncoder(w).Encode(hook)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write webhook"))
+		return
+	}
+}
+
+func (h *AuctionHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, code, err := h.ownWebhook(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), code)
+		return
+	}
+	if err = (*h.storage).DeleteWebhook(&hook); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, "", http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the delivery log of the webhook, the newest deliveries first.
+func (h *AuctionHandler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	hook, code, err := h.ownWebhook(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), code)
+		return
+	}
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	condition := webhook.Delivery{WebhookID: hook.ID, Status: webhook.Status(r.URL.Query().Get("status"))}
+	deliveries, err := (*h.storage).GetDeliveries(condition, limit, offset)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusInternalServerError)
+		h.logError(r, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		h.logError(r, errors.Wrap(err, "can't write deliveries"))
 		return
 	}
 }
+
 func (h *AuctionHandler) NotImplemented(w http.ResponseWriter, r *http.Request) {
 	h.logInfo(r, "Request not implemented")
 	_, _ = w.Write([]byte("not implemented"))
@@ -391,27 +1807,266 @@ func (h *AuctionHandler) HTMLGetLot(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
 		return
 	}
+	auction.Present(&lotData, time.Now())
 	h.temps.Render(w, "lot_details", lotData)
 }
+
+// bidEvents lists events caused by an accepted bid.
+func bidEvents(l lot.Lot) []event.Type {
+	types := []event.Type{event.BidPlaced}
+	if l.Extended {
+		types = append(types, event.LotExtended)
+	}
+	if l.Status == lot.Finished.String() {
+		types = append(types, event.LotFinished)
+	}
+	return types
+}
+
+// notifyBid publishes events of types of the lot after a bid in the transaction of the bid, published collects
+// them to call hooks after the commit.
+func (h *AuctionHandler) notifyBid(published *[]event.Event, types func(lot.Lot) []event.Type) storage.Notify {
+	return func(l lot.Lot, p event.Publisher) error {
+		auction.Present(&l, time.Now())
+		for _, t := range types(l) {
+			e, err := h.events.PublishLotWith(p, t, l)
+			if err != nil {
+				return err
+			}
+			*published = append(*published, e)
+		}
+		return nil
+	}
+}
+
+func (h *AuctionHandler) publishLot(l lot.Lot, types ...event.Type) {
+	for _, t := range types {
+		if err := h.events.PublishLot(t, l); err != nil {
+			h.logger.Errorf("can't publish %s for lot %d: %+v", t, l.ID, err)
+		}
+	}
+}
+
+func parseLastSeq(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("last_seq")
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("last_seq should be non-negative integer")
+	}
+	return seq, nil
+}
+
+// WSLotUpdate streams lot events. A client gets the global feed and can change subscriptions
+// with messages like {"action": "subscribe", "lots": [1, 2], "users": [3]} or {"action": "unsubscribe", "all": true}.
+// A reconnecting client passes ?last_seq= to get the events it has missed.
 func (h *AuctionHandler) WSLotUpdate(w http.ResponseWriter, r *http.Request) {
+	lastSeq, err := parseLastSeq(r)
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value(userKey).(int)
+	if !h.streams.acquire(userID) {
+		http.Error(w, errs.NewErrorStr("слишком много подключений").StringJSON(), http.StatusTooManyRequests)
+		return
+	}
+	defer h.streams.release(userID)
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.logError(r, err)
 		return
 	}
-	defer func() {
-		_ = conn.Close()
-	}()
-	h.wsClients.AddClient(h, conn)
+	client, missed := h.events.Subscribe(lastSeq, hub.Global)
+	h.logInfo(r, "websocket client connected, total clients: %d", h.events.Hub().Len())
+	expiry, stop := sessionExpiry(r)
+	defer stop()
+	go h.wsWrite(conn, client, missed, expiry)
+	h.wsRead(r, conn, client)
+	h.logInfo(r, "websocket client disconnected, total clients: %d", h.events.Hub().Len())
+}
+
+// LotsStream sends events of all lots as Server-Sent Events.
+func (h *AuctionHandler) LotsStream(w http.ResponseWriter, r *http.Request) {
+	h.streamEvents(w, r, hub.Global)
+}
+
+// LotStream sends events of a single lot as Server-Sent Events.
+func (h *AuctionHandler) LotStream(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	lotData := lot.Lot{ID: id}
+	if err = (*h.storage).GetLot(&lotData); err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusNotFound)
+		return
+	}
+	h.streamEvents(w, r, hub.LotTopic(id))
+}
+
+// streamEvents writes events as they come, the id of every event is its seq, so a reconnecting
+// EventSource sends Last-Event-ID and gets the events it has missed. Clients without EventSource can pass ?last_seq=.
+func (h *AuctionHandler) streamEvents(w http.ResponseWriter, r *http.Request, topics ...hub.Topic) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, errs.NewErrorStr("streaming is not supported").StringJSON(), http.StatusInternalServerError)
+		return
+	}
+	lastSeq, err := parseLastSeq(r)
+	if id := r.Header.Get("Last-Event-ID"); id != "" && err == nil {
+		if lastSeq, err = strconv.ParseUint(id, 10, 64); err != nil {
+			err = fmt.Errorf("header Last-Event-ID should be non-negative integer")
+		}
+	}
+	if err != nil {
+		http.Error(w, errs.NewError(err).StringJSON(), http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value(userKey).(int)
+	if !h.streams.acquire(userID) {
+		http.Error(w, errs.NewErrorStr("слишком много подключений").StringJSON(), http.StatusTooManyRequests)
+		return
+	}
+	defer h.streams.release(userID)
+	client, missed := h.events.Subscribe(lastSeq, topics...)
+	defer h.events.Hub().Unregister(client)
+	expiry, stop := sessionExpiry(r)
+	defer stop()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		data, err := json.Marshal(e)
+		if err != nil {
+			h.logError(r, errors.Wrap(err, "can't marshal event"))
+			return
+		}
+		if err = writeSSE(w, e, data); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	h.logInfo(r, "event stream opened, total clients: %d", h.events.Hub().Len())
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expiry:
+			h.logInfo(r, "event stream closed, session expired")
+			return
+		case data, ok := <-client.Send():
+			if !ok {
+				h.logInfo(r, "event stream closed, evicted: %t", client.Evicted())
+				return
+			}
+			var e event.Event
+			if err = json.Unmarshal(data, &e); err != nil {
+				h.logError(r, errors.Wrap(err, "can't read event"))
+				return
+			}
+			if err = writeSSE(w, e, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// sessionExpiry fires when the session of the request expires, it never fires without a session.
+func sessionExpiry(r *http.Request) (<-chan time.Time, func()) {
+	sess, ok := r.Context().Value(sessionKey).(*session.Session)
+	if !ok {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(sess.ValidUntil))
+	return timer.C, func() {
+		timer.Stop()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, e event.Event, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+	return err
+}
 
+func (h *AuctionHandler) wsRead(r *http.Request, conn *websocket.Conn, client *hub.Client) {
+	defer h.events.Hub().Unregister(client)
+	conn.SetReadLimit(wsMaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
 	for {
-		priceTick := <-h.priceTickCh
-		res, err := json.Marshal(priceTick)
+		_, message, err := conn.ReadMessage()
 		if err != nil {
-			h.logger.Infof("can't marshal message: %+v\n", err)
-			continue
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				h.logError(r, errors.Wrap(err, "websocket read failed"))
+			}
+			return
+		}
+		var request hub.Request
+		if err = json.Unmarshal(message, &request); err == nil {
+			err = request.Apply(client)
+		}
+		if err != nil {
+			h.logInfo(r, "bad subscription request %s: %s", message, err)
 		}
-		h.wsClients.BroadcastMessage(h, res)
 	}
+}
 
+// wsWrite is the only writer of the connection, it closes the connection when the client leaves the hub.
+func (h *AuctionHandler) wsWrite(conn *websocket.Conn, client *hub.Client, missed []event.Event, expiry <-chan time.Time) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = conn.Close()
+	}()
+	for _, e := range missed {
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteJSON(e); err != nil {
+			h.events.Hub().Unregister(client)
+			return
+		}
+	}
+	for {
+		select {
+		case message, ok := <-client.Send():
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				code, text := websocket.CloseNormalClosure, ""
+				if client.Evicted() {
+					code, text = websocket.CloseTryAgainLater, "slow consumer"
+				}
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				h.events.Hub().Unregister(client)
+				return
+			}
+		case <-expiry:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired"))
+			h.events.Hub().Unregister(client)
+			return
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				h.events.Hub().Unregister(client)
+				return
+			}
+		}
+	}
 }
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,11 +21,26 @@ import (
 
 	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
 
+	"github.com/go-chi/chi"
 	"github.com/golang/mock/gomock"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/internal/hub"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lockout"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/internal/mailer"
+	"gitlab.com/asciishell/tfs-go-auction/internal/memstore"
 	"gitlab.com/asciishell/tfs-go-auction/internal/mock_storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/session"
 	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
 	"gitlab.com/asciishell/tfs-go-auction/pkg/environment"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/totp"
 )
 
 const TimeOut = 2 * time.Second
@@ -70,6 +95,7 @@ func TestAuctionHandler_PostSignup(t *testing.T) {
 			m := mock_storage.NewMockStorage(ctrl)
 			if tc.Ok {
 				m.EXPECT().AddUser(gomock.Any()).Return(nil).Times(1)
+				m.EXPECT().AddUserToken(gomock.Any()).Return(nil).Times(1)
 			}
 			logger := log.New()
 			handler := NewAuctionHandler(m, &logger, template.Templates{})
@@ -160,3 +186,1532 @@ func TestAuctionHandler_PostSignin(t *testing.T) {
 	}
 
 }
+
+func TestAuctionHandler_GetLotBids(t *testing.T) {
+	type testCase struct {
+		Name   string
+		Query  string
+		Exists bool
+		Limit  int
+		Offset int
+		Code   int
+	}
+	testCases := []testCase{
+		{Name: "Default page", Query: "", Exists: true, Limit: 20, Offset: 0, Code: http.StatusOK},
+		{Name: "Custom page", Query: "?limit=5&offset=10", Exists: true, Limit: 5, Offset: 10, Code: http.StatusOK},
+		{Name: "Limit capped", Query: "?limit=1000", Exists: true, Limit: 100, Offset: 0, Code: http.StatusOK},
+		{Name: "Bad limit", Query: "?limit=-1", Code: http.StatusBadRequest},
+		{Name: "Bad offset", Query: "?offset=abc", Code: http.StatusBadRequest},
+		{Name: "Lot not found", Query: "", Exists: false, Code: http.StatusNotFound},
+	}
+	r := require.New(t)
+	timeout := RaceTimeout()
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			m := mock_storage.NewMockStorage(ctrl)
+			if tc.Code != http.StatusBadRequest {
+				if tc.Exists {
+					m.EXPECT().GetLot(gomock.Any()).Return(nil).Times(1)
+					m.EXPECT().GetBids(bid.Bid{LotID: 1}, tc.Limit, tc.Offset).Return([]bid.Bid{}, nil).Times(1)
+				} else {
+					m.EXPECT().GetLot(gomock.Any()).Return(errors.New("lot not found")).Times(1)
+				}
+			}
+			logger := log.New()
+			handler := NewAuctionHandler(m, &logger, template.Templates{})
+			mux := chi.NewRouter()
+			mux.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, 2)))
+				})
+			})
+			mux.Get("/lots/{id}/bids", handler.GetLotBids)
+			ts := httptest.NewServer(mux)
+			client := http.Client{Timeout: timeout}
+
+			resp, err := client.Get(ts.URL + "/lots/1/bids" + tc.Query)
+			r.NoError(err)
+			r.Equal(resp.StatusCode, tc.Code)
+		})
+	}
+}
+
+func TestAuctionHandler_MemStore(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	handler := NewAuctionHandler(memstore.NewMemStore(), &logger, template.Templates{})
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(handler.Authenticator)
+		mux.Post("/lots", handler.PostLots)
+		mux.Put("/lots/{id}/buy", handler.BuyLot)
+		mux.Get("/lots/{id}/bids", handler.GetLotBids)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+
+	do := func(method string, url string, token string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+url, bytes.NewReader([]byte(body)))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp
+	}
+	signin := func(email string) string {
+		resp := do(http.MethodPost, "/signup", "", `{"first_name": "Test","last_name": "Test","email": "`+email+`","password": "qwerty"}`)
+		r.Equal(http.StatusCreated, resp.StatusCode)
+		resp = do(http.MethodPost, "/signin", "", `{"email": "`+email+`","password": "qwerty"}`)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		r.NoError(json.NewDecoder(resp.Body).Decode(&token))
+		return token.AccessToken
+	}
+	seller := signin("seller@example.com")
+	buyer := signin("buyer@example.com")
+
+	endAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	resp := do(http.MethodPost, "/lots", seller, `{"title": "Lot","min_price": 10,"price_step": 5,"status": "active","end_at": "`+endAt+`"}`)
+	r.Equal(http.StatusOK, resp.StatusCode)
+	var created struct {
+		ID int `json:"id"`
+	}
+	r.NoError(json.NewDecoder(resp.Body).Decode(&created))
+	lotURL := "/lots/" + strconv.Itoa(created.ID)
+
+	r.Equal(http.StatusConflict, do(http.MethodPut, lotURL+"/buy", seller, `{"price": 15}`).StatusCode)
+	r.Equal(http.StatusConflict, do(http.MethodPut, lotURL+"/buy", buyer, `{"price": 12}`).StatusCode)
+	r.Equal(http.StatusOK, do(http.MethodPut, lotURL+"/buy", buyer, `{"price": 15}`).StatusCode)
+	r.Equal(http.StatusConflict, do(http.MethodPut, lotURL+"/buy", buyer, `{"price": 20}`).StatusCode)
+
+	resp = do(http.MethodGet, lotURL+"/bids", buyer, "")
+	r.Equal(http.StatusOK, resp.StatusCode)
+	var bids []struct {
+		Price money.Money `json:"price"`
+	}
+	r.NoError(json.NewDecoder(resp.Body).Decode(&bids))
+	r.Len(bids, 1)
+	r.Equal(money.FromMajor(15, money.RUB), bids[0].Price)
+}
+
+func TestAuctionHandler_Rates(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	seller := user.User{FirstName: "Seller", LastName: "Seller", Email: "seller@example.com", Password: "hash"}
+	r.NoError(m.AddUser(&seller))
+	r.NoError(m.AddLot(&lot.Lot{Title: "Lot", Currency: money.USD, MinPrice: money.FromMajor(10, money.USD),
+		Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}))
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	handler.adminToken = "secret"
+	mux := chi.NewRouter()
+	mux.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, seller.ID)))
+		})
+	})
+	mux.Get("/lots", handler.GetLots)
+	mux.With(handler.RequireRole(user.RoleAdmin)).Put("/rates", handler.PutRates)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+
+	putRates := func(token string, body string) int {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/rates", bytes.NewReader([]byte(body)))
+		r.NoError(err)
+		req.Header.Set("X-Admin-Token", token)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp.StatusCode
+	}
+	r.Equal(http.StatusForbidden, putRates("wrong", `{"base": "RUB", "rates": {"USD": "92.5"}}`))
+	r.Equal(http.StatusBadRequest, putRates("secret", `{"base": "RUB", "rates": {"USD": "-1"}}`))
+
+	resp, err := client.Get(ts.URL + "/lots?display_currency=RUB")
+	r.NoError(err)
+	r.Equal(http.StatusBadRequest, resp.StatusCode, "no rate for USD yet")
+	r.Equal(http.StatusOK, putRates("secret", `{"base": "RUB", "rates": {"USD": "92.5"}}`))
+
+	resp, err = client.Get(ts.URL + "/lots?display_currency=rub")
+	r.NoError(err)
+	r.Equal(http.StatusOK, resp.StatusCode)
+	var lots []struct {
+		Currency  money.Currency `json:"currency"`
+		Converted *lot.Converted `json:"converted"`
+	}
+	r.NoError(json.NewDecoder(resp.Body).Decode(&lots))
+	r.Len(lots, 1)
+	r.Equal(money.USD, lots[0].Currency)
+	r.NotNil(lots[0].Converted)
+	r.Equal(money.New(92500, money.RUB), lots[0].Converted.MinPrice)
+
+	resp, err = client.Get(ts.URL + "/lots?display_currency=rubles")
+	r.NoError(err)
+	r.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAuctionHandler_WSLotUpdate(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	seller := user.User{FirstName: "Seller", LastName: "Seller", Email: "seller@example.com", Password: "hash"}
+	buyer := user.User{FirstName: "Buyer", LastName: "Buyer", Email: "buyer@example.com", Password: "hash"}
+	r.NoError(m.AddUser(&seller))
+	r.NoError(m.AddUser(&buyer))
+	lots := make([]lot.Lot, 3)
+	for i := range lots {
+		lots[i] = lot.Lot{Title: "Lot", MinPrice: money.FromMajor(10, money.RUB), Status: lot.Active.String(),
+			CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+		r.NoError(m.AddLot(&lots[i]))
+	}
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	mux := chi.NewRouter()
+	mux.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, buyer.ID)))
+		})
+	})
+	mux.HandleFunc("/lots_ws", handler.WSLotUpdate)
+	mux.Put("/lots/{id}/buy", handler.BuyLot)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	buy := func(id int, price string) {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/lots/"+strconv.Itoa(id)+"/buy", strings.NewReader(`{"price": `+price+`}`))
+		r.NoError(err)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/lots_ws", nil)
+	r.NoError(err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	r.NoError(conn.WriteJSON(hub.Request{Action: "unsubscribe", All: true}))
+	r.NoError(conn.WriteJSON(hub.Request{Action: "subscribe", Lots: []int{lots[1].ID}}))
+	// subscription requests are applied asynchronously by the reader of the connection
+	time.Sleep(100 * time.Millisecond)
+	r.Equal(1, handler.events.Hub().Len())
+
+	buy(lots[0].ID, "12")
+	buy(lots[1].ID, "13")
+	type lotEvent struct {
+		Type    event.Type `json:"type"`
+		Seq     uint64     `json:"seq"`
+		LotID   int        `json:"lot_id"`
+		Payload struct {
+			CurrentPrice money.Money `json:"current_price"`
+		} `json:"payload"`
+	}
+	r.NoError(conn.SetReadDeadline(time.Now().Add(RaceTimeout())))
+	var received lotEvent
+	r.NoError(conn.ReadJSON(&received))
+	r.Equal(event.BidPlaced, received.Type)
+	r.Equal(uint64(2), received.Seq)
+	r.Equal(lots[1].ID, received.LotID)
+	r.Equal(money.FromMajor(13, money.RUB), received.Payload.CurrentPrice)
+
+	resumed, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/lots_ws?last_seq=1", nil)
+	r.NoError(err)
+	defer func() {
+		_ = resumed.Close()
+	}()
+	r.NoError(resumed.SetReadDeadline(time.Now().Add(RaceTimeout())))
+	r.NoError(resumed.ReadJSON(&received))
+	r.Equal(uint64(2), received.Seq, "only missed events are replayed")
+	buy(lots[2].ID, "14")
+	r.NoError(resumed.ReadJSON(&received))
+	r.Equal(uint64(3), received.Seq)
+	r.Equal(lots[2].ID, received.LotID)
+}
+
+func TestAuctionHandler_LotStream(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	seller := user.User{FirstName: "Seller", LastName: "Seller", Email: "seller@example.com", Password: "hash"}
+	buyer := user.User{FirstName: "Buyer", LastName: "Buyer", Email: "buyer@example.com", Password: "hash"}
+	r.NoError(m.AddUser(&seller))
+	r.NoError(m.AddUser(&buyer))
+	lots := make([]lot.Lot, 3)
+	for i := range lots {
+		lots[i] = lot.Lot{Title: "Lot", MinPrice: money.FromMajor(10, money.RUB), Status: lot.Active.String(),
+			CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+		r.NoError(m.AddLot(&lots[i]))
+	}
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	mux := chi.NewRouter()
+	mux.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, buyer.ID)))
+		})
+	})
+	mux.Get("/lots/stream", handler.LotsStream)
+	mux.Get("/lots/{id}/stream", handler.LotStream)
+	mux.Put("/lots/{id}/buy", handler.BuyLot)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	buy := func(id int, price string) {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/lots/"+strconv.Itoa(id)+"/buy", strings.NewReader(`{"price": `+price+`}`))
+		r.NoError(err)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+	}
+	buy(lots[0].ID, "11")
+
+	resp, err := client.Get(ts.URL + "/lots/100/stream")
+	r.NoError(err)
+	r.Equal(http.StatusNotFound, resp.StatusCode)
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/lots/stream", nil)
+	r.NoError(err)
+	req.Header.Set("Last-Event-ID", "abc")
+	resp, err = client.Do(req)
+	r.NoError(err)
+	r.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/lots/"+strconv.Itoa(lots[1].ID)+"/stream", nil)
+	r.NoError(err)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err = client.Do(req)
+	r.NoError(err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	r.Equal(http.StatusOK, resp.StatusCode)
+	r.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	buy(lots[2].ID, "11")
+	buy(lots[1].ID, "12")
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		r.NoError(err)
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	r.Equal("id: 3", lines[0], "events of other lots are skipped")
+	r.Equal("event: bid_placed", lines[1])
+	r.Contains(lines[2], `"lot_id":`+strconv.Itoa(lots[1].ID))
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/lots/stream?last_seq=1", nil)
+	r.NoError(err)
+	resumed, err := client.Do(req)
+	r.NoError(err)
+	defer func() {
+		_ = resumed.Body.Close()
+	}()
+	line, err := bufio.NewReader(resumed.Body).ReadString('\n')
+	r.NoError(err)
+	r.Equal("id: 2\n", line)
+}
+
+func TestRouter_Streams(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	u := user.User{FirstName: "User", LastName: "User", Email: "user@example.com", Password: "hash"}
+	r.NoError(m.AddUser(&u))
+	sess := session.Session{SessionID: "token", UserID: u.ID, CreatedAt: time.Now(), ValidUntil: time.Now().Add(time.Hour)}
+	r.NoError(m.AddSession(&sess))
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	timeout := 200 * time.Millisecond
+	ts := httptest.NewServer(newRouter(handler, config{MaxRequests: 1, HTTPTimeout: timeout}))
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		r.NoError(err)
+		req.Header.Set("Authorization", "Bearer "+sess.SessionID)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp
+	}
+
+	stream := get("/v1/auction/lots/stream")
+	defer func() {
+		_ = stream.Body.Close()
+	}()
+	r.Equal(http.StatusOK, stream.StatusCode)
+	r.Equal(http.StatusOK, get("/v1/auction/users/0").StatusCode, "an open stream does not take the request slot")
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/auction/lots_ws?access_token="+sess.SessionID, nil)
+	r.NoError(err)
+	defer func() {
+		_ = ws.Close()
+	}()
+	r.Equal(http.StatusOK, get("/v1/auction/users/0").StatusCode, "an open websocket does not take the request slot")
+
+	time.Sleep(2 * timeout)
+	l := lot.Lot{ID: 1, Title: "Lot", Status: lot.Active.String()}
+	r.NoError(handler.events.PublishLot(event.LotUpdated, l))
+	line, err := bufio.NewReader(stream.Body).ReadString('\n')
+	r.NoError(err, "the stream outlives the request timeout")
+	r.Equal("id: 1\n", line)
+	r.NoError(ws.SetReadDeadline(time.Now().Add(RaceTimeout())))
+	_, data, err := ws.ReadMessage()
+	r.NoError(err, "the websocket outlives the request timeout")
+	r.Contains(string(data), `"seq":1`)
+}
+
+func streams(h *AuctionHandler, userID int) int {
+	h.streams.mu.Lock()
+	defer h.streams.mu.Unlock()
+	return h.streams.conns[userID]
+}
+
+func TestAuctionHandler_WSAuth(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	u := user.User{FirstName: "User", LastName: "User", Email: "user@example.com", Password: "hash"}
+	r.NoError(m.AddUser(&u))
+	token := func(ttl time.Duration) string {
+		sess := session.Session{SessionID: fmt.Sprintf("token%d", ttl), UserID: u.ID, CreatedAt: time.Now(), ValidUntil: time.Now().Add(ttl)}
+		r.NoError(m.AddSession(&sess))
+		return sess.SessionID
+	}
+	valid := token(time.Hour)
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	handler.streams = newConnLimiter(2)
+	handler.upgrader.CheckOrigin = checkOrigin([]string{"https://auction.example.com"})
+	mux := chi.NewRouter()
+	mux.With(handler.Authenticator).HandleFunc("/lots_ws", handler.WSLotUpdate)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/lots_ws"
+
+	testCases := []struct {
+		Name      string
+		Query     string
+		Header    http.Header
+		Protocols []string
+		Code      int
+	}{
+		{Name: "No token", Code: http.StatusUnauthorized},
+		{Name: "Wrong token", Query: "?access_token=wrong", Code: http.StatusUnauthorized},
+		{Name: "Expired token", Query: "?access_token=" + token(-time.Minute), Code: http.StatusUnauthorized},
+		{Name: "Query", Query: "?access_token=" + valid, Code: http.StatusSwitchingProtocols},
+		{Name: "Cookie", Header: http.Header{"Cookie": {"BearerToken=" + valid}}, Code: http.StatusSwitchingProtocols},
+		{Name: "Subprotocol", Protocols: []string{"bearer", valid}, Code: http.StatusSwitchingProtocols},
+		{Name: "Allowed origin", Query: "?access_token=" + valid,
+			Header: http.Header{"Origin": {"https://auction.example.com"}}, Code: http.StatusSwitchingProtocols},
+		{Name: "Foreign origin", Query: "?access_token=" + valid,
+			Header: http.Header{"Origin": {"https://evil.example.com"}}, Code: http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			dialer := websocket.Dialer{Subprotocols: tc.Protocols}
+			conn, resp, err := dialer.Dial(wsURL+tc.Query, tc.Header)
+			r.NotNil(resp)
+			r.Equal(tc.Code, resp.StatusCode)
+			if tc.Code != http.StatusSwitchingProtocols {
+				r.Error(err)
+				return
+			}
+			r.NoError(err)
+			if tc.Protocols != nil {
+				r.Equal("bearer", conn.Subprotocol())
+			}
+			r.NoError(conn.Close())
+			// the server releases the connection after its reader notices the close
+			for deadline := time.Now().Add(RaceTimeout()); streams(handler, u.ID) != 0; {
+				r.True(time.Now().Before(deadline), "connection is not released")
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+
+	first, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+valid, nil)
+	r.NoError(err)
+	defer func() {
+		_ = first.Close()
+	}()
+	expiring, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+token(300*time.Millisecond), nil)
+	r.NoError(err)
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+valid, nil)
+	r.Error(err)
+	r.Equal(http.StatusTooManyRequests, resp.StatusCode)
+
+	r.NoError(expiring.SetReadDeadline(time.Now().Add(RaceTimeout())))
+	_, _, err = expiring.ReadMessage()
+	r.True(websocket.IsCloseError(err, websocket.ClosePolicyViolation), "%v", err)
+	time.Sleep(100 * time.Millisecond)
+	third, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+valid, nil)
+	r.NoError(err, "closed connections are released")
+	r.NoError(third.Close())
+}
+
+func TestAuctionHandler_Webhooks(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	seller := user.User{FirstName: "Seller", LastName: "Seller", Email: "seller@example.com", Password: "hash"}
+	other := user.User{FirstName: "Other", LastName: "Other", Email: "other@example.com", Password: "hash"}
+	r.NoError(m.AddUser(&seller))
+	r.NoError(m.AddUser(&other))
+
+	var secret string
+	var mu sync.Mutex
+	status := http.StatusInternalServerError
+	var received []webhook.Payload
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, webhook.Verify(secret, r.Header.Get(webhook.SignatureHeader), r.Header.Get(webhook.TimestampHeader),
+			body, time.Now(), 24*time.Hour), "deliveries are signed with the time of the attempt")
+		var p webhook.Payload
+		require.NoError(t, json.Unmarshal(body, &p))
+		require.Equal(t, p.Event, r.Header.Get(webhook.EventHeader))
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, p)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+	setStatus := func(code int) {
+		mu.Lock()
+		defer mu.Unlock()
+		status = code
+	}
+
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	dispatcher := webhook.NewDispatcher(m, logger)
+	dispatcher.BaseDelay = time.Minute
+	dispatcher.MaxFailures = 3
+	dispatcher.AllowPrivate = true
+	handler.events.OnPublish(func(e event.Event) {
+		require.NoError(t, dispatcher.Enqueue(e))
+	})
+	mux := chi.NewRouter()
+	mux.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, seller.ID)))
+		})
+	})
+	mux.Post("/webhooks", handler.PostWebhook)
+	mux.Get("/webhooks/{id}", handler.GetWebhook)
+	mux.Put("/webhooks/{id}", handler.PutWebhook)
+	mux.Get("/webhooks/{id}/deliveries", handler.GetWebhookDeliveries)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	send := func(method string, path string, body string, result interface{}) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		r.NoError(err)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		if result != nil && resp.StatusCode == http.StatusOK {
+			r.NoError(json.NewDecoder(resp.Body).Decode(result))
+		}
+		return resp.StatusCode
+	}
+
+	r.Equal(http.StatusBadRequest, send(http.MethodPost, "/webhooks", `{"url": "erp", "events": ["lot.finished"]}`, nil))
+	r.Equal(http.StatusBadRequest, send(http.MethodPost, "/webhooks", `{"url": "`+receiver.URL+`", "events": ["sold"]}`, nil))
+	var hook webhook.Webhook
+	r.Equal(http.StatusOK, send(http.MethodPost, "/webhooks", `{"url": "`+receiver.URL+`", "events": ["lot.finished"]}`, &hook))
+	r.NotEmpty(hook.Secret, "secret is generated")
+	secret = hook.Secret
+	path := "/webhooks/" + strconv.Itoa(hook.ID)
+
+	sold := lot.Lot{ID: 1, CreatorID: seller.ID, Status: lot.Finished.String()}
+	r.NoError(handler.events.PublishLot(event.BidPlaced, sold))
+	r.NoError(handler.events.PublishLot(event.LotFinished, sold))
+	r.NoError(handler.events.PublishLot(event.LotFinished, lot.Lot{ID: 2, CreatorID: other.ID}))
+
+	now := time.Now()
+	count, err := dispatcher.Deliver(now)
+	r.NoError(err)
+	r.Equal(1, count, "only lot.finished of the seller is queued")
+	count, err = dispatcher.Deliver(now)
+	r.NoError(err)
+	r.Zero(count, "retry is postponed")
+	setStatus(http.StatusOK)
+	count, err = dispatcher.Deliver(now.Add(time.Minute))
+	r.NoError(err)
+	r.Equal(1, count)
+	r.Len(received, 2)
+	r.Equal("lot.finished", received[1].Event)
+	r.Equal(sold.ID, received[1].LotID)
+
+	var deliveries []webhook.Delivery
+	r.Equal(http.StatusOK, send(http.MethodGet, path+"/deliveries", "", &deliveries))
+	r.Len(deliveries, 1)
+	r.Equal(webhook.Delivered, deliveries[0].Status)
+	r.Equal(2, deliveries[0].Attempts)
+	r.Equal(http.StatusOK, deliveries[0].ResponseCode)
+
+	setStatus(http.StatusServiceUnavailable)
+	r.NoError(handler.events.PublishLot(event.LotFinished, sold))
+	r.NoError(handler.events.PublishLot(event.LotFinished, sold))
+	for i := 0; i < 3; i++ {
+		_, err = dispatcher.Deliver(now.Add(time.Duration(i+2) * time.Hour))
+		r.NoError(err)
+	}
+	hook = webhook.Webhook{}
+	r.Equal(http.StatusOK, send(http.MethodGet, path, "", &hook))
+	r.False(hook.Active, "webhook is disabled after repeated failures")
+	r.Empty(hook.Secret)
+	r.NotNil(hook.DisabledAt)
+	var failed []webhook.Delivery
+	r.Equal(http.StatusOK, send(http.MethodGet, path+"/deliveries?status=failed", "", &failed))
+	r.Len(failed, 2)
+	r.Equal("webhook is disabled", failed[0].LastError, "pending deliveries of a disabled webhook are dropped")
+
+	r.Equal(http.StatusOK, send(http.MethodPut, path, `{"active": true}`, &hook))
+	r.True(hook.Active)
+	r.Zero(hook.Failures)
+	r.Equal(http.StatusNotFound, send(http.MethodGet, "/webhooks/100", "", nil))
+}
+
+func TestAuctionHandler_Sessions(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.With(handler.Authenticator).Post("/signout", handler.PostSignout)
+	mux.With(handler.Authenticator).Get("/users/{id}/sessions", handler.GetUserSessions)
+	mux.With(handler.Authenticator).Delete("/users/{id}/sessions/{session}", handler.DeleteUserSession)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	send := func(method string, path string, token string, agent string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set("User-Agent", agent)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp
+	}
+	credentials := `{"email": "user@example.com", "password": "password"}`
+	r.Equal(http.StatusCreated, send(http.MethodPost, "/signup", "", "", `{"first_name": "User", "last_name": "User", "email": "user@example.com", "password": "password"}`).StatusCode)
+	signin := func(agent string) string {
+		resp := send(http.MethodPost, "/signin", "", agent, credentials)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		r.NoError(json.NewDecoder(resp.Body).Decode(&token))
+		return token.AccessToken
+	}
+	laptop := signin("laptop")
+	phone := signin("phone")
+
+	resp := send(http.MethodGet, "/users/0/sessions", laptop, "laptop", "")
+	r.Equal(http.StatusOK, resp.StatusCode)
+	var sessions []session.Info
+	r.NoError(json.NewDecoder(resp.Body).Decode(&sessions))
+	r.Len(sessions, 2)
+	byAgent := make(map[string]session.Info)
+	for _, s := range sessions {
+		byAgent[s.UserAgent] = s
+		r.Equal("127.0.0.1", s.IP)
+		r.NotContains([]string{laptop, phone}, s.ID, "tokens are not exposed")
+	}
+	r.True(byAgent["laptop"].Current)
+	r.False(byAgent["phone"].Current)
+	r.Equal(http.StatusForbidden, send(http.MethodGet, "/users/100/sessions", laptop, "laptop", "").StatusCode)
+
+	r.Equal(http.StatusNotFound, send(http.MethodDelete, "/users/0/sessions/unknown", laptop, "laptop", "").StatusCode)
+	r.Equal(http.StatusNoContent, send(http.MethodDelete, "/users/0/sessions/"+byAgent["phone"].ID, laptop, "laptop", "").StatusCode)
+	r.Equal(http.StatusUnauthorized, send(http.MethodGet, "/users/0/sessions", phone, "phone", "").StatusCode, "revoked token")
+
+	resp = send(http.MethodPost, "/signout", laptop, "laptop", "")
+	r.Equal(http.StatusNoContent, resp.StatusCode)
+	cookies := resp.Cookies()
+	r.Len(cookies, 2)
+	for _, c := range cookies {
+		r.Contains([]string{"BearerToken", "RefreshToken"}, c.Name)
+		r.Empty(c.Value)
+		r.True(c.MaxAge < 0)
+	}
+	r.Equal(http.StatusUnauthorized, send(http.MethodPost, "/signout", laptop, "laptop", "").StatusCode)
+}
+
+func TestAuctionHandler_RefreshToken(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.Post("/token/refresh", handler.PostRefreshToken)
+	mux.With(handler.Authenticator).Get("/users/{id}/sessions", handler.GetUserSessions)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	type tokens struct {
+		TokenType    string `json:"token_type"`
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	post := func(path string, contentType string, body string) (int, tokens) {
+		resp, err := client.Post(ts.URL+path, contentType, strings.NewReader(body))
+		r.NoError(err)
+		var result tokens
+		if resp.StatusCode == http.StatusOK {
+			r.NoError(json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp.StatusCode, result
+	}
+	sessions := func(token string) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/users/0/sessions", nil)
+		r.NoError(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp.StatusCode
+	}
+	code, _ := post("/signup", "application/json", `{"first_name": "User", "last_name": "User", "email": "user@example.com", "password": "password"}`)
+	r.Equal(http.StatusCreated, code)
+	code, first := post("/signin", "application/json", `{"email": "user@example.com", "password": "password"}`)
+	r.Equal(http.StatusOK, code)
+	r.Equal("bearer", first.TokenType)
+	r.NotEmpty(first.RefreshToken)
+	r.InDelta(session.AccessTokenLifeTime.Seconds(), float64(first.ExpiresIn), 2)
+
+	code, second := post("/token/refresh", "application/json", `{"refresh_token": "`+first.RefreshToken+`"}`)
+	r.Equal(http.StatusOK, code)
+	r.NotEqual(first.AccessToken, second.AccessToken)
+	r.NotEqual(first.RefreshToken, second.RefreshToken)
+	r.Equal(http.StatusUnauthorized, sessions(first.AccessToken), "rotated access token is revoked")
+	r.Equal(http.StatusOK, sessions(second.AccessToken))
+
+	code, third := post("/token/refresh", "application/x-www-form-urlencoded", "grant_type=refresh_token&refresh_token="+second.RefreshToken)
+	r.Equal(http.StatusOK, code)
+	code, _ = post("/token/refresh", "application/json", `{"refresh_token": "`+first.RefreshToken+`"}`)
+	r.Equal(http.StatusUnauthorized, code, "reused refresh token")
+	r.Equal(http.StatusUnauthorized, sessions(third.AccessToken), "reuse revokes the family")
+	code, _ = post("/token/refresh", "application/json", `{"refresh_token": "`+third.RefreshToken+`"}`)
+	r.Equal(http.StatusUnauthorized, code)
+
+	code, _ = post("/token/refresh", "application/json", `{}`)
+	r.Equal(http.StatusBadRequest, code)
+	code, _ = post("/token/refresh", "application/x-www-form-urlencoded", "grant_type=password")
+	r.Equal(http.StatusBadRequest, code)
+}
+
+func TestAuctionHandler_JWT(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	r.NoError(err)
+	ring, err := jwt.NewKeyRing("2026-10", jwt.NewEd25519Key("2026-10", private))
+	r.NoError(err)
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	handler.tokens = jwt.NewTokens(ring, "auction")
+	handler.denylist = jwt.NewDenylist(m)
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.Post("/token/refresh", handler.PostRefreshToken)
+	mux.Get("/.well-known/jwks.json", handler.GetJWKS)
+	mux.With(handler.Authenticator).Post("/signout", handler.PostSignout)
+	mux.With(handler.Authenticator).Get("/users/{id}/sessions", handler.GetUserSessions)
+	mux.With(handler.Authenticator).Delete("/users/{id}/sessions/{session}", handler.DeleteUserSession)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	send := func(method string, path string, token string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp
+	}
+	type tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	issue := func(path string, body string) tokens {
+		resp := send(http.MethodPost, path, "", body)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		var result tokens
+		r.NoError(json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+	credentials := `{"email": "user@example.com", "password": "password"}`
+	r.Equal(http.StatusCreated, send(http.MethodPost, "/signup", "", `{"first_name": "User", "last_name": "User", "email": "user@example.com", "password": "password"}`).StatusCode)
+	laptop := issue("/signin", credentials)
+	phone := issue("/signin", credentials)
+	r.Equal(2, strings.Count(laptop.AccessToken, "."))
+	claims, err := handler.tokens.Parse(laptop.AccessToken, time.Now())
+	r.NoError(err)
+	r.Equal("1", claims.Subject)
+	r.Equal([]string{"user"}, claims.Roles)
+
+	resp := send(http.MethodGet, "/.well-known/jwks.json", "", "")
+	r.Equal(http.StatusOK, resp.StatusCode)
+	var keys jwt.JWKS
+	r.NoError(json.NewDecoder(resp.Body).Decode(&keys))
+	r.Len(keys.Keys, 1)
+	r.Equal("2026-10", keys.Keys[0].Kid)
+
+	resp = send(http.MethodGet, "/users/0/sessions", laptop.AccessToken, "")
+	r.Equal(http.StatusOK, resp.StatusCode)
+	var sessions []session.Info
+	r.NoError(json.NewDecoder(resp.Body).Decode(&sessions))
+	r.Len(sessions, 2)
+	var other string
+	for _, s := range sessions {
+		r.Equal(s.ID == claims.SessionID, s.Current)
+		if !s.Current {
+			other = s.ID
+		}
+	}
+	stored, err := m.GetSessions(1)
+	r.NoError(err)
+	r.Equal(http.StatusUnauthorized, send(http.MethodGet, "/users/0/sessions", stored[0].SessionID, "").StatusCode,
+		"opaque tokens are not accepted")
+
+	r.Equal(http.StatusNoContent, send(http.MethodDelete, "/users/0/sessions/"+other, laptop.AccessToken, "").StatusCode)
+	r.Equal(http.StatusUnauthorized, send(http.MethodGet, "/users/0/sessions", phone.AccessToken, "").StatusCode, "revoked family")
+	r.Equal(http.StatusUnauthorized, send(http.MethodPost, "/token/refresh", "", `{"refresh_token": "`+phone.RefreshToken+`"}`).StatusCode)
+
+	refreshed := issue("/token/refresh", `{"refresh_token": "`+laptop.RefreshToken+`"}`)
+	r.Equal(2, strings.Count(refreshed.AccessToken, "."))
+	r.Equal(http.StatusOK, send(http.MethodGet, "/users/0/sessions", refreshed.AccessToken, "").StatusCode)
+
+	r.Equal(http.StatusNoContent, send(http.MethodPost, "/signout", refreshed.AccessToken, "").StatusCode)
+	r.Equal(http.StatusUnauthorized, send(http.MethodGet, "/users/0/sessions", refreshed.AccessToken, "").StatusCode, "signed out")
+	r.Equal(http.StatusUnauthorized, send(http.MethodGet, "/users/0/sessions", laptop.AccessToken, "").StatusCode)
+	r.Equal(http.StatusUnauthorized, send(http.MethodPost, "/token/refresh", "", `{"refresh_token": "`+refreshed.RefreshToken+`"}`).StatusCode)
+
+	r.NoError(m.SetRole(1, user.RoleModerator))
+	claims, err = handler.tokens.Parse(issue("/signin", credentials).AccessToken, time.Now())
+	r.NoError(err)
+	r.Equal([]string{"moderator"}, claims.Roles, "new tokens carry the stored role")
+
+	opaque := NewAuctionHandler(m, &logger, template.Templates{})
+	w := httptest.NewRecorder()
+	opaque.GetJWKS(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	r.Equal(http.StatusNotFound, w.Code, "no keys in opaque mode")
+}
+
+// waitMail returns the token from the last message sent to the email, mail is sent in background.
+func waitMail(t *testing.T, m *mailer.Memory, to string, count int) string {
+	deadline := time.Now().Add(RaceTimeout())
+	for time.Now().Before(deadline) {
+		var found []mailer.Message
+		for _, v := range m.Messages() {
+			if v.To == to {
+				found = append(found, v)
+			}
+		}
+		if len(found) >= count {
+			line := strings.SplitN(found[count-1].Body, "\n", 2)[0]
+			return line[strings.LastIndex(line, " ")+1:]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "no mail to "+to)
+	return ""
+}
+
+func TestAuctionHandler_EmailVerification(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	handler := NewAuctionHandler(memstore.NewMemStore(), &logger, template.Templates{})
+	handler.requireVerified = true
+	mail := handler.mailer.(*mailer.Memory)
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.Post("/email/verify", handler.PostEmailVerify)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(handler.Authenticator)
+		mux.Post("/email/verify/resend", handler.PostEmailVerifyResend)
+		mux.Get("/users/{id}", handler.GetUser)
+		mux.Post("/lots", handler.PostLots)
+		mux.Put("/lots/{id}/buy", handler.BuyLot)
+		mux.Put("/lots/{id}/buy-now", handler.BuyNow)
+		mux.Put("/lots/{id}/max-bid", handler.SetMaxBid)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	do := func(method string, url string, token string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp
+	}
+	signin := func(email string) string {
+		r.Equal(http.StatusCreated, do(http.MethodPost, "/signup", "", `{"first_name": "Test","last_name": "Test","email": "`+email+`","password": "qwerty"}`).StatusCode)
+		resp := do(http.MethodPost, "/signin", "", `{"email": "`+email+`","password": "qwerty"}`)
+		r.Equal(http.StatusOK, resp.StatusCode)
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		r.NoError(json.NewDecoder(resp.Body).Decode(&token))
+		return token.AccessToken
+	}
+	verified := func(token string) bool {
+		resp := do(http.MethodGet, "/users/0", token, "")
+		r.Equal(http.StatusOK, resp.StatusCode)
+		var u struct {
+			EmailVerified bool `json:"email_verified"`
+		}
+		r.NoError(json.NewDecoder(resp.Body).Decode(&u))
+		return u.EmailVerified
+	}
+	seller := signin("seller@example.com")
+	buyer := signin("buyer@example.com")
+	endAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	resp := do(http.MethodPost, "/lots", seller, `{"title": "Lot","min_price": 10,"price_step": 5,"buy_now_price": 100,"status": "active","end_at": "`+endAt+`"}`)
+	r.Equal(http.StatusOK, resp.StatusCode)
+	var created struct {
+		ID int `json:"id"`
+	}
+	r.NoError(json.NewDecoder(resp.Body).Decode(&created))
+	lotURL := "/lots/" + strconv.Itoa(created.ID)
+
+	r.False(verified(buyer))
+	r.Equal(http.StatusForbidden, do(http.MethodPut, lotURL+"/buy", buyer, `{"price": 15}`).StatusCode)
+	r.Equal(http.StatusForbidden, do(http.MethodPut, lotURL+"/max-bid", buyer, `{"max_price": 50}`).StatusCode)
+	r.Equal(http.StatusForbidden, do(http.MethodPut, lotURL+"/buy-now", buyer, "").StatusCode)
+
+	first := waitMail(t, mail, "buyer@example.com", 1)
+	r.Equal(http.StatusAccepted, do(http.MethodPost, "/email/verify/resend", buyer, "").StatusCode)
+	second := waitMail(t, mail, "buyer@example.com", 2)
+	r.NotEqual(first, second)
+	r.Equal(http.StatusBadRequest, do(http.MethodPost, "/email/verify", "", `{"token": "wrong"}`).StatusCode)
+	r.Equal(http.StatusBadRequest, do(http.MethodPost, "/email/verify", "", `{}`).StatusCode)
+	r.Equal(http.StatusNoContent, do(http.MethodPost, "/email/verify", "", `{"token": "`+first+`"}`).StatusCode)
+	r.Equal(http.StatusBadRequest, do(http.MethodPost, "/email/verify", "", `{"token": "`+first+`"}`).StatusCode, "token is used once")
+	r.True(verified(buyer))
+	r.False(verified(seller))
+	r.Equal(http.StatusConflict, do(http.MethodPost, "/email/verify/resend", buyer, "").StatusCode)
+
+	r.Equal(http.StatusOK, do(http.MethodPut, lotURL+"/buy", buyer, `{"price": 15}`).StatusCode)
+	r.Equal(http.StatusOK, do(http.MethodPut, lotURL+"/max-bid", buyer, `{"max_price": 50}`).StatusCode)
+}
+
+func TestAuctionHandler_ReservePrice(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	handler := NewAuctionHandler(memstore.NewMemStore(), &logger, template.Templates{})
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(handler.Authenticator)
+		mux.Get("/lots", handler.GetLots)
+		mux.Post("/lots", handler.PostLots)
+		mux.Get("/lots/{id}", handler.GetLot)
+		mux.Put("/lots/{id}", handler.PutLot)
+		mux.Get("/users/{id}/lots", handler.GetUserLots)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	do := func(method string, url string, token string, body string, result interface{}) {
+		req, err := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode, method+" "+url)
+		r.NoError(json.NewDecoder(resp.Body).Decode(result))
+	}
+	signin := func(email string) string {
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		resp, err := client.Post(ts.URL+"/signup", "application/json",
+			strings.NewReader(`{"first_name": "Test","last_name": "Test","email": "`+email+`","password": "qwerty"}`))
+		r.NoError(err)
+		r.Equal(http.StatusCreated, resp.StatusCode)
+		do(http.MethodPost, "/signin", "", `{"email": "`+email+`","password": "qwerty"}`, &token)
+		return token.AccessToken
+	}
+	seller := signin("seller@example.com")
+	buyer := signin("buyer@example.com")
+	endAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	var created map[string]interface{}
+	do(http.MethodPost, "/lots", seller, `{"title": "Lot","min_price": 10,"price_step": 5,"reserve_price": 30,"end_at": "`+endAt+`"}`, &created)
+	r.Contains(created, "reserve_price")
+	lotURL := "/lots/" + strconv.Itoa(int(created["id"].(float64)))
+
+	var updated map[string]interface{}
+	do(http.MethodPut, lotURL, seller, `{"title": "Renamed","min_price": 10,"price_step": 5,"reserve_price": 40}`, &updated)
+	r.Equal(map[string]interface{}{"amount": "40.00", "currency": "RUB"}, updated["reserve_price"], "the creator confirms the reserve")
+	for _, tc := range []struct {
+		Token   string
+		Reserve bool
+	}{{Token: seller, Reserve: true}, {Token: buyer}} {
+		var single map[string]interface{}
+		do(http.MethodGet, lotURL, tc.Token, "", &single)
+		r.Equal(tc.Reserve, single["reserve_price"] != nil)
+		r.Equal(false, single["reserve_met"])
+		var all []map[string]interface{}
+		do(http.MethodGet, "/lots", tc.Token, "", &all)
+		r.Len(all, 1)
+		r.Equal(tc.Reserve, all[0]["reserve_price"] != nil)
+		var own []map[string]interface{}
+		do(http.MethodGet, "/users/1/lots", tc.Token, "", &own)
+		r.Len(own, 1)
+		r.Equal(tc.Reserve, own[0]["reserve_price"] != nil)
+	}
+}
+
+func TestAuctionHandler_PasswordReset(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	handler := NewAuctionHandler(memstore.NewMemStore(), &logger, template.Templates{})
+	handler.passwordPolicy = user.PasswordPolicy{RejectEmail: true}
+	mail := handler.mailer.(*mailer.Memory)
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.Post("/password/forgot", handler.PostPasswordForgot)
+	mux.Post("/password/reset", handler.PostPasswordReset)
+	mux.With(handler.Authenticator).Get("/users/{id}", handler.GetUser)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	post := func(url string, body string) *http.Response {
+		resp, err := client.Post(ts.URL+url, "application/json", strings.NewReader(body))
+		r.NoError(err)
+		return resp
+	}
+	signin := func(password string) (int, string) {
+		resp := post("/signin", `{"email": "user@example.com","password": "`+password+`"}`)
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			r.NoError(json.NewDecoder(resp.Body).Decode(&token))
+		}
+		return resp.StatusCode, token.AccessToken
+	}
+	r.Equal(http.StatusCreated, post("/signup", `{"first_name": "Test","last_name": "Test","email": "user@example.com","password": "qwerty"}`).StatusCode)
+	code, old := signin("qwerty")
+	r.Equal(http.StatusOK, code)
+
+	r.Equal(http.StatusAccepted, post("/password/forgot", `{"email": "missing@example.com"}`).StatusCode, "unknown emails are not disclosed")
+	r.Equal(http.StatusBadRequest, post("/password/forgot", `{}`).StatusCode)
+	r.Equal(http.StatusAccepted, post("/password/forgot", `{"email": "user@example.com"}`).StatusCode)
+	waitMail(t, mail, "user@example.com", 1)
+	token := waitMail(t, mail, "user@example.com", 2)
+	for _, m := range mail.Messages() {
+		r.NotEqual("missing@example.com", m.To)
+	}
+
+	r.Equal(http.StatusBadRequest, post("/password/reset", `{"token": "wrong", "password": "new password"}`).StatusCode)
+	r.Equal(http.StatusBadRequest, post("/password/reset", `{"token": "`+token+`"}`).StatusCode)
+	r.Equal(http.StatusBadRequest, post("/password/reset", `{"token": "`+token+`", "password": "user-password"}`).StatusCode,
+		"the email rule keeps the token")
+	r.Equal(http.StatusNoContent, post("/password/reset", `{"token": "`+token+`", "password": "new password"}`).StatusCode)
+	r.Equal(http.StatusBadRequest, post("/password/reset", `{"token": "`+token+`", "password": "other password"}`).StatusCode, "token is used once")
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/users/0", nil)
+	r.NoError(err)
+	req.Header.Set("Authorization", "Bearer "+old)
+	resp, err := client.Do(req)
+	r.NoError(err)
+	r.Equal(http.StatusUnauthorized, resp.StatusCode, "sessions are revoked")
+	code, _ = signin("qwerty")
+	r.Equal(http.StatusUnauthorized, code)
+	code, fresh := signin("new password")
+	r.Equal(http.StatusOK, code)
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/users/0", nil)
+	r.NoError(err)
+	req.Header.Set("Authorization", "Bearer "+fresh)
+	resp, err = client.Do(req)
+	r.NoError(err)
+	var u struct {
+		EmailVerified bool `json:"email_verified"`
+	}
+	r.NoError(json.NewDecoder(resp.Body).Decode(&u))
+	r.True(u.EmailVerified, "reset proves the email")
+}
+
+func TestAuctionHandler_PasswordForgotLimit(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	handler.accounts = lockout.NewLimiter(m, lockout.Policy{FreeFailures: 1, Delay: time.Minute, MaxDelay: time.Minute, Window: time.Hour})
+	handler.addresses = lockout.NewLimiter(m, lockout.Policy{FreeFailures: 2, Delay: time.Hour, MaxDelay: time.Hour, Window: time.Hour})
+	mail := handler.mailer.(*mailer.Memory)
+	r.NoError(m.AddUser(&user.User{FirstName: "User", LastName: "User", Email: "user@example.com", Password: "hash"}))
+	mux := chi.NewRouter()
+	mux.Post("/password/forgot", handler.PostPasswordForgot)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	forgot := func(email string) int {
+		resp, err := client.Post(ts.URL+"/password/forgot", "application/json", strings.NewReader(`{"email": "`+email+`"}`))
+		r.NoError(err)
+		return resp.StatusCode
+	}
+
+	r.Equal(http.StatusAccepted, forgot("user@example.com"))
+	r.Equal(http.StatusAccepted, forgot("user@example.com"))
+	r.Equal(http.StatusTooManyRequests, forgot(" User@example.com"), "mails to the address are limited")
+	r.Equal(http.StatusAccepted, forgot("missing@example.com"))
+	r.Equal(http.StatusTooManyRequests, forgot("other@example.com"), "requests from the client are limited")
+	waitMail(t, mail, "user@example.com", 2)
+	time.Sleep(50 * time.Millisecond)
+	r.Len(mail.Messages(), 2)
+}
+
+func TestAuctionHandler_PutUserPassword(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	handler := NewAuctionHandler(memstore.NewMemStore(), &logger, template.Templates{})
+	handler.passwordPolicy = user.DefaultPasswordPolicy
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.With(handler.Authenticator).Get("/users/{id}", handler.GetUser)
+	mux.With(handler.Authenticator).Put("/users/{id}/password", handler.PutUserPassword)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	send := func(method string, path string, token string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		return resp
+	}
+	signin := func(password string) (int, string) {
+		resp := send(http.MethodPost, "/signin", "", `{"email": "durov@telegram.org","password": "`+password+`"}`)
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			r.NoError(json.NewDecoder(resp.Body).Decode(&token))
+		}
+		return resp.StatusCode, token.AccessToken
+	}
+	signup := `{"first_name": "Pavel","last_name": "Durov","email": "durov@telegram.org","password": "%s"}`
+	for _, weak := range []string{"qwerty", "password1", "durov2019", "abcdefghij"} {
+		r.Equal(http.StatusBadRequest, send(http.MethodPost, "/signup", "", fmt.Sprintf(signup, weak)).StatusCode, weak)
+	}
+	r.Equal(http.StatusCreated, send(http.MethodPost, "/signup", "", fmt.Sprintf(signup, "Telegram-2013")).StatusCode)
+	code, laptop := signin("Telegram-2013")
+	r.Equal(http.StatusOK, code)
+	code, phone := signin("Telegram-2013")
+	r.Equal(http.StatusOK, code)
+
+	change := func(id string, current string, password string) int {
+		body := `{"current_password": "` + current + `", "new_password": "` + password + `"}`
+		return send(http.MethodPut, "/users/"+id+"/password", laptop, body).StatusCode
+	}
+	r.Equal(http.StatusForbidden, change("0", "wrong", "Secret-Chats-7"))
+	r.Equal(http.StatusForbidden, change("100", "Telegram-2013", "Secret-Chats-7"))
+	r.Equal(http.StatusBadRequest, change("0", "Telegram-2013", "qwerty"))
+	r.Equal(http.StatusBadRequest, change("0", "Telegram-2013", "Telegram-2013"), "password should change")
+	r.Equal(http.StatusBadRequest, send(http.MethodPut, "/users/0/password", laptop, "{").StatusCode)
+	r.Equal(http.StatusOK, send(http.MethodGet, "/users/0", phone, "").StatusCode, "failed changes keep sessions")
+	r.Equal(http.StatusNoContent, change("0", "Telegram-2013", "Secret-Chats-7"))
+
+	r.Equal(http.StatusUnauthorized, send(http.MethodGet, "/users/0", phone, "").StatusCode, "other sessions are revoked")
+	r.Equal(http.StatusOK, send(http.MethodGet, "/users/0", laptop, "").StatusCode, "current session is kept")
+	code, _ = signin("Telegram-2013")
+	r.Equal(http.StatusUnauthorized, code)
+	code, _ = signin("Secret-Chats-7")
+	r.Equal(http.StatusOK, code)
+}
+
+func TestAuctionHandler_TwoFactor(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	handler.totpIssuer = "Auction"
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.Post("/signin/2fa", handler.PostSigninTwoFactor)
+	mux.With(handler.Authenticator).Get("/users/{id}", handler.GetUser)
+	mux.With(handler.Authenticator).Post("/users/{id}/2fa", handler.PostUserTwoFactor)
+	mux.With(handler.Authenticator).Post("/users/{id}/2fa/confirm", handler.PostUserTwoFactorConfirm)
+	mux.With(handler.Authenticator).Delete("/users/{id}/2fa", handler.DeleteUserTwoFactor)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	send := func(method string, path string, token string, body string, result interface{}) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		if result != nil && resp.StatusCode < http.StatusBadRequest {
+			r.NoError(json.NewDecoder(resp.Body).Decode(result))
+		}
+		return resp.StatusCode
+	}
+	var signin struct {
+		AccessToken    string `json:"access_token"`
+		ChallengeToken string `json:"challenge_token"`
+		ExpiresIn      int64  `json:"expires_in"`
+	}
+	credentials := `{"email": "seller@example.com","password": "qwerty"}`
+	r.Equal(http.StatusCreated, send(http.MethodPost, "/signup", "", `{"first_name": "Seller","last_name": "Seller","email": "seller@example.com","password": "qwerty"}`, nil))
+	r.Equal(http.StatusOK, send(http.MethodPost, "/signin", "", credentials, &signin))
+	token := signin.AccessToken
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+	r.Equal(http.StatusForbidden, send(http.MethodPost, "/users/100/2fa", token, "", nil))
+	r.Equal(http.StatusCreated, send(http.MethodPost, "/users/0/2fa", token, "", &enrollment))
+	r.True(strings.HasPrefix(enrollment.URI, "otpauth://totp/Auction:seller@example.com?"))
+	r.Contains(enrollment.URI, "secret="+enrollment.Secret)
+	r.Equal(http.StatusOK, send(http.MethodPost, "/signin", "", credentials, nil), "2FA is enabled after confirmation")
+
+	code := func(at time.Time) string {
+		result, err := totp.Code(enrollment.Secret, at)
+		r.NoError(err)
+		return `{"code": "` + result + `"}`
+	}
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	r.Equal(http.StatusBadRequest, send(http.MethodPost, "/users/0/2fa/confirm", token, `{}`, nil))
+	r.Equal(http.StatusForbidden, send(http.MethodPost, "/users/0/2fa/confirm", token, code(time.Now().Add(time.Hour)), nil))
+	confirmed := code(time.Now())
+	r.Equal(http.StatusOK, send(http.MethodPost, "/users/0/2fa/confirm", token, confirmed, &recovery))
+	r.Len(recovery.RecoveryCodes, user.RecoveryCodeCount)
+	r.Equal(http.StatusConflict, send(http.MethodPost, "/users/0/2fa", token, "", nil))
+	var u struct {
+		TwoFactor bool `json:"two_factor_enabled"`
+	}
+	r.Equal(http.StatusOK, send(http.MethodGet, "/users/0", token, "", &u))
+	r.True(u.TwoFactor)
+
+	challenge := func() string {
+		signin.AccessToken, signin.ChallengeToken = "", ""
+		r.Equal(http.StatusAccepted, send(http.MethodPost, "/signin", "", credentials, &signin))
+		r.Empty(signin.AccessToken)
+		r.NotEmpty(signin.ChallengeToken)
+		r.Equal(int64(user.SigninChallengeLifeTime/time.Second), signin.ExpiresIn)
+		return signin.ChallengeToken
+	}
+	complete := func(challenge string, code string) int {
+		signin.AccessToken = ""
+		body := `{"challenge_token": "` + challenge + `", "code": "` + code + `"}`
+		return send(http.MethodPost, "/signin/2fa", "", body, &signin)
+	}
+	first := challenge()
+	r.Equal(http.StatusUnauthorized, send(http.MethodPost, "/signin/2fa", "", strings.Replace(confirmed, `{`, `{"challenge_token": "`+first+`", `, 1), nil),
+		"a code is accepted once")
+	next, err := totp.Code(enrollment.Secret, time.Now().Add(totp.Period))
+	r.NoError(err)
+	r.Equal(http.StatusOK, complete(first, next))
+	r.NotEmpty(signin.AccessToken)
+	r.Equal(http.StatusOK, send(http.MethodGet, "/users/0", signin.AccessToken, "", nil))
+	r.Equal(http.StatusUnauthorized, complete(first, recovery.RecoveryCodes[0]), "a challenge gives one session")
+	r.Equal(http.StatusUnauthorized, complete("unknown", recovery.RecoveryCodes[0]))
+
+	second := challenge()
+	for i := 0; i < user.MaxChallengeAttempts; i++ {
+		r.Equal(http.StatusUnauthorized, complete(second, "000000"))
+	}
+	r.Equal(http.StatusUnauthorized, complete(second, recovery.RecoveryCodes[0]), "attempts are exhausted")
+	third := challenge()
+	r.Equal(http.StatusOK, complete(third, strings.ToUpper(recovery.RecoveryCodes[0])))
+	r.Equal(http.StatusUnauthorized, complete(challenge(), recovery.RecoveryCodes[0]), "a recovery code is used once")
+
+	handler.accounts = lockout.NewLimiter(m, lockout.Policy{LockFailures: 1, LockDuration: time.Hour, Window: time.Hour})
+	r.Equal(http.StatusUnauthorized, complete(challenge(), "000000"))
+	r.Equal(http.StatusTooManyRequests, complete(challenge(), recovery.RecoveryCodes[1]), "wrong codes are limited across challenges")
+	r.Equal(http.StatusTooManyRequests, send(http.MethodDelete, "/users/0/2fa", token, `{"code": "`+recovery.RecoveryCodes[1]+`"}`, nil))
+	handler.accounts = lockout.NewLimiter(m, lockout.DefaultAccountPolicy)
+
+	r.Equal(http.StatusForbidden, send(http.MethodDelete, "/users/0/2fa", token, `{"code": "000000"}`, nil))
+	r.Equal(http.StatusNoContent, send(http.MethodDelete, "/users/0/2fa", token, `{"code": "`+recovery.RecoveryCodes[1]+`"}`, nil))
+	r.Equal(http.StatusConflict, send(http.MethodDelete, "/users/0/2fa", token, `{"code": "`+recovery.RecoveryCodes[2]+`"}`, nil))
+	r.Equal(http.StatusOK, send(http.MethodPost, "/signin", "", credentials, nil))
+	r.Equal(http.StatusOK, send(http.MethodGet, "/users/0", token, "", &u))
+	r.False(u.TwoFactor)
+}
+
+func TestAuctionHandler_Lockout(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	handler.adminToken = "secret"
+	handler.accounts = lockout.NewLimiter(m, lockout.Policy{FreeFailures: 1, Delay: time.Minute, MaxDelay: time.Minute,
+		LockFailures: 3, LockDuration: time.Hour, Window: time.Hour})
+	handler.addresses = lockout.NewLimiter(m, lockout.Policy{FreeFailures: 5, Delay: time.Hour, MaxDelay: time.Hour, Window: time.Hour})
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.With(handler.Authenticator, handler.RequireRole(user.RoleAdmin)).Post("/admin/users/{id}/unlock", handler.PostUserUnlock)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	type result struct {
+		Code       int
+		RetryAfter string
+		Body       string
+	}
+	send := func(path string, token string, admin string, body string) result {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if admin != "" {
+			req.Header.Set("X-Admin-Token", admin)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		return result{Code: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After"), Body: string(data)}
+	}
+	signin := func(email string, password string) result {
+		return send("/signin", "", "", `{"email": "`+email+`","password": "`+password+`"}`)
+	}
+	r.Equal(http.StatusCreated, send("/signup", "", "", `{"first_name": "User","last_name": "User","email": "user@example.com","password": "qwerty"}`).Code)
+	r.Equal(http.StatusCreated, send("/signup", "", "", `{"first_name": "Admin","last_name": "Admin","email": "admin@example.com","password": "qwerty"}`).Code)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	admin := signin("admin@example.com", "qwerty")
+	r.Equal(http.StatusOK, admin.Code)
+	r.NoError(json.Unmarshal([]byte(admin.Body), &token))
+
+	wrong := signin("user@example.com", "wrong")
+	r.Equal(http.StatusUnauthorized, wrong.Code)
+	r.Empty(wrong.RetryAfter)
+	delayed := signin("user@example.com", "wrong")
+	r.Equal(http.StatusUnauthorized, delayed.Code)
+	r.Equal("60", delayed.RetryAfter)
+	rejected := signin("user@example.com", "qwerty")
+	r.Equal(http.StatusTooManyRequests, rejected.Code, "the right password waits for the delay")
+	r.Equal("60", rejected.RetryAfter)
+
+	unknown := signin("missing@example.com", "wrong")
+	r.Equal(wrong, unknown, "unknown emails are not disclosed")
+	unknown = signin("missing@example.com", "wrong")
+	r.Equal(delayed, unknown)
+	r.Equal(http.StatusTooManyRequests, signin("missing@example.com", "wrong").Code)
+	r.Equal(http.StatusUnauthorized, signin("", "qwerty").Code)
+
+	r.Equal(http.StatusForbidden, send("/admin/users/1/unlock", token.AccessToken, "", "").Code)
+	r.Equal(http.StatusForbidden, send("/admin/users/1/unlock", token.AccessToken, "wrong", "").Code)
+	r.Equal(http.StatusNotFound, send("/admin/users/100/unlock", token.AccessToken, "secret", "").Code)
+	r.Equal(http.StatusNoContent, send("/admin/users/1/unlock", token.AccessToken, "secret", "").Code)
+	r.Equal(http.StatusOK, signin("user@example.com", "qwerty").Code, "the account is unlocked")
+
+	failed := signin("other@example.com", "wrong")
+	r.Equal(http.StatusUnauthorized, failed.Code)
+	r.Equal("3600", failed.RetryAfter, "failures from the address are counted across accounts")
+	r.Equal(http.StatusTooManyRequests, signin("user@example.com", "qwerty").Code)
+}
+
+func TestAuctionHandler_Roles(t *testing.T) {
+	r := require.New(t)
+	logger := log.New()
+	m := memstore.NewMemStore()
+	handler := NewAuctionHandler(m, &logger, template.Templates{})
+	handler.adminToken = "secret"
+	mux := chi.NewRouter()
+	mux.Post("/signup", handler.PostSignup)
+	mux.Post("/signin", handler.PostSignin)
+	mux.With(handler.Authenticator).Get("/users/{id}", handler.GetUser)
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(handler.Authenticator)
+		mux.With(handler.RequireRole(user.RoleModerator)).Put("/lots/{id}/finish", handler.FinishLot)
+		mux.With(handler.RequireRole(user.RoleModerator)).Delete("/lots/{id}", handler.DeleteAnyLot)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(handler.RequireRole(user.RoleAdmin))
+			mux.Get("/users", handler.GetUsers)
+			mux.Put("/users/{id}/role", handler.PutUserRole)
+			mux.Post("/users/{id}/ban", handler.PostUserBan)
+			mux.Delete("/users/{id}/ban", handler.DeleteUserBan)
+			mux.Delete("/users/{id}/sessions", handler.DeleteUserSessions)
+		})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client := http.Client{Timeout: RaceTimeout()}
+	send := func(method string, path string, token string, admin string, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		r.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if admin != "" {
+			req.Header.Set("X-Admin-Token", admin)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		r.NoError(err)
+		return resp.StatusCode, string(data)
+	}
+	signin := func(email string) (int, string) {
+		code, body := send(http.MethodPost, "/signin", "", "", `{"email": "`+email+`","password": "qwerty"}`)
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		if code == http.StatusOK {
+			r.NoError(json.Unmarshal([]byte(body), &token))
+		}
+		return code, token.AccessToken
+	}
+	tokens := map[string]string{}
+	for _, name := range []string{"admin", "moderator", "user"} {
+		code, _ := send(http.MethodPost, "/signup", "", "", `{"first_name": "`+name+`","last_name": "Test","email": "`+name+`@example.com","password": "qwerty"}`)
+		r.Equal(http.StatusCreated, code)
+		code, tokens[name] = signin(name + "@example.com")
+		r.Equal(http.StatusOK, code)
+	}
+	code, _ := send(http.MethodGet, "/admin/users", tokens["admin"], "", "")
+	r.Equal(http.StatusForbidden, code, "new users have the user role")
+	code, _ = send(http.MethodPut, "/admin/users/1/role", tokens["user"], "", `{"role": "admin"}`)
+	r.Equal(http.StatusForbidden, code)
+	code, body := send(http.MethodPut, "/admin/users/1/role", tokens["user"], "secret", `{"role": "admin"}`)
+	r.Equal(http.StatusOK, code, "the admin token appoints the first admin")
+	r.Contains(body, `"role":"admin"`)
+
+	testCases := []struct {
+		Name string
+		Path string
+		Body string
+		Code int
+	}{
+		{Name: "Unknown role", Path: "/admin/users/2/role", Body: `{"role": "owner"}`, Code: http.StatusBadRequest},
+		{Name: "Own role", Path: "/admin/users/1/role", Body: `{"role": "user"}`, Code: http.StatusBadRequest},
+		{Name: "Unknown user", Path: "/admin/users/100/role", Body: `{"role": "user"}`, Code: http.StatusNotFound},
+		{Name: "Moderator", Path: "/admin/users/2/role", Body: `{"role": "moderator"}`, Code: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		code, _ := send(http.MethodPut, tc.Path, tokens["admin"], "", tc.Body)
+		r.Equal(tc.Code, code, tc.Name)
+	}
+
+	code, body = send(http.MethodGet, "/admin/users?q=MODERATOR", tokens["admin"], "", "")
+	r.Equal(http.StatusOK, code)
+	var users []struct {
+		ID       int        `json:"id"`
+		Role     user.Role  `json:"role"`
+		BannedAt *time.Time `json:"banned_at"`
+	}
+	r.NoError(json.Unmarshal([]byte(body), &users))
+	r.Len(users, 1)
+	r.Equal(2, users[0].ID)
+	r.Equal(user.RoleModerator, users[0].Role)
+	code, body = send(http.MethodGet, "/admin/users?limit=2&offset=1", tokens["admin"], "", "")
+	r.Equal(http.StatusOK, code)
+	r.NoError(json.Unmarshal([]byte(body), &users))
+	r.Len(users, 2)
+	r.Equal(3, users[1].ID)
+	code, _ = send(http.MethodGet, "/admin/users", tokens["moderator"], "", "")
+	r.Equal(http.StatusForbidden, code, "moderators can't manage users")
+
+	active := lot.Lot{Title: "Active", MinPrice: money.FromMajor(10, money.RUB), PriceStep: money.FromMajor(1, money.RUB),
+		Status: lot.Active.String(), CreatorID: 3, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(m.AddLot(&active))
+	other := active
+	other.ID = 0
+	r.NoError(m.AddLot(&other))
+	lotPath := "/admin/lots/" + strconv.Itoa(active.ID)
+	code, _ = send(http.MethodPut, lotPath+"/finish", tokens["user"], "", "")
+	r.Equal(http.StatusForbidden, code)
+	code, body = send(http.MethodPut, lotPath+"/finish", tokens["moderator"], "", "")
+	r.Equal(http.StatusOK, code)
+	r.Contains(body, `"status":"finished"`)
+	code, _ = send(http.MethodPut, lotPath+"/finish", tokens["admin"], "", "")
+	r.Equal(http.StatusNotFound, code, "admins have powers of moderators, the lot is finished already")
+	otherPath := "/admin/lots/" + strconv.Itoa(other.ID)
+	code, _ = send(http.MethodDelete, otherPath, tokens["user"], "", "")
+	r.Equal(http.StatusForbidden, code)
+	code, _ = send(http.MethodDelete, otherPath, tokens["moderator"], "", "")
+	r.Equal(http.StatusNoContent, code)
+	code, _ = send(http.MethodDelete, otherPath, tokens["moderator"], "", "")
+	r.Equal(http.StatusNotFound, code)
+
+	code, _ = send(http.MethodPost, "/admin/users/1/ban", tokens["admin"], "", "")
+	r.Equal(http.StatusBadRequest, code, "admins can't ban themselves")
+	code, _ = send(http.MethodPost, "/admin/users/3/ban", tokens["admin"], "", "")
+	r.Equal(http.StatusNoContent, code)
+	code, _ = send(http.MethodGet, "/users/0", tokens["user"], "", "")
+	r.Equal(http.StatusUnauthorized, code, "sessions of a banned user are revoked")
+	code, _ = signin("user@example.com")
+	r.Equal(http.StatusForbidden, code)
+	code, body = send(http.MethodGet, "/admin/users?q=user@", tokens["admin"], "", "")
+	r.Equal(http.StatusOK, code)
+	r.NoError(json.Unmarshal([]byte(body), &users))
+	r.Len(users, 1)
+	r.NotNil(users[0].BannedAt)
+	code, _ = send(http.MethodDelete, "/admin/users/3/ban", tokens["admin"], "", "")
+	r.Equal(http.StatusNoContent, code)
+	code, tokens["user"] = signin("user@example.com")
+	r.Equal(http.StatusOK, code)
+
+	code, _ = send(http.MethodDelete, "/admin/users/3/sessions", tokens["admin"], "", "")
+	r.Equal(http.StatusNoContent, code)
+	code, _ = send(http.MethodGet, "/users/0", tokens["user"], "", "")
+	r.Equal(http.StatusUnauthorized, code)
+
+	code, _ = send(http.MethodPut, "/admin/users/2/role", tokens["admin"], "", `{"role": "user"}`)
+	r.Equal(http.StatusOK, code)
+	code, _ = send(http.MethodPut, lotPath+"/finish", tokens["moderator"], "", "")
+	r.Equal(http.StatusForbidden, code, "opaque tokens get the role from storage")
+}
+
+func TestConfig_String(t *testing.T) {
+	r := require.New(t)
+	cfg := config{AdminToken: "admin-secret", SMTPUser: "mailer", SMTPPassword: "smtp-secret", MailFrom: "auction@example.com"}
+	cfg.DB.URL = "cG9zdGdyZXM6Ly91c2VyOmRiLXNlY3JldEBsb2NhbGhvc3Q="
+	printed := cfg.String()
+	for _, secret := range []string{"admin-secret", "smtp-secret", cfg.DB.URL} {
+		r.NotContains(printed, secret)
+	}
+	r.Contains(printed, "SMTPUser:mailer")
+	r.Contains(printed, "SMTPPassword:***")
+	r.NotContains(config{}.String(), "***", "empty secrets are not masked")
+	r.Equal("admin-secret", cfg.AdminToken, "config itself is kept")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -14,20 +15,71 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"gitlab.com/asciishell/tfs-go-auction/internal/background"
 	"gitlab.com/asciishell/tfs-go-auction/internal/database"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/internal/hub"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lockout"
+	"gitlab.com/asciishell/tfs-go-auction/internal/mailer"
+	"gitlab.com/asciishell/tfs-go-auction/internal/memstore"
+	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
 	"gitlab.com/asciishell/tfs-go-auction/pkg/environment"
 	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
 )
 
 type config struct {
-	DB          database.DBCredential
-	HTTPAddress string
-	HTTPTimeout time.Duration
-	MaxRequests int
-	PrintConfig bool
+	Storage            string
+	DB                 database.DBCredential
+	HTTPAddress        string
+	HTTPTimeout        time.Duration
+	MaxRequests        int
+	RatesFile          string
+	Retention          int
+	EventBus           string
+	WSOrigins          []string
+	MaxStreams         int
+	AdminToken         string
+	WebhookMaxAttempts int
+	WebhookMaxFailures int
+	WebhookPrivate     bool
+	TrustProxyHeaders  bool
+	PurgeInterval      time.Duration
+	PurgeBatchSize     int
+	Mailer             string
+	SMTPAddress        string
+	SMTPUser           string
+	SMTPPassword       string
+	MailFrom           string
+	MailFile           string
+	RequireVerified    bool
+	PasswordPolicy     user.PasswordPolicy
+	TOTPIssuer         string
+	Lockout            bool
+	AccountPolicy      lockout.Policy
+	AddressPolicy      lockout.Policy
+	TokenMode          string
+	JWTKeysDir         string
+	JWTKeyID           string
+	JWTIssuer          string
+	PrintConfig        bool
+}
+
+// String formats the config for logs with secrets masked, the database URL contains the password.
+func (c config) String() string {
+	const masked = "***"
+	for _, secret := range []*string{&c.DB.URL, &c.AdminToken, &c.SMTPPassword} {
+		if *secret != "" {
+			*secret = masked
+		}
+	}
+	type plain config
+	return fmt.Sprintf("%+v", plain(c))
 }
 
 func loadConfig() config {
 	cfg := config{}
+	cfg.Storage = strings.ToLower(environment.GetStr("STORAGE", "postgres"))
 	cfg.DB.URL = environment.GetStr("BASE64_DB_URL", "")
 	cfg.DB.Repetitions = environment.GetInt("DB_ATTEMPTS", 10)
 	cfg.DB.Debug = environment.GetBool("DB_DEBUG", false)
@@ -35,9 +87,72 @@ func loadConfig() config {
 	cfg.MaxRequests = environment.GetInt("MAX_REQUESTS", 100)
 	cfg.HTTPAddress = environment.GetStr("ADDRESS", ":8000")
 	cfg.HTTPTimeout = environment.GetDuration("HTTP_TIMEOUT", 500*time.Second)
+	cfg.RatesFile = environment.GetStr("RATES_FILE", "")
+	cfg.Retention = environment.GetInt("EVENTS_RETENTION", event.DefaultRetention)
+	cfg.EventBus = strings.ToLower(environment.GetStr("EVENT_BUS", "local"))
+	if cfg.EventBus != "local" && cfg.EventBus != "postgres" {
+		log.New().Fatalf("unknown event bus %s, use local or postgres", cfg.EventBus)
+	}
+	if cfg.EventBus == "postgres" && cfg.Storage != "postgres" {
+		log.New().Fatalf("event bus postgres requires postgres storage")
+	}
+	cfg.MaxStreams = environment.GetInt("MAX_STREAMS_PER_USER", defaultStreams)
+	for _, origin := range strings.Split(environment.GetStr("WS_ALLOWED_ORIGINS", ""), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.WSOrigins = append(cfg.WSOrigins, origin)
+		}
+	}
+	cfg.AdminToken = environment.GetStr("ADMIN_TOKEN", "")
+	cfg.WebhookMaxAttempts = environment.GetInt("WEBHOOK_MAX_ATTEMPTS", webhook.DefaultMaxAttempts)
+	cfg.WebhookMaxFailures = environment.GetInt("WEBHOOK_MAX_FAILURES", webhook.DefaultMaxFailures)
+	cfg.WebhookPrivate = environment.GetBool("WEBHOOK_ALLOW_PRIVATE", false)
+	// X-Forwarded-For and X-Real-IP are set by clients unless the service runs behind a proxy which overwrites them.
+	cfg.TrustProxyHeaders = environment.GetBool("TRUST_PROXY_HEADERS", false)
+	cfg.PurgeInterval = environment.GetDuration("SESSION_PURGE_INTERVAL", 10*time.Minute)
+	cfg.PurgeBatchSize = environment.GetInt("SESSION_PURGE_BATCH", 1000)
+	if cfg.PurgeInterval <= 0 || cfg.PurgeBatchSize <= 0 {
+		log.New().Fatalf("SESSION_PURGE_INTERVAL and SESSION_PURGE_BATCH should be positive")
+	}
+	cfg.Mailer = strings.ToLower(environment.GetStr("MAILER", "file"))
+	if cfg.Mailer != "file" && cfg.Mailer != "smtp" {
+		log.New().Fatalf("unknown mailer %s, use file or smtp", cfg.Mailer)
+	}
+	cfg.SMTPAddress = environment.GetStr("SMTP_ADDRESS", "")
+	cfg.SMTPUser = environment.GetStr("SMTP_USER", "")
+	cfg.SMTPPassword = environment.GetStr("SMTP_PASSWORD", "")
+	cfg.MailFrom = environment.GetStr("MAIL_FROM", "auction@localhost")
+	cfg.MailFile = environment.GetStr("MAIL_FILE", "mail.log")
+	cfg.RequireVerified = environment.GetBool("REQUIRE_EMAIL_VERIFICATION", true)
+	cfg.PasswordPolicy.MinLength = environment.GetInt("PASSWORD_MIN_LENGTH", user.DefaultPasswordPolicy.MinLength)
+	cfg.PasswordPolicy.MinClasses = environment.GetInt("PASSWORD_MIN_CLASSES", user.DefaultPasswordPolicy.MinClasses)
+	cfg.PasswordPolicy.RejectCommon = environment.GetBool("PASSWORD_REJECT_COMMON", user.DefaultPasswordPolicy.RejectCommon)
+	cfg.PasswordPolicy.RejectEmail = environment.GetBool("PASSWORD_REJECT_EMAIL", user.DefaultPasswordPolicy.RejectEmail)
+	cfg.TOTPIssuer = environment.GetStr("TOTP_ISSUER", "TFS Auction")
+	cfg.Lockout = environment.GetBool("LOCKOUT", true)
+	cfg.AccountPolicy = lockout.DefaultAccountPolicy
+	cfg.AddressPolicy = lockout.DefaultAddressPolicy
+	cfg.AccountPolicy.LockFailures = environment.GetInt("LOCKOUT_ACCOUNT_FAILURES", cfg.AccountPolicy.LockFailures)
+	cfg.AddressPolicy.LockFailures = environment.GetInt("LOCKOUT_ADDRESS_FAILURES", cfg.AddressPolicy.LockFailures)
+	cfg.AccountPolicy.LockDuration = environment.GetDuration("LOCKOUT_DURATION", cfg.AccountPolicy.LockDuration)
+	cfg.AddressPolicy.LockDuration = cfg.AccountPolicy.LockDuration
+	for _, p := range []*lockout.Policy{&cfg.AccountPolicy, &cfg.AddressPolicy} {
+		if p.Window < p.LockDuration {
+			p.Window = p.LockDuration
+		}
+	}
+	cfg.TokenMode = strings.ToLower(environment.GetStr("TOKEN_MODE", "opaque"))
+	if cfg.TokenMode != "opaque" && cfg.TokenMode != "jwt" {
+		log.New().Fatalf("unknown token mode %s, use opaque or jwt", cfg.TokenMode)
+	}
+	cfg.JWTKeysDir = environment.GetStr("JWT_KEYS_DIR", "")
+	if cfg.TokenMode == "jwt" && cfg.JWTKeysDir == "" {
+		log.New().Fatalf("token mode jwt requires JWT_KEYS_DIR")
+	}
+	cfg.JWTKeyID = environment.GetStr("JWT_KEY_ID", "")
+	cfg.JWTIssuer = environment.GetStr("JWT_ISSUER", "tfs-go-auction")
 	cfg.PrintConfig = environment.GetBool("PRINT_CONFIG", false)
 	if cfg.PrintConfig {
-		log.New().Infof("%+v", cfg)
+		log.New().Info(cfg.String())
 	}
 	if cfg.DB.URL != "" {
 		dbURL, err := base64.StdEncoding.DecodeString(cfg.DB.URL)
@@ -52,38 +167,205 @@ func loadConfig() config {
 func main() {
 	cfg := loadConfig()
 
-	db, err := database.NewDataBaseStorage(cfg.DB)
-	if err != nil {
-		log.New().Fatalf("can't use database:%s", err)
+	logger := log.New()
+	var db storage.Storage
+	var bus event.Bus = event.NewLocalBus()
+	switch cfg.Storage {
+	case "memory":
+		db = memstore.NewMemStore()
+	case "postgres":
+		pg, err := database.NewDataBaseStorage(cfg.DB)
+		if err != nil {
+			log.New().Fatalf("can't use database:%s", err)
+		}
+		defer func() {
+			_ = pg.DB.Close()
+		}()
+		db = pg
+		if cfg.EventBus == "postgres" {
+			if bus, err = pg.NewNotifyBus(logger); err != nil {
+				log.New().Fatalf("can't listen events:%s", err)
+			}
+		}
+	default:
+		log.New().Fatalf("unknown storage %s, use postgres or memory", cfg.Storage)
 	}
 	defer func() {
-		_ = db.DB.Close()
+		_ = bus.Close()
 	}()
-	logger := log.New()
 
 	handler := NewAuctionHandler(db, &logger, template.NewTemplates())
-	background.NewBackground(logger, db)
+	handler.adminToken = cfg.AdminToken
+	handler.requireVerified = cfg.RequireVerified
+	handler.passwordPolicy = cfg.PasswordPolicy
+	handler.totpIssuer = cfg.TOTPIssuer
+	if cfg.Lockout {
+		handler.accounts = lockout.NewLimiter(db, cfg.AccountPolicy)
+		handler.addresses = lockout.NewLimiter(db, cfg.AddressPolicy)
+	}
+	switch cfg.Mailer {
+	case "smtp":
+		smtp, err := mailer.NewSMTP(cfg.SMTPAddress, cfg.SMTPUser, cfg.SMTPPassword, cfg.MailFrom)
+		if err != nil {
+			logger.Fatalf("can't use smtp: %s", err)
+		}
+		handler.mailer = smtp
+	default:
+		handler.mailer = mailer.NewFile(cfg.MailFile, cfg.MailFrom)
+	}
+	handler.events = event.NewStream(hub.New(hub.DefaultQueueSize), bus, cfg.Retention, logger)
+	handler.streams = newConnLimiter(cfg.MaxStreams)
+	handler.upgrader.CheckOrigin = checkOrigin(cfg.WSOrigins)
+	if cfg.RatesFile != "" {
+		if err := handler.rates.LoadFile(cfg.RatesFile); err != nil {
+			logger.Fatalf("can't load rates: %s", err)
+		}
+	}
+	dispatcher := webhook.NewDispatcher(db, logger)
+	dispatcher.MaxAttempts = cfg.WebhookMaxAttempts
+	dispatcher.MaxFailures = cfg.WebhookMaxFailures
+	dispatcher.AllowPrivate = cfg.WebhookPrivate
+	handler.events.OnPublish(func(e event.Event) {
+		if err := dispatcher.Enqueue(e); err != nil {
+			logger.Errorf("can't queue webhooks: %+v", err)
+		}
+	})
+	jobs := background.NewBackground(logger, db, handler.events)
+	jobs.RunWebhooks(dispatcher)
+	attemptsTTL := cfg.AccountPolicy.Window
+	if cfg.AddressPolicy.Window > attemptsTTL {
+		attemptsTTL = cfg.AddressPolicy.Window
+	}
+	jobs.RunPurge(cfg.PurgeInterval, cfg.PurgeBatchSize, attemptsTTL)
+	if cfg.TokenMode == "jwt" {
+		ring, err := jwt.LoadKeyRing(cfg.JWTKeysDir, cfg.JWTKeyID)
+		if err != nil {
+			logger.Fatalf("can't load keys: %s", err)
+		}
+		handler.tokens = jwt.NewTokens(ring, cfg.JWTIssuer)
+		handler.denylist = jwt.NewDenylist(db)
+		if err = handler.denylist.Sync(time.Now()); err != nil {
+			logger.Fatalf("can't load denylist: %s", err)
+		}
+		jobs.RunTokens(ring, cfg.JWTKeyID, handler.denylist)
+	}
+
+	r := newRouter(handler, cfg)
+	workDir, _ := os.Getwd()
+	filesDir := filepath.Join(workDir, "swagger")
+	FileServer(r, "/swagger", http.Dir(filesDir))
+	if err := http.ListenAndServe(cfg.HTTPAddress, r); err != nil {
+		logger.Fatalf("server error:%s", err)
+	}
+}
+
+func FileServer(r chi.Router, path string, root http.FileSystem) {
+	if strings.ContainsAny(path, "{}*") {
+		panic("FileServer does not permit URL parameters.")
+	}
+
+	fs := http.StripPrefix(path, http.FileServer(root))
+
+	if path != "/" && path[len(path)-1] != '/' {
+		r.Get(path, http.RedirectHandler(path+"/", http.StatusTemporaryRedirect).ServeHTTP)
+		path += "/"
+	}
+	path += "*"
+
+	r.Get(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fs.ServeHTTP(w, r)
+	}))
+}
 
+func newRouter(handler *AuctionHandler, cfg config) chi.Router {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Throttle(cfg.MaxRequests))
-	r.Use(middleware.Timeout(cfg.HTTPTimeout))
+	if cfg.TrustProxyHeaders {
+		r.Use(middleware.RealIP)
+	}
+	// Streams and websockets stay open as long as the client wants, they are limited by the connections of a user
+	// and the session lifetime instead of the request throttle and timeout.
+	r.Group(func(r chi.Router) {
+		r.Use(handler.Authenticator)
+		r.Get("/v1/auction/lots/stream", handler.LotsStream)
+		r.Get("/v1/auction/lots/{id}/stream", handler.LotStream)
+		r.HandleFunc("/auction/lots_ws", handler.WSLotUpdate)
+	})
+	// Throttle keeps the next handler in its own state, so it wraps the whole router of other requests.
+	api := chi.NewRouter()
+	api.Use(middleware.Throttle(cfg.MaxRequests))
+	api.Use(middleware.Timeout(cfg.HTTPTimeout))
+	routeAPI(api, handler)
+	r.Mount("/", api)
+	return r
+}
 
+// routeAPI adds requests which are bounded by the throttle and timeout.
+func routeAPI(r chi.Router, handler *AuctionHandler) {
 	r.Route("/v1/auction", func(r chi.Router) {
 		r.Post("/signup", handler.PostSignup)
 		r.Post("/signin", handler.PostSignin)
+		r.Post("/signin/2fa", handler.PostSigninTwoFactor)
+		r.With(handler.Authenticator).Post("/signout", handler.PostSignout)
+		r.Post("/token/refresh", handler.PostRefreshToken)
+		r.Get("/.well-known/jwks.json", handler.GetJWKS)
+		r.Post("/password/forgot", handler.PostPasswordForgot)
+		r.Post("/password/reset", handler.PostPasswordReset)
+		r.Post("/email/verify", handler.PostEmailVerify)
+		r.With(handler.Authenticator).Post("/email/verify/resend", handler.PostEmailVerifyResend)
 		r.Route("/users", func(r chi.Router) {
 			r.Use(handler.Authenticator)
 			r.Put("/{id}", handler.PutUser)
+			r.Put("/{id}/password", handler.PutUserPassword)
+			r.Post("/{id}/2fa", handler.PostUserTwoFactor)
+			r.Post("/{id}/2fa/confirm", handler.PostUserTwoFactorConfirm)
+			r.Delete("/{id}/2fa", handler.DeleteUserTwoFactor)
 			r.Get("/{id}", handler.GetUser)
 			r.Get("/{id}/lots", handler.GetUserLots)
+			r.Get("/{id}/bids", handler.GetUserBids)
+			r.Get("/{id}/sessions", handler.GetUserSessions)
+			r.Delete("/{id}/sessions/{session}", handler.DeleteUserSession)
+		})
+		r.Route("/rates", func(r chi.Router) {
+			r.Use(handler.Authenticator)
+			r.Get("/", handler.GetRates)
+			r.With(handler.RequireRole(user.RoleAdmin)).Put("/", handler.PutRates)
+		})
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(handler.Authenticator)
+			r.Group(func(r chi.Router) {
+				r.Use(handler.RequireRole(user.RoleModerator))
+				r.Put("/lots/{id}/finish", handler.FinishLot)
+				r.Delete("/lots/{id}", handler.DeleteAnyLot)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(handler.RequireRole(user.RoleAdmin))
+				r.Get("/users", handler.GetUsers)
+				r.Put("/users/{id}/role", handler.PutUserRole)
+				r.Post("/users/{id}/ban", handler.PostUserBan)
+				r.Delete("/users/{id}/ban", handler.DeleteUserBan)
+				r.Delete("/users/{id}/sessions", handler.DeleteUserSessions)
+				r.Post("/users/{id}/unlock", handler.PostUserUnlock)
+			})
+		})
+		r.Route("/webhooks", func(r chi.Router) {
+			r.Use(handler.Authenticator)
+			r.Get("/", handler.GetWebhooks)
+			r.Post("/", handler.PostWebhook)
+			r.Get("/{id}", handler.GetWebhook)
+			r.Put("/{id}", handler.PutWebhook)
+			r.Delete("/{id}", handler.DeleteWebhook)
+			r.Get("/{id}/deliveries", handler.GetWebhookDeliveries)
 		})
 		r.Route("/lots", func(r chi.Router) {
 			r.Use(handler.Authenticator)
 			r.Get("/", handler.GetLots)
 			r.Post("/", handler.PostLots)
 			r.Put("/{id}/buy", handler.BuyLot)
+			r.Put("/{id}/max-bid", handler.SetMaxBid)
+			r.Put("/{id}/buy-now", handler.BuyNow)
+			r.Put("/{id}/publish", handler.PublishLot)
+			r.Get("/{id}/bids", handler.GetLotBids)
 			r.Get("/{id}", handler.GetLot)
 			r.Put("/{id}", handler.PutLot)
 			r.Delete("/{id}", handler.DeleteLot)
@@ -100,31 +382,5 @@ func main() {
 			r.Get("/", handler.HTMLGetLots)
 			r.Get("/{id}", handler.HTMLGetLot)
 		})
-		r.HandleFunc("/lots_ws", handler.WSLotUpdate)
-
 	})
-	workDir, _ := os.Getwd()
-	filesDir := filepath.Join(workDir, "swagger")
-	FileServer(r, "/swagger", http.Dir(filesDir))
-	if err := http.ListenAndServe(cfg.HTTPAddress, r); err != nil {
-		logger.Fatalf("server error:%s", err)
-	}
-}
-
-func FileServer(r chi.Router, path string, root http.FileSystem) {
-	if strings.ContainsAny(path, "{}*") {
-		panic("FileServer does not permit URL parameters.")
-	}
-
-	fs := http.StripPrefix(path, http.FileServer(root))
-
-	if path != "/" && path[len(path)-1] != '/' {
-		r.Get(path, http.RedirectHandler(path+"/", http.StatusTemporaryRedirect).ServeHTTP)
-		path += "/"
-	}
-	path += "*"
-
-	r.Get(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fs.ServeHTTP(w, r)
-	}))
 }
@@ -0,0 +1,255 @@
+package auction
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+// Strategy implements rules of an auction format. Storage calls it under the lot lock,
+// so implementations only work with passed values.
+type Strategy interface {
+	// Sealed auctions hide bids until the end, every user can place only one bid.
+	Sealed() bool
+	Validate(l lot.Lot) error
+	CheckBid(l lot.Lot, b bid.Bid, now time.Time) error
+	// Accept updates the lot after the bid was checked, it can correct the price of the bid.
+	Accept(l *lot.Lot, b *bid.Bid, now time.Time)
+	// Present prepares the lot to be shown to users: sets the visible price and hides secret data.
+	Present(l *lot.Lot, now time.Time)
+	// Finish determines the winner, bids are ordered by creation time.
+	Finish(l *lot.Lot, bids []bid.Bid)
+}
+
+func New(t lot.AuctionType) (Strategy, error) {
+	switch t {
+	case lot.English, "":
+		return english{}, nil
+	case lot.Dutch:
+		return dutch{}, nil
+	case lot.SealedFirstPrice:
+		return sealed{}, nil
+	case lot.SealedSecondPrice:
+		return sealed{secondPrice: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown auction type %s", t)
+	}
+}
+
+func Validate(l lot.Lot) error {
+	s, err := New(l.AuctionType)
+	if err != nil {
+		return err
+	}
+	if err = l.Validate(); err != nil {
+		return err
+	}
+	return s.Validate(l)
+}
+
+func Present(l *lot.Lot, now time.Time) {
+	if s, err := New(l.AuctionType); err == nil {
+		s.Present(l, now)
+	}
+}
+
+func PresentAll(lots []lot.Lot, now time.Time) {
+	for i := range lots {
+		Present(&lots[i], now)
+	}
+}
+
+// BidsVisible reports whether bids of the lot can be shown to everyone.
+func BidsVisible(l lot.Lot) bool {
+	s, err := New(l.AuctionType)
+	return err == nil && (!s.Sealed() || l.Status == lot.Finished.String())
+}
+
+func checkCommon(l lot.Lot, b bid.Bid, now time.Time) error {
+	if l.Status != lot.Active.String() || !l.EndAt.After(now) {
+		return fmt.Errorf("lot is not active")
+	}
+	if l.CreatorID == b.BuyerID {
+		return fmt.Errorf("creator can't bid on own lot")
+	}
+	if !b.Price.SameCurrency(l.MinPrice) {
+		return fmt.Errorf("bid should be in %s", l.MinPrice.Currency)
+	}
+	return nil
+}
+
+func checkStep(l lot.Lot, price money.Money) error {
+	if price.Less(l.MinPrice) || price.Sub(l.MinPrice).Amount%l.PriceStep.Amount != 0 {
+		return fmt.Errorf("price should be equal n*step + start_price")
+	}
+	return nil
+}
+
+func finish(l *lot.Lot) {
+	l.Status = lot.Finished.String()
+	l.Result = l.FinishResult()
+}
+
+func copyPrice(p *money.Money) *money.Money {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+type english struct{}
+
+func (english) Sealed() bool { return false }
+
+func (english) Validate(l lot.Lot) error { return nil }
+
+func (english) CheckBid(l lot.Lot, b bid.Bid, now time.Time) error {
+	if err := checkCommon(l, b, now); err != nil {
+		return err
+	}
+	if l.BuyerID != nil && *l.BuyerID == b.BuyerID {
+		return fmt.Errorf("you already have the highest bid")
+	}
+	if l.BuyPrice != nil && !l.BuyPrice.Less(b.Price) {
+		return fmt.Errorf("price should be more than a last price")
+	}
+	return checkStep(l, b.Price)
+}
+
+func (english) Accept(l *lot.Lot, b *bid.Bid, now time.Time) {
+	price, buyer := b.Price, b.BuyerID
+	l.BuyPrice = &price
+	l.BuyerID = &buyer
+	l.Extend(now)
+}
+
+func (english) Present(l *lot.Lot, now time.Time) {
+	l.CurrentPrice = copyPrice(l.BuyPrice)
+}
+
+func (english) Finish(l *lot.Lot, bids []bid.Bid) {
+	finish(l)
+}
+
+// dutch auction starts at StartPrice and drops the price by PriceStep every DropInterval seconds
+// down to MinPrice, the first bid wins.
+type dutch struct{}
+
+func (dutch) Sealed() bool { return false }
+
+func (dutch) Validate(l lot.Lot) error {
+	if l.StartPrice == nil || !l.MinPrice.Less(*l.StartPrice) {
+		return fmt.Errorf("start_price should be more than min_price for dutch auction")
+	}
+	if l.DropInterval <= 0 {
+		return fmt.Errorf("drop_interval should be positive for dutch auction")
+	}
+	return nil
+}
+
+func (dutch) price(l lot.Lot, now time.Time) money.Money {
+	if l.StartPrice == nil || l.DropInterval <= 0 {
+		return l.MinPrice
+	}
+	start := l.CreatedAt
+	if l.StartAt != nil {
+		start = *l.StartAt
+	}
+	var drops int64
+	if now.After(start) {
+		drops = int64(now.Sub(start) / (time.Duration(l.DropInterval) * time.Second))
+	}
+	return money.Max(l.MinPrice, l.StartPrice.Sub(l.PriceStep.Mul(drops)))
+}
+
+func (d dutch) CheckBid(l lot.Lot, b bid.Bid, now time.Time) error {
+	if err := checkCommon(l, b, now); err != nil {
+		return err
+	}
+	if l.BuyerID != nil {
+		return fmt.Errorf("lot is already sold")
+	}
+	if current := d.price(l, now); b.Price.Less(current) {
+		return fmt.Errorf("price should not be less than current price %v", current)
+	}
+	return nil
+}
+
+func (d dutch) Accept(l *lot.Lot, b *bid.Bid, now time.Time) {
+	b.Price = d.price(*l, now)
+	price, buyer := b.Price, b.BuyerID
+	l.BuyPrice = &price
+	l.BuyerID = &buyer
+	finish(l)
+}
+
+func (d dutch) Present(l *lot.Lot, now time.Time) {
+	if l.Status == lot.Active.String() && l.BuyerID == nil {
+		price := d.price(*l, now)
+		l.CurrentPrice = &price
+		return
+	}
+	l.CurrentPrice = copyPrice(l.BuyPrice)
+}
+
+func (dutch) Finish(l *lot.Lot, bids []bid.Bid) {
+	finish(l)
+}
+
+// sealed auction hides bids until the end. The highest bid wins, the winner pays own price
+// or the second highest price for Vickrey auction.
+type sealed struct {
+	secondPrice bool
+}
+
+func (sealed) Sealed() bool { return true }
+
+func (sealed) Validate(l lot.Lot) error { return nil }
+
+func (sealed) CheckBid(l lot.Lot, b bid.Bid, now time.Time) error {
+	if err := checkCommon(l, b, now); err != nil {
+		return err
+	}
+	return checkStep(l, b.Price)
+}
+
+func (sealed) Accept(l *lot.Lot, b *bid.Bid, now time.Time) {}
+
+func (sealed) Present(l *lot.Lot, now time.Time) {
+	if l.Status != lot.Finished.String() {
+		l.BuyPrice, l.BuyerID, l.Buyer, l.CurrentPrice = nil, nil, nil, nil
+		return
+	}
+	l.CurrentPrice = copyPrice(l.BuyPrice)
+}
+
+func (s sealed) Finish(l *lot.Lot, bids []bid.Bid) {
+	sorted := make([]bid.Bid, len(bids))
+	copy(sorted, bids)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[j].Price.Less(sorted[i].Price)
+	})
+	if len(sorted) == 0 {
+		l.BuyPrice, l.BuyerID = nil, nil
+		finish(l)
+		return
+	}
+	price, buyer := sorted[0].Price, sorted[0].BuyerID
+	if s.secondPrice {
+		price = l.MinPrice
+		if len(sorted) > 1 {
+			price = sorted[1].Price
+		}
+		if l.ReservePrice != nil && !sorted[0].Price.Less(*l.ReservePrice) && price.Less(*l.ReservePrice) {
+			price = *l.ReservePrice
+		}
+	}
+	l.BuyPrice = &price
+	l.BuyerID = &buyer
+	finish(l)
+}
@@ -0,0 +1,116 @@
+package auction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+func TestDutchPrice(t *testing.T) {
+	start := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	startPrice := rub(100)
+	l := lot.Lot{AuctionType: lot.Dutch, MinPrice: rub(30), PriceStep: rub(20), StartPrice: &startPrice, DropInterval: 60,
+		Status: lot.Active.String(), StartAt: &start, EndAt: start.Add(time.Hour), CreatorID: 1}
+	testCases := []struct {
+		Name     string
+		After    time.Duration
+		Expected int64
+	}{
+		{Name: "Before start", After: -time.Minute, Expected: 100},
+		{Name: "Start", After: 0, Expected: 100},
+		{Name: "Inside first interval", After: 59 * time.Second, Expected: 100},
+		{Name: "First drop", After: time.Minute, Expected: 80},
+		{Name: "Third drop", After: 3 * time.Minute, Expected: 40},
+		{Name: "Floor", After: 10 * time.Minute, Expected: 30},
+	}
+	s, err := New(lot.Dutch)
+	require.NoError(t, err)
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			shown := l
+			s.Present(&shown, start.Add(tc.After))
+			r.Equal(rub(tc.Expected), *shown.CurrentPrice)
+		})
+	}
+	r := require.New(t)
+	now := start.Add(2 * time.Minute)
+	r.Error(s.CheckBid(l, bid.Bid{BuyerID: 2, Price: rub(59)}, now))
+	b := bid.Bid{BuyerID: 2, Price: rub(100)}
+	r.NoError(s.CheckBid(l, b, now))
+	s.Accept(&l, &b, now)
+	r.Equal(rub(60), b.Price)
+	r.Equal(rub(60), *l.BuyPrice)
+	r.Equal(lot.Finished.String(), l.Status)
+	r.Equal(lot.Sold, l.Result)
+}
+
+func TestSealedFinish(t *testing.T) {
+	reserve := rub(45)
+	bids := []bid.Bid{{BuyerID: 2, Price: rub(40)}, {BuyerID: 3, Price: rub(50)}, {BuyerID: 4, Price: rub(50)}, {BuyerID: 5, Price: rub(20)}}
+	testCases := []struct {
+		Name        string
+		Type        lot.AuctionType
+		Reserve     *money.Money
+		Bids        []bid.Bid
+		ExpectPrice *money.Money
+		ExpectBuyer *int
+		Result      lot.Result
+	}{
+		{Name: "First price, no bids", Type: lot.SealedFirstPrice, Result: lot.Unsold},
+		{Name: "First price", Type: lot.SealedFirstPrice, Bids: bids, ExpectPrice: price(50), ExpectBuyer: buyer(3), Result: lot.Sold},
+		{Name: "Second price", Type: lot.SealedSecondPrice, Bids: bids, ExpectPrice: price(50), ExpectBuyer: buyer(3), Result: lot.Sold},
+		{Name: "Second price, single bid", Type: lot.SealedSecondPrice, Bids: bids[:1], ExpectPrice: price(10), ExpectBuyer: buyer(2), Result: lot.Sold},
+		{Name: "Second price, reserve raises price", Type: lot.SealedSecondPrice, Reserve: &reserve,
+			Bids: []bid.Bid{bids[1], bids[0]}, ExpectPrice: price(45), ExpectBuyer: buyer(3), Result: lot.Sold},
+		{Name: "Second price, reserve not met", Type: lot.SealedSecondPrice, Reserve: &reserve,
+			Bids: []bid.Bid{bids[0], bids[3]}, ExpectPrice: price(20), ExpectBuyer: buyer(2), Result: lot.ReserveNotMet},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			s, err := New(tc.Type)
+			r.NoError(err)
+			r.True(s.Sealed())
+			l := lot.Lot{AuctionType: tc.Type, MinPrice: rub(10), PriceStep: rub(10), ReservePrice: tc.Reserve, Status: lot.Active.String()}
+			s.Finish(&l, tc.Bids)
+			r.Equal(tc.ExpectPrice, l.BuyPrice)
+			r.Equal(tc.ExpectBuyer, l.BuyerID)
+			r.Equal(tc.Result, l.Result)
+			r.Equal(lot.Finished.String(), l.Status)
+		})
+	}
+}
+
+func TestPresentSealed(t *testing.T) {
+	r := require.New(t)
+	p, id := rub(50), 2
+	l := lot.Lot{AuctionType: lot.SealedFirstPrice, BuyPrice: &p, BuyerID: &id, Status: lot.Active.String()}
+	r.False(BidsVisible(l))
+	Present(&l, time.Now())
+	r.Nil(l.BuyPrice)
+	r.Nil(l.BuyerID)
+	r.Nil(l.CurrentPrice)
+
+	l = lot.Lot{AuctionType: lot.SealedFirstPrice, BuyPrice: &p, BuyerID: &id, Status: lot.Finished.String()}
+	r.True(BidsVisible(l))
+	Present(&l, time.Now())
+	r.Equal(rub(50), *l.CurrentPrice)
+}
+
+func price(p int64) *money.Money {
+	m := rub(p)
+	return &m
+}
+
+func rub(v int64) money.Money {
+	return money.FromMajor(v, money.RUB)
+}
+
+func buyer(id int) *int { return &id }
@@ -2,29 +2,135 @@ package auth
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	"gitlab.com/asciishell/tfs-go-auction/internal/errs"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
 	"gitlab.com/asciishell/tfs-go-auction/internal/services"
 	"gitlab.com/asciishell/tfs-go-auction/internal/session"
 	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/user"
 )
 
-func Signin(email string, password string, storage *storage.Storage) (session.Session, error) {
+// Challenge is given by Signin instead of a session when the user has 2FA enabled.
+type Challenge struct {
+	Token     string `json:"challenge_token"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+func Signin(email string, password string, ip string, userAgent string, storage *storage.Storage) (session.Session, *Challenge, error) {
 	u, err := services.FindUserByEmail(email, password, storage)
 	if err != nil {
+		return session.Session{}, nil, err
+	}
+	if u.TwoFactorEnabled() {
+		token, err := services.IssueUserToken(u.ID, user.SigninChallenge, user.SigninChallengeLifeTime, *storage)
+		if err != nil {
+			return session.Session{}, nil, err
+		}
+		return session.Session{}, &Challenge{Token: token, ExpiresIn: int64(user.SigninChallengeLifeTime / time.Second)}, nil
+	}
+	sess, err := services.NewSession(u.ID, ip, userAgent, storage)
+	if err != nil {
+		return session.Session{}, nil, errors.Wrapf(err, "can't create session for user ID %d", u.ID)
+	}
+	return sess, nil, nil
+}
+
+// CheckChallenge counts an attempt to pass the challenge and returns the user who got it. A challenge is
+// invalid after user.MaxChallengeAttempts attempts.
+func CheckChallenge(challenge string, storage *storage.Storage) (*user.User, error) {
+	token, err := (*storage).AttemptUserToken(user.TokenHash(challenge), user.SigninChallenge, time.Now(), user.MaxChallengeAttempts)
+	if err != nil {
+		return nil, err
+	}
+	u, err := services.FindUserByID(token.UserID, storage)
+	if err != nil {
+		return nil, err
+	}
+	if !u.TwoFactorEnabled() {
+		return nil, errs.ErrTwoFactorDisabled
+	}
+	if u.Banned() {
+		return nil, errs.ErrBanned
+	}
+	return u, nil
+}
+
+// SigninTwoFactor checks the code of the user of the challenge and exchanges the challenge for a session,
+// so a challenge gives one session.
+func SigninTwoFactor(u user.User, challenge string, code string, ip string, userAgent string, storage *storage.Storage) (session.Session, error) {
+	if err := services.VerifyTwoFactor(u, code, *storage); err != nil {
 		return session.Session{}, err
 	}
-	sess, err := services.NewSession(u.ID, storage)
+	if _, err := (*storage).UseUserToken(user.TokenHash(challenge), user.SigninChallenge, time.Now()); err != nil {
+		return session.Session{}, err
+	}
+	sess, err := services.NewSession(u.ID, ip, userAgent, storage)
 	if err != nil {
 		return session.Session{}, errors.Wrapf(err, "can't create session for user ID %d", u.ID)
 	}
 	return sess, nil
 }
 
+// WSProtocol is the websocket subprotocol for authentication: browsers can't set headers on a handshake,
+// so a client offers protocols "bearer" and the token, the server selects "bearer".
+const WSProtocol = "bearer"
+
+// HandleToken looks for the token in the Authorization header and the BearerToken cookie.
+// Websocket handshakes may also pass it as ?access_token= or as a subprotocol.
 func HandleToken(r *http.Request, s *storage.Storage) (*session.Session, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errs.ErrNotFound
+	}
+	sess, err := services.GetSession(token, s)
+	if err != nil || sess.ValidUntil.Before(time.Now()) {
+		return nil, errs.ErrNotFound
+	}
+	return sess, nil
+}
+
+// IssueJWT sets a JWT as the access token of the session, it expires with the session. The role is kept
+// in the token, so a changed role applies to new tokens.
+func IssueJWT(sess *session.Session, role user.Role, tokens *jwt.Tokens) error {
+	token, err := tokens.Sign(jwt.Claims{
+		Subject:   strconv.Itoa(sess.UserID),
+		SessionID: sess.PublicID(),
+		Roles:     []string{string(role)},
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: sess.ValidUntil.Unix(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't sign access token")
+	}
+	sess.AccessToken = token
+	return nil
+}
+
+// HandleJWT finds the token like HandleToken and verifies it without storage.
+func HandleJWT(r *http.Request, tokens *jwt.Tokens, denylist *jwt.Denylist) (*session.Session, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errs.ErrNotFound
+	}
+	claims, err := tokens.Parse(token, time.Now())
+	if err != nil {
+		return nil, errs.ErrUnauthorized
+	}
+	if denylist != nil && denylist.Revoked(claims) {
+		return nil, errs.ErrUnauthorized
+	}
+	userID, _ := claims.UserID()
+	return &session.Session{UserID: userID, CreatedAt: time.Unix(claims.IssuedAt, 0), ValidUntil: claims.Expires(),
+		AccessToken: token, Claims: &claims}, nil
+}
+
+func bearerToken(r *http.Request) string {
 	var token string
 	headerPair := strings.Split(r.Header.Get("Authorization"), " ")
 	if len(headerPair) == 2 && headerPair[0] == "Bearer" {
@@ -34,12 +140,21 @@ func HandleToken(r *http.Request, s *storage.Storage) (*session.Session, error)
 	if token == "" && err == nil {
 		token = cookie.Value
 	}
-	if token == "" {
-		return nil, errs.ErrNotFound
+	if token == "" && websocket.IsWebSocketUpgrade(r) {
+		token = wsToken(r)
 	}
-	sess, err := services.GetSession(token, s)
-	if err != nil || sess.ValidUntil.Before(time.Now()) {
-		return nil, errs.ErrNotFound
+	return token
+}
+
+func wsToken(r *http.Request) string {
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token
 	}
-	return sess, nil
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == WSProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
 }
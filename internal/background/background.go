@@ -3,31 +3,133 @@ package background
 import (
 	"time"
 
+	"gitlab.com/asciishell/tfs-go-auction/internal/auction"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
 	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
 	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
 )
 
 type Background struct {
 	logger  log.Logger
 	storage storage.Storage
+	events  *event.Stream
 }
 
 func (b Background) RunCloseLots() {
 	go func() {
 		for {
-			count, err := b.storage.CloseLots()
+			closed, err := b.storage.CloseLots()
 			if err != nil {
 				b.logger.Errorf("error during closing: %+v", err)
 			}
-			if count != 0 {
-				b.logger.Infof("closed %d lots", count)
+			if len(closed) != 0 {
+				b.logger.Infof("closed %d lots", len(closed))
+			}
+			for i := range closed {
+				auction.Present(&closed[i], time.Now())
+				if err = b.events.PublishLot(event.LotFinished, closed[i]); err != nil {
+					b.logger.Errorf("can't publish closed lot %d: %+v", closed[i].ID, err)
+				}
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+}
+func (b Background) RunActivateLots() {
+	go func() {
+		for {
+			activated, err := b.storage.ActivateLots()
+			if err != nil {
+				b.logger.Errorf("error during activation: %+v", err)
+			}
+			if len(activated) != 0 {
+				b.logger.Infof("activated %d lots", len(activated))
+			}
+			for i := range activated {
+				auction.Present(&activated[i], time.Now())
+				if err = b.events.PublishLot(event.LotUpdated, activated[i]); err != nil {
+					b.logger.Errorf("can't publish activated lot %d: %+v", activated[i].ID, err)
+				}
 			}
 			time.Sleep(time.Second)
 		}
 	}()
 }
-func NewBackground(logger log.Logger, storage storage.Storage) Background {
-	result := Background{logger: logger, storage: storage}
+
+// RunWebhooks sends queued webhook deliveries, a full batch is followed by the next one without a pause.
+func (b Background) RunWebhooks(d *webhook.Dispatcher) {
+	go func() {
+		for {
+			count, err := d.Deliver(time.Now())
+			if err != nil {
+				b.logger.Errorf("error during webhook delivery: %+v", err)
+			}
+			if count < d.BatchSize {
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+// RunPurge deletes expired sessions and revocations and counters of failed attempts without failures
+// for attemptsTTL every interval in batches of batchSize, a full batch is followed by the next one without a pause.
+func (b Background) RunPurge(interval time.Duration, batchSize int, attemptsTTL time.Duration) {
+	go func() {
+		for {
+			total := 0
+			for {
+				now := time.Now()
+				sessions, err := b.storage.PurgeSessions(now, batchSize)
+				if err != nil {
+					b.logger.Errorf("error during session purge: %+v", err)
+				}
+				revocations, err := b.storage.PurgeRevocations(now, batchSize)
+				if err != nil {
+					b.logger.Errorf("error during revocation purge: %+v", err)
+				}
+				attempts, err := b.storage.PurgeAttempts(now.Add(-attemptsTTL), batchSize)
+				if err != nil {
+					b.logger.Errorf("error during attempts purge: %+v", err)
+				}
+				total += sessions + revocations + attempts
+				if sessions < batchSize && revocations < batchSize && attempts < batchSize {
+					break
+				}
+			}
+			if total != 0 {
+				b.logger.Infof("purged %d expired sessions, revocations and attempts", total)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// RunTokens syncs the denylist of access tokens with other instances and reloads the key ring,
+// so a key is rotated by changing files of the ring.
+func (b Background) RunTokens(ring *jwt.KeyRing, keyID string, denylist *jwt.Denylist) {
+	go func() {
+		reload := time.NewTicker(time.Minute)
+		defer reload.Stop()
+		for {
+			if err := denylist.Sync(time.Now()); err != nil {
+				b.logger.Errorf("error during denylist sync: %+v", err)
+			}
+			select {
+			case <-reload.C:
+				if err := ring.Reload(keyID); err != nil {
+					b.logger.Errorf("can't reload keys: %+v", err)
+				}
+			default:
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+func NewBackground(logger log.Logger, storage storage.Storage, events *event.Stream) Background {
+	result := Background{logger: logger, storage: storage, events: events}
+	result.RunActivateLots()
 	result.RunCloseLots()
 	return result
 }
@@ -0,0 +1,30 @@
+package bid
+
+import (
+	"time"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+type Bid struct {
+	ID        int            `json:"id" gorm:"PRIMARY_KEY;AUTO_INCREMENT"`
+	LotID     int            `json:"lot_id" gorm:"NOT NULL;index"`
+	BuyerID   int            `json:"-" gorm:"NOT NULL;index"`
+	Buyer     *user.User     `json:"buyer,omitempty" gorm:"-"`
+	Price     money.Money    `json:"price" gorm:"NOT NULL;type:bigint"`
+	Currency  money.Currency `json:"-" gorm:"NOT NULL;default:'RUB'"`
+	Auto      bool           `json:"auto" gorm:"NOT NULL;default:false"`
+	CreatedAt time.Time      `json:"created_at" gorm:"NOT NULL"`
+}
+
+// BeforeSave and AfterFind keep the currency of the price in its own column.
+func (b *Bid) BeforeSave() error {
+	b.Currency = b.Price.Currency
+	return nil
+}
+
+func (b *Bid) AfterFind() error {
+	b.Price.Currency = b.Currency
+	return nil
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
+)
+
+const (
+	eventChannel = "lot_events"
+	eventSeq     = "lot_event_seq"
+	// maxNotifyPayload is a bit less than the 8000 bytes limit of pg_notify.
+	maxNotifyPayload = 7900
+	listenerPing     = 90 * time.Second
+)
+
+// NotifyBus delivers events between instances with pg_notify, seq comes from a database sequence.
+// Bids of the database publish their events in their transactions through the bus.
+// Postgres does not keep notifications, events published while an instance is reconnecting are lost for it.
+type NotifyBus struct {
+	db       *DataBase
+	listener *pq.Listener
+	logger   log.Logger
+	mu       sync.RWMutex
+	handlers []func(event.Event)
+	done     chan struct{}
+}
+
+func (d *DataBase) NewNotifyBus(logger log.Logger) (*NotifyBus, error) {
+	if err := d.DB.Exec("CREATE SEQUENCE IF NOT EXISTS " + eventSeq).Error; err != nil {
+		return nil, errors.Wrap(err, "can't create event sequence")
+	}
+	b := &NotifyBus{db: d, logger: logger, done: make(chan struct{})}
+	b.listener = pq.NewListener(d.url, 100*time.Millisecond, 10*time.Second, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Errorf("event listener: %+v", err)
+		}
+		if ev == pq.ListenerEventReconnected {
+			logger.Info("event listener reconnected, events published meanwhile are lost")
+		}
+	})
+	if err := b.listener.Listen(eventChannel); err != nil {
+		_ = b.listener.Close()
+		return nil, errors.Wrapf(err, "can't listen %s", eventChannel)
+	}
+	d.bus = b
+	go b.run()
+	return b, nil
+}
+
+func (b *NotifyBus) Publish(e event.Event) error {
+	tx := b.db.DB.Begin()
+	if err := b.publish(tx, e); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Wrap(err, "can't commit event")
+	}
+	return nil
+}
+
+// publish sends the event in tx, Postgres delivers it when tx commits. The lock is held until the end of tx,
+// so transactions commit in the order of seqs and notifications come in this order.
+func (b *NotifyBus) publish(tx *gorm.DB, e event.Event) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", eventSeq).Error; err != nil {
+		return errors.Wrap(err, "can't lock event seq")
+	}
+	var seq struct {
+		Seq uint64
+	}
+	if err := tx.Raw("SELECT nextval(?) AS seq", eventSeq).Scan(&seq).Error; err != nil {
+		return errors.Wrap(err, "can't get event seq")
+	}
+	e.Seq = seq.Seq
+	data, err := json.Marshal(event.Message{Event: e, Topics: e.Topics})
+	if err != nil {
+		return errors.Wrap(err, "can't marshal event")
+	}
+	if len(data) > maxNotifyPayload {
+		// clients fetch the lot by id when the payload doesn't fit into a notification
+		b.logger.Infof("payload of %s for lot %d is too large for pg_notify, sending the id only", e.Type, e.LotID)
+		e.Payload, _ = json.Marshal(struct {
+			ID int `json:"id"`
+		}{ID: e.LotID})
+		if data, err = json.Marshal(event.Message{Event: e, Topics: e.Topics}); err != nil {
+			return errors.Wrap(err, "can't marshal event")
+		}
+	}
+	if err = tx.Exec("SELECT pg_notify(?, ?)", eventChannel, string(data)).Error; err != nil {
+		return errors.Wrap(err, "can't notify")
+	}
+	return nil
+}
+
+// txPublisher sends events in the transaction of a change, they are delivered only if it commits.
+type txPublisher struct {
+	bus *NotifyBus
+	tx  *gorm.DB
+}
+
+func (p txPublisher) Publish(e event.Event) error {
+	return p.bus.publish(p.tx, e)
+}
+
+func (b *NotifyBus) Listen(handler func(event.Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *NotifyBus) Close() error {
+	close(b.done)
+	return b.listener.Close()
+}
+
+func (b *NotifyBus) run() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			// nil is sent after reconnection
+			if n == nil {
+				continue
+			}
+			var m event.Message
+			if err := json.Unmarshal([]byte(n.Extra), &m); err != nil {
+				b.logger.Errorf("can't read event notification: %+v", err)
+				continue
+			}
+			m.Event.Topics = m.Topics
+			b.mu.RLock()
+			for _, h := range b.handlers {
+				h(m.Event)
+			}
+			b.mu.RUnlock()
+		case <-time.After(listenerPing):
+			go func() {
+				_ = b.listener.Ping()
+			}()
+		}
+	}
+}
@@ -2,13 +2,22 @@ package database
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
+	"gitlab.com/asciishell/tfs-go-auction/internal/auction"
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lockout"
 	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/internal/proxybid"
 	"gitlab.com/asciishell/tfs-go-auction/internal/session"
+	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
 	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
 	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
 
 	// Registry postgres
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -16,7 +25,10 @@ import (
 )
 
 type DataBase struct {
-	DB *gorm.DB
+	DB  *gorm.DB
+	url string
+	// bus publishes events of bids in their transactions, it is set by NewNotifyBus
+	bus *NotifyBus
 }
 
 type DBCredential struct {
@@ -42,7 +54,7 @@ func NewDataBaseStorage(credential DBCredential) (*DataBase, error) {
 		return nil, errors.Wrapf(err, "can't connect to database, dsn %s", credential.URL)
 	}
 	db.LogMode(credential.Debug)
-	result := DataBase{DB: db}
+	result := DataBase{DB: db, url: credential.URL}
 	if credential.Migrate {
 		result.Migrate()
 		logger.Info("Migrate completed")
@@ -54,8 +66,47 @@ func (d *DataBase) constraintExists(table string, constraint string) bool {
          INNER JOIN pg_catalog.pg_class rel ON rel.oid = con.conrelid
 WHERE rel.relname = ? AND con.conname = ?;`, table, constraint).RowsAffected == 1
 }
+func (d *DataBase) columnType(table string, column string) string {
+	var result string
+	_ = d.DB.Raw(`SELECT data_type FROM information_schema.columns
+WHERE table_name = ? AND column_name = ?;`, table, column).Row().Scan(&result)
+	return result
+}
+
+// migrateMoney converts prices stored as numeric major units to bigint minor units of money.Money.
+func (d *DataBase) migrateMoney() {
+	type column struct {
+		Table string
+		Name  string
+	}
+	columns := []column{
+		{Table: "lots", Name: "min_price"},
+		{Table: "lots", Name: "price_step"},
+		{Table: "lots", Name: "start_price"},
+		{Table: "lots", Name: "buy_price"},
+		{Table: "lots", Name: "reserve_price"},
+		{Table: "lots", Name: "buy_now_price"},
+		{Table: "bids", Name: "price"},
+		{Table: "proxy_bids", Name: "max_price"},
+	}
+	scale := money.FromMajor(1, money.DefaultCurrency).Amount
+	for _, v := range columns {
+		if d.columnType(v.Table, v.Name) == "numeric" {
+			d.DB.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE bigint USING round(%s * %d)", v.Table, v.Name, v.Name, scale))
+		}
+	}
+	d.DB.Exec(fmt.Sprintf("ALTER TABLE lots ALTER COLUMN price_step SET DEFAULT %d", scale))
+}
+
 func (d *DataBase) Migrate() {
-	d.DB.AutoMigrate(&user.User{}, &session.Session{}, &lot.Lot{})
+	// Users registered before email verification keep access to bidding.
+	verifyExisting := d.columnType("users", "id") != "" && d.columnType("users", "email_verified_at") == ""
+	d.DB.AutoMigrate(&user.User{}, &session.Session{}, &lot.Lot{}, &bid.Bid{}, &proxybid.ProxyBid{}, &webhook.Webhook{}, &webhook.Delivery{},
+		&jwt.Revocation{}, &user.Token{}, &lockout.Attempts{})
+	if verifyExisting {
+		d.DB.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL")
+	}
+	d.migrateMoney()
 	d.DB.Model(&session.Session{}).AddForeignKey("user_id", "users(id)", "CASCADE", "CASCADE")
 	if d.DB.Exec("SELECT 1 FROM pg_type WHERE typname = 'lot_status'").RowsAffected == 0 {
 		d.DB.Exec("CREATE TYPE lot_status  AS enum('created','active','finished')")
@@ -71,6 +122,20 @@ func (d *DataBase) Migrate() {
 		{Table: "lots", Name: "lots_check_buy_price", Rule: "CHECK(buy_price >= min_price)"},
 		{Table: "lots", Name: "lots_check_buyer_owner", Rule: "CHECK(creator_id != buyer_id)"},
 		{Table: "lots", Name: "lots_check_end", Rule: "CHECK(end_at >= created_at OR end_at IS NULL)"},
+		{Table: "lots", Name: "lots_check_start", Rule: "CHECK(start_at < end_at OR start_at IS NULL)"},
+		{Table: "lots", Name: "lots_check_reserve_price", Rule: "CHECK(reserve_price >= min_price)"},
+		{Table: "lots", Name: "lots_check_buy_now_price", Rule: "CHECK(buy_now_price >= min_price AND buy_now_price >= reserve_price)"},
+		{Table: "lots", Name: "lots_check_result", Rule: "CHECK(result IN ('', 'sold', 'unsold', 'reserve_not_met'))"},
+		{Table: "lots", Name: "lots_check_currency", Rule: "CHECK(currency ~ '^[A-Z]{3}$')"},
+		{Table: "lots", Name: "lots_check_auction_type", Rule: "CHECK(auction_type IN ('english', 'dutch', 'sealed_first_price', 'sealed_second_price'))"},
+		{Table: "lots", Name: "lots_check_dutch", Rule: "CHECK(auction_type != 'dutch' OR (start_price > min_price AND drop_interval > 0))"},
+		{Table: "lots", Name: "lots_check_extend", Rule: "CHECK(extend_window >= 0 AND extend_duration >= 0 AND extensions <= max_extensions)"},
+		// Not validated against existing lots, which were created before the rule and never extend.
+		{Table: "lots", Name: "lots_check_extend_limits",
+			Rule: "CHECK(extend_window = 0 OR (extend_duration > 0 AND max_extensions > 0)) NOT VALID"},
+		{Table: "bids", Name: "bids_check_price", Rule: "CHECK(price >= 1)"},
+		{Table: "proxy_bids", Name: "proxy_bids_check_max_price", Rule: "CHECK(max_price >= 1)"},
+		{Table: "webhook_deliveries", Name: "webhook_deliveries_check_status", Rule: "CHECK(status IN ('pending', 'delivered', 'failed'))"},
 	}
 	for _, v := range constraints {
 		if !d.constraintExists(v.Table, v.Name) {
@@ -80,6 +145,12 @@ func (d *DataBase) Migrate() {
 
 	d.DB.Model(&lot.Lot{}).AddForeignKey("creator_id", "users(id)", "CASCADE", "CASCADE")
 	d.DB.Model(&lot.Lot{}).AddForeignKey("buyer_id", "users(id)", "CASCADE", "CASCADE")
+	d.DB.Model(&bid.Bid{}).AddForeignKey("lot_id", "lots(id)", "CASCADE", "CASCADE")
+	d.DB.Model(&bid.Bid{}).AddForeignKey("buyer_id", "users(id)", "CASCADE", "CASCADE")
+	d.DB.Model(&proxybid.ProxyBid{}).AddForeignKey("lot_id", "lots(id)", "CASCADE", "CASCADE")
+	d.DB.Model(&proxybid.ProxyBid{}).AddForeignKey("user_id", "users(id)", "CASCADE", "CASCADE")
+	d.DB.Model(&webhook.Webhook{}).AddForeignKey("user_id", "users(id)", "CASCADE", "CASCADE")
+	d.DB.Model(&webhook.Delivery{}).AddForeignKey("webhook_id", "webhooks(id)", "CASCADE", "CASCADE")
 }
 func (d *DataBase) GetUser(u *user.User) error {
 	if err := d.DB.Where(&u).First(&u).Error; err != nil {
@@ -94,6 +165,133 @@ func (d *DataBase) AddUser(u *user.User) error {
 	return nil
 }
 
+func (d *DataBase) SetPassword(userID int, hash string) error {
+	request := d.DB.Model(&user.User{}).Where("id = ?", userID).Updates(map[string]interface{}{"password": hash, "updated_at": time.Now()})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't set password")
+	}
+	if request.RowsAffected == 0 {
+		return fmt.Errorf("can't set password: user %d not found", userID)
+	}
+	return nil
+}
+
+func (d *DataBase) VerifyEmail(userID int, at time.Time) error {
+	if err := d.DB.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?", at, userID).Error; err != nil {
+		return errors.Wrap(err, "can't verify email")
+	}
+	return nil
+}
+
+func (d *DataBase) SetTOTP(userID int, secret string, enabledAt *time.Time) error {
+	request := d.DB.Model(&user.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"totp_secret": secret, "totp_enabled_at": enabledAt, "updated_at": time.Now()})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't set totp")
+	}
+	if request.RowsAffected == 0 {
+		return fmt.Errorf("can't set totp: user %d not found", userID)
+	}
+	return nil
+}
+
+func (d *DataBase) UseTOTPStep(userID int, step int64) error {
+	request := d.DB.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't use totp step")
+	}
+	if request.RowsAffected == 0 {
+		return user.ErrCodeUsed
+	}
+	return nil
+}
+
+func (d *DataBase) FindUsers(query string, limit int, offset int) ([]user.User, error) {
+	var result []user.User
+	request := d.DB.Order("id").Limit(limit).Offset(offset)
+	if query != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+		request = request.Where("email ILIKE ? OR first_name || ' ' || last_name ILIKE ?", pattern, pattern)
+	}
+	if err := request.Find(&result).Error; err != nil {
+		return nil, errors.Wrap(err, "can't find users")
+	}
+	return result, nil
+}
+
+func (d *DataBase) SetRole(userID int, role user.Role) error {
+	request := d.DB.Model(&user.User{}).Where("id = ?", userID).Updates(map[string]interface{}{"role": role, "updated_at": time.Now()})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't set role")
+	}
+	if request.RowsAffected == 0 {
+		return fmt.Errorf("can't set role: user %d not found", userID)
+	}
+	return nil
+}
+
+func (d *DataBase) SetBanned(userID int, bannedAt *time.Time) error {
+	request := d.DB.Model(&user.User{}).Where("id = ?", userID).Updates(map[string]interface{}{"banned_at": bannedAt, "updated_at": time.Now()})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't set ban")
+	}
+	if request.RowsAffected == 0 {
+		return fmt.Errorf("can't set ban: user %d not found", userID)
+	}
+	return nil
+}
+
+func (d *DataBase) AddUserToken(t *user.Token) error {
+	if err := d.DB.Create(t).Error; err != nil {
+		return errors.Wrap(err, "can't create token")
+	}
+	return nil
+}
+
+func (d *DataBase) GetUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error) {
+	var result user.Token
+	if err := d.DB.Where("hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hash, purpose, now).
+		First(&result).Error; err != nil {
+		return user.Token{}, fmt.Errorf("token is invalid or expired")
+	}
+	return result, nil
+}
+
+func (d *DataBase) UseUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error) {
+	var result []user.Token
+	err := d.DB.Raw(`UPDATE user_tokens SET used_at = ?
+WHERE hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+RETURNING *`, now, hash, purpose, now).Scan(&result).Error
+	if err != nil {
+		return user.Token{}, errors.Wrap(err, "can't use token")
+	}
+	if len(result) == 0 {
+		return user.Token{}, fmt.Errorf("token is invalid or expired")
+	}
+	return result[0], nil
+}
+
+func (d *DataBase) AttemptUserToken(hash string, purpose user.Purpose, now time.Time, maxAttempts int) (user.Token, error) {
+	var result []user.Token
+	err := d.DB.Raw(`UPDATE user_tokens SET attempts = attempts + 1
+WHERE hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ? AND attempts < ?
+RETURNING *`, hash, purpose, now, maxAttempts).Scan(&result).Error
+	if err != nil {
+		return user.Token{}, errors.Wrap(err, "can't attempt token")
+	}
+	if len(result) == 0 {
+		return user.Token{}, fmt.Errorf("token is invalid or expired")
+	}
+	return result[0], nil
+}
+
+func (d *DataBase) DeleteUserTokens(userID int, purpose user.Purpose) error {
+	if err := d.DB.Exec("DELETE FROM user_tokens WHERE user_id = ? AND purpose = ?", userID, purpose).Error; err != nil {
+		return errors.Wrapf(err, "can't delete %s tokens", purpose)
+	}
+	return nil
+}
+
 func (d *DataBase) GetSession(s *session.Session) error {
 	if err := d.DB.First(s).Error; err != nil {
 		return errors.Wrapf(err, "session not found %+v", s)
@@ -108,6 +306,149 @@ func (d *DataBase) AddSession(s *session.Session) error {
 	return nil
 }
 
+func (d *DataBase) GetSessions(userID int) ([]session.Session, error) {
+	result := []session.Session{}
+	now := time.Now()
+	if err := d.DB.Where("user_id = ? AND rotated_at IS NULL AND (valid_until > ? OR refresh_until > ?)", userID, now, now).
+		Order("created_at DESC").Find(&result).Error; err != nil {
+		return nil, errors.Wrap(err, "can't select sessions")
+	}
+	return result, nil
+}
+
+func (d *DataBase) DeleteSession(s *session.Session) error {
+	var found session.Session
+	if err := d.DB.Where("session_id = ? AND user_id = ?", s.SessionID, s.UserID).First(&found).Error; err != nil {
+		return errors.Wrap(err, "session not found")
+	}
+	request := d.DB.Where("session_id = ? OR (family_id = ? AND family_id != '')", found.SessionID, found.FamilyID).Delete(&session.Session{})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't delete session")
+	}
+	return nil
+}
+
+func (d *DataBase) RotateSession(refreshToken string, next *session.Session) error {
+	if refreshToken == "" {
+		return fmt.Errorf("refresh token not found")
+	}
+	tx := d.DB.Begin()
+	var old session.Session
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("refresh_token = ?", refreshToken).First(&old).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "refresh token not found")
+	}
+	if old.RotatedAt != nil {
+		if err := tx.Where("family_id = ?", old.FamilyID).Delete(&session.Session{}).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "can't revoke sessions")
+		}
+		if err := tx.Commit().Error; err != nil {
+			return errors.Wrap(err, "can't revoke sessions")
+		}
+		return session.ErrRefreshReused
+	}
+	now := time.Now()
+	if !old.RefreshUntil.After(now) {
+		tx.Rollback()
+		return fmt.Errorf("refresh token is expired")
+	}
+	if err := tx.Exec("UPDATE sessions SET rotated_at = ?, valid_until = LEAST(valid_until, ?) WHERE session_id = ?",
+		now, now, old.SessionID).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "can't rotate session")
+	}
+	next.UserID = old.UserID
+	next.FamilyID = old.FamilyID
+	next.CreatedAt = old.CreatedAt
+	if err := tx.Create(next).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "can't create session")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Wrap(err, "can't commit session")
+	}
+	return nil
+}
+
+func (d *DataBase) PurgeSessions(now time.Time, limit int) (int, error) {
+	request := d.DB.Exec("DELETE FROM sessions WHERE session_id IN "+
+		"(SELECT session_id FROM sessions WHERE valid_until <= ? AND refresh_until <= ? LIMIT ?)", now, now, limit)
+	if request.Error != nil {
+		return 0, errors.Wrap(request.Error, "can't purge sessions")
+	}
+	return int(request.RowsAffected), nil
+}
+
+func (d *DataBase) AddRevocation(r *jwt.Revocation) error {
+	if err := d.DB.Exec("INSERT INTO revoked_tokens (id, expires_at) VALUES (?, ?) "+
+		"ON CONFLICT (id) DO UPDATE SET expires_at = GREATEST(revoked_tokens.expires_at, EXCLUDED.expires_at)",
+		r.ID, r.ExpiresAt).Error; err != nil {
+		return errors.Wrap(err, "can't add revocation")
+	}
+	return nil
+}
+
+func (d *DataBase) GetRevocations(now time.Time) ([]jwt.Revocation, error) {
+	result := []jwt.Revocation{}
+	if err := d.DB.Where("expires_at > ?", now).Find(&result).Error; err != nil {
+		return nil, errors.Wrap(err, "can't select revocations")
+	}
+	return result, nil
+}
+
+func (d *DataBase) PurgeRevocations(now time.Time, limit int) (int, error) {
+	request := d.DB.Exec("DELETE FROM revoked_tokens WHERE id IN "+
+		"(SELECT id FROM revoked_tokens WHERE expires_at <= ? LIMIT ?)", now, limit)
+	if request.Error != nil {
+		return 0, errors.Wrap(request.Error, "can't purge revocations")
+	}
+	return int(request.RowsAffected), nil
+}
+
+func (d *DataBase) AddFailure(key string, now time.Time, forgetBefore time.Time) (lockout.Attempts, error) {
+	var result []lockout.Attempts
+	err := d.DB.Raw(`INSERT INTO login_attempts (key, failures, last_failure_at) VALUES (?, 1, ?)
+ON CONFLICT (key) DO UPDATE SET
+failures = CASE WHEN login_attempts.last_failure_at > ? THEN login_attempts.failures + 1 ELSE 1 END,
+last_failure_at = EXCLUDED.last_failure_at
+RETURNING *`, key, now, forgetBefore).Scan(&result).Error
+	if err != nil {
+		return lockout.Attempts{}, errors.Wrap(err, "can't add failure")
+	}
+	if len(result) == 0 {
+		return lockout.Attempts{}, fmt.Errorf("can't add failure of %s", key)
+	}
+	return result[0], nil
+}
+
+func (d *DataBase) GetAttempts(key string) (lockout.Attempts, error) {
+	var result []lockout.Attempts
+	if err := d.DB.Where("key = ?", key).Find(&result).Error; err != nil {
+		return lockout.Attempts{}, errors.Wrap(err, "can't get attempts")
+	}
+	if len(result) == 0 {
+		return lockout.Attempts{Key: key}, nil
+	}
+	return result[0], nil
+}
+
+func (d *DataBase) ResetAttempts(key string) error {
+	if err := d.DB.Exec("DELETE FROM login_attempts WHERE key = ?", key).Error; err != nil {
+		return errors.Wrap(err, "can't reset attempts")
+	}
+	return nil
+}
+
+func (d *DataBase) PurgeAttempts(before time.Time, limit int) (int, error) {
+	request := d.DB.Exec("DELETE FROM login_attempts WHERE key IN "+
+		"(SELECT key FROM login_attempts WHERE last_failure_at < ? LIMIT ?)", before, limit)
+	if request.Error != nil {
+		return 0, errors.Wrap(request.Error, "can't purge attempts")
+	}
+	return int(request.RowsAffected), nil
+}
+
 func (d *DataBase) attachUsersToLot(l *lot.Lot) {
 	var write user.User
 	d.DB.Where("id = ?", l.CreatorID).First(&write)
@@ -139,6 +480,9 @@ func (d *DataBase) GetLot(l *lot.Lot) error {
 }
 
 func (d *DataBase) AddLot(l *lot.Lot) error {
+	if err := l.ResolveCurrency(); err != nil {
+		return errors.Wrap(err, "can't create lot")
+	}
 	if err := d.DB.Create(&l).Error; err != nil {
 		return errors.Wrap(err, "can't create lot")
 	}
@@ -147,13 +491,18 @@ func (d *DataBase) AddLot(l *lot.Lot) error {
 }
 
 func (d *DataBase) UpdateUser(u *user.User, n *user.User) error {
-	if err := d.DB.Where(&u).Update(n).Error; err != nil {
+	if err := d.DB.Model(&user.User{}).Where(u).Updates(*n).Error; err != nil {
 		return errors.Wrap(err, "can't update user")
 	}
 	return nil
 }
 
 func (d *DataBase) UpdateLot(n *lot.Lot) error {
+	if n.Currency != "" {
+		if err := n.ResolveCurrency(); err != nil {
+			return errors.Wrap(err, "can't update lot")
+		}
+	}
 	if err := d.DB.Model(&lot.Lot{}).Updates(*n).Error; err != nil {
 		return errors.Wrap(err, "can't update lot")
 	}
@@ -182,43 +531,369 @@ func (d *DataBase) GetOwnLots(l *lot.Lot, r *lot.Lot) ([]lot.Lot, error) {
 	}
 	return result, nil
 }
-func (d *DataBase) BuyLot(id int, owner int, price int) (lot.Lot, error) {
+
+// notify calls n with the lot changed by a bid in tx, events are sent in tx when the bus is pg_notify.
+func (d *DataBase) notify(tx *gorm.DB, n storage.Notify, l lot.Lot) error {
+	if n == nil {
+		return nil
+	}
+	if d.bus == nil {
+		return n(l, nil)
+	}
+	return n(l, txPublisher{bus: d.bus, tx: tx})
+}
+
+func (d *DataBase) BuyLot(id int, owner int, price money.Money, n storage.Notify) (lot.Lot, error) {
 	tx := d.DB.Begin()
-	defer tx.Commit()
-	result := d.DB.Exec(`UPDATE lots
-SET buy_price = ?,
-    buyer_id = ?
+	var l lot.Lot
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", id).First(&l).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't buy lot %d", id)
+	}
+	strategy, err := auction.New(l.AuctionType)
+	if err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't buy lot")
+	}
+	if price, err = price.Resolve(l.Currency); err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't buy lot")
+	}
+	now := time.Now()
+	b := bid.Bid{LotID: id, BuyerID: owner, Price: price}
+	if err = strategy.CheckBid(l, b, now); err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't buy lot")
+	}
+	if strategy.Sealed() {
+		var count int
+		if err = tx.Model(&bid.Bid{}).Where("lot_id = ? AND buyer_id = ?", id, owner).Count(&count).Error; err != nil {
+			tx.Rollback()
+			return lot.Lot{}, errors.Wrap(err, "can't count bids")
+		}
+		if count > 0 {
+			tx.Rollback()
+			return lot.Lot{}, fmt.Errorf("can't buy lot, you have already placed a sealed bid")
+		}
+	}
+	strategy.Accept(&l, &b, now)
+	if err = tx.Model(&l).Updates(map[string]interface{}{
+		"buy_price":  l.BuyPrice,
+		"buyer_id":   l.BuyerID,
+		"status":     l.Status,
+		"result":     l.Result,
+		"end_at":     l.EndAt,
+		"extensions": l.Extensions,
+	}).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, fmt.Errorf("can't buy lot :%+v", err)
+	}
+	if err = tx.Create(&b).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't save bid, rollback")
+	}
+	if l.AuctionType == lot.English {
+		if err = d.resolveProxyBids(tx, &l, now); err != nil {
+			tx.Rollback()
+			return lot.Lot{}, errors.Wrap(err, "rollback")
+		}
+	}
+	var lotResult lot.Lot
+	if err = tx.Where("id = ?", id).First(&lotResult).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't fetch new lot, rollback")
+
+	}
+	lotResult.Extended = l.Extended
+	d.attachUsersToLot(&lotResult)
+	if err = d.notify(tx, n, lotResult); err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't publish bid, rollback")
+	}
+	if err = tx.Commit().Error; err != nil {
+		return lot.Lot{}, errors.Wrap(err, "can't commit bid")
+	}
+	return lotResult, nil
+}
+func (d *DataBase) BuyNow(id int, owner int, n storage.Notify) (lot.Lot, error) {
+	tx := d.DB.Begin()
+	result := tx.Exec(`UPDATE lots
+SET buy_price = buy_now_price,
+    buyer_id = ?,
+    status = 'finished',
+    result = 'sold'
 WHERE id = ?
   AND deleted_at IS NULL
   AND status = 'active'
+  AND end_at > NOW()
+  AND auction_type = 'english'
   AND creator_id != ?
-  AND (buyer_id != ? OR buyer_id IS NULL)
-  AND (buy_price < ? OR buy_price IS NULL)
-  AND (? - min_price) % price_step = 0`, price, owner, id, owner, owner, price, price)
+  AND buy_now_price IS NOT NULL
+  AND (buy_price < buy_now_price OR buy_price IS NULL)`, owner, id, owner)
 	if result.Error != nil {
-		return lot.Lot{}, fmt.Errorf("can't buy lot :%+v", result.Error)
+		tx.Rollback()
+		return lot.Lot{}, fmt.Errorf("can't buy lot now :%+v", result.Error)
 	}
 	if result.RowsAffected == 0 {
-		return lot.Lot{}, fmt.Errorf("can't buy lot, check lot status, owner and buyer statuses, your price: it should be more than a last price and equal n*step + start_price")
-
+		tx.Rollback()
+		return lot.Lot{}, fmt.Errorf("can't buy lot now, check lot status, owner and buy now price")
 	}
 	var lotResult lot.Lot
-	if err := d.DB.Where("id = ?", id).First(&lotResult).Error; err != nil {
+	if err := tx.Where("id = ?", id).First(&lotResult).Error; err != nil {
 		tx.Rollback()
 		return lot.Lot{}, errors.Wrapf(err, "can't fetch new lot, rollback")
-
+	}
+	b := bid.Bid{LotID: id, BuyerID: owner, Price: *lotResult.BuyPrice}
+	if err := tx.Create(&b).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't save bid, rollback")
 	}
 	d.attachUsersToLot(&lotResult)
+	if err := d.notify(tx, n, lotResult); err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't publish bid, rollback")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return lot.Lot{}, errors.Wrap(err, "can't commit bid")
+	}
 	return lotResult, nil
 }
-func (d *DataBase) CloseLots() (int, error) {
-	result := d.DB.Exec(`UPDATE lots
-SET status = 'finished'
+
+// CloseLots finishes active lots after their end and returns them.
+func (d *DataBase) CloseLots() ([]lot.Lot, error) {
+	tx := d.DB.Begin()
+	var lots []lot.Lot
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("status = 'active' AND end_at < NOW()").Find(&lots).Error; err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "can't select lots to close")
+	}
+	for i := range lots {
+		strategy, err := auction.New(lots[i].AuctionType)
+		if err != nil {
+			tx.Rollback()
+			return nil, errors.Wrapf(err, "can't close lot %d", lots[i].ID)
+		}
+		var bids []bid.Bid
+		if err = tx.Where("lot_id = ?", lots[i].ID).Order("created_at, id").Find(&bids).Error; err != nil {
+			tx.Rollback()
+			return nil, errors.Wrapf(err, "can't fetch bids for lot %d", lots[i].ID)
+		}
+		strategy.Finish(&lots[i], bids)
+		if err = tx.Model(&lots[i]).Updates(map[string]interface{}{
+			"buy_price": lots[i].BuyPrice,
+			"buyer_id":  lots[i].BuyerID,
+			"status":    lots[i].Status,
+			"result":    lots[i].Result,
+		}).Error; err != nil {
+			tx.Rollback()
+			return nil, errors.Wrapf(err, "can't close lot %d", lots[i].ID)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, errors.Wrap(err, "can't commit closed lots")
+	}
+	for i := range lots {
+		d.attachUsersToLot(&lots[i])
+	}
+	return lots, nil
+}
+
+func (d *DataBase) FinishLot(id int) (lot.Lot, error) {
+	tx := d.DB.Begin()
+	var l lot.Lot
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ? AND status <> 'finished'", id).First(&l).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't finish lot %d", id)
+	}
+	strategy, err := auction.New(l.AuctionType)
+	if err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't finish lot %d", id)
+	}
+	var bids []bid.Bid
+	if err = tx.Where("lot_id = ?", id).Order("created_at, id").Find(&bids).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't fetch bids for lot %d", id)
+	}
+	strategy.Finish(&l, bids)
+	l.EndAt = time.Now()
+	if err = tx.Model(&l).Updates(map[string]interface{}{
+		"buy_price": l.BuyPrice,
+		"buyer_id":  l.BuyerID,
+		"status":    l.Status,
+		"result":    l.Result,
+		"end_at":    l.EndAt,
+	}).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't finish lot %d", id)
+	}
+	if err = tx.Commit().Error; err != nil {
+		return lot.Lot{}, errors.Wrapf(err, "can't commit finished lot %d", id)
+	}
+	d.attachUsersToLot(&l)
+	return l, nil
+}
+func (d *DataBase) ActivateLots() ([]lot.Lot, error) {
+	var lots []lot.Lot
+	if err := d.DB.Raw(`UPDATE lots
+SET status = 'active'
 WHERE deleted_at IS NULL
-  AND status = 'active'
-  AND end_at < NOW()`)
+  AND status = 'created'
+  AND start_at <= NOW()
+RETURNING *`).Scan(&lots).Error; err != nil {
+		return nil, errors.Wrapf(err, "can't activate lots")
+	}
+	for i := range lots {
+		d.attachUsersToLot(&lots[i])
+	}
+	return lots, nil
+}
+func (d *DataBase) PublishLot(id int, owner int) (lot.Lot, error) {
+	result := d.DB.Exec(`UPDATE lots
+SET status = 'active',
+    start_at = NOW()
+WHERE id = ?
+  AND deleted_at IS NULL
+  AND status = 'created'
+  AND creator_id = ?
+  AND end_at > NOW()`, id, owner)
 	if result.Error != nil {
-		return 0, errors.Wrapf(result.Error, "can't delete lot")
+		return lot.Lot{}, fmt.Errorf("can't publish lot :%+v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return lot.Lot{}, fmt.Errorf("can't publish lot, check lot status, owner and end time")
+	}
+	var lotResult lot.Lot
+	if err := d.DB.Where("id = ?", id).First(&lotResult).Error; err != nil {
+		return lot.Lot{}, errors.Wrapf(err, "can't fetch published lot")
+	}
+	d.attachUsersToLot(&lotResult)
+	return lotResult, nil
+}
+
+func (d *DataBase) attachUserToBid(b *bid.Bid) {
+	var write user.User
+	d.DB.Where("id = ?", b.BuyerID).First(&write)
+	write.IsShort = true
+	b.Buyer = &write
+}
+
+func (d *DataBase) AddBid(b *bid.Bid) error {
+	if err := d.DB.Create(&b).Error; err != nil {
+		return errors.Wrap(err, "can't create bid")
+	}
+	d.attachUserToBid(b)
+	return nil
+}
+
+func (d *DataBase) GetBids(condition bid.Bid, limit int, offset int) ([]bid.Bid, error) {
+	var result []bid.Bid
+	if err := d.DB.Where(condition).Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&result).Error; err != nil {
+		return nil, errors.Wrap(err, "can't select bids")
+	}
+	for i := range result {
+		d.attachUserToBid(&result[i])
+	}
+	return result, nil
+}
+
+func (d *DataBase) GetVisibleBids(buyerID int, limit int, offset int) ([]bid.Bid, error) {
+	var result []bid.Bid
+	sealed := []lot.AuctionType{lot.SealedFirstPrice, lot.SealedSecondPrice}
+	if err := d.DB.Select("bids.*").Joins("JOIN lots ON lots.id = bids.lot_id").
+		Where("bids.buyer_id = ? AND lots.deleted_at IS NULL AND (lots.auction_type NOT IN (?) OR lots.status = 'finished')", buyerID, sealed).
+		Order("bids.created_at DESC, bids.id DESC").Limit(limit).Offset(offset).Find(&result).Error; err != nil {
+		return nil, errors.Wrap(err, "can't select bids")
+	}
+	for i := range result {
+		d.attachUserToBid(&result[i])
+	}
+	return result, nil
+}
+
+// resolveProxyBids places bids on behalf of proxies and accepts them like manual bids, so they extend the lot.
+// It should be called inside the transaction which locked the lot, l is the current state of the lot.
+func (d *DataBase) resolveProxyBids(tx *gorm.DB, l *lot.Lot, now time.Time) error {
+	var proxies []proxybid.ProxyBid
+	if err := tx.Where("lot_id = ?", l.ID).Order("created_at, id").Find(&proxies).Error; err != nil {
+		return errors.Wrapf(err, "can't fetch proxy bids for lot %d", l.ID)
+	}
+	steps := proxybid.Resolve(*l, proxies)
+	if len(steps) == 0 {
+		return nil
+	}
+	strategy, err := auction.New(l.AuctionType)
+	if err != nil {
+		return errors.Wrap(err, "can't place proxy bids")
+	}
+	for _, step := range steps {
+		b := bid.Bid{LotID: l.ID, BuyerID: step.UserID, Price: step.Price, Auto: true}
+		strategy.Accept(l, &b, now)
+		if err = tx.Create(&b).Error; err != nil {
+			return errors.Wrap(err, "can't save proxy bid")
+		}
+	}
+	if err = tx.Model(l).Updates(map[string]interface{}{
+		"buy_price":  l.BuyPrice,
+		"buyer_id":   l.BuyerID,
+		"end_at":     l.EndAt,
+		"extensions": l.Extensions,
+	}).Error; err != nil {
+		return errors.Wrap(err, "can't update lot by proxy bid")
+	}
+	return nil
+}
+
+func (d *DataBase) SetMaxBid(p *proxybid.ProxyBid, n storage.Notify) (lot.Lot, error) {
+	tx := d.DB.Begin()
+	var l lot.Lot
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("id = ? AND status = 'active' AND auction_type = 'english' AND end_at > NOW()", p.LotID).First(&l).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't set max bid, check lot status")
+	}
+	maxPrice, err := p.MaxPrice.Resolve(l.Currency)
+	if err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't set max bid")
 	}
-	return int(result.RowsAffected), nil
+	p.MaxPrice = maxPrice
+	if err = p.Check(l); err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't set max bid")
+	}
+	var existing proxybid.ProxyBid
+	err = tx.Where("lot_id = ? AND user_id = ?", p.LotID, p.UserID).First(&existing).Error
+	switch {
+	case err == nil:
+		existing.MaxPrice = p.MaxPrice
+		err = tx.Save(&existing).Error
+		*p = existing
+	case gorm.IsRecordNotFoundError(err):
+		err = tx.Create(p).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't save max bid")
+	}
+	if err = d.resolveProxyBids(tx, &l, time.Now()); err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "rollback")
+	}
+	var lotResult lot.Lot
+	if err = tx.Where("id = ?", l.ID).First(&lotResult).Error; err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrapf(err, "can't fetch new lot, rollback")
+	}
+	lotResult.Extended = l.Extended
+	d.attachUsersToLot(&lotResult)
+	if err = d.notify(tx, n, lotResult); err != nil {
+		tx.Rollback()
+		return lot.Lot{}, errors.Wrap(err, "can't publish bid, rollback")
+	}
+	if err = tx.Commit().Error; err != nil {
+		return lot.Lot{}, errors.Wrap(err, "can't commit max bid")
+	}
+	return lotResult, nil
 }
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/storagetest"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/environment"
+)
+
+// TEST_DB_URL should point to a disposable database, all tables are truncated before each test case.
+func TestDataBase_Conformance(t *testing.T) {
+	url := environment.GetStr("TEST_DB_URL", "")
+	if url == "" {
+		t.Skip("TEST_DB_URL is not set")
+	}
+	db, err := NewDataBaseStorage(DBCredential{URL: url, Repetitions: 1, Migrate: true})
+	require.NoError(t, err)
+	defer func() {
+		_ = db.DB.Close()
+	}()
+	storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+		require.NoError(t, db.DB.Exec("TRUNCATE bids, lots, sessions, users RESTART IDENTITY CASCADE").Error)
+		return db
+	})
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
+)
+
+func (d *DataBase) AddWebhook(w *webhook.Webhook) error {
+	if err := d.DB.Create(w).Error; err != nil {
+		return errors.Wrap(err, "can't create webhook")
+	}
+	return nil
+}
+
+func (d *DataBase) GetWebhook(w *webhook.Webhook) error {
+	if err := d.DB.Where(w).First(w).Error; err != nil {
+		return errors.Wrapf(err, "webhook not found %+v", w)
+	}
+	return nil
+}
+
+func (d *DataBase) GetWebhooks(condition webhook.Webhook) ([]webhook.Webhook, error) {
+	result := []webhook.Webhook{}
+	if err := d.DB.Where(condition).Order("id").Find(&result).Error; err != nil {
+		return nil, errors.Wrap(err, "can't select webhooks")
+	}
+	return result, nil
+}
+
+func (d *DataBase) UpdateWebhook(n *webhook.Webhook) error {
+	request := d.DB.Model(&webhook.Webhook{}).Where("id = ? AND user_id = ?", n.ID, n.UserID).Updates(map[string]interface{}{
+		"url":         n.URL,
+		"events":      strings.Join(n.Events, ","),
+		"active":      n.Active,
+		"failures":    n.Failures,
+		"disabled_at": n.DisabledAt,
+	})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't update webhook")
+	}
+	if request.RowsAffected == 0 {
+		return fmt.Errorf("webhook not found %+v", n)
+	}
+	if err := d.DB.Where("id = ?", n.ID).First(n).Error; err != nil {
+		return errors.Wrapf(err, "webhook not found %+v", n)
+	}
+	return nil
+}
+
+func (d *DataBase) DeleteWebhook(w *webhook.Webhook) error {
+	request := d.DB.Where("id = ? AND user_id = ?", w.ID, w.UserID).Delete(&webhook.Webhook{})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't delete webhook")
+	}
+	if request.RowsAffected == 0 {
+		return fmt.Errorf("webhook not found")
+	}
+	return nil
+}
+
+func (d *DataBase) RecordWebhookResult(id int, success bool, maxFailures int) (webhook.Webhook, error) {
+	// the right side of every assignment sees the old row
+	request := d.DB.Exec(`UPDATE webhooks
+SET failures    = CASE WHEN ? THEN 0 ELSE failures + 1 END,
+    disabled_at = CASE WHEN NOT ? AND active AND failures + 1 >= ? THEN NOW() ELSE disabled_at END,
+    active      = active AND (? OR failures + 1 < ?),
+    updated_at  = NOW()
+WHERE id = ?`, success, success, maxFailures, success, maxFailures, id)
+	if request.Error != nil {
+		return webhook.Webhook{}, errors.Wrap(request.Error, "can't update webhook")
+	}
+	var result webhook.Webhook
+	if err := d.DB.Where("id = ?", id).First(&result).Error; err != nil {
+		return webhook.Webhook{}, errors.Wrapf(err, "webhook not found %d", id)
+	}
+	return result, nil
+}
+
+func (d *DataBase) AddDelivery(delivery *webhook.Delivery) error {
+	if err := d.DB.Create(delivery).Error; err != nil {
+		return errors.Wrap(err, "can't create delivery")
+	}
+	return nil
+}
+
+func (d *DataBase) GetDeliveries(condition webhook.Delivery, limit int, offset int) ([]webhook.Delivery, error) {
+	result := []webhook.Delivery{}
+	if err := d.DB.Where(condition).Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&result).Error; err != nil {
+		return nil, errors.Wrap(err, "can't select deliveries")
+	}
+	return result, nil
+}
+
+func (d *DataBase) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]webhook.Delivery, error) {
+	result := []webhook.Delivery{}
+	err := d.DB.Raw(`UPDATE webhook_deliveries
+SET next_attempt_at = ?
+WHERE id IN (SELECT id
+             FROM webhook_deliveries
+             WHERE status = 'pending'
+               AND next_attempt_at <= ?
+             ORDER BY next_attempt_at, id
+             LIMIT ? FOR UPDATE SKIP LOCKED)
+RETURNING *`, now.Add(lease), now, limit).Scan(&result).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "can't claim deliveries")
+	}
+	return result, nil
+}
+
+func (d *DataBase) UpdateDelivery(delivery *webhook.Delivery) error {
+	request := d.DB.Model(&webhook.Delivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"response_code":   delivery.ResponseCode,
+		"last_error":      delivery.LastError,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"delivered_at":    delivery.DeliveredAt,
+	})
+	if request.Error != nil {
+		return errors.Wrap(request.Error, "can't update delivery")
+	}
+	if request.RowsAffected == 0 {
+		return fmt.Errorf("delivery not found %d", delivery.ID)
+	}
+	return nil
+}
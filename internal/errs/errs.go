@@ -28,3 +28,10 @@ func (e Err) StringJSON() string {
 var ErrUnauthorized = errors.New("неавторизованный запрос")
 var ErrNotFound = errors.New("контент по переданному идентификатору не найден")
 var ErrEmptyCredits = errors.New("email and password should not be blank")
+var ErrWrongPassword = errors.New("current password is wrong")
+var ErrEmailNotVerified = errors.New("email is not verified")
+var ErrWrongCode = errors.New("code is wrong")
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+var ErrTwoFactorDisabled = errors.New("two-factor authentication is not enabled")
+var ErrWrongCredentials = errors.New("wrong email or password")
+var ErrBanned = errors.New("user is banned")
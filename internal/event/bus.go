@@ -0,0 +1,62 @@
+package event
+
+import (
+	"sync"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/hub"
+)
+
+// Publisher sends events, a Bus is one and storage gives one bound to the transaction of a change.
+type Publisher interface {
+	Publish(e Event) error
+}
+
+// Bus delivers published events to every running instance, including the publisher.
+// The bus assigns seq, so it is shared by all instances.
+type Bus interface {
+	Publish(e Event) error
+	// Listen calls handler for every event in the order of delivery.
+	Listen(handler func(Event))
+	Close() error
+}
+
+// LocalBus is the in-process bus for a single instance and tests.
+type LocalBus struct {
+	mu       sync.Mutex
+	seq      uint64
+	handlers []func(Event)
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+func (b *LocalBus) Publish(e Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	for _, h := range b.handlers {
+		h(e)
+	}
+	return nil
+}
+
+func (b *LocalBus) Listen(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *LocalBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = nil
+	return nil
+}
+
+// Message is the form of an event on a bus between instances, topics are not a part of the public envelope.
+type Message struct {
+	Event  Event       `json:"event"`
+	Topics []hub.Topic `json:"topics"`
+}
@@ -0,0 +1,238 @@
+package event
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/hub"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
+)
+
+// Version of the envelope, it changes on incompatible changes of the protocol.
+const Version = 1
+
+const DefaultRetention = 1000
+
+// ReorderWindow is how long a missing seq is awaited before the event is considered lost.
+const ReorderWindow = 2 * time.Second
+
+type Type string
+
+const (
+	BidPlaced   Type = "bid_placed"
+	LotUpdated  Type = "lot_updated"
+	LotExtended Type = "lot_extended"
+	LotFinished Type = "lot_finished"
+	LotDeleted  Type = "lot_deleted"
+	// Reset tells a resuming client that some events are lost and the state should be fetched again.
+	Reset Type = "reset"
+)
+
+// Event is the envelope of every realtime message. Payload of lot events is the lot after the event,
+// lot_deleted carries only {"id": ...}.
+type Event struct {
+	Version int             `json:"version"`
+	Type    Type            `json:"type"`
+	Seq     uint64          `json:"seq"`
+	LotID   int             `json:"lot_id,omitempty"`
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Topics  []hub.Topic     `json:"-"`
+}
+
+func (e Event) match(topics map[hub.Topic]bool) bool {
+	for _, t := range e.Topics {
+		if topics[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// Stream sends events through the bus, so every instance gets them, keeps the last received events
+// for resuming clients and fans them out to local clients through the hub.
+type Stream struct {
+	mu        sync.Mutex
+	hub       *hub.Hub
+	bus       Bus
+	logger    log.Logger
+	seq       uint64
+	gap       uint64
+	missing   map[uint64]time.Time
+	window    time.Duration
+	events    []Event
+	retention int
+	hooks     []func(Event)
+}
+
+func NewStream(h *hub.Hub, bus Bus, retention int, logger log.Logger) *Stream {
+	if retention < 1 {
+		retention = DefaultRetention
+	}
+	s := &Stream{hub: h, bus: bus, retention: retention, logger: logger,
+		missing: make(map[uint64]time.Time), window: ReorderWindow}
+	bus.Listen(s.receive)
+	return s
+}
+
+func (s *Stream) Hub() *hub.Hub {
+	return s.hub
+}
+
+// Publish sends the event to clients subscribed to any of topics on every instance, the bus assigns its seq.
+func (s *Stream) Publish(t Type, lotID int, payload interface{}, topics ...hub.Topic) error {
+	e, err := s.send(s.bus, t, lotID, payload, topics...)
+	if err != nil {
+		return err
+	}
+	s.Hooks(e)
+	return nil
+}
+
+// PublishLotWith sends the lot event through p instead of the bus, nil p means the bus. Storage gives p bound
+// to the transaction of a change, so hooks are not called, the caller passes the events to Hooks after the commit.
+func (s *Stream) PublishLotWith(p Publisher, t Type, l lot.Lot) (Event, error) {
+	if p == nil {
+		p = s.bus
+	}
+	return s.send(p, t, l.ID, l, LotTopics(l)...)
+}
+
+func (s *Stream) send(p Publisher, t Type, lotID int, payload interface{}, topics ...hub.Topic) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, errors.Wrapf(err, "can't marshal %s payload", t)
+	}
+	e := Event{Version: Version, Type: t, LotID: lotID, Time: time.Now(), Payload: data, Topics: topics}
+	if err = p.Publish(e); err != nil {
+		return Event{}, errors.Wrapf(err, "can't publish %s", t)
+	}
+	return e, nil
+}
+
+// Hooks calls hooks registered by OnPublish for the events.
+func (s *Stream) Hooks(events ...Event) {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+	for _, e := range events {
+		for _, hook := range hooks {
+			hook(e)
+		}
+	}
+}
+
+// OnPublish registers a hook called for events published by this instance only, unlike the bus listeners.
+// Seq of the event is not known to hooks.
+func (s *Stream) OnPublish(hook func(Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// receive keeps events ordered by seq. A gap in seq may be filled by events delivered out of order, seqs
+// missing for longer than the reorder window mean that the bus has lost them, clients resuming from before
+// the gap get Reset.
+func (s *Stream) receive(e Event) {
+	message, err := json.Marshal(e)
+	if err != nil {
+		s.logger.Errorf("can't marshal %s event: %+v", e.Type, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.seq != 0 && e.Seq > s.seq+1 {
+		if e.Seq-s.seq-1 > uint64(s.retention) {
+			// too many events to wait for, they can't be replayed anyway
+			s.gap = e.Seq
+		} else {
+			for seq := s.seq + 1; seq < e.Seq; seq++ {
+				s.missing[seq] = now
+			}
+		}
+	}
+	delete(s.missing, e.Seq)
+	s.expire(now)
+	i := sort.Search(len(s.events), func(i int) bool {
+		return s.events[i].Seq > e.Seq
+	})
+	s.events = append(s.events, Event{})
+	copy(s.events[i+1:], s.events[i:])
+	s.events[i] = e
+	if len(s.events) > s.retention {
+		s.events = s.events[len(s.events)-s.retention:]
+	}
+	if e.Seq > s.seq {
+		s.seq = e.Seq
+	}
+	if evicted := s.hub.Publish(message, e.Topics...); evicted != 0 {
+		s.logger.Infof("evicted %d slow clients", evicted)
+	}
+}
+
+// expire declares seqs missing for the reorder window lost.
+func (s *Stream) expire(now time.Time) {
+	for seq, since := range s.missing {
+		if now.Sub(since) < s.window {
+			continue
+		}
+		delete(s.missing, seq)
+		if seq+1 > s.gap {
+			s.gap = seq + 1
+		}
+	}
+}
+
+// PublishLot sends the lot to the global feed and to subscribers of the lot, its creator and its buyer.
+func (s *Stream) PublishLot(t Type, l lot.Lot) error {
+	return s.Publish(t, l.ID, l, LotTopics(l)...)
+}
+
+// PublishDeleted notifies about the deleted lot, only the id is known to clients.
+func (s *Stream) PublishDeleted(id int, creatorID int) error {
+	payload := struct {
+		ID int `json:"id"`
+	}{ID: id}
+	return s.Publish(LotDeleted, id, payload, hub.Global, hub.LotTopic(id), hub.UserTopic(creatorID))
+}
+
+func LotTopics(l lot.Lot) []hub.Topic {
+	topics := []hub.Topic{hub.Global, hub.LotTopic(l.ID), hub.UserTopic(l.CreatorID)}
+	if l.BuyerID != nil {
+		topics = append(topics, hub.UserTopic(*l.BuyerID))
+	}
+	return topics
+}
+
+// Subscribe registers a client and returns events after lastSeq it has missed. Registration and replay
+// happen atomically, so the client gets every later event exactly once. If the missed events are not
+// retained anymore the replay starts with a Reset event. lastSeq 0 means a new client without replay.
+func (s *Stream) Subscribe(lastSeq uint64, topics ...hub.Topic) (*hub.Client, []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	client := s.hub.Register(topics...)
+	if lastSeq == 0 || lastSeq == s.seq {
+		return client, nil
+	}
+	var missed []Event
+	if lastSeq > s.seq || lastSeq+1 < s.gap || len(s.events) == 0 || s.events[0].Seq > lastSeq+1 {
+		missed = append(missed, Event{Version: Version, Type: Reset, Seq: s.seq, Time: time.Now()})
+	}
+	filter := make(map[hub.Topic]bool, len(topics))
+	for _, t := range topics {
+		filter[t] = true
+	}
+	for _, e := range s.events {
+		if e.Seq > lastSeq && e.match(filter) {
+			missed = append(missed, e)
+		}
+	}
+	return client, missed
+}
@@ -0,0 +1,133 @@
+package event
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/internal/hub"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
+)
+
+func TestStream_Publish(t *testing.T) {
+	r := require.New(t)
+	s := NewStream(hub.New(10), NewLocalBus(), 10, log.New())
+	client := s.Hub().Register(hub.LotTopic(1))
+	buyer := 3
+	err := s.PublishLot(BidPlaced, lot.Lot{ID: 1, CreatorID: 2, BuyerID: &buyer})
+	r.NoError(err)
+	err = s.PublishDeleted(2, 2)
+	r.NoError(err)
+
+	var e Event
+	r.NoError(json.Unmarshal(<-client.Send(), &e))
+	r.Equal(Version, e.Version)
+	r.Equal(BidPlaced, e.Type)
+	r.Equal(uint64(1), e.Seq)
+	r.Equal(1, e.LotID)
+	r.Empty(client.Send())
+}
+
+func TestStream_Subscribe(t *testing.T) {
+	s := NewStream(hub.New(10), NewLocalBus(), 3, log.New())
+	for id := 1; id <= 5; id++ {
+		err := s.PublishLot(LotUpdated, lot.Lot{ID: id, CreatorID: 10})
+		require.NoError(t, err)
+	}
+	testCases := []struct {
+		Name     string
+		LastSeq  uint64
+		Topics   []hub.Topic
+		Expected []uint64
+		Reset    bool
+	}{
+		{Name: "New client", LastSeq: 0, Topics: []hub.Topic{hub.Global}},
+		{Name: "Up to date", LastSeq: 5, Topics: []hub.Topic{hub.Global}},
+		{Name: "Missed", LastSeq: 3, Topics: []hub.Topic{hub.Global}, Expected: []uint64{4, 5}},
+		{Name: "Filtered", LastSeq: 2, Topics: []hub.Topic{hub.LotTopic(4)}, Expected: []uint64{4}},
+		{Name: "First retained", LastSeq: 2, Topics: []hub.Topic{hub.UserTopic(10)}, Expected: []uint64{3, 4, 5}},
+		{Name: "Not retained", LastSeq: 1, Topics: []hub.Topic{hub.Global}, Expected: []uint64{3, 4, 5}, Reset: true},
+		{Name: "From the future", LastSeq: 100, Topics: []hub.Topic{hub.Global}, Reset: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			client, missed := s.Subscribe(tc.LastSeq, tc.Topics...)
+			defer s.Hub().Unregister(client)
+			if tc.Reset {
+				r.NotEmpty(missed)
+				r.Equal(Reset, missed[0].Type)
+				r.Equal(uint64(5), missed[0].Seq)
+				missed = missed[1:]
+			}
+			var seqs []uint64
+			for _, e := range missed {
+				seqs = append(seqs, e.Seq)
+			}
+			r.Equal(tc.Expected, seqs)
+		})
+	}
+}
+
+func TestStream_Instances(t *testing.T) {
+	r := require.New(t)
+	bus := NewLocalBus()
+	first := NewStream(hub.New(10), bus, 10, log.New())
+	second := NewStream(hub.New(10), bus, 10, log.New())
+	client := second.Hub().Register(hub.Global)
+	r.NoError(first.PublishLot(LotUpdated, lot.Lot{ID: 1, CreatorID: 2}))
+	r.NoError(second.PublishLot(LotUpdated, lot.Lot{ID: 2, CreatorID: 2}))
+
+	var e Event
+	r.NoError(json.Unmarshal(<-client.Send(), &e))
+	r.Equal(1, e.LotID, "event published by another instance is delivered")
+	r.NoError(json.Unmarshal(<-client.Send(), &e))
+	r.Equal(uint64(2), e.Seq)
+	_, missed := first.Subscribe(1, hub.Global)
+	r.Len(missed, 1)
+	r.Equal(2, missed[0].LotID)
+}
+
+func TestStream_Gap(t *testing.T) {
+	r := require.New(t)
+	s := NewStream(hub.New(10), NewLocalBus(), 10, log.New())
+	s.window = 0
+	for _, seq := range []uint64{1, 2, 5, 6} {
+		s.receive(Event{Version: Version, Type: LotUpdated, Seq: seq, Topics: []hub.Topic{hub.Global}})
+	}
+	_, missed := s.Subscribe(2, hub.Global)
+	r.Equal(Reset, missed[0].Type, "events 3 and 4 are lost")
+	_, missed = s.Subscribe(5, hub.Global)
+	r.Len(missed, 1)
+	r.Equal(uint64(6), missed[0].Seq)
+}
+
+func TestStream_Reorder(t *testing.T) {
+	r := require.New(t)
+	s := NewStream(hub.New(10), NewLocalBus(), 10, log.New())
+	receive := func(seq uint64) {
+		s.receive(Event{Version: Version, Type: LotUpdated, Seq: seq, Topics: []hub.Topic{hub.Global}})
+	}
+	seqs := func(events []Event) []uint64 {
+		var result []uint64
+		for _, e := range events {
+			result = append(result, e.Seq)
+		}
+		return result
+	}
+	receive(1)
+	receive(3)
+	_, missed := s.Subscribe(1, hub.Global)
+	r.Equal([]uint64{3}, seqs(missed), "event 2 is awaited within the reorder window")
+	receive(2)
+	_, missed = s.Subscribe(1, hub.Global)
+	r.Equal([]uint64{2, 3}, seqs(missed))
+
+	s.window = 0
+	receive(5)
+	_, missed = s.Subscribe(3, hub.Global)
+	r.Equal([]uint64{5, 5}, seqs(missed), "event 4 is lost after the reorder window")
+	r.Equal(Reset, missed[0].Type)
+}
@@ -0,0 +1,193 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Topic names a feed clients subscribe to.
+type Topic string
+
+// Global is the feed with every lot event.
+const Global Topic = "all"
+
+const DefaultQueueSize = 64
+
+func LotTopic(id int) Topic {
+	return Topic(fmt.Sprintf("lot:%d", id))
+}
+
+// UserTopic is the feed of lots created or bought by the user.
+func UserTopic(id int) Topic {
+	return Topic(fmt.Sprintf("user:%d", id))
+}
+
+// Hub fans messages out to subscribed clients. Publish never blocks: a client whose queue is full
+// is evicted and its Send channel is closed.
+type Hub struct {
+	mu        sync.RWMutex
+	clients   map[*Client]struct{}
+	queueSize int
+}
+
+type Client struct {
+	send    chan []byte
+	mu      sync.RWMutex
+	topics  map[Topic]bool
+	evicted bool
+}
+
+func New(queueSize int) *Hub {
+	if queueSize < 1 {
+		queueSize = DefaultQueueSize
+	}
+	return &Hub{clients: make(map[*Client]struct{}), queueSize: queueSize}
+}
+
+// Register adds a client subscribed to topics.
+func (h *Hub) Register(topics ...Topic) *Client {
+	c := &Client{send: make(chan []byte, h.queueSize), topics: make(map[Topic]bool)}
+	c.Subscribe(topics...)
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+// Unregister removes the client and closes its Send channel, it is safe to call it several times.
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c)
+}
+
+func (h *Hub) remove(c *Client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	close(c.send)
+}
+
+// Publish sends data once to every client subscribed to any of topics and returns the number of evicted clients.
+func (h *Hub) Publish(data []byte, topics ...Topic) int {
+	var slow []*Client
+	h.mu.RLock()
+	for c := range h.clients {
+		if !c.subscribed(topics) {
+			continue
+		}
+		select {
+		case c.send <- data:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+	if len(slow) == 0 {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range slow {
+		c.mu.Lock()
+		c.evicted = true
+		c.mu.Unlock()
+		h.remove(c)
+	}
+	return len(slow)
+}
+
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// Send returns the queue of the client, it is closed after Unregister or eviction.
+func (c *Client) Send() <-chan []byte {
+	return c.send
+}
+
+// Evicted reports whether the client was dropped for not reading its queue in time.
+func (c *Client) Evicted() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.evicted
+}
+
+func (c *Client) Subscribe(topics ...Topic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range topics {
+		c.topics[t] = true
+	}
+}
+
+func (c *Client) Unsubscribe(topics ...Topic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range topics {
+		delete(c.topics, t)
+	}
+}
+
+func (c *Client) Topics() []Topic {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make([]Topic, 0, len(c.topics))
+	for t := range c.topics {
+		result = append(result, t)
+	}
+	return result
+}
+
+func (c *Client) subscribed(topics []Topic) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, t := range topics {
+		if c.topics[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// Request is a subscription message sent by a client, e.g. {"action": "subscribe", "lots": [1, 2]}.
+type Request struct {
+	Action string `json:"action"`
+	Lots   []int  `json:"lots,omitempty"`
+	Users  []int  `json:"users,omitempty"`
+	All    bool   `json:"all,omitempty"`
+}
+
+func (r Request) Topics() []Topic {
+	var topics []Topic
+	if r.All {
+		topics = append(topics, Global)
+	}
+	for _, id := range r.Lots {
+		topics = append(topics, LotTopic(id))
+	}
+	for _, id := range r.Users {
+		topics = append(topics, UserTopic(id))
+	}
+	return topics
+}
+
+// Apply changes subscriptions of the client.
+func (r Request) Apply(c *Client) error {
+	topics := r.Topics()
+	if len(topics) == 0 {
+		return fmt.Errorf("subscription should contain lots, users or all")
+	}
+	switch r.Action {
+	case "subscribe":
+		c.Subscribe(topics...)
+	case "unsubscribe":
+		c.Unsubscribe(topics...)
+	default:
+		return fmt.Errorf("unknown action %q, use subscribe or unsubscribe", r.Action)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub_Publish(t *testing.T) {
+	r := require.New(t)
+	h := New(4)
+	all := h.Register(Global)
+	lot := h.Register(LotTopic(1))
+	user := h.Register(UserTopic(7), LotTopic(1))
+	none := h.Register()
+
+	r.Equal(0, h.Publish([]byte("first"), Global, LotTopic(1), UserTopic(7)))
+	r.Equal(0, h.Publish([]byte("second"), Global, LotTopic(2)))
+
+	r.Equal([]string{"first", "second"}, drain(all))
+	r.Equal([]string{"first"}, drain(lot))
+	r.Equal([]string{"first"}, drain(user), "message is delivered once for several topics")
+	r.Empty(drain(none))
+
+	h.Unregister(lot)
+	h.Unregister(lot)
+	_, ok := <-lot.Send()
+	r.False(ok)
+	r.False(lot.Evicted())
+	r.Equal(3, h.Len())
+}
+
+func TestHub_SlowConsumer(t *testing.T) {
+	r := require.New(t)
+	h := New(2)
+	slow := h.Register(Global)
+	fast := h.Register(Global)
+	for i := 0; i < 2; i++ {
+		r.Equal(0, h.Publish([]byte("tick"), Global))
+		<-fast.Send()
+	}
+	r.Equal(1, h.Publish([]byte("tick"), Global))
+	r.True(slow.Evicted())
+	r.False(fast.Evicted())
+	r.Equal(1, h.Len())
+	r.Len(drain(slow), 2, "queued messages are kept after eviction")
+	_, ok := <-slow.Send()
+	r.False(ok)
+	h.Unregister(slow)
+}
+
+func TestRequest_Apply(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Request  Request
+		Expected []Topic
+		Error    bool
+	}{
+		{Name: "Lots", Request: Request{Action: "subscribe", Lots: []int{1, 2}}, Expected: []Topic{Global, LotTopic(1), LotTopic(2)}},
+		{Name: "User", Request: Request{Action: "subscribe", Users: []int{3}}, Expected: []Topic{Global, UserTopic(3)}},
+		{Name: "Unsubscribe global", Request: Request{Action: "unsubscribe", All: true}, Expected: []Topic{}},
+		{Name: "Empty", Request: Request{Action: "subscribe"}, Expected: []Topic{Global}, Error: true},
+		{Name: "Unknown action", Request: Request{Action: "listen", All: true}, Expected: []Topic{Global}, Error: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			c := New(1).Register(Global)
+			err := tc.Request.Apply(c)
+			if tc.Error {
+				r.Error(err)
+			} else {
+				r.NoError(err)
+			}
+			r.ElementsMatch(tc.Expected, c.Topics())
+		})
+	}
+}
+
+func drain(c *Client) []string {
+	var result []string
+	for {
+		select {
+		case data, ok := <-c.Send():
+			if !ok {
+				return result
+			}
+			result = append(result, string(data))
+		default:
+			return result
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Revocation denies tokens with the ID or of the session family with the ID until ExpiresAt,
+// when the tokens expire anyway.
+type Revocation struct {
+	ID        string    `json:"id" gorm:"PRIMARY_KEY"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"NOT NULL;index"`
+}
+
+func (Revocation) TableName() string {
+	return "revoked_tokens"
+}
+
+// Store is the part of storage.Storage used by the denylist.
+type Store interface {
+	AddRevocation(r *Revocation) error
+	// GetRevocations returns revocations which are not expired at now.
+	GetRevocations(now time.Time) ([]Revocation, error)
+}
+
+const sessionPrefix = "sid:"
+
+// Denylist keeps revocations in memory, so verification does not touch storage. Revocations of
+// other instances are seen after the next Sync.
+type Denylist struct {
+	store Store
+	mu    sync.RWMutex
+	ids   map[string]time.Time
+}
+
+func NewDenylist(store Store) *Denylist {
+	return &Denylist{store: store, ids: make(map[string]time.Time)}
+}
+
+// RevokeToken denies the token until it expires.
+func (d *Denylist) RevokeToken(c Claims) error {
+	return d.add(c.ID, c.Expires().Add(Leeway))
+}
+
+// RevokeSession denies tokens of the session family, they live no longer than ttl.
+func (d *Denylist) RevokeSession(sessionID string, ttl time.Duration) error {
+	return d.add(sessionPrefix+sessionID, time.Now().Add(ttl+Leeway))
+}
+
+func (d *Denylist) add(id string, until time.Time) error {
+	if err := d.store.AddRevocation(&Revocation{ID: id, ExpiresAt: until}); err != nil {
+		return errors.Wrapf(err, "can't revoke %s", id)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ids[id] = until
+	return nil
+}
+
+func (d *Denylist) Revoked(c Claims) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.ids[c.ID]; ok {
+		return true
+	}
+	if c.SessionID == "" {
+		return false
+	}
+	_, ok := d.ids[sessionPrefix+c.SessionID]
+	return ok
+}
+
+// Sync adds revocations from storage and drops expired ones.
+func (d *Denylist) Sync(now time.Time) error {
+	revocations, err := d.store.GetRevocations(now)
+	if err != nil {
+		return errors.Wrap(err, "can't get revocations")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, until := range d.ids {
+		if !until.After(now) {
+			delete(d.ids, id)
+		}
+	}
+	for _, r := range revocations {
+		d.ids[r.ID] = r.ExpiresAt
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrMalformed  = errors.New("token is malformed")
+	ErrUnknownKey = errors.New("token is signed with unknown key")
+	ErrSignature  = errors.New("token signature is invalid")
+	ErrExpired    = errors.New("token is expired")
+	ErrIssuer     = errors.New("token has wrong issuer")
+)
+
+// Leeway is the allowed clock skew between instances.
+const Leeway = 30 * time.Second
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Claims of an access token. SessionID is the public id of the session family, the token itself
+// can't be used to find the session in storage.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub"`
+	ID        string   `json:"jti"`
+	SessionID string   `json:"sid,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+func (c Claims) UserID() (int, error) {
+	id, err := strconv.Atoi(c.Subject)
+	if err != nil {
+		return 0, errors.Wrap(ErrMalformed, "subject should be user id")
+	}
+	return id, nil
+}
+
+func (c Claims) Expires() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Tokens signs access tokens with the current key of the ring and verifies them locally.
+type Tokens struct {
+	ring   *KeyRing
+	issuer string
+}
+
+func NewTokens(ring *KeyRing, issuer string) *Tokens {
+	return &Tokens{ring: ring, issuer: issuer}
+}
+
+func (t *Tokens) KeyRing() *KeyRing {
+	return t.ring
+}
+
+// Sign sets the issuer and a new ID of the claims and returns the token.
+func (t *Tokens) Sign(c Claims) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "can't generate token id")
+	}
+	c.ID = hex.EncodeToString(id)
+	c.Issuer = t.issuer
+	k := t.ring.Current()
+	h, err := json.Marshal(header{Alg: k.Alg, Typ: "JWT", Kid: k.ID})
+	if err != nil {
+		return "", errors.Wrap(err, "can't marshal header")
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", errors.Wrap(err, "can't marshal claims")
+	}
+	signed := encode(h) + "." + encode(payload)
+	var signature []byte
+	switch k.Alg {
+	case EdDSA:
+		signature = ed25519.Sign(k.private, []byte(signed))
+	default:
+		signature = hs256(k.secret, signed)
+	}
+	return signed + "." + encode(signature), nil
+}
+
+// Parse verifies the token and returns its claims. The algorithm is taken from the key, not from
+// the header, so a public key can't be used as an HS256 secret.
+func (t *Tokens) Parse(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformed
+	}
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return Claims{}, err
+	}
+	k, ok := t.ring.Get(h.Kid)
+	if !ok {
+		return Claims{}, ErrUnknownKey
+	}
+	if h.Alg != k.Alg {
+		return Claims{}, ErrSignature
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	signed := parts[0] + "." + parts[1]
+	switch k.Alg {
+	case EdDSA:
+		ok = ed25519.Verify(k.public, []byte(signed), signature)
+	default:
+		ok = hmac.Equal(signature, hs256(k.secret, signed))
+	}
+	if !ok {
+		return Claims{}, ErrSignature
+	}
+	var c Claims
+	if err = decodeJSON(parts[1], &c); err != nil {
+		return Claims{}, err
+	}
+	if t.issuer != "" && c.Issuer != t.issuer {
+		return Claims{}, ErrIssuer
+	}
+	if !now.Before(c.Expires().Add(Leeway)) {
+		return Claims{}, ErrExpired
+	}
+	if _, err = c.UserID(); err != nil {
+		return Claims{}, err
+	}
+	return c, nil
+}
+
+func hs256(secret []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func edKey(t *testing.T, id string) Key {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return NewEd25519Key(id, private)
+}
+
+func hsKey(t *testing.T, id string) Key {
+	k, err := NewHS256Key(id, []byte(strings.Repeat("s", minSecretLen)))
+	require.NoError(t, err)
+	return k
+}
+
+func TestTokens_Parse(t *testing.T) {
+	now := time.Now()
+	claims := Claims{Subject: "7", SessionID: "family", Roles: []string{"user"}, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()}
+	ed, hs := edKey(t, "ed"), hsKey(t, "hs")
+	ring, err := NewKeyRing("ed", ed, hs)
+	require.NoError(t, err)
+	tokens := NewTokens(ring, "auction")
+	signed, err := tokens.Sign(claims)
+	require.NoError(t, err)
+	parts := strings.Split(signed, ".")
+
+	hsRing, err := NewKeyRing("hs", ed, hs)
+	require.NoError(t, err)
+	hsSigned, err := NewTokens(hsRing, "auction").Sign(claims)
+	require.NoError(t, err)
+	// Public key of "ed" used as HMAC secret with alg swapped.
+	confused := encode([]byte(`{"alg":"HS256","typ":"JWT","kid":"ed"}`)) + "." + parts[1]
+	confused += "." + encode(hs256(ed.public, confused))
+	tampered := parts[0] + "." + encode([]byte(`{"iss":"auction","sub":"1","exp":9999999999}`)) + "." + parts[2]
+	otherRing, err := NewKeyRing("ed", edKey(t, "ed"))
+	require.NoError(t, err)
+	foreign, err := NewTokens(otherRing, "auction").Sign(claims)
+	require.NoError(t, err)
+	unknownRing, err := NewKeyRing("next", edKey(t, "next"))
+	require.NoError(t, err)
+	unknown, err := NewTokens(unknownRing, "auction").Sign(claims)
+	require.NoError(t, err)
+	otherIssuer, err := NewTokens(ring, "other").Sign(claims)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Name  string
+		Token string
+		Now   time.Time
+		Error error
+	}{
+		{Name: "EdDSA", Token: signed, Now: now},
+		{Name: "HS256", Token: hsSigned, Now: now},
+		{Name: "Within leeway", Token: signed, Now: now.Add(time.Minute + Leeway/2)},
+		{Name: "Expired", Token: signed, Now: now.Add(time.Minute + Leeway), Error: ErrExpired},
+		{Name: "Algorithm confusion", Token: confused, Now: now, Error: ErrSignature},
+		{Name: "Tampered claims", Token: tampered, Now: now, Error: ErrSignature},
+		{Name: "Other key with same kid", Token: foreign, Now: now, Error: ErrSignature},
+		{Name: "Unknown kid", Token: unknown, Now: now, Error: ErrUnknownKey},
+		{Name: "Other issuer", Token: otherIssuer, Now: now, Error: ErrIssuer},
+		{Name: "Opaque token", Token: "ex8RYZ5ZbfGGY8EP", Now: now, Error: ErrMalformed},
+		{Name: "Broken header", Token: "e30." + parts[1] + "." + parts[2], Now: now, Error: ErrUnknownKey},
+		{Name: "Not base64", Token: "!." + parts[1] + "." + parts[2], Now: now, Error: ErrMalformed},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			result, err := tokens.Parse(tc.Token, tc.Now)
+			if tc.Error != nil {
+				r.Equal(tc.Error, err)
+				return
+			}
+			r.NoError(err)
+			r.Equal("auction", result.Issuer)
+			r.NotEmpty(result.ID)
+			r.Equal([]string{"user"}, result.Roles)
+			r.Equal("family", result.SessionID)
+			id, err := result.UserID()
+			r.NoError(err)
+			r.Equal(7, id)
+		})
+	}
+}
+
+func TestTokens_SignUniqueID(t *testing.T) {
+	r := require.New(t)
+	ring, err := NewKeyRing("ed", edKey(t, "ed"))
+	r.NoError(err)
+	tokens := NewTokens(ring, "")
+	claims := Claims{Subject: "1", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	first, err := tokens.Sign(claims)
+	r.NoError(err)
+	second, err := tokens.Sign(claims)
+	r.NoError(err)
+	r.NotEqual(first, second)
+	r.Equal(2, strings.Count(first, "."))
+}
+
+func writeKeys(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0600))
+	}
+}
+
+func privatePEM(t *testing.T) ([]byte, ed25519.PublicKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), public
+}
+
+func publicPEM(t *testing.T, public ed25519.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestLoadKeyRing_Rotation(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "keys")
+	r.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	first, firstPublic := privatePEM(t)
+	writeKeys(t, dir, map[string][]byte{"2026-01.pem": first, "README": []byte("not a key")})
+	ring, err := LoadKeyRing(dir, "")
+	r.NoError(err)
+	tokens := NewTokens(ring, "auction")
+	claims := Claims{Subject: "1", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	old, err := tokens.Sign(claims)
+	r.NoError(err)
+
+	second, _ := privatePEM(t)
+	writeKeys(t, dir, map[string][]byte{"2026-02.pem": second, "2025-12.secret": []byte(strings.Repeat("x", minSecretLen) + "\n")})
+	r.NoError(ring.Reload(""))
+	r.Equal("2026-02", ring.Current().ID, "the last kid signs")
+	next, err := tokens.Sign(claims)
+	r.NoError(err)
+	_, err = tokens.Parse(old, time.Now())
+	r.NoError(err, "tokens of the previous key are accepted")
+	_, err = tokens.Parse(next, time.Now())
+	r.NoError(err)
+
+	// The previous key is retired: only the public part is kept.
+	r.NoError(os.Remove(filepath.Join(dir, "2026-01.pem")))
+	writeKeys(t, dir, map[string][]byte{"2026-01.pem": publicPEM(t, firstPublic)})
+	r.NoError(ring.Reload(""))
+	_, err = tokens.Parse(old, time.Now())
+	r.NoError(err)
+	r.Error(ring.Reload("2026-01"), "a public key can't sign")
+	r.Equal("2026-02", ring.Current().ID, "the ring is kept on errors")
+
+	jwks := ring.JWKS()
+	data, err := json.Marshal(jwks)
+	r.NoError(err)
+	r.NotContains(string(data), "2025-12", "secrets are not published")
+	r.Len(jwks.Keys, 2)
+	r.Equal("2026-01", jwks.Keys[0].Kid)
+	x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	r.NoError(err)
+	r.Equal([]byte(firstPublic), x)
+	r.Equal("OKP", jwks.Keys[0].Kty)
+
+	r.NoError(os.Remove(filepath.Join(dir, "2026-01.pem")))
+	r.NoError(ring.Reload(""))
+	_, err = tokens.Parse(old, time.Now())
+	r.Equal(ErrUnknownKey, err, "tokens of removed keys are rejected")
+
+	writeKeys(t, dir, map[string][]byte{"short.secret": []byte("short")})
+	r.Error(ring.Reload(""))
+	_, err = LoadKeyRing(filepath.Join(dir, "missing"), "")
+	r.Error(err)
+}
+
+type memRevocations map[string]Revocation
+
+func (m memRevocations) AddRevocation(r *Revocation) error {
+	m[r.ID] = *r
+	return nil
+}
+
+func (m memRevocations) GetRevocations(now time.Time) ([]Revocation, error) {
+	var result []Revocation
+	for _, r := range m {
+		if r.ExpiresAt.After(now) {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+func TestDenylist(t *testing.T) {
+	r := require.New(t)
+	store := memRevocations{}
+	local, other := NewDenylist(store), NewDenylist(store)
+	now := time.Now()
+	token := Claims{ID: "token", SessionID: "family", ExpiresAt: now.Add(time.Minute).Unix()}
+	sibling := Claims{ID: "sibling", SessionID: "family", ExpiresAt: now.Add(time.Minute).Unix()}
+
+	r.NoError(local.RevokeToken(token))
+	r.True(local.Revoked(token))
+	r.False(local.Revoked(sibling))
+	r.False(other.Revoked(token), "other instances see revocations after sync")
+	r.NoError(other.Sync(now))
+	r.True(other.Revoked(token))
+
+	r.NoError(local.RevokeSession("family", time.Minute))
+	r.True(local.Revoked(sibling), "tokens of the family are revoked")
+	r.False(local.Revoked(Claims{ID: "third", SessionID: "other"}))
+
+	r.NoError(other.Sync(now.Add(time.Hour)))
+	r.False(other.Revoked(token), "expired revocations are dropped")
+	r.Empty(other.ids)
+}
@@ -0,0 +1,231 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	EdDSA = "EdDSA"
+	HS256 = "HS256"
+)
+
+const minSecretLen = 32
+
+// Key signs and verifies tokens with the kid ID. A key without the private part only verifies tokens,
+// it is how retired keys and keys of other issuers are kept.
+type Key struct {
+	ID      string
+	Alg     string
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	secret  []byte
+}
+
+func NewEd25519Key(id string, private ed25519.PrivateKey) Key {
+	return Key{ID: id, Alg: EdDSA, private: private, public: private.Public().(ed25519.PublicKey)}
+}
+
+func NewEd25519PublicKey(id string, public ed25519.PublicKey) Key {
+	return Key{ID: id, Alg: EdDSA, public: public}
+}
+
+func NewHS256Key(id string, secret []byte) (Key, error) {
+	if len(secret) < minSecretLen {
+		return Key{}, fmt.Errorf("secret of key %s should be at least %d bytes", id, minSecretLen)
+	}
+	return Key{ID: id, Alg: HS256, secret: secret}, nil
+}
+
+func (k Key) CanSign() bool {
+	return k.private != nil || k.secret != nil
+}
+
+// KeyRing keeps keys by kid. New tokens are signed with the current key, tokens signed with any key
+// of the ring are accepted, so a key is rotated by adding the next one and removing the old one
+// after tokens signed with it expire.
+type KeyRing struct {
+	mu      sync.RWMutex
+	dir     string
+	current string
+	keys    map[string]Key
+}
+
+func NewKeyRing(current string, keys ...Key) (*KeyRing, error) {
+	r := &KeyRing{}
+	if err := r.set(current, keys); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadKeyRing reads keys from files of dir, the name of a file without the extension is the kid:
+// "<kid>.pem" is an Ed25519 private key (PKCS#8) or public key (PKIX), "<kid>.secret" is an HS256 secret.
+// Without current the signing key is the last one by kid, so kids like dates rotate in order.
+func LoadKeyRing(dir string, current string) (*KeyRing, error) {
+	r := &KeyRing{dir: dir}
+	keys, err := readKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.set(current, keys); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the directory of the ring again, the ring is not changed on errors.
+func (r *KeyRing) Reload(current string) error {
+	if r.dir == "" {
+		return nil
+	}
+	keys, err := readKeys(r.dir)
+	if err != nil {
+		return err
+	}
+	return r.set(current, keys)
+}
+
+func (r *KeyRing) set(current string, keys []Key) error {
+	byID := make(map[string]Key, len(keys))
+	for _, k := range keys {
+		if _, ok := byID[k.ID]; ok {
+			return fmt.Errorf("duplicate key %s", k.ID)
+		}
+		byID[k.ID] = k
+	}
+	if current == "" {
+		for _, k := range keys {
+			if k.CanSign() && k.ID > current {
+				current = k.ID
+			}
+		}
+	}
+	if k, ok := byID[current]; !ok || !k.CanSign() {
+		return fmt.Errorf("signing key %q not found", current)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = current
+	r.keys = byID
+	return nil
+}
+
+func readKeys(dir string) ([]Key, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't read keys from %s", dir)
+	}
+	var result []Key
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(f.Name())
+		if ext != ".pem" && ext != ".secret" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read key %s", f.Name())
+		}
+		id := strings.TrimSuffix(f.Name(), ext)
+		var k Key
+		if ext == ".secret" {
+			k, err = NewHS256Key(id, []byte(strings.TrimSpace(string(data))))
+		} else {
+			k, err = parsePEM(id, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, k)
+	}
+	return result, nil
+}
+
+func parsePEM(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, fmt.Errorf("key %s is not PEM", id)
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return Key{}, errors.Wrapf(err, "can't parse key %s", id)
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return Key{}, fmt.Errorf("key %s is not Ed25519", id)
+		}
+		return NewEd25519Key(id, private), nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return Key{}, errors.Wrapf(err, "can't parse key %s", id)
+		}
+		public, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return Key{}, fmt.Errorf("key %s is not Ed25519", id)
+		}
+		return NewEd25519PublicKey(id, public), nil
+	default:
+		return Key{}, fmt.Errorf("key %s has unknown PEM type %s", id, block.Type)
+	}
+}
+
+func (r *KeyRing) Current() Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[r.current]
+}
+
+func (r *KeyRing) Get(id string) (Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	k, ok := r.keys[id]
+	return k, ok
+}
+
+// JWK is a public key in the form of RFC 8037.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns public keys of the ring, HS256 secrets are never published.
+func (r *KeyRing) JWKS() JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := JWKS{Keys: []JWK{}}
+	for _, k := range r.keys {
+		if k.Alg != EdDSA {
+			continue
+		}
+		result.Keys = append(result.Keys, JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(k.public),
+			Kid: k.ID, Alg: EdDSA, Use: "sig"})
+	}
+	sort.Slice(result.Keys, func(i, j int) bool {
+		return result.Keys[i].Kid < result.Keys[j].Kid
+	})
+	return result
+}
@@ -0,0 +1,135 @@
+package lockout
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Attempts counts failed attempts of a key: an account, a user or an address.
+type Attempts struct {
+	Key           string    `json:"key" gorm:"PRIMARY_KEY"`
+	Failures      int       `json:"failures" gorm:"NOT NULL"`
+	LastFailureAt time.Time `json:"last_failure_at" gorm:"NOT NULL;index"`
+}
+
+func (Attempts) TableName() string {
+	return "login_attempts"
+}
+
+// Store is the part of storage.Storage used by the limiter.
+type Store interface {
+	// AddFailure counts a failure of the key at now and returns its attempts. Failures of a key
+	// without failures after forgetBefore are counted anew.
+	AddFailure(key string, now time.Time, forgetBefore time.Time) (Attempts, error)
+	// GetAttempts returns attempts of the key, a key without failures has zero attempts.
+	GetAttempts(key string) (Attempts, error)
+	ResetAttempts(key string) error
+}
+
+// Policy tells how long attempts of a key are rejected after its failures.
+type Policy struct {
+	// FreeFailures are not followed by a delay.
+	FreeFailures int
+	// Delay follows the first failure after free ones, it doubles with every next failure up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// LockFailures failures lock the key for LockDuration, every next failure locks it again.
+	LockFailures int
+	LockDuration time.Duration
+	// Window forgets failures of a key which fails no more for the window, it should not be shorter
+	// than LockDuration.
+	Window time.Duration
+}
+
+var (
+	DefaultAccountPolicy = Policy{FreeFailures: 3, Delay: time.Second, MaxDelay: time.Minute,
+		LockFailures: 10, LockDuration: 15 * time.Minute, Window: time.Hour}
+	// DefaultAddressPolicy allows more failures, many users may share an address.
+	DefaultAddressPolicy = Policy{FreeFailures: 20, Delay: time.Second, MaxDelay: time.Minute,
+		LockFailures: 100, LockDuration: 15 * time.Minute, Window: time.Hour}
+)
+
+// Until returns the time attempts of the key are rejected until.
+func (p Policy) Until(a Attempts) time.Time {
+	var wait time.Duration
+	switch {
+	case a.Failures >= p.LockFailures && p.LockFailures > 0:
+		wait = p.LockDuration
+	case a.Failures > p.FreeFailures:
+		wait = p.Delay
+		for i := p.FreeFailures + 1; i < a.Failures && wait < p.MaxDelay; i++ {
+			wait *= 2
+		}
+		if wait > p.MaxDelay {
+			wait = p.MaxDelay
+		}
+	}
+	return a.LastFailureAt.Add(wait)
+}
+
+// Limiter counts failures of keys in the store, so the counters are shared by instances.
+type Limiter struct {
+	store  Store
+	policy Policy
+}
+
+func NewLimiter(store Store, policy Policy) *Limiter {
+	return &Limiter{store: store, policy: policy}
+}
+
+func (l *Limiter) wait(a Attempts, now time.Time) time.Duration {
+	if a.Failures == 0 || !now.Before(a.LastFailureAt.Add(l.policy.Window)) {
+		return 0
+	}
+	if wait := l.policy.Until(a).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Wait returns how long attempts of the key are rejected at now.
+func (l *Limiter) Wait(key string, now time.Time) (time.Duration, error) {
+	a, err := l.store.GetAttempts(key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't get attempts of %s", key)
+	}
+	return l.wait(a, now), nil
+}
+
+// Fail counts a failure of the key at now and returns how long next attempts are rejected.
+func (l *Limiter) Fail(key string, now time.Time) (time.Duration, error) {
+	a, err := l.store.AddFailure(key, now, now.Add(-l.policy.Window))
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't count failure of %s", key)
+	}
+	return l.wait(a, now), nil
+}
+
+func (l *Limiter) Reset(key string) error {
+	if err := l.store.ResetAttempts(key); err != nil {
+		return errors.Wrapf(err, "can't reset attempts of %s", key)
+	}
+	return nil
+}
+
+// AccountKey counts password failures by email, so unknown emails are counted like existing ones.
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ResetKey counts password reset requests by email, they send mails to the address.
+func ResetKey(email string) string {
+	return "reset:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// UserKey counts failures of 2FA codes of the user.
+func UserKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func AddressKey(ip string) string {
+	return "ip:" + ip
+}
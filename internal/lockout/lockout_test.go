@@ -0,0 +1,95 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Until(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		Name     string
+		Failures int
+		Wait     time.Duration
+	}{
+		{Name: "No failures", Failures: 0},
+		{Name: "Free failures", Failures: 3},
+		{Name: "First delay", Failures: 4, Wait: time.Second},
+		{Name: "Doubled delay", Failures: 6, Wait: 4 * time.Second},
+		{Name: "Max delay", Failures: 9, Wait: 32 * time.Second},
+		{Name: "Lock", Failures: 10, Wait: 15 * time.Minute},
+		{Name: "Locked again", Failures: 25, Wait: 15 * time.Minute},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			until := DefaultAccountPolicy.Until(Attempts{Failures: tc.Failures, LastFailureAt: now})
+			require.Equal(t, tc.Wait, until.Sub(now))
+		})
+	}
+	capped := Policy{Delay: time.Second, MaxDelay: 5 * time.Second, Window: time.Hour}
+	require.Equal(t, 5*time.Second, capped.Until(Attempts{Failures: 50, LastFailureAt: now}).Sub(now))
+}
+
+type memAttempts map[string]Attempts
+
+func (m memAttempts) AddFailure(key string, now time.Time, forgetBefore time.Time) (Attempts, error) {
+	a := m[key]
+	if !a.LastFailureAt.After(forgetBefore) {
+		a = Attempts{Key: key}
+	}
+	a.Failures++
+	a.LastFailureAt = now
+	m[key] = a
+	return a, nil
+}
+
+func (m memAttempts) GetAttempts(key string) (Attempts, error) {
+	return m[key], nil
+}
+
+func (m memAttempts) ResetAttempts(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	r := require.New(t)
+	store := memAttempts{}
+	limiter := NewLimiter(store, Policy{FreeFailures: 1, Delay: time.Second, MaxDelay: time.Minute,
+		LockFailures: 3, LockDuration: 10 * time.Minute, Window: time.Hour})
+	key := AccountKey(" Durov@Telegram.org")
+	r.Equal("account:durov@telegram.org", key)
+	now := time.Now()
+
+	wait, err := limiter.Fail(key, now)
+	r.NoError(err)
+	r.Zero(wait)
+	wait, err = limiter.Fail(key, now)
+	r.NoError(err)
+	r.Equal(time.Second, wait)
+	wait, err = limiter.Wait(key, now.Add(time.Second))
+	r.NoError(err)
+	r.Zero(wait, "the delay is over")
+	wait, err = limiter.Fail(key, now)
+	r.NoError(err)
+	r.Equal(10*time.Minute, wait, "locked")
+	wait, err = limiter.Wait(key, now.Add(time.Minute))
+	r.NoError(err)
+	r.Equal(9*time.Minute, wait)
+	wait, err = limiter.Wait(AccountKey("other@telegram.org"), now)
+	r.NoError(err)
+	r.Zero(wait, "keys are counted apart")
+
+	wait, err = limiter.Fail(key, now.Add(2*time.Hour))
+	r.NoError(err)
+	r.Zero(wait, "failures out of the window are forgotten")
+	_, err = limiter.Fail(key, now.Add(2*time.Hour))
+	r.NoError(err)
+	r.NoError(limiter.Reset(key))
+	wait, err = limiter.Wait(key, now.Add(2*time.Hour))
+	r.NoError(err)
+	r.Zero(wait)
+}
@@ -1,11 +1,13 @@
 package lot
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
 )
 
 type Status int
@@ -42,20 +44,177 @@ func NewStatus(s string) (Status, error) {
 	}
 }
 
+type Result string
+
+const (
+	Sold          Result = "sold"
+	Unsold        Result = "unsold"
+	ReserveNotMet Result = "reserve_not_met"
+)
+
+// AuctionType defines rules of bidding, they are implemented in the auction package.
+type AuctionType string
+
+const (
+	English           AuctionType = "english"
+	Dutch             AuctionType = "dutch"
+	SealedFirstPrice  AuctionType = "sealed_first_price"
+	SealedSecondPrice AuctionType = "sealed_second_price"
+)
+
 type Lot struct {
-	ID          int        `json:"id" gorm:"PRIMARY_KEY;AUTO_INCREMENT"`
-	Title       string     `json:"title" gorm:"NOT NULL"`
-	Description *string    `json:"description"`
-	MinPrice    float64    `json:"min_price" gorm:"NOT NULL;type:numeric"`
-	PriceStep   float64    `json:"price_step" gorm:"NOT NULL;type:numeric;default:1"`
-	BuyPrice    *float64   `json:"buy_price,omitempty" gorm:"type:numeric"`
-	Status      string     `json:"status" gorm:"NOT NULL;type:lot_status;default:'created'"`
-	EndAt       time.Time  `json:"end_at" gorm:"NOT NULL"`
-	CreatorID   int        `json:"-" gorm:"NOT NULL"`
-	Creator     *user.User `json:"creator" gorm:"-"`
-	BuyerID     *int       `json:"-" gorm:""`
-	Buyer       *user.User `json:"buyer,omitempty" gorm:"-"`
-	CreatedAt   time.Time  `json:"created_at" gorm:"NOT NULL"`
-	UpdatedAt   time.Time  `json:"updated_at" gorm:"NOT NULL"`
-	DeletedAt   *time.Time `json:"-"`
+	ID             int            `json:"id" gorm:"PRIMARY_KEY;AUTO_INCREMENT"`
+	Title          string         `json:"title" gorm:"NOT NULL"`
+	Description    *string        `json:"description"`
+	AuctionType    AuctionType    `json:"auction_type" gorm:"NOT NULL;default:'english'"`
+	Currency       money.Currency `json:"currency" gorm:"NOT NULL;default:'RUB'"`
+	MinPrice       money.Money    `json:"min_price" gorm:"NOT NULL;type:bigint"`
+	PriceStep      money.Money    `json:"price_step" gorm:"NOT NULL;type:bigint;default:100"`
+	StartPrice     *money.Money   `json:"start_price,omitempty" gorm:"type:bigint"`
+	DropInterval   int            `json:"drop_interval,omitempty" gorm:"NOT NULL;default:0"`
+	BuyPrice       *money.Money   `json:"buy_price,omitempty" gorm:"type:bigint"`
+	CurrentPrice   *money.Money   `json:"current_price,omitempty" gorm:"-"`
+	Converted      *Converted     `json:"converted,omitempty" gorm:"-"`
+	ReservePrice   *money.Money   `json:"reserve_price,omitempty" gorm:"type:bigint"`
+	BuyNowPrice    *money.Money   `json:"buy_now_price,omitempty" gorm:"type:bigint"`
+	Status         string         `json:"status" gorm:"NOT NULL;type:lot_status;default:'created'"`
+	Result         Result         `json:"result,omitempty" gorm:""`
+	StartAt        *time.Time     `json:"start_at,omitempty" gorm:"index"`
+	EndAt          time.Time      `json:"end_at" gorm:"NOT NULL"`
+	ExtendWindow   int            `json:"extend_window" gorm:"NOT NULL;default:0"`
+	ExtendDuration int            `json:"extend_duration" gorm:"NOT NULL;default:0"`
+	MaxExtensions  int            `json:"max_extensions" gorm:"NOT NULL;default:0"`
+	Extensions     int            `json:"extensions" gorm:"NOT NULL;default:0"`
+	Extended       bool           `json:"extended,omitempty" gorm:"-"`
+	CreatorID      int            `json:"-" gorm:"NOT NULL"`
+	Creator        *user.User     `json:"creator" gorm:"-"`
+	BuyerID        *int           `json:"-" gorm:""`
+	Buyer          *user.User     `json:"buyer,omitempty" gorm:"-"`
+	CreatedAt      time.Time      `json:"created_at" gorm:"NOT NULL"`
+	UpdatedAt      time.Time      `json:"updated_at" gorm:"NOT NULL"`
+	DeletedAt      *time.Time     `json:"-"`
+	ShowReserve    bool           `json:"-" gorm:"-"` // reveals ReservePrice in JSON to the creator of the lot
+}
+
+// Converted keeps indicative prices in the currency requested by the client.
+type Converted struct {
+	Currency     money.Currency `json:"currency"`
+	MinPrice     money.Money    `json:"min_price"`
+	CurrentPrice *money.Money   `json:"current_price,omitempty"`
+	BuyNowPrice  *money.Money   `json:"buy_now_price,omitempty"`
+}
+
+func (l *Lot) prices() []*money.Money {
+	return []*money.Money{&l.MinPrice, &l.PriceStep, l.StartPrice, l.BuyPrice, l.CurrentPrice, l.ReservePrice, l.BuyNowPrice}
+}
+
+// ResolveCurrency binds prices given without currency to the lot currency and rejects prices
+// in other currencies. Empty Currency becomes money.DefaultCurrency, unset prices stay zero.
+func (l *Lot) ResolveCurrency() error {
+	if l.Currency == "" {
+		l.Currency = money.DefaultCurrency
+	}
+	if !l.Currency.Valid() {
+		return fmt.Errorf("currency should be an ISO 4217 code")
+	}
+	for _, p := range l.prices() {
+		if p == nil || *p == (money.Money{}) {
+			continue
+		}
+		resolved, err := p.Resolve(l.Currency)
+		if err != nil {
+			return err
+		}
+		*p = resolved
+	}
+	return nil
+}
+
+// ApplyCurrency sets the lot currency to all prices, storage keeps prices as minor units only.
+func (l *Lot) ApplyCurrency() {
+	for _, p := range l.prices() {
+		if p != nil {
+			p.Currency = l.Currency
+		}
+	}
+}
+
+func (l *Lot) AfterFind() error {
+	l.ApplyCurrency()
+	return nil
+}
+
+func (l Lot) Validate() error {
+	if l.StartAt != nil && !l.EndAt.IsZero() && !l.StartAt.Before(l.EndAt) {
+		return fmt.Errorf("start_at should be before end_at")
+	}
+	if l.ReservePrice != nil && l.ReservePrice.Less(l.MinPrice) {
+		return fmt.Errorf("reserve_price should not be less than min_price")
+	}
+	if l.BuyNowPrice != nil && l.BuyNowPrice.Less(l.MinPrice) {
+		return fmt.Errorf("buy_now_price should not be less than min_price")
+	}
+	if l.BuyNowPrice != nil && l.ReservePrice != nil && l.BuyNowPrice.Less(*l.ReservePrice) {
+		return fmt.Errorf("buy_now_price should not be less than reserve_price")
+	}
+	if l.ExtendWindow < 0 || l.ExtendDuration < 0 || l.MaxExtensions < 0 {
+		return fmt.Errorf("extend_window, extend_duration and max_extensions should not be negative")
+	}
+	if l.ExtendWindow > 0 && l.ExtendDuration == 0 {
+		return fmt.Errorf("extend_duration should be set with extend_window")
+	}
+	if l.ExtendWindow > 0 && l.MaxExtensions == 0 {
+		return fmt.Errorf("max_extensions should be set with extend_window")
+	}
+	return nil
+}
+
+// Extend moves EndAt forward by ExtendDuration seconds if the bid at the moment now
+// is placed less than ExtendWindow seconds before the end and MaxExtensions is not reached.
+func (l *Lot) Extend(now time.Time) bool {
+	if l.ExtendWindow == 0 || l.Extensions >= l.MaxExtensions {
+		return false
+	}
+	if l.EndAt.Sub(now) > time.Duration(l.ExtendWindow)*time.Second {
+		return false
+	}
+	l.EndAt = l.EndAt.Add(time.Duration(l.ExtendDuration) * time.Second)
+	l.Extensions++
+	l.Extended = true
+	return true
+}
+
+// ReserveMet returns nil if the lot has no reserve price.
+func (l Lot) ReserveMet() *bool {
+	if l.ReservePrice == nil {
+		return nil
+	}
+	met := l.BuyPrice != nil && !l.BuyPrice.Less(*l.ReservePrice)
+	return &met
+}
+
+// FinishResult returns the result of the auction if it was finished right now.
+func (l Lot) FinishResult() Result {
+	switch {
+	case l.BuyerID == nil:
+		return Unsold
+	case l.ReservePrice != nil && (l.BuyPrice == nil || l.BuyPrice.Less(*l.ReservePrice)):
+		return ReserveNotMet
+	default:
+		return Sold
+	}
+}
+
+// MarshalJSON hides the reserve price unless ShowReserve is set, only the fact that it was met is public.
+func (l Lot) MarshalJSON() ([]byte, error) {
+	type alias Lot
+	result := struct {
+		alias
+		ReservePrice *money.Money `json:"reserve_price,omitempty"`
+		ReserveMet   *bool        `json:"reserve_met,omitempty"`
+	}{alias: alias(l), ReserveMet: l.ReserveMet()}
+	if l.ShowReserve {
+		result.ReservePrice = l.ReservePrice
+	}
+	return json.Marshal(result)
 }
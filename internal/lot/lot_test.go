@@ -0,0 +1,85 @@
+package lot
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+func TestLot_MarshalJSON(t *testing.T) {
+	price := func(p int64) *money.Money { m := money.FromMajor(p, money.RUB); return &m }
+	type testCase struct {
+		Name        string
+		Lot         Lot
+		ReserveMet  interface{}
+		ShowReserve bool
+	}
+	testCases := []testCase{
+		{Name: "No reserve", Lot: Lot{ID: 1, MinPrice: money.FromMajor(10, money.RUB), BuyPrice: price(20)}, ReserveMet: nil},
+		{Name: "Reserve not met", Lot: Lot{ID: 1, MinPrice: money.FromMajor(10, money.RUB), BuyPrice: price(20), ReservePrice: price(30)}, ReserveMet: false},
+		{Name: "Reserve without bids", Lot: Lot{ID: 1, MinPrice: money.FromMajor(10, money.RUB), ReservePrice: price(30)}, ReserveMet: false},
+		{Name: "Reserve met", Lot: Lot{ID: 1, MinPrice: money.FromMajor(10, money.RUB), BuyPrice: price(30), ReservePrice: price(30)}, ReserveMet: true},
+		{Name: "Reserve shown", Lot: Lot{ID: 1, MinPrice: money.FromMajor(10, money.RUB), ReservePrice: price(30), ShowReserve: true},
+			ReserveMet: false, ShowReserve: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			data, err := json.Marshal(tc.Lot)
+			r.NoError(err)
+			var result map[string]interface{}
+			r.NoError(json.Unmarshal(data, &result))
+			if tc.ShowReserve {
+				r.Equal(map[string]interface{}{"amount": "30.00", "currency": "RUB"}, result["reserve_price"])
+			} else {
+				r.NotContains(result, "reserve_price")
+			}
+			r.Equal(1.0, result["id"])
+			r.Equal(tc.ReserveMet, result["reserve_met"])
+		})
+	}
+}
+
+func TestLot_FinishResult(t *testing.T) {
+	r := require.New(t)
+	price := func(p int64) *money.Money { m := money.FromMajor(p, money.RUB); return &m }
+	buyer := 1
+	r.Equal(Unsold, Lot{ReservePrice: price(30)}.FinishResult())
+	r.Equal(ReserveNotMet, Lot{BuyerID: &buyer, BuyPrice: price(20), ReservePrice: price(30)}.FinishResult())
+	r.Equal(Sold, Lot{BuyerID: &buyer, BuyPrice: price(30), ReservePrice: price(30)}.FinishResult())
+	r.Equal(Sold, Lot{BuyerID: &buyer, BuyPrice: price(20)}.FinishResult())
+}
+
+func TestLot_ValidateExtend(t *testing.T) {
+	r := require.New(t)
+	end := time.Now().Add(time.Hour)
+	r.NoError(Lot{EndAt: end}.Validate())
+	r.NoError(Lot{EndAt: end, ExtendWindow: 60, ExtendDuration: 120, MaxExtensions: 3}.Validate())
+	r.Error(Lot{EndAt: end, ExtendWindow: 60}.Validate())
+	r.Error(Lot{EndAt: end, ExtendWindow: 60, ExtendDuration: 120}.Validate(), "the lot would never extend")
+	r.Error(Lot{EndAt: end, ExtendWindow: -1}.Validate())
+}
+
+func TestLot_ResolveCurrency(t *testing.T) {
+	r := require.New(t)
+	buyNow := money.New(5000, "")
+	l := Lot{MinPrice: money.New(1000, ""), BuyNowPrice: &buyNow}
+	r.NoError(l.ResolveCurrency())
+	r.Equal(money.DefaultCurrency, l.Currency)
+	r.Equal(money.New(1000, money.RUB), l.MinPrice)
+	r.Equal(money.New(5000, money.RUB), *l.BuyNowPrice)
+	r.True(l.PriceStep.IsZero())
+
+	l = Lot{Currency: money.USD, MinPrice: money.New(1000, money.EUR)}
+	r.Error(l.ResolveCurrency())
+	l = Lot{Currency: "usd", MinPrice: money.New(1000, "")}
+	r.Error(l.ResolveCurrency())
+
+	l = Lot{Currency: money.EUR, MinPrice: money.New(1000, money.RUB)}
+	l.ApplyCurrency()
+	r.Equal(money.New(1000, money.EUR), l.MinPrice)
+}
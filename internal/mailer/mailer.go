@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func (m Message) Check() error {
+	if m.To == "" {
+		return fmt.Errorf("recipient should not be empty")
+	}
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return fmt.Errorf("recipient and subject should not contain line breaks")
+	}
+	return nil
+}
+
+// Mailer sends messages to users.
+type Mailer interface {
+	Send(m Message) error
+}
+
+// SMTP sends messages through a relay, it authenticates with PLAIN when a username is set.
+type SMTP struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTP(addr string, username string, password string, from string) (*SMTP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "smtp address %s should be host:port", addr)
+	}
+	s := &SMTP{addr: addr, from: from}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s, nil
+}
+
+func (s *SMTP) Send(m Message) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+	if err := smtp.SendMail(s.addr, s.auth, s.from, []string{m.To}, format(s.from, m, time.Now())); err != nil {
+		return errors.Wrapf(err, "can't send mail to %s", m.To)
+	}
+	return nil
+}
+
+func format(from string, m Message, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// File appends messages to a file, it is intended for local demos.
+type File struct {
+	mu   sync.Mutex
+	path string
+	from string
+}
+
+func NewFile(path string, from string) *File {
+	return &File{path: path, from: from}
+}
+
+func (f *File) Send(m Message) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s", f.path)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err = file.Write(append(format(f.from, m, time.Now()), "\r\n"...)); err != nil {
+		return errors.Wrapf(err, "can't write %s", f.path)
+	}
+	return nil
+}
+
+// Memory keeps messages for tests.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Send(message Message) error {
+	if err := message.Check(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
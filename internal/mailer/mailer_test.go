@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_Check(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Message Message
+		Error   bool
+	}{
+		{Name: "Valid", Message: Message{To: "user@example.com", Subject: "Сброс пароля", Body: "line\nline"}},
+		{Name: "No recipient", Message: Message{Subject: "subject"}, Error: true},
+		{Name: "Injected header", Message: Message{To: "user@example.com\r\nBcc: other@example.com"}, Error: true},
+		{Name: "Broken subject", Message: Message{To: "user@example.com", Subject: "subject\nBcc: other@example.com"}, Error: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.Message.Check()
+			if tc.Error {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	r := require.New(t)
+	data := string(format("auction@example.com", Message{To: "user@example.com", Subject: "Сброс пароля", Body: "first\nsecond"},
+		time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)))
+	r.Contains(data, "From: auction@example.com\r\n")
+	r.Contains(data, "To: user@example.com\r\n")
+	r.Contains(data, "Subject: =?utf-8?q?")
+	r.Contains(data, "Date: Sun, 18 Oct 2026 12:00:00 +0000\r\n")
+	r.True(strings.HasSuffix(data, "\r\n\r\nfirst\r\nsecond\r\n"))
+}
+
+func TestFile(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "mail")
+	r.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	f := NewFile(filepath.Join(dir, "mail.log"), "auction@example.com")
+	r.NoError(f.Send(Message{To: "first@example.com", Body: "first"}))
+	r.NoError(f.Send(Message{To: "second@example.com", Body: "second"}))
+	r.Error(f.Send(Message{}))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "mail.log"))
+	r.NoError(err)
+	r.Equal(2, strings.Count(string(data), "From: auction@example.com"))
+	r.Contains(string(data), "To: second@example.com")
+}
+
+func TestMemory(t *testing.T) {
+	r := require.New(t)
+	m := NewMemory()
+	r.NoError(m.Send(Message{To: "user@example.com", Body: "body"}))
+	messages := m.Messages()
+	r.Len(messages, 1)
+	messages[0].Body = "changed"
+	r.Equal("body", m.Messages()[0].Body)
+}
@@ -0,0 +1,1245 @@
+package memstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/auction"
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lockout"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/internal/proxybid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/session"
+	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+// MemStore keeps all entities in process memory. It follows the behaviour of database.DataBase
+// and is intended for tests and local demos.
+type MemStore struct {
+	mu          sync.RWMutex
+	users       map[int]user.User
+	sessions    map[string]session.Session
+	lots        map[int]lot.Lot
+	bids        []bid.Bid
+	proxies     []proxybid.ProxyBid
+	webhooks    map[int]webhook.Webhook
+	deliveries  []webhook.Delivery
+	revoked     map[string]jwt.Revocation
+	userTokens  map[string]user.Token
+	attempts    map[string]lockout.Attempts
+	userSeq     int
+	lotSeq      int
+	bidSeq      int
+	proxySeq    int
+	hookSeq     int
+	deliverySeq int
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		users:      make(map[int]user.User),
+		sessions:   make(map[string]session.Session),
+		lots:       make(map[int]lot.Lot),
+		webhooks:   make(map[int]webhook.Webhook),
+		revoked:    make(map[string]jwt.Revocation),
+		userTokens: make(map[string]user.Token),
+		attempts:   make(map[string]lockout.Attempts),
+	}
+}
+
+func (m *MemStore) Migrate() {}
+
+func matchUser(u user.User, c user.User) bool {
+	if c.ID != 0 && u.ID != c.ID {
+		return false
+	}
+	if c.Email != "" && u.Email != c.Email {
+		return false
+	}
+	if c.FirstName != "" && u.FirstName != c.FirstName {
+		return false
+	}
+	if c.LastName != "" && u.LastName != c.LastName {
+		return false
+	}
+	return true
+}
+
+func (m *MemStore) findUser(c user.User) (user.User, bool) {
+	ids := make([]int, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if matchUser(m.users[id], c) {
+			return m.users[id], true
+		}
+	}
+	return user.User{}, false
+}
+
+func (m *MemStore) GetUser(u *user.User) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found, ok := m.findUser(*u)
+	if !ok {
+		return fmt.Errorf("user not found %+v", u)
+	}
+	*u = found
+	return nil
+}
+
+func (m *MemStore) AddUser(u *user.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u.Email == "" || u.Password == "" {
+		return fmt.Errorf("can't create user: email and password are required")
+	}
+	if _, ok := m.findUser(user.User{Email: u.Email}); ok {
+		return fmt.Errorf("can't create user: email %s already exists", u.Email)
+	}
+	m.userSeq++
+	now := time.Now()
+	u.ID = m.userSeq
+	if u.Role == "" {
+		u.Role = user.RoleUser
+	}
+	u.CreatedAt = now
+	u.UpdatedAt = now
+	m.users[u.ID] = *u
+	return nil
+}
+
+func (m *MemStore) UpdateUser(u *user.User, n *user.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.findUser(*u)
+	if !ok {
+		return fmt.Errorf("can't update user: user not found %+v", u)
+	}
+	found.Update(*n)
+	m.users[found.ID] = found
+	*u = found
+	return nil
+}
+
+func (m *MemStore) SetPassword(userID int, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.users[userID]
+	if !ok {
+		return fmt.Errorf("can't set password: user %d not found", userID)
+	}
+	found.Password = hash
+	found.UpdatedAt = time.Now()
+	m.users[userID] = found
+	return nil
+}
+
+func (m *MemStore) VerifyEmail(userID int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.users[userID]
+	if !ok {
+		return fmt.Errorf("can't verify email: user %d not found", userID)
+	}
+	if found.EmailVerifiedAt == nil {
+		found.EmailVerifiedAt = &at
+		m.users[userID] = found
+	}
+	return nil
+}
+
+func (m *MemStore) SetTOTP(userID int, secret string, enabledAt *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.users[userID]
+	if !ok {
+		return fmt.Errorf("can't set totp: user %d not found", userID)
+	}
+	found.TOTPSecret = secret
+	found.TOTPEnabledAt = enabledAt
+	found.UpdatedAt = time.Now()
+	m.users[userID] = found
+	return nil
+}
+
+func (m *MemStore) UseTOTPStep(userID int, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.users[userID]
+	if !ok || found.TOTPLastStep >= step {
+		return user.ErrCodeUsed
+	}
+	found.TOTPLastStep = step
+	m.users[userID] = found
+	return nil
+}
+
+func (m *MemStore) FindUsers(query string, limit int, offset int) ([]user.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]int, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	query = strings.ToLower(query)
+	result := []user.User{}
+	for _, id := range ids {
+		u := m.users[id]
+		if !strings.Contains(strings.ToLower(u.Email), query) && !strings.Contains(strings.ToLower(u.FirstName+" "+u.LastName), query) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if limit >= 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+func (m *MemStore) SetRole(userID int, role user.Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.users[userID]
+	if !ok {
+		return fmt.Errorf("can't set role: user %d not found", userID)
+	}
+	found.Role = role
+	found.UpdatedAt = time.Now()
+	m.users[userID] = found
+	return nil
+}
+
+func (m *MemStore) SetBanned(userID int, bannedAt *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.users[userID]
+	if !ok {
+		return fmt.Errorf("can't set ban: user %d not found", userID)
+	}
+	found.BannedAt = bannedAt
+	found.UpdatedAt = time.Now()
+	m.users[userID] = found
+	return nil
+}
+
+func (m *MemStore) AddUserToken(t *user.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[t.UserID]; !ok {
+		return fmt.Errorf("can't create token: user %d not found", t.UserID)
+	}
+	if _, ok := m.userTokens[t.Hash]; ok {
+		return fmt.Errorf("can't create token: duplicate hash")
+	}
+	m.userTokens[t.Hash] = *t
+	return nil
+}
+
+func (m *MemStore) GetUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found, ok := m.userTokens[hash]
+	if !ok || found.Purpose != purpose || found.UsedAt != nil || !found.ExpiresAt.After(now) {
+		return user.Token{}, fmt.Errorf("token is invalid or expired")
+	}
+	return found, nil
+}
+
+func (m *MemStore) UseUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.userTokens[hash]
+	if !ok || found.Purpose != purpose || found.UsedAt != nil || !found.ExpiresAt.After(now) {
+		return user.Token{}, fmt.Errorf("token is invalid or expired")
+	}
+	found.UsedAt = &now
+	m.userTokens[hash] = found
+	return found, nil
+}
+
+func (m *MemStore) AttemptUserToken(hash string, purpose user.Purpose, now time.Time, maxAttempts int) (user.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.userTokens[hash]
+	if !ok || found.Purpose != purpose || found.UsedAt != nil || !found.ExpiresAt.After(now) || found.Attempts >= maxAttempts {
+		return user.Token{}, fmt.Errorf("token is invalid or expired")
+	}
+	found.Attempts++
+	m.userTokens[hash] = found
+	return found, nil
+}
+
+func (m *MemStore) DeleteUserTokens(userID int, purpose user.Purpose) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, t := range m.userTokens {
+		if t.UserID == userID && t.Purpose == purpose {
+			delete(m.userTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) GetSession(s *session.Session) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found, ok := m.sessions[s.SessionID]
+	if !ok {
+		return fmt.Errorf("session not found %+v", s)
+	}
+	*s = found
+	return nil
+}
+
+func (m *MemStore) AddSession(s *session.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[s.SessionID]; ok {
+		return fmt.Errorf("can't create session: duplicate id")
+	}
+	if _, ok := m.users[s.UserID]; !ok {
+		return fmt.Errorf("can't create session: user %d not found", s.UserID)
+	}
+	m.sessions[s.SessionID] = *s
+	return nil
+}
+
+func (m *MemStore) GetSessions(userID int) ([]session.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	result := []session.Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.RotatedAt == nil && (s.ValidUntil.After(now) || s.RefreshUntil.After(now)) {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+func (m *MemStore) DeleteSession(s *session.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.sessions[s.SessionID]
+	if !ok || found.UserID != s.UserID {
+		return fmt.Errorf("session not found")
+	}
+	delete(m.sessions, s.SessionID)
+	m.deleteFamily(found.FamilyID)
+	return nil
+}
+
+func (m *MemStore) deleteFamily(family string) {
+	if family == "" {
+		return
+	}
+	for id, v := range m.sessions {
+		if v.FamilyID == family {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *MemStore) RotateSession(refreshToken string, next *session.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if refreshToken == "" {
+		return fmt.Errorf("refresh token not found")
+	}
+	var old session.Session
+	found := false
+	for _, v := range m.sessions {
+		if v.RefreshToken == refreshToken {
+			old, found = v, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("refresh token not found")
+	}
+	if old.RotatedAt != nil {
+		m.deleteFamily(old.FamilyID)
+		return session.ErrRefreshReused
+	}
+	now := time.Now()
+	if !old.RefreshUntil.After(now) {
+		return fmt.Errorf("refresh token is expired")
+	}
+	if _, ok := m.sessions[next.SessionID]; ok {
+		return fmt.Errorf("can't create session: duplicate id")
+	}
+	old.RotatedAt = &now
+	if old.ValidUntil.After(now) {
+		old.ValidUntil = now
+	}
+	m.sessions[old.SessionID] = old
+	next.UserID = old.UserID
+	next.FamilyID = old.FamilyID
+	next.CreatedAt = old.CreatedAt
+	m.sessions[next.SessionID] = *next
+	return nil
+}
+
+func (m *MemStore) PurgeSessions(now time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for id, s := range m.sessions {
+		if count == limit {
+			break
+		}
+		if !s.ValidUntil.After(now) && !s.RefreshUntil.After(now) {
+			delete(m.sessions, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemStore) AddRevocation(r *jwt.Revocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if found, ok := m.revoked[r.ID]; ok && found.ExpiresAt.After(r.ExpiresAt) {
+		return nil
+	}
+	m.revoked[r.ID] = *r
+	return nil
+}
+
+func (m *MemStore) GetRevocations(now time.Time) ([]jwt.Revocation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []jwt.Revocation{}
+	for _, r := range m.revoked {
+		if r.ExpiresAt.After(now) {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemStore) PurgeRevocations(now time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for id, r := range m.revoked {
+		if count == limit {
+			break
+		}
+		if !r.ExpiresAt.After(now) {
+			delete(m.revoked, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemStore) AddFailure(key string, now time.Time, forgetBefore time.Time) (lockout.Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.attempts[key]
+	if !ok || !a.LastFailureAt.After(forgetBefore) {
+		a = lockout.Attempts{Key: key}
+	}
+	a.Failures++
+	a.LastFailureAt = now
+	m.attempts[key] = a
+	return a, nil
+}
+
+func (m *MemStore) GetAttempts(key string) (lockout.Attempts, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if a, ok := m.attempts[key]; ok {
+		return a, nil
+	}
+	return lockout.Attempts{Key: key}, nil
+}
+
+func (m *MemStore) ResetAttempts(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+func (m *MemStore) PurgeAttempts(before time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for key, a := range m.attempts {
+		if count == limit {
+			break
+		}
+		if a.LastFailureAt.Before(before) {
+			delete(m.attempts, key)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func isEmptyLot(c lot.Lot) bool {
+	return c.ID == 0 && c.Title == "" && c.Status == "" && c.CreatorID == 0 && c.BuyerID == nil
+}
+
+func matchLot(l lot.Lot, c lot.Lot) bool {
+	if l.DeletedAt != nil {
+		return false
+	}
+	if c.ID != 0 && l.ID != c.ID {
+		return false
+	}
+	if c.Title != "" && l.Title != c.Title {
+		return false
+	}
+	if c.Status != "" && l.Status != c.Status {
+		return false
+	}
+	if c.CreatorID != 0 && l.CreatorID != c.CreatorID {
+		return false
+	}
+	if c.BuyerID != nil && (l.BuyerID == nil || *l.BuyerID != *c.BuyerID) {
+		return false
+	}
+	return true
+}
+
+func (m *MemStore) shortUser(id int) *user.User {
+	u := m.users[id]
+	u.IsShort = true
+	return &u
+}
+
+// attachUsersToLot returns a copy of the lot with its own pointers, so callers can't modify stored data.
+func (m *MemStore) attachUsersToLot(l lot.Lot) lot.Lot {
+	if l.Description != nil {
+		d := *l.Description
+		l.Description = &d
+	}
+	if l.BuyPrice != nil {
+		p := *l.BuyPrice
+		l.BuyPrice = &p
+	}
+	if l.ReservePrice != nil {
+		p := *l.ReservePrice
+		l.ReservePrice = &p
+	}
+	if l.BuyNowPrice != nil {
+		p := *l.BuyNowPrice
+		l.BuyNowPrice = &p
+	}
+	if l.StartPrice != nil {
+		p := *l.StartPrice
+		l.StartPrice = &p
+	}
+	if l.StartAt != nil {
+		start := *l.StartAt
+		l.StartAt = &start
+	}
+	l.Creator = m.shortUser(l.CreatorID)
+	if l.BuyerID != nil {
+		id := *l.BuyerID
+		l.BuyerID = &id
+		l.Buyer = m.shortUser(id)
+	}
+	return l
+}
+
+func (m *MemStore) selectLots(match func(l lot.Lot) bool) []lot.Lot {
+	ids := make([]int, 0, len(m.lots))
+	for id := range m.lots {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var result []lot.Lot
+	for _, id := range ids {
+		if match(m.lots[id]) {
+			result = append(result, m.attachUsersToLot(m.lots[id]))
+		}
+	}
+	return result
+}
+
+func (m *MemStore) GetLots(condition lot.Lot) ([]lot.Lot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.selectLots(func(l lot.Lot) bool { return matchLot(l, condition) }), nil
+}
+
+func (m *MemStore) GetLot(l *lot.Lot) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := m.selectLots(func(v lot.Lot) bool { return matchLot(v, *l) })
+	if len(found) == 0 {
+		return fmt.Errorf("lot not found %+v", l)
+	}
+	*l = found[0]
+	return nil
+}
+
+func (m *MemStore) GetOwnLots(l *lot.Lot, r *lot.Lot) ([]lot.Lot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.selectLots(func(v lot.Lot) bool {
+		return matchLot(v, *l) || (!isEmptyLot(*r) && matchLot(v, *r))
+	}), nil
+}
+
+func validateLot(l lot.Lot) error {
+	if l.MinPrice.Amount < 1 {
+		return fmt.Errorf("min price should be positive")
+	}
+	if l.PriceStep.Amount < 1 {
+		return fmt.Errorf("price step should be positive")
+	}
+	if l.BuyPrice != nil && l.BuyPrice.Less(l.MinPrice) {
+		return fmt.Errorf("buy price should not be less than min price")
+	}
+	if l.BuyerID != nil && *l.BuyerID == l.CreatorID {
+		return fmt.Errorf("creator can't be a buyer")
+	}
+	if l.Extensions > l.MaxExtensions {
+		return fmt.Errorf("extensions should not exceed max extensions")
+	}
+	if l.EndAt.Before(l.CreatedAt) {
+		return fmt.Errorf("end time should not be before creation time")
+	}
+	if err := auction.Validate(l); err != nil {
+		return err
+	}
+	if _, err := lot.NewStatus(l.Status); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MemStore) AddLot(l *lot.Lot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[l.CreatorID]; !ok {
+		return fmt.Errorf("can't create lot: creator %d not found", l.CreatorID)
+	}
+	n := *l
+	now := time.Now()
+	n.CreatedAt = now
+	n.UpdatedAt = now
+	if n.Status == "" {
+		n.Status = lot.Created.String()
+	}
+	if err := n.ResolveCurrency(); err != nil {
+		return fmt.Errorf("can't create lot: %s", err)
+	}
+	if n.PriceStep.IsZero() {
+		n.PriceStep = money.FromMajor(1, n.Currency)
+	}
+	if n.AuctionType == "" {
+		n.AuctionType = lot.English
+	}
+	if err := validateLot(n); err != nil {
+		return fmt.Errorf("can't create lot: %s", err)
+	}
+	m.lotSeq++
+	n.ID = m.lotSeq
+	n.Creator, n.Buyer = nil, nil
+	n.Extensions, n.Extended = 0, false
+	n.Result = ""
+	m.lots[n.ID] = n
+	*l = m.attachUsersToLot(n)
+	return nil
+}
+
+func (m *MemStore) UpdateLot(n *lot.Lot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.lots[n.ID]
+	if !ok || l.DeletedAt != nil {
+		return fmt.Errorf("lot not found %+v", n)
+	}
+	if n.Currency != "" {
+		if err := n.ResolveCurrency(); err != nil {
+			return fmt.Errorf("can't update lot: %s", err)
+		}
+		l.Currency = n.Currency
+	}
+	if n.Title != "" {
+		l.Title = n.Title
+	}
+	if n.Description != nil {
+		d := *n.Description
+		l.Description = &d
+	}
+	if !n.MinPrice.IsZero() {
+		l.MinPrice = n.MinPrice
+	}
+	if !n.PriceStep.IsZero() {
+		l.PriceStep = n.PriceStep
+	}
+	if n.Status != "" {
+		l.Status = strings.ToLower(n.Status)
+	}
+	if n.ReservePrice != nil {
+		p := *n.ReservePrice
+		l.ReservePrice = &p
+	}
+	if n.BuyNowPrice != nil {
+		p := *n.BuyNowPrice
+		l.BuyNowPrice = &p
+	}
+	if n.AuctionType != "" {
+		l.AuctionType = n.AuctionType
+	}
+	if n.StartPrice != nil {
+		p := *n.StartPrice
+		l.StartPrice = &p
+	}
+	if n.DropInterval != 0 {
+		l.DropInterval = n.DropInterval
+	}
+	if n.StartAt != nil {
+		start := *n.StartAt
+		l.StartAt = &start
+	}
+	if !n.EndAt.IsZero() {
+		l.EndAt = n.EndAt
+	}
+	if n.ExtendWindow != 0 {
+		l.ExtendWindow = n.ExtendWindow
+	}
+	if n.ExtendDuration != 0 {
+		l.ExtendDuration = n.ExtendDuration
+	}
+	if n.MaxExtensions != 0 {
+		l.MaxExtensions = n.MaxExtensions
+	}
+	l.ApplyCurrency()
+	l.UpdatedAt = time.Now()
+	if err := validateLot(l); err != nil {
+		return fmt.Errorf("can't update lot: %s", err)
+	}
+	m.lots[l.ID] = l
+	*n = m.attachUsersToLot(l)
+	return nil
+}
+
+func (m *MemStore) DeleteLot(l *lot.Lot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for id, v := range m.lots {
+		if matchLot(v, *l) {
+			v.DeletedAt = &now
+			m.lots[id] = v
+			count++
+		}
+	}
+	if count == 0 {
+		return fmt.Errorf("lot not found")
+	}
+	return nil
+}
+
+// notify calls n with the lot changed by a bid, memstore has no transactions, so events are published at once.
+func notify(n storage.Notify, l lot.Lot) error {
+	if n == nil {
+		return nil
+	}
+	return n(l, nil)
+}
+
+func (m *MemStore) BuyLot(id int, owner int, price money.Money, n storage.Notify) (lot.Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.lots[id]
+	if !ok || l.DeletedAt != nil {
+		return lot.Lot{}, fmt.Errorf("can't buy lot %d: lot not found", id)
+	}
+	strategy, err := auction.New(l.AuctionType)
+	if err != nil {
+		return lot.Lot{}, fmt.Errorf("can't buy lot: %s", err)
+	}
+	if price, err = price.Resolve(l.Currency); err != nil {
+		return lot.Lot{}, fmt.Errorf("can't buy lot: %s", err)
+	}
+	now := time.Now()
+	b := bid.Bid{LotID: id, BuyerID: owner, Price: price, CreatedAt: now}
+	if err = strategy.CheckBid(l, b, now); err != nil {
+		return lot.Lot{}, fmt.Errorf("can't buy lot: %s", err)
+	}
+	if _, ok := m.users[owner]; !ok {
+		return lot.Lot{}, fmt.Errorf("can't buy lot: user %d not found", owner)
+	}
+	if strategy.Sealed() {
+		for _, v := range m.bids {
+			if v.LotID == id && v.BuyerID == owner {
+				return lot.Lot{}, fmt.Errorf("can't buy lot, you have already placed a sealed bid")
+			}
+		}
+	}
+	bids, bidSeq := len(m.bids), m.bidSeq
+	strategy.Accept(&l, &b, now)
+	m.bidSeq++
+	b.ID = m.bidSeq
+	m.bids = append(m.bids, b)
+	if l.AuctionType == lot.English {
+		m.resolveProxyBids(&l, strategy, now)
+	}
+	extended := l.Extended
+	l.Extended = false
+	result := m.attachUsersToLot(l)
+	result.Extended = extended
+	if err = notify(n, result); err != nil {
+		m.bids, m.bidSeq = m.bids[:bids], bidSeq
+		return lot.Lot{}, fmt.Errorf("can't publish bid: %s", err)
+	}
+	m.lots[id] = l
+	return result, nil
+}
+
+func (m *MemStore) BuyNow(id int, owner int, n storage.Notify) (lot.Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.lots[id]
+	now := time.Now()
+	if !ok || l.DeletedAt != nil ||
+		l.Status != lot.Active.String() ||
+		!l.EndAt.After(now) ||
+		l.AuctionType != lot.English ||
+		l.CreatorID == owner ||
+		l.BuyNowPrice == nil ||
+		(l.BuyPrice != nil && !l.BuyPrice.Less(*l.BuyNowPrice)) {
+		return lot.Lot{}, fmt.Errorf("can't buy lot now, check lot status, owner and buy now price")
+	}
+	if _, ok := m.users[owner]; !ok {
+		return lot.Lot{}, fmt.Errorf("can't buy lot now: user %d not found", owner)
+	}
+	price, buyer := *l.BuyNowPrice, owner
+	l.BuyPrice = &price
+	l.BuyerID = &buyer
+	l.Status = lot.Finished.String()
+	l.Result = lot.Sold
+	result := m.attachUsersToLot(l)
+	if err := notify(n, result); err != nil {
+		return lot.Lot{}, fmt.Errorf("can't publish bid: %s", err)
+	}
+	m.lots[id] = l
+	m.bidSeq++
+	m.bids = append(m.bids, bid.Bid{ID: m.bidSeq, LotID: id, BuyerID: owner, Price: price, CreatedAt: now})
+	return result, nil
+}
+
+func (m *MemStore) CloseLots() ([]lot.Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var closed []lot.Lot
+	for id, l := range m.lots {
+		if l.DeletedAt != nil || l.Status != lot.Active.String() || !l.EndAt.Before(now) {
+			continue
+		}
+		strategy, err := auction.New(l.AuctionType)
+		if err != nil {
+			return closed, fmt.Errorf("can't close lot %d: %s", id, err)
+		}
+		var bids []bid.Bid
+		for _, b := range m.bids {
+			if b.LotID == id {
+				bids = append(bids, b)
+			}
+		}
+		strategy.Finish(&l, bids)
+		m.lots[id] = l
+		closed = append(closed, m.attachUsersToLot(l))
+	}
+	return closed, nil
+}
+
+func (m *MemStore) FinishLot(id int) (lot.Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.lots[id]
+	if !ok || l.DeletedAt != nil || l.Status == lot.Finished.String() {
+		return lot.Lot{}, fmt.Errorf("can't finish lot %d: lot not found", id)
+	}
+	strategy, err := auction.New(l.AuctionType)
+	if err != nil {
+		return lot.Lot{}, fmt.Errorf("can't finish lot %d: %s", id, err)
+	}
+	var bids []bid.Bid
+	for _, b := range m.bids {
+		if b.LotID == id {
+			bids = append(bids, b)
+		}
+	}
+	strategy.Finish(&l, bids)
+	l.EndAt = time.Now()
+	m.lots[id] = l
+	return m.attachUsersToLot(l), nil
+}
+
+func (m *MemStore) ActivateLots() ([]lot.Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var result []lot.Lot
+	for id, l := range m.lots {
+		if l.DeletedAt == nil && l.Status == lot.Created.String() && l.StartAt != nil && !l.StartAt.After(now) {
+			l.Status = lot.Active.String()
+			m.lots[id] = l
+			result = append(result, m.attachUsersToLot(l))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (m *MemStore) PublishLot(id int, owner int) (lot.Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.lots[id]
+	if !ok || l.DeletedAt != nil ||
+		l.Status != lot.Created.String() ||
+		l.CreatorID != owner ||
+		!l.EndAt.After(time.Now()) {
+		return lot.Lot{}, fmt.Errorf("can't publish lot, check lot status, owner and end time")
+	}
+	now := time.Now()
+	l.Status = lot.Active.String()
+	l.StartAt = &now
+	m.lots[id] = l
+	return m.attachUsersToLot(l), nil
+}
+
+func (m *MemStore) AddBid(b *bid.Bid) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.lots[b.LotID]; !ok || l.DeletedAt != nil {
+		return fmt.Errorf("can't create bid: lot %d not found", b.LotID)
+	}
+	if _, ok := m.users[b.BuyerID]; !ok {
+		return fmt.Errorf("can't create bid: user %d not found", b.BuyerID)
+	}
+	if b.Price.Amount < 1 {
+		return fmt.Errorf("can't create bid: price should be positive")
+	}
+	m.bidSeq++
+	b.ID = m.bidSeq
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = time.Now()
+	}
+	b.Buyer = nil
+	m.bids = append(m.bids, *b)
+	b.Buyer = m.shortUser(b.BuyerID)
+	return nil
+}
+
+func (m *MemStore) GetBids(condition bid.Bid, limit int, offset int) ([]bid.Bid, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.selectBids(func(b bid.Bid) bool {
+		return (condition.LotID == 0 || b.LotID == condition.LotID) && (condition.BuyerID == 0 || b.BuyerID == condition.BuyerID)
+	}, limit, offset), nil
+}
+
+func (m *MemStore) GetVisibleBids(buyerID int, limit int, offset int) ([]bid.Bid, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.selectBids(func(b bid.Bid) bool {
+		l, ok := m.lots[b.LotID]
+		return b.BuyerID == buyerID && ok && l.DeletedAt == nil && auction.BidsVisible(l)
+	}, limit, offset), nil
+}
+
+// selectBids returns a page of matched bids, newest first. It should be called under the lock.
+func (m *MemStore) selectBids(match func(b bid.Bid) bool, limit int, offset int) []bid.Bid {
+	var selected []bid.Bid
+	for i := len(m.bids) - 1; i >= 0; i-- {
+		if match(m.bids[i]) {
+			selected = append(selected, m.bids[i])
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].CreatedAt.After(selected[j].CreatedAt)
+	})
+	if offset >= len(selected) {
+		return []bid.Bid{}
+	}
+	selected = selected[offset:]
+	if limit >= 0 && limit < len(selected) {
+		selected = selected[:limit]
+	}
+	result := make([]bid.Bid, len(selected))
+	for i, b := range selected {
+		b.Buyer = m.shortUser(b.BuyerID)
+		result[i] = b
+	}
+	return result
+}
+
+// resolveProxyBids places bids on behalf of proxies and accepts them like manual bids, so they extend the lot.
+func (m *MemStore) resolveProxyBids(l *lot.Lot, strategy auction.Strategy, now time.Time) {
+	for _, step := range proxybid.Resolve(*l, m.proxies) {
+		m.bidSeq++
+		b := bid.Bid{ID: m.bidSeq, LotID: l.ID, BuyerID: step.UserID, Price: step.Price, Auto: true, CreatedAt: now}
+		strategy.Accept(l, &b, now)
+		m.bids = append(m.bids, b)
+	}
+}
+
+func (m *MemStore) SetMaxBid(p *proxybid.ProxyBid, n storage.Notify) (lot.Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	l, ok := m.lots[p.LotID]
+	if !ok || l.DeletedAt != nil || l.Status != lot.Active.String() || l.AuctionType != lot.English || !l.EndAt.After(now) {
+		return lot.Lot{}, fmt.Errorf("can't set max bid, check lot status")
+	}
+	if _, ok := m.users[p.UserID]; !ok {
+		return lot.Lot{}, fmt.Errorf("can't set max bid: user %d not found", p.UserID)
+	}
+	maxPrice, err := p.MaxPrice.Resolve(l.Currency)
+	if err != nil {
+		return lot.Lot{}, fmt.Errorf("can't set max bid: %s", err)
+	}
+	p.MaxPrice = maxPrice
+	if err := p.Check(l); err != nil {
+		return lot.Lot{}, fmt.Errorf("can't set max bid: %s", err)
+	}
+	proxies, bids, bidSeq := append([]proxybid.ProxyBid(nil), m.proxies...), len(m.bids), m.bidSeq
+	found := false
+	for i, v := range m.proxies {
+		if v.LotID == p.LotID && v.UserID == p.UserID {
+			m.proxies[i].MaxPrice = p.MaxPrice
+			m.proxies[i].UpdatedAt = now
+			*p = m.proxies[i]
+			found = true
+		}
+	}
+	if !found {
+		m.proxySeq++
+		p.ID = m.proxySeq
+		p.CreatedAt = now
+		p.UpdatedAt = now
+		m.proxies = append(m.proxies, *p)
+	}
+	strategy, err := auction.New(l.AuctionType)
+	if err != nil {
+		return lot.Lot{}, fmt.Errorf("can't set max bid: %s", err)
+	}
+	m.resolveProxyBids(&l, strategy, now)
+	extended := l.Extended
+	l.Extended = false
+	result := m.attachUsersToLot(l)
+	result.Extended = extended
+	if err = notify(n, result); err != nil {
+		m.proxies, m.bids, m.bidSeq = proxies, m.bids[:bids], bidSeq
+		return lot.Lot{}, fmt.Errorf("can't publish bid: %s", err)
+	}
+	m.lots[l.ID] = l
+	return result, nil
+}
+
+func copyWebhook(w webhook.Webhook) webhook.Webhook {
+	w.Events = append([]string(nil), w.Events...)
+	return w
+}
+
+func (m *MemStore) AddWebhook(w *webhook.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[w.UserID]; !ok {
+		return fmt.Errorf("can't create webhook: user %d not found", w.UserID)
+	}
+	now := time.Now()
+	m.hookSeq++
+	w.ID = m.hookSeq
+	w.CreatedAt = now
+	w.UpdatedAt = now
+	m.webhooks[w.ID] = copyWebhook(*w)
+	return nil
+}
+
+func (m *MemStore) GetWebhook(w *webhook.Webhook) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found, ok := m.webhooks[w.ID]
+	if !ok || (w.UserID != 0 && found.UserID != w.UserID) {
+		return fmt.Errorf("webhook not found %+v", w)
+	}
+	*w = copyWebhook(found)
+	return nil
+}
+
+func (m *MemStore) GetWebhooks(condition webhook.Webhook) ([]webhook.Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []webhook.Webhook{}
+	for _, w := range m.webhooks {
+		if condition.UserID != 0 && w.UserID != condition.UserID {
+			continue
+		}
+		if condition.Active && !w.Active {
+			continue
+		}
+		result = append(result, copyWebhook(w))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (m *MemStore) UpdateWebhook(n *webhook.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.webhooks[n.ID]
+	if !ok || w.UserID != n.UserID {
+		return fmt.Errorf("webhook not found %+v", n)
+	}
+	w.URL = n.URL
+	w.Events = n.Events
+	w.Active = n.Active
+	w.Failures = n.Failures
+	w.DisabledAt = n.DisabledAt
+	w.UpdatedAt = time.Now()
+	m.webhooks[w.ID] = copyWebhook(w)
+	*n = copyWebhook(w)
+	return nil
+}
+
+func (m *MemStore) DeleteWebhook(w *webhook.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found, ok := m.webhooks[w.ID]
+	if !ok || found.UserID != w.UserID {
+		return fmt.Errorf("webhook not found")
+	}
+	delete(m.webhooks, w.ID)
+	deliveries := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.WebhookID != w.ID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	m.deliveries = deliveries
+	return nil
+}
+
+func (m *MemStore) RecordWebhookResult(id int, success bool, maxFailures int) (webhook.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.webhooks[id]
+	if !ok {
+		return webhook.Webhook{}, fmt.Errorf("webhook not found %d", id)
+	}
+	now := time.Now()
+	if success {
+		w.Failures = 0
+	} else {
+		w.Failures++
+		if w.Active && w.Failures >= maxFailures {
+			w.Active = false
+			w.DisabledAt = &now
+		}
+	}
+	w.UpdatedAt = now
+	m.webhooks[id] = w
+	return copyWebhook(w), nil
+}
+
+func (m *MemStore) AddDelivery(d *webhook.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[d.WebhookID]; !ok {
+		return fmt.Errorf("can't create delivery: webhook %d not found", d.WebhookID)
+	}
+	m.deliverySeq++
+	d.ID = m.deliverySeq
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	m.deliveries = append(m.deliveries, *d)
+	return nil
+}
+
+func (m *MemStore) GetDeliveries(condition webhook.Delivery, limit int, offset int) ([]webhook.Delivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var selected []webhook.Delivery
+	for i := len(m.deliveries) - 1; i >= 0; i-- {
+		d := m.deliveries[i]
+		if condition.WebhookID != 0 && d.WebhookID != condition.WebhookID {
+			continue
+		}
+		if condition.Status != "" && d.Status != condition.Status {
+			continue
+		}
+		selected = append(selected, d)
+	}
+	if offset >= len(selected) {
+		return []webhook.Delivery{}, nil
+	}
+	selected = selected[offset:]
+	if limit >= 0 && limit < len(selected) {
+		selected = selected[:limit]
+	}
+	return selected, nil
+}
+
+func (m *MemStore) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]webhook.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []int
+	for i, d := range m.deliveries {
+		if d.Status == webhook.Pending && !d.NextAttemptAt.After(now) {
+			due = append(due, i)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return m.deliveries[due[i]].NextAttemptAt.Before(m.deliveries[due[j]].NextAttemptAt)
+	})
+	if limit < len(due) {
+		due = due[:limit]
+	}
+	result := make([]webhook.Delivery, 0, len(due))
+	for _, i := range due {
+		m.deliveries[i].NextAttemptAt = now.Add(lease)
+		result = append(result, m.deliveries[i])
+	}
+	return result, nil
+}
+
+func (m *MemStore) UpdateDelivery(d *webhook.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, v := range m.deliveries {
+		if v.ID == d.ID {
+			d.CreatedAt = v.CreatedAt
+			d.WebhookID = v.WebhookID
+			m.deliveries[i] = *d
+			return nil
+		}
+	}
+	return fmt.Errorf("delivery not found %d", d.ID)
+}
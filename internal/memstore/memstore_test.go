@@ -0,0 +1,14 @@
+package memstore
+
+import (
+	"testing"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/storagetest"
+)
+
+func TestMemStore_Conformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+		return NewMemStore()
+	})
+}
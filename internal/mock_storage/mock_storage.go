@@ -6,10 +6,18 @@ package mock_storage
 
 import (
 	gomock "github.com/golang/mock/gomock"
+	bid "gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	jwt "gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	lockout "gitlab.com/asciishell/tfs-go-auction/internal/lockout"
 	lot "gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	proxybid "gitlab.com/asciishell/tfs-go-auction/internal/proxybid"
 	session "gitlab.com/asciishell/tfs-go-auction/internal/session"
+	storage "gitlab.com/asciishell/tfs-go-auction/internal/storage"
 	user "gitlab.com/asciishell/tfs-go-auction/internal/user"
+	webhook "gitlab.com/asciishell/tfs-go-auction/internal/webhook"
+	money "gitlab.com/asciishell/tfs-go-auction/pkg/money"
 	reflect "reflect"
+	time "time"
 )
 
 // MockStorage is a mock of Storage interface
@@ -89,6 +97,178 @@ func (mr *MockStorageMockRecorder) UpdateUser(u, n interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUser", reflect.TypeOf((*MockStorage)(nil).UpdateUser), u, n)
 }
 
+// SetPassword mocks base method
+func (m *MockStorage) SetPassword(userID int, hash string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetPassword", userID, hash)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetPassword indicates an expected call of SetPassword
+func (mr *MockStorageMockRecorder) SetPassword(userID, hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPassword", reflect.TypeOf((*MockStorage)(nil).SetPassword), userID, hash)
+}
+
+// VerifyEmail mocks base method
+func (m *MockStorage) VerifyEmail(userID int, at time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "VerifyEmail", userID, at)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// VerifyEmail indicates an expected call of VerifyEmail
+func (mr *MockStorageMockRecorder) VerifyEmail(userID, at interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyEmail", reflect.TypeOf((*MockStorage)(nil).VerifyEmail), userID, at)
+}
+
+// SetTOTP mocks base method
+func (m *MockStorage) SetTOTP(userID int, secret string, enabledAt *time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTOTP", userID, secret, enabledAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTOTP indicates an expected call of SetTOTP
+func (mr *MockStorageMockRecorder) SetTOTP(userID, secret, enabledAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTOTP", reflect.TypeOf((*MockStorage)(nil).SetTOTP), userID, secret, enabledAt)
+}
+
+// UseTOTPStep mocks base method
+func (m *MockStorage) UseTOTPStep(userID int, step int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseTOTPStep", userID, step)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseTOTPStep indicates an expected call of UseTOTPStep
+func (mr *MockStorageMockRecorder) UseTOTPStep(userID, step interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseTOTPStep", reflect.TypeOf((*MockStorage)(nil).UseTOTPStep), userID, step)
+}
+
+// FindUsers mocks base method
+func (m *MockStorage) FindUsers(query string, limit, offset int) ([]user.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindUsers", query, limit, offset)
+	ret0, _ := ret[0].([]user.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindUsers indicates an expected call of FindUsers
+func (mr *MockStorageMockRecorder) FindUsers(query, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindUsers", reflect.TypeOf((*MockStorage)(nil).FindUsers), query, limit, offset)
+}
+
+// SetRole mocks base method
+func (m *MockStorage) SetRole(userID int, role user.Role) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetRole", userID, role)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetRole indicates an expected call of SetRole
+func (mr *MockStorageMockRecorder) SetRole(userID, role interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRole", reflect.TypeOf((*MockStorage)(nil).SetRole), userID, role)
+}
+
+// SetBanned mocks base method
+func (m *MockStorage) SetBanned(userID int, bannedAt *time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetBanned", userID, bannedAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetBanned indicates an expected call of SetBanned
+func (mr *MockStorageMockRecorder) SetBanned(userID, bannedAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBanned", reflect.TypeOf((*MockStorage)(nil).SetBanned), userID, bannedAt)
+}
+
+// AddUserToken mocks base method
+func (m *MockStorage) AddUserToken(t *user.Token) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddUserToken", t)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddUserToken indicates an expected call of AddUserToken
+func (mr *MockStorageMockRecorder) AddUserToken(t interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddUserToken", reflect.TypeOf((*MockStorage)(nil).AddUserToken), t)
+}
+
+// GetUserToken mocks base method
+func (m *MockStorage) GetUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserToken", hash, purpose, now)
+	ret0, _ := ret[0].(user.Token)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserToken indicates an expected call of GetUserToken
+func (mr *MockStorageMockRecorder) GetUserToken(hash, purpose, now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserToken", reflect.TypeOf((*MockStorage)(nil).GetUserToken), hash, purpose, now)
+}
+
+// UseUserToken mocks base method
+func (m *MockStorage) UseUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseUserToken", hash, purpose, now)
+	ret0, _ := ret[0].(user.Token)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UseUserToken indicates an expected call of UseUserToken
+func (mr *MockStorageMockRecorder) UseUserToken(hash, purpose, now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseUserToken", reflect.TypeOf((*MockStorage)(nil).UseUserToken), hash, purpose, now)
+}
+
+// AttemptUserToken mocks base method
+func (m *MockStorage) AttemptUserToken(hash string, purpose user.Purpose, now time.Time, maxAttempts int) (user.Token, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AttemptUserToken", hash, purpose, now, maxAttempts)
+	ret0, _ := ret[0].(user.Token)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AttemptUserToken indicates an expected call of AttemptUserToken
+func (mr *MockStorageMockRecorder) AttemptUserToken(hash, purpose, now, maxAttempts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AttemptUserToken", reflect.TypeOf((*MockStorage)(nil).AttemptUserToken), hash, purpose, now, maxAttempts)
+}
+
+// DeleteUserTokens mocks base method
+func (m *MockStorage) DeleteUserTokens(userID int, purpose user.Purpose) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUserTokens", userID, purpose)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUserTokens indicates an expected call of DeleteUserTokens
+func (mr *MockStorageMockRecorder) DeleteUserTokens(userID, purpose interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUserTokens", reflect.TypeOf((*MockStorage)(nil).DeleteUserTokens), userID, purpose)
+}
+
 // GetSession mocks base method
 func (m *MockStorage) GetSession(s *session.Session) error {
 	m.ctrl.T.Helper()
@@ -117,6 +297,167 @@ func (mr *MockStorageMockRecorder) AddSession(s interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSession", reflect.TypeOf((*MockStorage)(nil).AddSession), s)
 }
 
+// GetSessions mocks base method
+func (m *MockStorage) GetSessions(userID int) ([]session.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSessions", userID)
+	ret0, _ := ret[0].([]session.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSessions indicates an expected call of GetSessions
+func (mr *MockStorageMockRecorder) GetSessions(userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSessions", reflect.TypeOf((*MockStorage)(nil).GetSessions), userID)
+}
+
+// DeleteSession mocks base method
+func (m *MockStorage) DeleteSession(s *session.Session) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteSession", s)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteSession indicates an expected call of DeleteSession
+func (mr *MockStorageMockRecorder) DeleteSession(s interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSession", reflect.TypeOf((*MockStorage)(nil).DeleteSession), s)
+}
+
+// RotateSession mocks base method
+func (m *MockStorage) RotateSession(refreshToken string, next *session.Session) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateSession", refreshToken, next)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RotateSession indicates an expected call of RotateSession
+func (mr *MockStorageMockRecorder) RotateSession(refreshToken, next interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateSession", reflect.TypeOf((*MockStorage)(nil).RotateSession), refreshToken, next)
+}
+
+// PurgeSessions mocks base method
+func (m *MockStorage) PurgeSessions(now time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeSessions", now, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeSessions indicates an expected call of PurgeSessions
+func (mr *MockStorageMockRecorder) PurgeSessions(now, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeSessions", reflect.TypeOf((*MockStorage)(nil).PurgeSessions), now, limit)
+}
+
+// AddRevocation mocks base method
+func (m *MockStorage) AddRevocation(r *jwt.Revocation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddRevocation", r)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddRevocation indicates an expected call of AddRevocation
+func (mr *MockStorageMockRecorder) AddRevocation(r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddRevocation", reflect.TypeOf((*MockStorage)(nil).AddRevocation), r)
+}
+
+// GetRevocations mocks base method
+func (m *MockStorage) GetRevocations(now time.Time) ([]jwt.Revocation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRevocations", now)
+	ret0, _ := ret[0].([]jwt.Revocation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRevocations indicates an expected call of GetRevocations
+func (mr *MockStorageMockRecorder) GetRevocations(now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRevocations", reflect.TypeOf((*MockStorage)(nil).GetRevocations), now)
+}
+
+// PurgeRevocations mocks base method
+func (m *MockStorage) PurgeRevocations(now time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeRevocations", now, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeRevocations indicates an expected call of PurgeRevocations
+func (mr *MockStorageMockRecorder) PurgeRevocations(now, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeRevocations", reflect.TypeOf((*MockStorage)(nil).PurgeRevocations), now, limit)
+}
+
+// AddFailure mocks base method
+func (m *MockStorage) AddFailure(key string, now, forgetBefore time.Time) (lockout.Attempts, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddFailure", key, now, forgetBefore)
+	ret0, _ := ret[0].(lockout.Attempts)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddFailure indicates an expected call of AddFailure
+func (mr *MockStorageMockRecorder) AddFailure(key, now, forgetBefore interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddFailure", reflect.TypeOf((*MockStorage)(nil).AddFailure), key, now, forgetBefore)
+}
+
+// GetAttempts mocks base method
+func (m *MockStorage) GetAttempts(key string) (lockout.Attempts, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAttempts", key)
+	ret0, _ := ret[0].(lockout.Attempts)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAttempts indicates an expected call of GetAttempts
+func (mr *MockStorageMockRecorder) GetAttempts(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttempts", reflect.TypeOf((*MockStorage)(nil).GetAttempts), key)
+}
+
+// ResetAttempts mocks base method
+func (m *MockStorage) ResetAttempts(key string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetAttempts", key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetAttempts indicates an expected call of ResetAttempts
+func (mr *MockStorageMockRecorder) ResetAttempts(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetAttempts", reflect.TypeOf((*MockStorage)(nil).ResetAttempts), key)
+}
+
+// PurgeAttempts mocks base method
+func (m *MockStorage) PurgeAttempts(before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeAttempts", before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeAttempts indicates an expected call of PurgeAttempts
+func (mr *MockStorageMockRecorder) PurgeAttempts(before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeAttempts", reflect.TypeOf((*MockStorage)(nil).PurgeAttempts), before, limit)
+}
+
 // GetLots mocks base method
 func (m *MockStorage) GetLots(condition lot.Lot) ([]lot.Lot, error) {
 	m.ctrl.T.Helper()
@@ -162,18 +503,33 @@ func (mr *MockStorageMockRecorder) GetOwnLots(l, r interface{}) *gomock.Call {
 }
 
 // BuyLot mocks base method
-func (m *MockStorage) BuyLot(id, owner, price int) (lot.Lot, error) {
+func (m *MockStorage) BuyLot(id, owner int, price money.Money, notify storage.Notify) (lot.Lot, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "BuyLot", id, owner, price)
+	ret := m.ctrl.Call(m, "BuyLot", id, owner, price, notify)
 	ret0, _ := ret[0].(lot.Lot)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // BuyLot indicates an expected call of BuyLot
-func (mr *MockStorageMockRecorder) BuyLot(id, owner, price interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) BuyLot(id, owner, price, notify interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BuyLot", reflect.TypeOf((*MockStorage)(nil).BuyLot), id, owner, price)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BuyLot", reflect.TypeOf((*MockStorage)(nil).BuyLot), id, owner, price, notify)
+}
+
+// BuyNow mocks base method
+func (m *MockStorage) BuyNow(id, owner int, notify storage.Notify) (lot.Lot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BuyNow", id, owner, notify)
+	ret0, _ := ret[0].(lot.Lot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BuyNow indicates an expected call of BuyNow
+func (mr *MockStorageMockRecorder) BuyNow(id, owner, notify interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BuyNow", reflect.TypeOf((*MockStorage)(nil).BuyNow), id, owner, notify)
 }
 
 // AddLot mocks base method
@@ -219,10 +575,10 @@ func (mr *MockStorageMockRecorder) DeleteLot(l interface{}) *gomock.Call {
 }
 
 // CloseLots mocks base method
-func (m *MockStorage) CloseLots() (int, error) {
+func (m *MockStorage) CloseLots() ([]lot.Lot, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "CloseLots")
-	ret0, _ := ret[0].(int)
+	ret0, _ := ret[0].([]lot.Lot)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -232,3 +588,251 @@ func (mr *MockStorageMockRecorder) CloseLots() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseLots", reflect.TypeOf((*MockStorage)(nil).CloseLots))
 }
+
+// FinishLot mocks base method
+func (m *MockStorage) FinishLot(id int) (lot.Lot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishLot", id)
+	ret0, _ := ret[0].(lot.Lot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FinishLot indicates an expected call of FinishLot
+func (mr *MockStorageMockRecorder) FinishLot(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishLot", reflect.TypeOf((*MockStorage)(nil).FinishLot), id)
+}
+
+// ActivateLots mocks base method
+func (m *MockStorage) ActivateLots() ([]lot.Lot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ActivateLots")
+	ret0, _ := ret[0].([]lot.Lot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ActivateLots indicates an expected call of ActivateLots
+func (mr *MockStorageMockRecorder) ActivateLots() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ActivateLots", reflect.TypeOf((*MockStorage)(nil).ActivateLots))
+}
+
+// PublishLot mocks base method
+func (m *MockStorage) PublishLot(id, owner int) (lot.Lot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishLot", id, owner)
+	ret0, _ := ret[0].(lot.Lot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PublishLot indicates an expected call of PublishLot
+func (mr *MockStorageMockRecorder) PublishLot(id, owner interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishLot", reflect.TypeOf((*MockStorage)(nil).PublishLot), id, owner)
+}
+
+// AddBid mocks base method
+func (m *MockStorage) AddBid(b *bid.Bid) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddBid", b)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddBid indicates an expected call of AddBid
+func (mr *MockStorageMockRecorder) AddBid(b interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddBid", reflect.TypeOf((*MockStorage)(nil).AddBid), b)
+}
+
+// GetBids mocks base method
+func (m *MockStorage) GetBids(condition bid.Bid, limit, offset int) ([]bid.Bid, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBids", condition, limit, offset)
+	ret0, _ := ret[0].([]bid.Bid)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBids indicates an expected call of GetBids
+func (mr *MockStorageMockRecorder) GetBids(condition, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBids", reflect.TypeOf((*MockStorage)(nil).GetBids), condition, limit, offset)
+}
+
+// GetVisibleBids mocks base method
+func (m *MockStorage) GetVisibleBids(buyerID, limit, offset int) ([]bid.Bid, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetVisibleBids", buyerID, limit, offset)
+	ret0, _ := ret[0].([]bid.Bid)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetVisibleBids indicates an expected call of GetVisibleBids
+func (mr *MockStorageMockRecorder) GetVisibleBids(buyerID, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVisibleBids", reflect.TypeOf((*MockStorage)(nil).GetVisibleBids), buyerID, limit, offset)
+}
+
+// SetMaxBid mocks base method
+func (m *MockStorage) SetMaxBid(p *proxybid.ProxyBid, notify storage.Notify) (lot.Lot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetMaxBid", p, notify)
+	ret0, _ := ret[0].(lot.Lot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetMaxBid indicates an expected call of SetMaxBid
+func (mr *MockStorageMockRecorder) SetMaxBid(p, notify interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMaxBid", reflect.TypeOf((*MockStorage)(nil).SetMaxBid), p, notify)
+}
+
+// AddWebhook mocks base method
+func (m *MockStorage) AddWebhook(w *webhook.Webhook) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddWebhook", w)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddWebhook indicates an expected call of AddWebhook
+func (mr *MockStorageMockRecorder) AddWebhook(w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddWebhook", reflect.TypeOf((*MockStorage)(nil).AddWebhook), w)
+}
+
+// GetWebhook mocks base method
+func (m *MockStorage) GetWebhook(w *webhook.Webhook) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWebhook", w)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// GetWebhook indicates an expected call of GetWebhook
+func (mr *MockStorageMockRecorder) GetWebhook(w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWebhook", reflect.TypeOf((*MockStorage)(nil).GetWebhook), w)
+}
+
+// GetWebhooks mocks base method
+func (m *MockStorage) GetWebhooks(condition webhook.Webhook) ([]webhook.Webhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWebhooks", condition)
+	ret0, _ := ret[0].([]webhook.Webhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetWebhooks indicates an expected call of GetWebhooks
+func (mr *MockStorageMockRecorder) GetWebhooks(condition interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWebhooks", reflect.TypeOf((*MockStorage)(nil).GetWebhooks), condition)
+}
+
+// UpdateWebhook mocks base method
+func (m *MockStorage) UpdateWebhook(n *webhook.Webhook) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateWebhook", n)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateWebhook indicates an expected call of UpdateWebhook
+func (mr *MockStorageMockRecorder) UpdateWebhook(n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateWebhook", reflect.TypeOf((*MockStorage)(nil).UpdateWebhook), n)
+}
+
+// DeleteWebhook mocks base method
+func (m *MockStorage) DeleteWebhook(w *webhook.Webhook) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteWebhook", w)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteWebhook indicates an expected call of DeleteWebhook
+func (mr *MockStorageMockRecorder) DeleteWebhook(w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteWebhook", reflect.TypeOf((*MockStorage)(nil).DeleteWebhook), w)
+}
+
+// RecordWebhookResult mocks base method
+func (m *MockStorage) RecordWebhookResult(id int, success bool, maxFailures int) (webhook.Webhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordWebhookResult", id, success, maxFailures)
+	ret0, _ := ret[0].(webhook.Webhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecordWebhookResult indicates an expected call of RecordWebhookResult
+func (mr *MockStorageMockRecorder) RecordWebhookResult(id, success, maxFailures interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordWebhookResult", reflect.TypeOf((*MockStorage)(nil).RecordWebhookResult), id, success, maxFailures)
+}
+
+// AddDelivery mocks base method
+func (m *MockStorage) AddDelivery(d *webhook.Delivery) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddDelivery", d)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddDelivery indicates an expected call of AddDelivery
+func (mr *MockStorageMockRecorder) AddDelivery(d interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddDelivery", reflect.TypeOf((*MockStorage)(nil).AddDelivery), d)
+}
+
+// GetDeliveries mocks base method
+func (m *MockStorage) GetDeliveries(condition webhook.Delivery, limit, offset int) ([]webhook.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeliveries", condition, limit, offset)
+	ret0, _ := ret[0].([]webhook.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeliveries indicates an expected call of GetDeliveries
+func (mr *MockStorageMockRecorder) GetDeliveries(condition, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeliveries", reflect.TypeOf((*MockStorage)(nil).GetDeliveries), condition, limit, offset)
+}
+
+// ClaimDeliveries mocks base method
+func (m *MockStorage) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]webhook.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimDeliveries", now, lease, limit)
+	ret0, _ := ret[0].([]webhook.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimDeliveries indicates an expected call of ClaimDeliveries
+func (mr *MockStorageMockRecorder) ClaimDeliveries(now, lease, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimDeliveries", reflect.TypeOf((*MockStorage)(nil).ClaimDeliveries), now, lease, limit)
+}
+
+// UpdateDelivery mocks base method
+func (m *MockStorage) UpdateDelivery(d *webhook.Delivery) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateDelivery", d)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateDelivery indicates an expected call of UpdateDelivery
+func (mr *MockStorageMockRecorder) UpdateDelivery(d interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDelivery", reflect.TypeOf((*MockStorage)(nil).UpdateDelivery), d)
+}
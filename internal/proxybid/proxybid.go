@@ -0,0 +1,134 @@
+package proxybid
+
+import (
+	"fmt"
+	"time"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+// ProxyBid is a maximum amount the user is ready to pay for the lot. The system bids on the user's behalf
+// in price_step increments only as much as needed to stay on top.
+type ProxyBid struct {
+	ID        int            `json:"id" gorm:"PRIMARY_KEY;AUTO_INCREMENT"`
+	LotID     int            `json:"lot_id" gorm:"NOT NULL;unique_index:proxy_bids_lot_user"`
+	UserID    int            `json:"-" gorm:"NOT NULL;unique_index:proxy_bids_lot_user"`
+	MaxPrice  money.Money    `json:"max_price" gorm:"NOT NULL;type:bigint"`
+	Currency  money.Currency `json:"-" gorm:"NOT NULL;default:'RUB'"`
+	CreatedAt time.Time      `json:"created_at" gorm:"NOT NULL"`
+	UpdatedAt time.Time      `json:"updated_at" gorm:"NOT NULL"`
+}
+
+// BeforeSave and AfterFind keep the currency of the max price in its own column.
+func (p *ProxyBid) BeforeSave() error {
+	p.Currency = p.MaxPrice.Currency
+	return nil
+}
+
+func (p *ProxyBid) AfterFind() error {
+	p.MaxPrice.Currency = p.Currency
+	return nil
+}
+
+// Step is a bid placed by the system on behalf of UserID.
+type Step struct {
+	UserID int
+	Price  money.Money
+}
+
+// limit returns the highest valid price (min_price + n*price_step) not greater than max.
+func limit(l lot.Lot, max money.Money) money.Money {
+	if max.Less(l.MinPrice) {
+		return money.New(-1, l.MinPrice.Currency)
+	}
+	return l.MinPrice.Add(l.PriceStep.Mul(max.Sub(l.MinPrice).Amount / l.PriceStep.Amount))
+}
+
+func next(l lot.Lot, price *money.Money) money.Money {
+	if price == nil {
+		return l.MinPrice
+	}
+	return price.Add(l.PriceStep)
+}
+
+func (p ProxyBid) Check(l lot.Lot) error {
+	if p.UserID == l.CreatorID {
+		return fmt.Errorf("creator can't bid on own lot")
+	}
+	if !p.MaxPrice.SameCurrency(l.MinPrice) {
+		return fmt.Errorf("max price should be in %s", l.MinPrice.Currency)
+	}
+	if l.BuyerID != nil && *l.BuyerID == p.UserID {
+		if p.MaxPrice.Less(*l.BuyPrice) {
+			return fmt.Errorf("max price should not be less than your current bid %v", *l.BuyPrice)
+		}
+		return nil
+	}
+	if required := next(l, l.BuyPrice); limit(l, p.MaxPrice).Less(required) {
+		return fmt.Errorf("max price should be at least %v", required)
+	}
+	return nil
+}
+
+// Resolve returns bids that proxies have to place after the current state of the lot.
+// Proxies should be ordered by creation time: on equal ceilings the current leader keeps the lot,
+// otherwise the earliest proxy wins.
+func Resolve(l lot.Lot, proxies []ProxyBid) []Step {
+	var steps []Step
+	var price *money.Money
+	var leader *int
+	if l.BuyPrice != nil {
+		p := *l.BuyPrice
+		price = &p
+	}
+	if l.BuyerID != nil {
+		id := *l.BuyerID
+		leader = &id
+	}
+	place := func(userID int, p money.Money) {
+		steps = append(steps, Step{UserID: userID, Price: p})
+		price = &p
+	}
+	for {
+		required := next(l, price)
+		challenger, leaderProxy := -1, -1
+		for i, p := range proxies {
+			if p.LotID != l.ID || p.UserID == l.CreatorID {
+				continue
+			}
+			if leader != nil && p.UserID == *leader {
+				leaderProxy = i
+				continue
+			}
+			current := limit(l, p.MaxPrice)
+			if !current.Less(required) && (challenger == -1 || limit(l, proxies[challenger].MaxPrice).Less(current)) {
+				challenger = i
+			}
+		}
+		if challenger == -1 {
+			return steps
+		}
+		challengerLimit := limit(l, proxies[challenger].MaxPrice)
+		if leaderProxy != -1 && !limit(l, proxies[leaderProxy].MaxPrice).Less(challengerLimit) {
+			leaderLimit := limit(l, proxies[leaderProxy].MaxPrice)
+			challengerPrice := challengerLimit
+			if leaderLimit.Cmp(challengerLimit) == 0 {
+				challengerPrice = challengerPrice.Sub(l.PriceStep)
+			}
+			if !challengerPrice.Less(required) {
+				place(proxies[challenger].UserID, challengerPrice)
+			}
+			place(*leader, money.Min(next(l, price), leaderLimit))
+			continue
+		}
+		if leaderProxy != -1 {
+			if leaderLimit := limit(l, proxies[leaderProxy].MaxPrice); !leaderLimit.Less(required) {
+				place(*leader, leaderLimit)
+			}
+		}
+		id := proxies[challenger].UserID
+		place(id, next(l, price))
+		leader = &id
+	}
+}
@@ -0,0 +1,95 @@
+package proxybid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+func TestResolve(t *testing.T) {
+	price := func(p int64) *money.Money { m := rub(p); return &m }
+	buyer := func(id int) *int { return &id }
+	type testCase struct {
+		Name     string
+		Lot      lot.Lot
+		Proxies  []ProxyBid
+		Expected []Step
+	}
+	base := lot.Lot{ID: 1, MinPrice: rub(10), PriceStep: rub(5), CreatorID: 100}
+	withBid := base
+	withBid.BuyPrice = price(20)
+	withBid.BuyerID = buyer(1)
+	testCases := []testCase{
+		{Name: "No proxies", Lot: withBid},
+		{Name: "Single proxy takes min price",
+			Lot:      base,
+			Proxies:  []ProxyBid{{LotID: 1, UserID: 2, MaxPrice: rub(100)}},
+			Expected: []Step{{UserID: 2, Price: rub(10)}}},
+		{Name: "Single proxy outbids manual bid",
+			Lot:      withBid,
+			Proxies:  []ProxyBid{{LotID: 1, UserID: 2, MaxPrice: rub(100)}},
+			Expected: []Step{{UserID: 2, Price: rub(25)}}},
+		{Name: "Proxy below next price",
+			Lot:     withBid,
+			Proxies: []ProxyBid{{LotID: 1, UserID: 2, MaxPrice: rub(24)}}},
+		{Name: "Creator proxy ignored",
+			Lot:     withBid,
+			Proxies: []ProxyBid{{LotID: 1, UserID: 100, MaxPrice: rub(100)}}},
+		{Name: "Leader proxy defends",
+			Lot:      withBid,
+			Proxies:  []ProxyBid{{LotID: 1, UserID: 1, MaxPrice: rub(100)}, {LotID: 1, UserID: 2, MaxPrice: rub(50)}},
+			Expected: []Step{{UserID: 2, Price: rub(50)}, {UserID: 1, Price: rub(55)}}},
+		{Name: "Leader proxy defends up to its limit",
+			Lot:      withBid,
+			Proxies:  []ProxyBid{{LotID: 1, UserID: 1, MaxPrice: rub(53)}, {LotID: 1, UserID: 2, MaxPrice: rub(49)}},
+			Expected: []Step{{UserID: 2, Price: rub(45)}, {UserID: 1, Price: rub(50)}}},
+		{Name: "Leader keeps lot on equal limits",
+			Lot:      withBid,
+			Proxies:  []ProxyBid{{LotID: 1, UserID: 1, MaxPrice: rub(50)}, {LotID: 1, UserID: 2, MaxPrice: rub(50)}},
+			Expected: []Step{{UserID: 2, Price: rub(45)}, {UserID: 1, Price: rub(50)}}},
+		{Name: "Challenger beats leader proxy",
+			Lot:      withBid,
+			Proxies:  []ProxyBid{{LotID: 1, UserID: 1, MaxPrice: rub(40)}, {LotID: 1, UserID: 2, MaxPrice: rub(100)}},
+			Expected: []Step{{UserID: 1, Price: rub(40)}, {UserID: 2, Price: rub(45)}}},
+		{Name: "Several challengers",
+			Lot: withBid,
+			Proxies: []ProxyBid{
+				{LotID: 1, UserID: 2, MaxPrice: rub(30)},
+				{LotID: 1, UserID: 3, MaxPrice: rub(60)},
+				{LotID: 1, UserID: 4, MaxPrice: rub(40)},
+			},
+			Expected: []Step{{UserID: 3, Price: rub(25)}, {UserID: 4, Price: rub(40)}, {UserID: 3, Price: rub(45)}}},
+		{Name: "Earliest proxy wins on equal limits",
+			Lot: base,
+			Proxies: []ProxyBid{
+				{LotID: 1, UserID: 2, MaxPrice: rub(30)},
+				{LotID: 1, UserID: 3, MaxPrice: rub(30)},
+			},
+			Expected: []Step{{UserID: 2, Price: rub(10)}, {UserID: 3, Price: rub(25)}, {UserID: 2, Price: rub(30)}}},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			r.Equal(tc.Expected, Resolve(tc.Lot, tc.Proxies))
+		})
+	}
+}
+
+func TestProxyBid_Check(t *testing.T) {
+	r := require.New(t)
+	p := rub(20)
+	id := 1
+	l := lot.Lot{ID: 1, MinPrice: rub(10), PriceStep: rub(5), CreatorID: 100, BuyPrice: &p, BuyerID: &id}
+	r.Error(ProxyBid{LotID: 1, UserID: 100, MaxPrice: rub(100)}.Check(l))
+	r.Error(ProxyBid{LotID: 1, UserID: 2, MaxPrice: rub(24)}.Check(l))
+	r.NoError(ProxyBid{LotID: 1, UserID: 2, MaxPrice: rub(25)}.Check(l))
+	r.Error(ProxyBid{LotID: 1, UserID: 1, MaxPrice: rub(15)}.Check(l))
+	r.NoError(ProxyBid{LotID: 1, UserID: 1, MaxPrice: rub(20)}.Check(l))
+}
+
+func rub(v int64) money.Money {
+	return money.FromMajor(v, money.RUB)
+}
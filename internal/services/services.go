@@ -3,8 +3,12 @@ package services
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"gitlab.com/asciishell/tfs-go-auction/internal/auction"
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lockout"
 	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
 
 	"gitlab.com/asciishell/tfs-go-auction/internal/errs"
@@ -12,19 +16,24 @@ import (
 	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
 
 	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/totp"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/pkg/errors"
 	"gitlab.com/asciishell/tfs-go-auction/internal/session"
 )
 
-func Registry(u *user.User, storage *storage.Storage) error {
+func Registry(u *user.User, policy user.PasswordPolicy, storage *storage.Storage) error {
 	if u.ID != 0 {
 		return fmt.Errorf("user seems have been alredy registered %v", u)
 	}
 	if u.Email == "" || u.Password == "" {
 		return errs.ErrEmptyCredits
 	}
+	if err := policy.Check(u.Password, u.Email); err != nil {
+		return err
+	}
 	hash, err := user.HashPassword(u.Password)
 	if err != nil {
 		return errors.Wrapf(err, "can't hash password %s", u.Password)
@@ -37,15 +46,35 @@ func Registry(u *user.User, storage *storage.Storage) error {
 	return nil
 }
 
+var dummyHash struct {
+	once sync.Once
+	hash []byte
+}
+
+// dummyPasswordHash is compared with passwords of unknown emails.
+func dummyPasswordHash() []byte {
+	dummyHash.once.Do(func() {
+		dummyHash.hash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	return dummyHash.hash
+}
+
+// FindUserByEmail returns errs.ErrWrongCredentials both for unknown emails and wrong passwords. A password
+// is compared with a hash even for an unknown email, so the response time doesn't tell whether the email exists.
 func FindUserByEmail(email string, password string, storage *storage.Storage) (*user.User, error) {
 	u := user.User{Email: email}
-	if err := (*storage).GetUser(&u); err != nil {
-		return nil, fmt.Errorf("user not found %s", email)
+	if email == "" || (*storage).GetUser(&u) != nil {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, errs.ErrWrongCredentials
 	}
-	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil {
-		return &u, nil
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return nil, errs.ErrWrongCredentials
 	}
-	return nil, fmt.Errorf("wrong password for %s", email)
+	// The ban is reported only with the right password, so it does not reveal the account.
+	if u.Banned() {
+		return nil, errs.ErrBanned
+	}
+	return &u, nil
 }
 
 func FindUserByID(id int, storage *storage.Storage) (*user.User, error) {
@@ -56,19 +85,233 @@ func FindUserByID(id int, storage *storage.Storage) (*user.User, error) {
 	return &u, nil
 }
 
-func NewSession(userID int, storage *storage.Storage) (session.Session, error) {
-
+// issueTokens returns a session with new access and refresh tokens.
+func issueTokens(ip string, userAgent string) (session.Session, error) {
 	token, err := session.GenerateToken()
 	if err != nil {
 		return session.Session{}, errors.Wrapf(err, "can't generate token")
 	}
-	result := session.Session{SessionID: token, UserID: userID, CreatedAt: time.Now(), ValidUntil: time.Now().Add(session.TokenLifeTime)}
+	refresh, err := session.GenerateToken()
+	if err != nil {
+		return session.Session{}, errors.Wrapf(err, "can't generate refresh token")
+	}
+	now := time.Now()
+	return session.Session{SessionID: token, CreatedAt: now, ValidUntil: now.Add(session.AccessTokenLifeTime),
+		RefreshToken: refresh, RefreshUntil: now.Add(session.RefreshTokenLifeTime), IP: ip, UserAgent: userAgent}, nil
+}
+
+func NewSession(userID int, ip string, userAgent string, storage *storage.Storage) (session.Session, error) {
+	result, err := issueTokens(ip, userAgent)
+	if err != nil {
+		return session.Session{}, err
+	}
+	result.UserID = userID
+	result.FamilyID = result.SessionID
 	if err = (*storage).AddSession(&result); err != nil {
 		return session.Session{}, errors.Wrapf(err, "can't add session to database")
 	}
 	return result, nil
 }
 
+// RefreshSession exchanges the refresh token for a new session of the same family.
+func RefreshSession(refreshToken string, ip string, userAgent string, storage storage.Storage) (session.Session, error) {
+	result, err := issueTokens(ip, userAgent)
+	if err != nil {
+		return session.Session{}, err
+	}
+	if err = storage.RotateSession(refreshToken, &result); err != nil {
+		return session.Session{}, err
+	}
+	return result, nil
+}
+
+// IssueUserToken stores a new token of the user and returns the token to send.
+func IssueUserToken(userID int, purpose user.Purpose, lifeTime time.Duration, storage storage.Storage) (string, error) {
+	plain, token, err := user.NewToken(userID, purpose, lifeTime)
+	if err != nil {
+		return "", err
+	}
+	if err = storage.AddUserToken(&token); err != nil {
+		return "", errors.Wrapf(err, "can't add %s token", purpose)
+	}
+	return plain, nil
+}
+
+// ResetPassword sets the password of the user the reset token was sent to. The token came by email,
+// so the email is verified too. The token is used only after the password passes the policy.
+func ResetPassword(plain string, password string, policy user.PasswordPolicy, storage storage.Storage) (int, error) {
+	tokenHash := user.TokenHash(plain)
+	token, err := storage.GetUserToken(tokenHash, user.PasswordReset, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	u := user.User{ID: token.UserID}
+	if err = storage.GetUser(&u); err != nil {
+		return 0, errors.Wrapf(err, "can't get user %d", token.UserID)
+	}
+	if err = policy.Check(password, u.Email); err != nil {
+		return 0, err
+	}
+	if token, err = storage.UseUserToken(tokenHash, user.PasswordReset, time.Now()); err != nil {
+		return 0, err
+	}
+	hash, err := user.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+	if err = storage.SetPassword(token.UserID, hash); err != nil {
+		return 0, errors.Wrap(err, "can't reset password")
+	}
+	if err = storage.VerifyEmail(token.UserID, time.Now()); err != nil {
+		return 0, errors.Wrap(err, "can't verify email")
+	}
+	return token.UserID, nil
+}
+
+// ChangePassword sets the password of the user if the current one is right.
+func ChangePassword(userID int, current string, password string, policy user.PasswordPolicy, storage storage.Storage) error {
+	u := user.User{ID: userID}
+	if err := storage.GetUser(&u); err != nil {
+		return errors.Wrapf(err, "can't get user %d", userID)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(current)) != nil {
+		return errs.ErrWrongPassword
+	}
+	if current == password {
+		return user.PolicyError("password should differ from the current one")
+	}
+	if err := policy.Check(password, u.Email); err != nil {
+		return err
+	}
+	hash, err := user.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err = storage.SetPassword(userID, hash); err != nil {
+		return errors.Wrap(err, "can't change password")
+	}
+	return nil
+}
+
+func VerifyEmail(plain string, storage storage.Storage) (int, error) {
+	token, err := storage.UseUserToken(user.TokenHash(plain), user.EmailVerification, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if err = storage.VerifyEmail(token.UserID, time.Now()); err != nil {
+		return 0, errors.Wrap(err, "can't verify email")
+	}
+	return token.UserID, nil
+}
+
+// EnrollTwoFactor sets a new TOTP secret of the user and returns it with the otpauth URI, 2FA is enabled
+// after the user confirms a code of the secret.
+func EnrollTwoFactor(userID int, issuer string, storage storage.Storage) (string, string, error) {
+	u := user.User{ID: userID}
+	if err := storage.GetUser(&u); err != nil {
+		return "", "", errors.Wrapf(err, "can't get user %d", userID)
+	}
+	if u.TwoFactorEnabled() {
+		return "", "", errs.ErrTwoFactorEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err = storage.SetTOTP(userID, secret, nil); err != nil {
+		return "", "", errors.Wrap(err, "can't enroll totp")
+	}
+	return secret, totp.URI(issuer, u.Email, secret), nil
+}
+
+// ConfirmTwoFactor enables 2FA with a code of the enrolled secret and returns new recovery codes.
+func ConfirmTwoFactor(userID int, code string, storage storage.Storage) ([]string, error) {
+	u := user.User{ID: userID}
+	if err := storage.GetUser(&u); err != nil {
+		return nil, errors.Wrapf(err, "can't get user %d", userID)
+	}
+	if u.TwoFactorEnabled() {
+		return nil, errs.ErrTwoFactorEnabled
+	}
+	if u.TOTPSecret == "" {
+		return nil, errs.ErrTwoFactorDisabled
+	}
+	now := time.Now()
+	step, ok := totp.Validate(u.TOTPSecret, strings.TrimSpace(code), now)
+	if !ok {
+		return nil, errs.ErrWrongCode
+	}
+	if err := storage.UseTOTPStep(userID, step); err != nil {
+		return nil, err
+	}
+	if err := storage.SetTOTP(userID, u.TOTPSecret, &now); err != nil {
+		return nil, errors.Wrap(err, "can't enable totp")
+	}
+	return replaceRecoveryCodes(userID, storage)
+}
+
+func replaceRecoveryCodes(userID int, storage storage.Storage) ([]string, error) {
+	codes, tokens, err := user.NewRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.DeleteUserTokens(userID, user.RecoveryCode); err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		if err = storage.AddUserToken(&tokens[i]); err != nil {
+			return nil, errors.Wrap(err, "can't add recovery code")
+		}
+	}
+	return codes, nil
+}
+
+// VerifyTwoFactor accepts a TOTP code of the user or one of the recovery codes, every code is accepted once.
+func VerifyTwoFactor(u user.User, code string, storage storage.Storage) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return errs.ErrWrongCode
+	}
+	if step, ok := totp.Validate(u.TOTPSecret, code, time.Now()); ok {
+		return storage.UseTOTPStep(u.ID, step)
+	}
+	if _, err := storage.UseUserToken(user.RecoveryCodeHash(u.ID, code), user.RecoveryCode, time.Now()); err != nil {
+		return errs.ErrWrongCode
+	}
+	return nil
+}
+
+// DisableTwoFactor turns 2FA off with a valid code and drops the recovery codes.
+func DisableTwoFactor(userID int, code string, storage storage.Storage) error {
+	u := user.User{ID: userID}
+	if err := storage.GetUser(&u); err != nil {
+		return errors.Wrapf(err, "can't get user %d", userID)
+	}
+	if !u.TwoFactorEnabled() {
+		return errs.ErrTwoFactorDisabled
+	}
+	if err := VerifyTwoFactor(u, code, storage); err != nil {
+		return err
+	}
+	if err := storage.SetTOTP(userID, "", nil); err != nil {
+		return errors.Wrap(err, "can't disable totp")
+	}
+	if err := storage.DeleteUserTokens(userID, user.RecoveryCode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnlockUser forgets failed signin and 2FA attempts of the user.
+func UnlockUser(u user.User, storage storage.Storage) error {
+	for _, key := range []string{lockout.AccountKey(u.Email), lockout.UserKey(u.ID)} {
+		if err := storage.ResetAttempts(key); err != nil {
+			return errors.Wrapf(err, "can't unlock user %d", u.ID)
+		}
+	}
+	return nil
+}
+
 func GetSession(sessionID string, storage *storage.Storage) (*session.Session, error) {
 	sess := session.Session{SessionID: sessionID}
 	if err := (*storage).GetSession(&sess); err != nil {
@@ -77,6 +320,21 @@ func GetSession(sessionID string, storage *storage.Storage) (*session.Session, e
 	}
 	return &sess, nil
 }
+
+// FindSession looks for an active session of the user by its public id.
+func FindSession(userID int, publicID string, storage storage.Storage) (session.Session, error) {
+	sessions, err := storage.GetSessions(userID)
+	if err != nil {
+		return session.Session{}, errors.Wrap(err, "can't get sessions")
+	}
+	for _, s := range sessions {
+		if s.PublicID() == publicID {
+			return s, nil
+		}
+	}
+	return session.Session{}, errs.ErrNotFound
+}
+
 func GetLots(lotType string, s storage.Storage) ([]lot.Lot, error) {
 	t, err := lot.NewStatus(lotType)
 	selector := lot.Lot{}
@@ -87,6 +345,7 @@ func GetLots(lotType string, s storage.Storage) ([]lot.Lot, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "can't select lots")
 	}
+	auction.PresentAll(data, time.Now())
 	return data, nil
 }
 
@@ -102,5 +361,67 @@ func GetUserLots(id int, lotType string, s storage.Storage) ([]lot.Lot, error) {
 		lots, err = s.GetOwnLots(&lot.Lot{CreatorID: id}, &lot.Lot{BuyerID: &id})
 
 	}
+	auction.PresentAll(lots, time.Now())
 	return lots, err
 }
+
+// ConvertLots fills indicative prices of the lots in currency to. Lots are still traded in their own currency.
+func ConvertLots(lots []lot.Lot, to money.Currency, rates *money.Rates) error {
+	for i := range lots {
+		if err := ConvertLot(&lots[i], to, rates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ConvertLot(l *lot.Lot, to money.Currency, rates *money.Rates) error {
+	c := lot.Converted{Currency: to}
+	var err error
+	if c.MinPrice, err = rates.Convert(l.MinPrice, to); err != nil {
+		return errors.Wrapf(err, "can't convert lot %d", l.ID)
+	}
+	for _, v := range []struct {
+		From *money.Money
+		To   **money.Money
+	}{{From: l.CurrentPrice, To: &c.CurrentPrice}, {From: l.BuyNowPrice, To: &c.BuyNowPrice}} {
+		if v.From == nil {
+			continue
+		}
+		converted, err := rates.Convert(*v.From, to)
+		if err != nil {
+			return errors.Wrapf(err, "can't convert lot %d", l.ID)
+		}
+		*v.To = &converted
+	}
+	l.Converted = &c
+	return nil
+}
+
+// GetLotBids returns only own bids of the viewer while bids of the lot are hidden.
+func GetLotBids(l lot.Lot, viewer int, limit int, offset int, s storage.Storage) ([]bid.Bid, error) {
+	condition := bid.Bid{LotID: l.ID}
+	if !auction.BidsVisible(l) {
+		condition.BuyerID = viewer
+	}
+	bids, err := s.GetBids(condition, limit, offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't select bids for lot %d", l.ID)
+	}
+	return bids, nil
+}
+
+// GetUserBids skips bids on lots with hidden bids unless the viewer is the bidder.
+func GetUserBids(id int, viewer int, limit int, offset int, s storage.Storage) ([]bid.Bid, error) {
+	var bids []bid.Bid
+	var err error
+	if id == viewer {
+		bids, err = s.GetBids(bid.Bid{BuyerID: id}, limit, offset)
+	} else {
+		bids, err = s.GetVisibleBids(id, limit, offset)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't select bids for user %d", id)
+	}
+	return bids, nil
+}
@@ -2,21 +2,51 @@ package session
 
 import (
 	"crypto/rand"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"math/big"
 	"time"
 
 	"github.com/pkg/errors"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
 )
 
+// Session is identified by its short-lived access token. A refresh token can be exchanged once for a new
+// session of the same family, a second use of it means the token leaked and revokes the whole family.
 type Session struct {
-	SessionID  string    `json:"session_id" gorm:"PRIMARY_KEY"`
-	UserID     int       `json:"user_id" gorm:"NOT NULL"`
-	CreatedAt  time.Time `json:"created_at" gorm:"NOT NULL"`
-	ValidUntil time.Time `json:"valid_until" gorm:"NOT NULL"`
+	SessionID    string     `json:"session_id" gorm:"PRIMARY_KEY"`
+	UserID       int        `json:"user_id" gorm:"NOT NULL"`
+	CreatedAt    time.Time  `json:"created_at" gorm:"NOT NULL"`
+	ValidUntil   time.Time  `json:"valid_until" gorm:"NOT NULL"`
+	IP           string     `json:"ip" gorm:"NOT NULL;default:''"`
+	UserAgent    string     `json:"user_agent" gorm:"NOT NULL;default:''"`
+	RefreshToken string     `json:"-" gorm:"NOT NULL;default:'';index"`
+	RefreshUntil time.Time  `json:"-" gorm:"NOT NULL;default:'epoch';index"`
+	FamilyID     string     `json:"-" gorm:"NOT NULL;default:'';index"`
+	RotatedAt    *time.Time `json:"-"`
+	// AccessToken is given to the client instead of SessionID when access tokens are JWTs.
+	AccessToken string `json:"-" gorm:"-"`
+	// Claims are set on sessions restored from a JWT, they are not read from storage.
+	Claims *jwt.Claims `json:"-" gorm:"-"`
 }
 
-const TokenLifeTime = time.Hour * 24
+var ErrRefreshReused = errors.New("refresh token is already used, sessions of the family are revoked")
+
+// Info describes a session to its owner without the token.
+type Info struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ValidUntil time.Time `json:"valid_until"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+}
+
+const (
+	AccessTokenLifeTime  = 15 * time.Minute
+	RefreshTokenLifeTime = 30 * 24 * time.Hour
+)
 
 const alphabet = "qwertyuiopasdfghjlzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM1234567890"
 
@@ -34,6 +64,46 @@ func GenerateToken() (string, error) {
 	return string(result), nil
 }
 
+// Token returns the access token of the session.
+func (s Session) Token() string {
+	if s.AccessToken != "" {
+		return s.AccessToken
+	}
+	return s.SessionID
+}
+
+// MarshalJSON returns the token response of OAuth2.
 func (s Session) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf(`{"token_type":"bearer","access_token":"%s"}`, s.SessionID)), nil
+	expiresIn := int64(time.Until(s.ValidUntil).Round(time.Second) / time.Second)
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	return json.Marshal(struct {
+		TokenType    string `json:"token_type"`
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+	}{TokenType: "bearer", AccessToken: s.Token(), ExpiresIn: expiresIn, RefreshToken: s.RefreshToken})
+}
+
+// PublicID identifies the session in the API, the token itself is never shown after signin.
+// Sessions of one family share the id.
+func (s Session) PublicID() string {
+	if s.Claims != nil {
+		return s.Claims.SessionID
+	}
+	key := s.FamilyID
+	if key == "" {
+		key = s.SessionID
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s Session) Info(current bool) Info {
+	validUntil := s.ValidUntil
+	if s.RefreshUntil.After(validUntil) {
+		validUntil = s.RefreshUntil
+	}
+	return Info{ID: s.PublicID(), CreatedAt: s.CreatedAt, ValidUntil: validUntil, IP: s.IP, UserAgent: s.UserAgent, Current: current}
 }
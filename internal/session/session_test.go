@@ -1,7 +1,9 @@
 package session
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -12,3 +14,23 @@ func TestGenerateToken(t *testing.T) {
 	r.NoError(err)
 	r.Equal(len(str), tokenLen)
 }
+
+func TestSession_MarshalJSON(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	data, err := json.Marshal(Session{SessionID: "access", ValidUntil: now.Add(AccessTokenLifeTime), RefreshToken: "refresh"})
+	r.NoError(err)
+	r.JSONEq(`{"token_type": "bearer", "access_token": "access", "expires_in": 900, "refresh_token": "refresh"}`, string(data))
+	data, err = json.Marshal(Session{SessionID: "access", ValidUntil: now.Add(-time.Minute)})
+	r.NoError(err)
+	r.JSONEq(`{"token_type": "bearer", "access_token": "access", "expires_in": 0}`, string(data))
+}
+
+func TestSession_PublicID(t *testing.T) {
+	r := require.New(t)
+	first := Session{SessionID: "first", FamilyID: "first"}
+	second := Session{SessionID: "second", FamilyID: "first"}
+	r.Equal(first.PublicID(), second.PublicID(), "sessions of a family share the id")
+	r.NotContains(first.PublicID(), "first")
+	r.NotEqual(first.PublicID(), Session{SessionID: "other"}.PublicID())
+}
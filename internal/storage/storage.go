@@ -1,27 +1,118 @@
 package storage
 
 import (
+	"time"
+
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lockout"
 	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/internal/proxybid"
 	"gitlab.com/asciishell/tfs-go-auction/internal/session"
 	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
 )
 
+// Notify publishes events of the lot changed by a bid with p before the change commits, so the events are
+// delivered in the order of bids and only for committed ones, an error rolls the change back. Storage without
+// a transactional publisher passes nil p, then events are published at once.
+type Notify func(l lot.Lot, p event.Publisher) error
+
 type Storage interface {
 	Migrate()
 
 	GetUser(u *user.User) error
 	AddUser(u *user.User) error
 	UpdateUser(u *user.User, n *user.User) error
+	SetPassword(userID int, hash string) error
+	// VerifyEmail marks the email of the user as verified at the time, a verified email is kept as is.
+	VerifyEmail(userID int, at time.Time) error
+	// SetTOTP sets the 2FA secret of the user, 2FA is enabled with non-nil enabledAt and disabled with an empty secret.
+	SetTOTP(userID int, secret string, enabledAt *time.Time) error
+	// UseTOTPStep accepts a code of the step, a step which is not after the last accepted one returns user.ErrCodeUsed.
+	UseTOTPStep(userID int, step int64) error
+	// FindUsers returns users with the query in the email or the name ignoring case, the oldest first.
+	// An empty query matches every user.
+	FindUsers(query string, limit int, offset int) ([]user.User, error)
+	SetRole(userID int, role user.Role) error
+	// SetBanned bans the user at bannedAt, nil lifts the ban.
+	SetBanned(userID int, bannedAt *time.Time) error
+
+	AddUserToken(t *user.Token) error
+	// GetUserToken returns the valid token with the hash and purpose without using it.
+	GetUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error)
+	// UseUserToken marks the token with the hash and purpose as used at now and returns it. A used or
+	// expired token is an error, so a token is used once even by concurrent requests.
+	UseUserToken(hash string, purpose user.Purpose, now time.Time) (user.Token, error)
+	// AttemptUserToken counts an attempt to check a code against the token and returns it, a token with
+	// maxAttempts attempts is invalid like a used one.
+	AttemptUserToken(hash string, purpose user.Purpose, now time.Time, maxAttempts int) (user.Token, error)
+	DeleteUserTokens(userID int, purpose user.Purpose) error
 
 	GetSession(s *session.Session) error
 	AddSession(s *session.Session) error
+	// GetSessions returns the last sessions of families of the user which can be used or refreshed, the newest first.
+	GetSessions(userID int) ([]session.Session, error)
+	// DeleteSession revokes the session with all sessions of its family.
+	DeleteSession(s *session.Session) error
+	// RotateSession marks the session of the refresh token as used, revokes its access token and adds next
+	// to the same family. A used refresh token revokes the family and returns session.ErrRefreshReused.
+	RotateSession(refreshToken string, next *session.Session) error
+	// PurgeSessions deletes up to limit sessions which can be neither used nor refreshed at now,
+	// it returns how many sessions were deleted.
+	PurgeSessions(now time.Time, limit int) (int, error)
+
+	// AddRevocation adds a revocation of access tokens or replaces the one with the same id.
+	AddRevocation(r *jwt.Revocation) error
+	GetRevocations(now time.Time) ([]jwt.Revocation, error)
+	// PurgeRevocations deletes up to limit revocations expired at now.
+	PurgeRevocations(now time.Time, limit int) (int, error)
+
+	// AddFailure counts a failed attempt of the key, failures before forgetBefore are forgotten.
+	AddFailure(key string, now time.Time, forgetBefore time.Time) (lockout.Attempts, error)
+	GetAttempts(key string) (lockout.Attempts, error)
+	ResetAttempts(key string) error
+	// PurgeAttempts deletes up to limit counters without failures after before.
+	PurgeAttempts(before time.Time, limit int) (int, error)
 
 	GetLots(condition lot.Lot) ([]lot.Lot, error)
 	GetLot(l *lot.Lot) error
 	GetOwnLots(l *lot.Lot, r *lot.Lot) ([]lot.Lot, error)
-	BuyLot(id int, owner int, price int) (lot.Lot, error)
+	// BuyLot places the bid and calls notify with the lot after it, nil notify publishes nothing.
+	BuyLot(id int, owner int, price money.Money, notify Notify) (lot.Lot, error)
+	BuyNow(id int, owner int, notify Notify) (lot.Lot, error)
 	AddLot(l *lot.Lot) error
 	UpdateLot(n *lot.Lot) error
 	DeleteLot(l *lot.Lot) error
-	CloseLots() (int, error)
+	CloseLots() ([]lot.Lot, error)
+	// FinishLot finishes the created or active lot before its end and returns it.
+	FinishLot(id int) (lot.Lot, error)
+	// ActivateLots activates created lots after their start and returns them.
+	ActivateLots() ([]lot.Lot, error)
+	PublishLot(id int, owner int) (lot.Lot, error)
+
+	AddBid(b *bid.Bid) error
+	GetBids(condition bid.Bid, limit int, offset int) ([]bid.Bid, error)
+	// GetVisibleBids returns bids of the buyer on lots which show bids to everyone.
+	GetVisibleBids(buyerID int, limit int, offset int) ([]bid.Bid, error)
+
+	SetMaxBid(p *proxybid.ProxyBid, notify Notify) (lot.Lot, error)
+
+	AddWebhook(w *webhook.Webhook) error
+	GetWebhook(w *webhook.Webhook) error
+	GetWebhooks(condition webhook.Webhook) ([]webhook.Webhook, error)
+	UpdateWebhook(n *webhook.Webhook) error
+	DeleteWebhook(w *webhook.Webhook) error
+	// RecordWebhookResult resets failures of the webhook after a success, counts a failure otherwise
+	// and disables the webhook when failures reach maxFailures.
+	RecordWebhookResult(id int, success bool, maxFailures int) (webhook.Webhook, error)
+
+	AddDelivery(d *webhook.Delivery) error
+	GetDeliveries(condition webhook.Delivery, limit int, offset int) ([]webhook.Delivery, error)
+	// ClaimDeliveries returns pending deliveries due at now and postpones them by lease,
+	// so a delivery is not sent by several instances at once.
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]webhook.Delivery, error)
+	UpdateDelivery(d *webhook.Delivery) error
 }
@@ -0,0 +1,1431 @@
+package storagetest
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/internal/bid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/internal/jwt"
+	"gitlab.com/asciishell/tfs-go-auction/internal/lot"
+	"gitlab.com/asciishell/tfs-go-auction/internal/proxybid"
+	"gitlab.com/asciishell/tfs-go-auction/internal/session"
+	"gitlab.com/asciishell/tfs-go-auction/internal/storage"
+	"gitlab.com/asciishell/tfs-go-auction/internal/user"
+	"gitlab.com/asciishell/tfs-go-auction/internal/webhook"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/money"
+)
+
+// Factory returns an empty storage. It is called once per test case.
+type Factory func(t *testing.T) storage.Storage
+
+// RunConformance checks that the storage implementation follows the behavioral contract of storage.Storage.
+func RunConformance(t *testing.T, factory Factory) {
+	testCases := []struct {
+		Name string
+		Test func(t *testing.T, s storage.Storage)
+	}{
+		{Name: "Users", Test: testUsers},
+		{Name: "Sessions", Test: testSessions},
+		{Name: "RotateSession", Test: testRotateSession},
+		{Name: "UserTokens", Test: testUserTokens},
+		{Name: "SetPassword", Test: testSetPassword},
+		{Name: "TOTP", Test: testTOTP},
+		{Name: "AttemptUserToken", Test: testAttemptUserToken},
+		{Name: "FindUsers", Test: testFindUsers},
+		{Name: "RolesAndBans", Test: testRolesAndBans},
+		{Name: "Revocations", Test: testRevocations},
+		{Name: "PurgeSessions", Test: testPurgeSessions},
+		{Name: "PurgeRevocations", Test: testPurgeRevocations},
+		{Name: "Attempts", Test: testAttempts},
+		{Name: "AddLot", Test: testAddLot},
+		{Name: "GetLots", Test: testGetLots},
+		{Name: "GetOwnLots", Test: testGetOwnLots},
+		{Name: "UpdateLot", Test: testUpdateLot},
+		{Name: "DeleteLot", Test: testDeleteLot},
+		{Name: "BuyLot", Test: testBuyLot},
+		{Name: "BuyLotStatus", Test: testBuyLotStatus},
+		{Name: "BuyLotExtend", Test: testBuyLotExtend},
+		{Name: "BuyLotAfterEnd", Test: testBuyLotAfterEnd},
+		{Name: "BuyLotNotify", Test: testBuyLotNotify},
+		{Name: "CloseLots", Test: testCloseLots},
+		{Name: "CloseLotsResult", Test: testCloseLotsResult},
+		{Name: "FinishLot", Test: testFinishLot},
+		{Name: "BuyNow", Test: testBuyNow},
+		{Name: "ActivateLots", Test: testActivateLots},
+		{Name: "PublishLot", Test: testPublishLot},
+		{Name: "Bids", Test: testBids},
+		{Name: "MaxBid", Test: testMaxBid},
+		{Name: "MaxBidExtend", Test: testMaxBidExtend},
+		{Name: "DutchAuction", Test: testDutchAuction},
+		{Name: "SealedAuction", Test: testSealedAuction},
+		{Name: "VisibleBids", Test: testVisibleBids},
+		{Name: "Currency", Test: testCurrency},
+		{Name: "Webhooks", Test: testWebhooks},
+		{Name: "Deliveries", Test: testDeliveries},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			tc.Test(t, factory(t))
+		})
+	}
+}
+
+func addUser(t *testing.T, s storage.Storage, email string) user.User {
+	u := user.User{FirstName: "First", LastName: "Last", Email: email, Password: "hash"}
+	require.NoError(t, s.AddUser(&u))
+	require.NotZero(t, u.ID)
+	return u
+}
+
+func addLot(t *testing.T, s storage.Storage, creator int, status lot.Status) lot.Lot {
+	l := lot.Lot{Title: "Lot", MinPrice: rub(10), PriceStep: rub(5), Status: status.String(), CreatorID: creator, EndAt: time.Now().Add(time.Hour)}
+	require.NoError(t, s.AddLot(&l))
+	require.NotZero(t, l.ID)
+	return l
+}
+
+func rub(v int64) money.Money {
+	return money.FromMajor(v, money.RUB)
+}
+
+func lotIDs(lots []lot.Lot) []int {
+	result := make([]int, 0, len(lots))
+	for _, l := range lots {
+		result = append(result, l.ID)
+	}
+	return result
+}
+
+func testUsers(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "first@example.com")
+	r.False(u.CreatedAt.IsZero())
+	r.Error(s.AddUser(&user.User{FirstName: "Dup", LastName: "Dup", Email: "first@example.com", Password: "hash"}))
+
+	byID := user.User{ID: u.ID}
+	r.NoError(s.GetUser(&byID))
+	r.Equal(u.Email, byID.Email)
+	byEmail := user.User{Email: u.Email}
+	r.NoError(s.GetUser(&byEmail))
+	r.Equal(u.ID, byEmail.ID)
+	r.Error(s.GetUser(&user.User{Email: "missing@example.com"}))
+	r.Error(s.GetUser(&user.User{ID: u.ID + 100}))
+
+	r.NoError(s.UpdateUser(&user.User{ID: u.ID}, &user.User{FirstName: "New"}))
+	updated := user.User{ID: u.ID}
+	r.NoError(s.GetUser(&updated))
+	r.Equal("New", updated.FirstName)
+	r.Equal(u.Email, updated.Email)
+}
+
+func testSessions(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "session@example.com")
+	now := time.Now()
+	sess := session.Session{SessionID: "token", UserID: u.ID, CreatedAt: now, ValidUntil: now.Add(session.AccessTokenLifeTime)}
+	r.NoError(s.AddSession(&sess))
+	r.Error(s.AddSession(&session.Session{SessionID: "token", UserID: u.ID, CreatedAt: now, ValidUntil: now}))
+
+	found := session.Session{SessionID: "token"}
+	r.NoError(s.GetSession(&found))
+	r.Equal(u.ID, found.UserID)
+	r.WithinDuration(sess.ValidUntil, found.ValidUntil, time.Second)
+	r.Error(s.GetSession(&session.Session{SessionID: "missing"}))
+
+	other := addUser(t, s, "other-session@example.com")
+	newer := session.Session{SessionID: "newer", UserID: u.ID, CreatedAt: now.Add(time.Minute), ValidUntil: now.Add(session.AccessTokenLifeTime),
+		IP: "10.0.0.1", UserAgent: "curl/7.64"}
+	r.NoError(s.AddSession(&newer))
+	r.NoError(s.AddSession(&session.Session{SessionID: "expired", UserID: u.ID, CreatedAt: now.Add(-time.Hour), ValidUntil: now.Add(-time.Minute)}))
+	r.NoError(s.AddSession(&session.Session{SessionID: "other", UserID: other.ID, CreatedAt: now, ValidUntil: now.Add(time.Hour)}))
+	sessions, err := s.GetSessions(u.ID)
+	r.NoError(err)
+	r.Len(sessions, 2, "expired sessions are not listed")
+	r.Equal("newer", sessions[0].SessionID)
+	r.Equal("10.0.0.1", sessions[0].IP)
+	r.Equal("curl/7.64", sessions[0].UserAgent)
+
+	r.Error(s.DeleteSession(&session.Session{SessionID: "newer", UserID: other.ID}), "session of another user")
+	r.NoError(s.DeleteSession(&session.Session{SessionID: "newer", UserID: u.ID}))
+	r.Error(s.GetSession(&session.Session{SessionID: "newer"}))
+	r.Error(s.DeleteSession(&session.Session{SessionID: "newer", UserID: u.ID}))
+	sessions, err = s.GetSessions(u.ID)
+	r.NoError(err)
+	r.Len(sessions, 1)
+}
+
+func testRotateSession(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "refresh@example.com")
+	now := time.Now()
+	first := session.Session{SessionID: "first", UserID: u.ID, CreatedAt: now, ValidUntil: now.Add(time.Minute),
+		RefreshToken: "refresh1", RefreshUntil: now.Add(time.Hour), FamilyID: "first"}
+	r.NoError(s.AddSession(&first))
+	r.NoError(s.AddSession(&session.Session{SessionID: "expired", UserID: u.ID, CreatedAt: now, ValidUntil: now.Add(-time.Hour),
+		RefreshToken: "refresh-expired", RefreshUntil: now.Add(-time.Minute), FamilyID: "expired"}))
+
+	second := session.Session{SessionID: "second", ValidUntil: now.Add(time.Minute), RefreshToken: "refresh2", RefreshUntil: now.Add(time.Hour)}
+	r.NoError(s.RotateSession("refresh1", &second))
+	r.Equal(u.ID, second.UserID)
+	r.Equal("first", second.FamilyID)
+	found := session.Session{SessionID: "first"}
+	r.NoError(s.GetSession(&found))
+	r.NotNil(found.RotatedAt)
+	r.False(found.ValidUntil.After(time.Now()), "access token of the rotated session is revoked")
+	sessions, err := s.GetSessions(u.ID)
+	r.NoError(err)
+	r.Len(sessions, 1, "only the last session of the family is listed")
+	r.Equal("second", sessions[0].SessionID)
+
+	r.Error(s.RotateSession("refresh-expired", &session.Session{SessionID: "late", RefreshToken: "refresh-late"}))
+	r.Error(s.RotateSession("missing", &session.Session{SessionID: "missing", RefreshToken: "refresh-missing"}))
+	r.Error(s.RotateSession("", &session.Session{SessionID: "blank", RefreshToken: "refresh-blank"}))
+
+	err = s.RotateSession("refresh1", &session.Session{SessionID: "third", RefreshToken: "refresh3", RefreshUntil: now.Add(time.Hour)})
+	r.Equal(session.ErrRefreshReused, err)
+	r.Error(s.GetSession(&session.Session{SessionID: "second"}), "reuse revokes the family")
+	r.Error(s.GetSession(&session.Session{SessionID: "third"}))
+	r.Error(s.RotateSession("refresh2", &session.Session{SessionID: "fourth", RefreshToken: "refresh4"}))
+	r.NoError(s.GetSession(&session.Session{SessionID: "expired"}), "other families are kept")
+}
+
+func testUserTokens(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "tokens@example.com")
+	now := time.Now()
+	plain, token, err := user.NewToken(u.ID, user.PasswordReset, time.Hour)
+	r.NoError(err)
+	r.NoError(s.AddUserToken(&token))
+	r.Error(s.AddUserToken(&token), "duplicate hash")
+	_, expired, err := user.NewToken(u.ID, user.EmailVerification, -time.Minute)
+	r.NoError(err)
+	r.NoError(s.AddUserToken(&expired))
+	_, unknown, err := user.NewToken(100500, user.PasswordReset, time.Hour)
+	r.NoError(err)
+	r.Error(s.AddUserToken(&unknown), "unknown user")
+
+	_, err = s.UseUserToken(user.TokenHash(plain), user.EmailVerification, now)
+	r.Error(err, "other purpose")
+	_, err = s.GetUserToken(user.TokenHash(plain), user.EmailVerification, now)
+	r.Error(err)
+	valid, err := s.GetUserToken(user.TokenHash(plain), user.PasswordReset, now)
+	r.NoError(err)
+	r.Equal(u.ID, valid.UserID)
+	r.Nil(valid.UsedAt, "the token is not used by lookup")
+	used, err := s.UseUserToken(user.TokenHash(plain), user.PasswordReset, now)
+	r.NoError(err)
+	r.Equal(u.ID, used.UserID)
+	r.NotNil(used.UsedAt)
+	_, err = s.UseUserToken(user.TokenHash(plain), user.PasswordReset, now)
+	r.Error(err, "token is used once")
+	_, err = s.GetUserToken(user.TokenHash(plain), user.PasswordReset, now)
+	r.Error(err)
+	_, err = s.UseUserToken(expired.Hash, user.EmailVerification, now)
+	r.Error(err, "expired token")
+	_, err = s.GetUserToken(expired.Hash, user.EmailVerification, now)
+	r.Error(err)
+	_, err = s.UseUserToken("missing", user.PasswordReset, now)
+	r.Error(err)
+
+	found := user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.False(found.EmailVerified())
+	r.NoError(s.VerifyEmail(u.ID, now))
+	r.NoError(s.VerifyEmail(u.ID, now.Add(time.Hour)))
+	found = user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.True(found.EmailVerified())
+	r.WithinDuration(now, *found.EmailVerifiedAt, time.Second, "the first verification is kept")
+}
+
+func testSetPassword(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "password@example.com")
+	r.NoError(s.SetPassword(u.ID, "hash"))
+	found := user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.Equal("hash", found.Password)
+	r.Equal("password@example.com", found.Email)
+	r.Error(s.SetPassword(100500, "hash"))
+}
+
+func testTOTP(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "totp@example.com")
+	r.NoError(s.SetTOTP(u.ID, "SECRET", nil))
+	found := user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.Equal("SECRET", found.TOTPSecret)
+	r.False(found.TwoFactorEnabled())
+	now := time.Now()
+	r.NoError(s.SetTOTP(u.ID, "SECRET", &now))
+	found = user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.True(found.TwoFactorEnabled())
+	r.Error(s.SetTOTP(100500, "SECRET", nil))
+
+	r.NoError(s.UseTOTPStep(u.ID, 100))
+	r.Equal(user.ErrCodeUsed, s.UseTOTPStep(u.ID, 100), "a step is accepted once")
+	r.Equal(user.ErrCodeUsed, s.UseTOTPStep(u.ID, 99), "earlier steps are not accepted")
+	r.NoError(s.UseTOTPStep(u.ID, 101))
+
+	r.NoError(s.SetTOTP(u.ID, "", nil))
+	found = user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.Empty(found.TOTPSecret)
+	r.False(found.TwoFactorEnabled())
+	r.Equal(int64(101), found.TOTPLastStep)
+}
+
+func testAttemptUserToken(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "attempts@example.com")
+	other := addUser(t, s, "attempts-other@example.com")
+	now := time.Now()
+	plain, challenge, err := user.NewToken(u.ID, user.SigninChallenge, time.Minute)
+	r.NoError(err)
+	r.NoError(s.AddUserToken(&challenge))
+	for i := 1; i <= 3; i++ {
+		found, err := s.AttemptUserToken(user.TokenHash(plain), user.SigninChallenge, now, 3)
+		r.NoError(err)
+		r.Equal(i, found.Attempts)
+		r.Equal(u.ID, found.UserID)
+	}
+	_, err = s.AttemptUserToken(user.TokenHash(plain), user.SigninChallenge, now, 3)
+	r.Error(err, "attempts are exhausted")
+	_, err = s.AttemptUserToken(user.TokenHash(plain), user.SigninChallenge, now, 5)
+	r.NoError(err)
+	_, err = s.AttemptUserToken(user.TokenHash(plain), user.PasswordReset, now, 5)
+	r.Error(err, "other purpose")
+	_, err = s.AttemptUserToken(user.TokenHash(plain), user.SigninChallenge, now.Add(time.Hour), 5)
+	r.Error(err, "expired token")
+	_, err = s.UseUserToken(user.TokenHash(plain), user.SigninChallenge, now)
+	r.NoError(err)
+	_, err = s.AttemptUserToken(user.TokenHash(plain), user.SigninChallenge, now, 5)
+	r.Error(err, "used token")
+
+	codes, tokens, err := user.NewRecoveryCodes(u.ID)
+	r.NoError(err)
+	for i := range tokens {
+		r.NoError(s.AddUserToken(&tokens[i]))
+	}
+	_, otherTokens, err := user.NewRecoveryCodes(other.ID)
+	r.NoError(err)
+	r.NoError(s.AddUserToken(&otherTokens[0]))
+	_, err = s.UseUserToken(user.RecoveryCodeHash(other.ID, codes[0]), user.RecoveryCode, now)
+	r.Error(err, "codes of other users are not found")
+	r.NoError(s.DeleteUserTokens(u.ID, user.RecoveryCode))
+	_, err = s.UseUserToken(user.RecoveryCodeHash(u.ID, codes[0]), user.RecoveryCode, now)
+	r.Error(err, "deleted code")
+	_, err = s.UseUserToken(otherTokens[0].Hash, user.RecoveryCode, now)
+	r.NoError(err, "codes of other users are kept")
+}
+
+func testFindUsers(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	ann := user.User{FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Password: "hash"}
+	r.NoError(s.AddUser(&ann))
+	bob := user.User{FirstName: "Bob", LastName: "Smithson", Email: "bob@example.org", Password: "hash"}
+	r.NoError(s.AddUser(&bob))
+	carl := user.User{FirstName: "Carl", LastName: "Jones", Email: "carl_100%@example.org", Password: "hash"}
+	r.NoError(s.AddUser(&carl))
+	ids := func(users []user.User) []int {
+		result := []int{}
+		for _, u := range users {
+			result = append(result, u.ID)
+		}
+		return result
+	}
+	testCases := []struct {
+		Name   string
+		Query  string
+		Limit  int
+		Offset int
+		IDs    []int
+	}{
+		{Name: "Everyone", Limit: 10, IDs: []int{ann.ID, bob.ID, carl.ID}},
+		{Name: "Email", Query: "EXAMPLE.ORG", Limit: 10, IDs: []int{bob.ID, carl.ID}},
+		{Name: "Name", Query: "smith", Limit: 10, IDs: []int{ann.ID, bob.ID}},
+		{Name: "Full name", Query: "ann smith", Limit: 10, IDs: []int{ann.ID}},
+		{Name: "Wildcards are literal", Query: "_100%", Limit: 10, IDs: []int{carl.ID}},
+		{Name: "Page", Limit: 1, Offset: 1, IDs: []int{bob.ID}},
+		{Name: "Nobody", Query: "nobody", Limit: 10, IDs: []int{}},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			found, err := s.FindUsers(tc.Query, tc.Limit, tc.Offset)
+			require.NoError(t, err)
+			require.Equal(t, tc.IDs, ids(found))
+		})
+	}
+}
+
+func testRolesAndBans(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "roles@example.com")
+	found := user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.Equal(user.RoleUser, found.Role, "users are created with the user role")
+	r.False(found.Banned())
+
+	r.NoError(s.SetRole(u.ID, user.RoleModerator))
+	now := time.Now()
+	r.NoError(s.SetBanned(u.ID, &now))
+	found = user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.Equal(user.RoleModerator, found.Role)
+	r.True(found.Banned())
+	r.WithinDuration(now, *found.BannedAt, time.Second)
+
+	r.NoError(s.SetBanned(u.ID, nil))
+	found = user.User{ID: u.ID}
+	r.NoError(s.GetUser(&found))
+	r.False(found.Banned())
+	r.Error(s.SetRole(100500, user.RoleAdmin))
+	r.Error(s.SetBanned(100500, &now))
+}
+
+func testRevocations(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	now := time.Now().Truncate(time.Second)
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "active", ExpiresAt: now.Add(time.Minute)}))
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "expired", ExpiresAt: now.Add(-time.Minute)}))
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "extended", ExpiresAt: now.Add(-time.Minute)}))
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "extended", ExpiresAt: now.Add(time.Hour)}))
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "active", ExpiresAt: now.Add(-time.Hour)}), "revocation is replaced")
+
+	revocations, err := s.GetRevocations(now)
+	r.NoError(err)
+	ids := map[string]time.Time{}
+	for _, v := range revocations {
+		ids[v.ID] = v.ExpiresAt
+	}
+	r.Len(ids, 2)
+	r.True(ids["active"].Equal(now.Add(time.Minute)), "later expiration is kept")
+	r.True(ids["extended"].Equal(now.Add(time.Hour)))
+}
+
+func testPurgeSessions(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "purge@example.com")
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		r.NoError(s.AddSession(&session.Session{SessionID: "expired" + strconv.Itoa(i), UserID: u.ID, CreatedAt: now.Add(-time.Hour),
+			ValidUntil: now.Add(-time.Minute)}))
+	}
+	r.NoError(s.AddSession(&session.Session{SessionID: "refreshable", UserID: u.ID, CreatedAt: now.Add(-time.Hour),
+		ValidUntil: now.Add(-time.Minute), RefreshToken: "refresh", RefreshUntil: now.Add(time.Hour)}))
+	rotated := now.Add(-time.Minute)
+	r.NoError(s.AddSession(&session.Session{SessionID: "rotated", UserID: u.ID, CreatedAt: now.Add(-time.Hour),
+		ValidUntil: now.Add(-time.Minute), RefreshToken: "used", RefreshUntil: now.Add(time.Hour), RotatedAt: &rotated}))
+	r.NoError(s.AddSession(&session.Session{SessionID: "active", UserID: u.ID, CreatedAt: now, ValidUntil: now.Add(time.Minute)}))
+
+	count, err := s.PurgeSessions(now, 2)
+	r.NoError(err)
+	r.Equal(2, count)
+	count, err = s.PurgeSessions(now, 2)
+	r.NoError(err)
+	r.Equal(1, count)
+	count, err = s.PurgeSessions(now, 2)
+	r.NoError(err)
+	r.Equal(0, count)
+	for i := 0; i < 3; i++ {
+		r.Error(s.GetSession(&session.Session{SessionID: "expired" + strconv.Itoa(i)}))
+	}
+	for _, id := range []string{"refreshable", "rotated", "active"} {
+		r.NoError(s.GetSession(&session.Session{SessionID: id}), id)
+	}
+	r.Equal(session.ErrRefreshReused, s.RotateSession("used", &session.Session{SessionID: "next", RefreshToken: "next"}),
+		"rotated sessions are kept for reuse detection")
+
+	count, err = s.PurgeSessions(now.Add(2*time.Hour), 10)
+	r.NoError(err)
+	r.Equal(3, count)
+	r.Error(s.GetSession(&session.Session{SessionID: "active"}))
+}
+
+func testAttempts(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	now := time.Now().Truncate(time.Second)
+	a, err := s.GetAttempts("account:missing")
+	r.NoError(err)
+	r.Zero(a.Failures)
+	for i := 1; i <= 3; i++ {
+		a, err = s.AddFailure("account:user", now, now.Add(-time.Hour))
+		r.NoError(err)
+		r.Equal(i, a.Failures)
+	}
+	r.WithinDuration(now, a.LastFailureAt, time.Second)
+	_, err = s.AddFailure("ip:127.0.0.1", now, now.Add(-time.Hour))
+	r.NoError(err)
+	a, err = s.GetAttempts("account:user")
+	r.NoError(err)
+	r.Equal(3, a.Failures)
+	r.Equal("account:user", a.Key)
+
+	later := now.Add(2 * time.Hour)
+	a, err = s.AddFailure("account:user", later, later.Add(-time.Hour))
+	r.NoError(err)
+	r.Equal(1, a.Failures, "old failures are forgotten")
+	r.WithinDuration(later, a.LastFailureAt, time.Second)
+
+	r.NoError(s.ResetAttempts("account:user"))
+	r.NoError(s.ResetAttempts("account:missing"))
+	a, err = s.GetAttempts("account:user")
+	r.NoError(err)
+	r.Zero(a.Failures)
+
+	_, err = s.AddFailure("account:recent", later, later.Add(-time.Hour))
+	r.NoError(err)
+	purged, err := s.PurgeAttempts(now.Add(time.Hour), 100)
+	r.NoError(err)
+	r.Equal(1, purged)
+	a, err = s.GetAttempts("ip:127.0.0.1")
+	r.NoError(err)
+	r.Zero(a.Failures)
+	a, err = s.GetAttempts("account:recent")
+	r.NoError(err)
+	r.Equal(1, a.Failures)
+}
+
+func testPurgeRevocations(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	now := time.Now()
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "expired1", ExpiresAt: now.Add(-time.Minute)}))
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "expired2", ExpiresAt: now.Add(-time.Hour)}))
+	r.NoError(s.AddRevocation(&jwt.Revocation{ID: "active", ExpiresAt: now.Add(time.Minute)}))
+	count, err := s.PurgeRevocations(now, 1)
+	r.NoError(err)
+	r.Equal(1, count)
+	count, err = s.PurgeRevocations(now, 10)
+	r.NoError(err)
+	r.Equal(1, count)
+	revocations, err := s.GetRevocations(now.Add(-2 * time.Hour))
+	r.NoError(err)
+	r.Len(revocations, 1)
+	r.Equal("active", revocations[0].ID)
+}
+
+func testAddLot(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "creator@example.com")
+
+	l := lot.Lot{Title: "Lot", MinPrice: rub(10), CreatorID: u.ID, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&l))
+	r.Equal(lot.Created.String(), l.Status)
+	r.Equal(rub(1), l.PriceStep)
+	r.NotNil(l.Creator)
+	r.Equal(u.ID, l.Creator.ID)
+	r.True(l.Creator.IsShort)
+	r.Nil(l.BuyPrice)
+	r.Nil(l.Buyer)
+
+	found := lot.Lot{ID: l.ID}
+	r.NoError(s.GetLot(&found))
+	r.Equal(l.Title, found.Title)
+	r.Equal(u.ID, found.CreatorID)
+	r.Error(s.GetLot(&lot.Lot{ID: l.ID + 100}))
+
+	invalid := []lot.Lot{
+		{Title: "Min price", MinPrice: rub(0), PriceStep: rub(1), CreatorID: u.ID, EndAt: time.Now().Add(time.Hour)},
+		{Title: "Price step", MinPrice: rub(10), PriceStep: rub(-1), CreatorID: u.ID, EndAt: time.Now().Add(time.Hour)},
+		{Title: "End at", MinPrice: rub(10), PriceStep: rub(1), CreatorID: u.ID, EndAt: time.Now().Add(-time.Hour)},
+	}
+	for _, v := range invalid {
+		v := v
+		r.Error(s.AddLot(&v), v.Title)
+	}
+}
+
+func testGetLots(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "creator@example.com")
+	created := addLot(t, s, u.ID, lot.Created)
+	active := addLot(t, s, u.ID, lot.Active)
+
+	all, err := s.GetLots(lot.Lot{})
+	r.NoError(err)
+	r.ElementsMatch([]int{created.ID, active.ID}, lotIDs(all))
+	for _, l := range all {
+		r.NotNil(l.Creator)
+	}
+
+	onlyActive, err := s.GetLots(lot.Lot{Status: lot.Active.String()})
+	r.NoError(err)
+	r.Equal([]int{active.ID}, lotIDs(onlyActive))
+
+	onlyFinished, err := s.GetLots(lot.Lot{Status: lot.Finished.String()})
+	r.NoError(err)
+	r.Empty(onlyFinished)
+}
+
+func testGetOwnLots(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	own := addLot(t, s, buyer.ID, lot.Created)
+	bought := addLot(t, s, seller.ID, lot.Active)
+	other := addLot(t, s, seller.ID, lot.Active)
+	_, err := s.BuyLot(bought.ID, buyer.ID, rub(10), nil)
+	r.NoError(err)
+
+	lots, err := s.GetOwnLots(&lot.Lot{CreatorID: buyer.ID}, &lot.Lot{})
+	r.NoError(err)
+	r.Equal([]int{own.ID}, lotIDs(lots))
+
+	lots, err = s.GetOwnLots(&lot.Lot{BuyerID: &buyer.ID}, &lot.Lot{})
+	r.NoError(err)
+	r.Equal([]int{bought.ID}, lotIDs(lots))
+
+	lots, err = s.GetOwnLots(&lot.Lot{CreatorID: buyer.ID}, &lot.Lot{BuyerID: &buyer.ID})
+	r.NoError(err)
+	r.ElementsMatch([]int{own.ID, bought.ID}, lotIDs(lots))
+
+	lots, err = s.GetOwnLots(&lot.Lot{CreatorID: seller.ID}, &lot.Lot{})
+	r.NoError(err)
+	r.ElementsMatch([]int{bought.ID, other.ID}, lotIDs(lots))
+}
+
+func testUpdateLot(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	u := addUser(t, s, "creator@example.com")
+	l := addLot(t, s, u.ID, lot.Created)
+
+	description := "new description"
+	n := lot.Lot{ID: l.ID, Title: "New title", Description: &description, Status: lot.Active.String()}
+	r.NoError(s.UpdateLot(&n))
+	r.Equal("New title", n.Title)
+	r.Equal(l.MinPrice, n.MinPrice)
+	r.NotNil(n.Creator)
+
+	found := lot.Lot{ID: l.ID}
+	r.NoError(s.GetLot(&found))
+	r.Equal("New title", found.Title)
+	r.Equal(description, *found.Description)
+	r.Equal(lot.Active.String(), found.Status)
+	r.Equal(l.PriceStep, found.PriceStep)
+}
+
+func testDeleteLot(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	creator := addUser(t, s, "creator@example.com")
+	other := addUser(t, s, "other@example.com")
+	l := addLot(t, s, creator.ID, lot.Created)
+	active := addLot(t, s, creator.ID, lot.Active)
+
+	r.Error(s.DeleteLot(&lot.Lot{ID: l.ID, Status: lot.Created.String(), CreatorID: other.ID}))
+	r.Error(s.DeleteLot(&lot.Lot{ID: active.ID, Status: lot.Created.String(), CreatorID: creator.ID}))
+	r.NoError(s.DeleteLot(&lot.Lot{ID: l.ID, Status: lot.Created.String(), CreatorID: creator.ID}))
+	r.Error(s.DeleteLot(&lot.Lot{ID: l.ID, Status: lot.Created.String(), CreatorID: creator.ID}))
+
+	r.Error(s.GetLot(&lot.Lot{ID: l.ID}))
+	lots, err := s.GetLots(lot.Lot{})
+	r.NoError(err)
+	r.Equal([]int{active.ID}, lotIDs(lots))
+}
+
+func testBuyLot(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	first := addUser(t, s, "first@example.com")
+	second := addUser(t, s, "second@example.com")
+	l := addLot(t, s, seller.ID, lot.Active)
+
+	type buy struct {
+		Name  string
+		Buyer int
+		Price money.Money
+		Ok    bool
+	}
+	steps := []buy{
+		{Name: "Creator can't bid", Buyer: seller.ID, Price: rub(10)},
+		{Name: "Below min price", Buyer: first.ID, Price: rub(5)},
+		{Name: "Not aligned with step", Buyer: first.ID, Price: rub(12)},
+		{Name: "Min price", Buyer: first.ID, Price: rub(10), Ok: true},
+		{Name: "Self outbid", Buyer: first.ID, Price: rub(15)},
+		{Name: "Same price", Buyer: second.ID, Price: rub(10)},
+		{Name: "Outbid", Buyer: second.ID, Price: rub(20), Ok: true},
+		{Name: "Lower price", Buyer: first.ID, Price: rub(15)},
+		{Name: "Outbid again", Buyer: first.ID, Price: rub(30), Ok: true},
+		{Name: "Unknown lot", Buyer: second.ID, Price: rub(35)},
+	}
+	for _, step := range steps {
+		id := l.ID
+		if step.Name == "Unknown lot" {
+			id = l.ID + 100
+		}
+		result, err := s.BuyLot(id, step.Buyer, step.Price, nil)
+		if !step.Ok {
+			r.Error(err, step.Name)
+			continue
+		}
+		r.NoError(err, step.Name)
+		r.Equal(l.ID, result.ID, step.Name)
+		r.NotNil(result.BuyPrice, step.Name)
+		r.Equal(step.Price, *result.BuyPrice, step.Name)
+		r.NotNil(result.BuyerID, step.Name)
+		r.Equal(step.Buyer, *result.BuyerID, step.Name)
+		r.NotNil(result.Buyer, step.Name)
+		r.Equal(step.Buyer, result.Buyer.ID, step.Name)
+	}
+
+	found := lot.Lot{ID: l.ID}
+	r.NoError(s.GetLot(&found))
+	r.Equal(rub(30), *found.BuyPrice)
+	r.Equal(first.ID, *found.BuyerID)
+}
+
+func testBuyLotStatus(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	created := addLot(t, s, seller.ID, lot.Created)
+	finished := addLot(t, s, seller.ID, lot.Finished)
+	deleted := addLot(t, s, seller.ID, lot.Active)
+	r.NoError(s.DeleteLot(&lot.Lot{ID: deleted.ID}))
+
+	for _, id := range []int{created.ID, finished.ID, deleted.ID} {
+		_, err := s.BuyLot(id, buyer.ID, rub(10), nil)
+		r.Error(err)
+	}
+	bids, err := s.GetBids(bid.Bid{BuyerID: buyer.ID}, 10, 0)
+	r.NoError(err)
+	r.Empty(bids)
+}
+
+func testBuyLotExtend(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	first := addUser(t, s, "first@example.com")
+	second := addUser(t, s, "second@example.com")
+	endAt := time.Now().Add(30 * time.Second)
+	soft := lot.Lot{Title: "Soft close", MinPrice: rub(10), PriceStep: rub(1), Status: lot.Active.String(), CreatorID: seller.ID, EndAt: endAt,
+		ExtendWindow: 60, ExtendDuration: 120, MaxExtensions: 1}
+	r.NoError(s.AddLot(&soft))
+	r.Error(s.AddLot(&lot.Lot{Title: "No duration", MinPrice: rub(10), PriceStep: rub(1), CreatorID: seller.ID, EndAt: endAt, ExtendWindow: 60}))
+	r.Error(s.AddLot(&lot.Lot{Title: "No max extensions", MinPrice: rub(10), PriceStep: rub(1), CreatorID: seller.ID, EndAt: endAt,
+		ExtendWindow: 60, ExtendDuration: 120}), "the lot would never extend")
+	early := lot.Lot{Title: "Early", MinPrice: rub(10), PriceStep: rub(1), Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour),
+		ExtendWindow: 60, ExtendDuration: 120, MaxExtensions: 1}
+	r.NoError(s.AddLot(&early))
+	hard := lot.Lot{Title: "Hard close", MinPrice: rub(10), PriceStep: rub(1), Status: lot.Active.String(), CreatorID: seller.ID, EndAt: endAt}
+	r.NoError(s.AddLot(&hard))
+
+	result, err := s.BuyLot(soft.ID, first.ID, rub(10), nil)
+	r.NoError(err)
+	r.True(result.Extended)
+	r.Equal(1, result.Extensions)
+	r.WithinDuration(endAt.Add(120*time.Second), result.EndAt, time.Second)
+
+	result, err = s.BuyLot(soft.ID, second.ID, rub(11), nil)
+	r.NoError(err)
+	r.False(result.Extended)
+	r.Equal(1, result.Extensions)
+	r.WithinDuration(endAt.Add(120*time.Second), result.EndAt, time.Second)
+
+	result, err = s.BuyLot(early.ID, first.ID, rub(10), nil)
+	r.NoError(err)
+	r.False(result.Extended)
+	r.Equal(0, result.Extensions)
+
+	result, err = s.BuyLot(hard.ID, first.ID, rub(10), nil)
+	r.NoError(err)
+	r.False(result.Extended)
+	r.WithinDuration(endAt, result.EndAt, time.Second)
+
+	found := lot.Lot{ID: soft.ID}
+	r.NoError(s.GetLot(&found))
+	r.Equal(1, found.Extensions)
+	r.WithinDuration(endAt.Add(120*time.Second), found.EndAt, time.Second)
+}
+
+func testBuyLotAfterEnd(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	l := lot.Lot{Title: "Soon", MinPrice: rub(10), PriceStep: rub(1), Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(100 * time.Millisecond)}
+	r.NoError(s.AddLot(&l))
+	time.Sleep(200 * time.Millisecond)
+	_, err := s.BuyLot(l.ID, buyer.ID, rub(10), nil)
+	r.Error(err)
+}
+
+func testCloseLots(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	soon := lot.Lot{Title: "Soon", MinPrice: rub(10), PriceStep: rub(1), Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(100 * time.Millisecond)}
+	r.NoError(s.AddLot(&soon))
+	created := lot.Lot{Title: "Created", MinPrice: rub(10), PriceStep: rub(1), CreatorID: seller.ID, EndAt: time.Now().Add(100 * time.Millisecond)}
+	r.NoError(s.AddLot(&created))
+	later := addLot(t, s, seller.ID, lot.Active)
+
+	time.Sleep(200 * time.Millisecond)
+	closed, err := s.CloseLots()
+	r.NoError(err)
+	r.Equal([]int{soon.ID}, lotIDs(closed))
+	r.Equal(lot.Finished.String(), closed[0].Status)
+	closed, err = s.CloseLots()
+	r.NoError(err)
+	r.Empty(closed)
+
+	finished, err := s.GetLots(lot.Lot{Status: lot.Finished.String()})
+	r.NoError(err)
+	r.Equal([]int{soon.ID}, lotIDs(finished))
+	active, err := s.GetLots(lot.Lot{Status: lot.Active.String()})
+	r.NoError(err)
+	r.Equal([]int{later.ID}, lotIDs(active))
+
+	_, err = s.BuyLot(soon.ID, buyer.ID, rub(10), nil)
+	r.Error(err)
+}
+
+func testCloseLotsResult(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	price := func(p int64) *money.Money { m := rub(p); return &m }
+	newLot := func(title string, reserve *money.Money) lot.Lot {
+		l := lot.Lot{Title: title, MinPrice: rub(10), PriceStep: rub(10), ReservePrice: reserve, Status: lot.Active.String(),
+			CreatorID: seller.ID, EndAt: time.Now().Add(300 * time.Millisecond)}
+		r.NoError(s.AddLot(&l))
+		r.Equal(reserve == nil, l.ReserveMet() == nil)
+		return l
+	}
+	unsold := newLot("Unsold", price(30))
+	notMet := newLot("Reserve not met", price(30))
+	met := newLot("Reserve met", price(30))
+	sold := newLot("Sold", nil)
+	for _, b := range []struct {
+		ID    int
+		Price money.Money
+	}{{ID: notMet.ID, Price: rub(20)}, {ID: met.ID, Price: rub(30)}, {ID: sold.ID, Price: rub(10)}} {
+		_, err := s.BuyLot(b.ID, buyer.ID, b.Price, nil)
+		r.NoError(err)
+	}
+	r.Error(s.AddLot(&lot.Lot{Title: "Low reserve", MinPrice: rub(10), PriceStep: rub(1), ReservePrice: price(5), CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}))
+
+	time.Sleep(400 * time.Millisecond)
+	closed, err := s.CloseLots()
+	r.NoError(err)
+	r.Len(closed, 4)
+	expected := map[int]lot.Result{unsold.ID: lot.Unsold, notMet.ID: lot.ReserveNotMet, met.ID: lot.Sold, sold.ID: lot.Sold}
+	for id, result := range expected {
+		found := lot.Lot{ID: id}
+		r.NoError(s.GetLot(&found))
+		r.Equal(lot.Finished.String(), found.Status)
+		r.Equal(result, found.Result, found.Title)
+	}
+}
+
+func testFinishLot(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	active := addLot(t, s, seller.ID, lot.Active)
+	created := addLot(t, s, seller.ID, lot.Created)
+	_, err := s.BuyLot(active.ID, buyer.ID, active.MinPrice, nil)
+	r.NoError(err)
+
+	finished, err := s.FinishLot(active.ID)
+	r.NoError(err)
+	r.Equal(lot.Finished.String(), finished.Status)
+	r.Equal(lot.Sold, finished.Result)
+	r.Equal(buyer.ID, *finished.BuyerID)
+	r.WithinDuration(time.Now(), finished.EndAt, time.Second)
+	_, err = s.FinishLot(active.ID)
+	r.Error(err, "a finished lot can't be finished again")
+
+	finished, err = s.FinishLot(created.ID)
+	r.NoError(err)
+	r.Equal(lot.Unsold, finished.Result)
+	found := lot.Lot{ID: created.ID}
+	r.NoError(s.GetLot(&found))
+	r.Equal(lot.Finished.String(), found.Status)
+
+	deleted := addLot(t, s, seller.ID, lot.Created)
+	r.NoError(s.DeleteLot(&lot.Lot{ID: deleted.ID}))
+	_, err = s.FinishLot(deleted.ID)
+	r.Error(err)
+	_, err = s.FinishLot(100500)
+	r.Error(err)
+}
+
+func testBuyLotNotify(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	buyNow := rub(50)
+	l := lot.Lot{Title: "Notify", MinPrice: rub(10), PriceStep: rub(10), BuyNowPrice: &buyNow, Status: lot.Active.String(),
+		CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&l))
+	failed := func(lot.Lot, event.Publisher) error {
+		return fmt.Errorf("bus is down")
+	}
+	_, err := s.BuyLot(l.ID, buyer.ID, rub(10), failed)
+	r.Error(err)
+	_, err = s.BuyNow(l.ID, buyer.ID, failed)
+	r.Error(err)
+	_, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: buyer.ID, MaxPrice: rub(20)}, failed)
+	r.Error(err)
+	r.NoError(s.GetLot(&l))
+	r.Nil(l.BuyerID, "bid is rolled back when its events can't be published")
+	bids, err := s.GetBids(bid.Bid{LotID: l.ID}, 10, 0)
+	r.NoError(err)
+	r.Empty(bids)
+
+	var notified []lot.Lot
+	result, err := s.BuyLot(l.ID, buyer.ID, rub(10), func(n lot.Lot, _ event.Publisher) error {
+		notified = append(notified, n)
+		return nil
+	})
+	r.NoError(err)
+	r.Len(notified, 1)
+	r.Equal(buyer.ID, *notified[0].BuyerID)
+	r.Equal(*result.BuyPrice, *notified[0].BuyPrice)
+}
+
+func testBuyNow(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	first := addUser(t, s, "first@example.com")
+	second := addUser(t, s, "second@example.com")
+	buyNow := rub(50)
+	l := lot.Lot{Title: "Buy now", MinPrice: rub(10), PriceStep: rub(10), BuyNowPrice: &buyNow, Status: lot.Active.String(),
+		CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&l))
+	passed := lot.Lot{Title: "Passed", MinPrice: rub(10), PriceStep: rub(10), BuyNowPrice: &buyNow, Status: lot.Active.String(),
+		CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&passed))
+	plain := addLot(t, s, seller.ID, lot.Active)
+	low := rub(5)
+	r.Error(s.AddLot(&lot.Lot{Title: "Low", MinPrice: rub(10), PriceStep: rub(1), BuyNowPrice: &low, CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}))
+
+	_, err := s.BuyNow(l.ID, seller.ID, nil)
+	r.Error(err)
+	_, err = s.BuyNow(plain.ID, first.ID, nil)
+	r.Error(err)
+	_, err = s.BuyLot(passed.ID, first.ID, rub(50), nil)
+	r.NoError(err)
+	_, err = s.BuyNow(passed.ID, second.ID, nil)
+	r.Error(err)
+
+	_, err = s.BuyLot(l.ID, first.ID, rub(20), nil)
+	r.NoError(err)
+	result, err := s.BuyNow(l.ID, second.ID, nil)
+	r.NoError(err)
+	r.Equal(lot.Finished.String(), result.Status)
+	r.Equal(lot.Sold, result.Result)
+	r.Equal(rub(50), *result.BuyPrice)
+	r.Equal(second.ID, *result.BuyerID)
+
+	_, err = s.BuyNow(l.ID, first.ID, nil)
+	r.Error(err)
+	_, err = s.BuyLot(l.ID, first.ID, rub(60), nil)
+	r.Error(err)
+	bids, err := s.GetBids(bid.Bid{LotID: l.ID}, 10, 0)
+	r.NoError(err)
+	r.Len(bids, 2)
+	r.Equal(rub(50), bids[0].Price)
+	r.Equal(second.ID, bids[0].BuyerID)
+}
+
+func testActivateLots(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	start := time.Now().Add(100 * time.Millisecond)
+	due := lot.Lot{Title: "Due", MinPrice: rub(10), PriceStep: rub(1), CreatorID: seller.ID, StartAt: &start, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&due))
+	r.Equal(lot.Created.String(), due.Status)
+	r.NotNil(due.StartAt)
+	later := time.Now().Add(30 * time.Minute)
+	notDue := lot.Lot{Title: "Not due", MinPrice: rub(10), PriceStep: rub(1), CreatorID: seller.ID, StartAt: &later, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&notDue))
+	manual := addLot(t, s, seller.ID, lot.Created)
+
+	afterEnd := time.Now().Add(2 * time.Hour)
+	r.Error(s.AddLot(&lot.Lot{Title: "Start after end", MinPrice: rub(10), PriceStep: rub(1), CreatorID: seller.ID, StartAt: &afterEnd, EndAt: time.Now().Add(time.Hour)}))
+
+	activated, err := s.ActivateLots()
+	r.NoError(err)
+	r.Empty(activated)
+	time.Sleep(200 * time.Millisecond)
+	activated, err = s.ActivateLots()
+	r.NoError(err)
+	r.Equal([]int{due.ID}, lotIDs(activated))
+	r.Equal(lot.Active.String(), activated[0].Status)
+	r.Equal(seller.ID, activated[0].Creator.ID)
+
+	active, err := s.GetLots(lot.Lot{Status: lot.Active.String()})
+	r.NoError(err)
+	r.Equal([]int{due.ID}, lotIDs(active))
+	created, err := s.GetLots(lot.Lot{Status: lot.Created.String()})
+	r.NoError(err)
+	r.ElementsMatch([]int{notDue.ID, manual.ID}, lotIDs(created))
+}
+
+func testPublishLot(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	other := addUser(t, s, "other@example.com")
+	l := addLot(t, s, seller.ID, lot.Created)
+	active := addLot(t, s, seller.ID, lot.Active)
+
+	_, err := s.PublishLot(l.ID, other.ID)
+	r.Error(err)
+	_, err = s.PublishLot(active.ID, seller.ID)
+	r.Error(err)
+	_, err = s.PublishLot(l.ID+100, seller.ID)
+	r.Error(err)
+
+	published, err := s.PublishLot(l.ID, seller.ID)
+	r.NoError(err)
+	r.Equal(l.ID, published.ID)
+	r.Equal(lot.Active.String(), published.Status)
+	r.NotNil(published.Creator)
+	_, err = s.PublishLot(l.ID, seller.ID)
+	r.Error(err)
+
+	_, err = s.BuyLot(l.ID, other.ID, rub(10), nil)
+	r.NoError(err)
+}
+
+func testBids(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	first := addUser(t, s, "first@example.com")
+	second := addUser(t, s, "second@example.com")
+	l := addLot(t, s, seller.ID, lot.Active)
+	other := addLot(t, s, seller.ID, lot.Active)
+
+	prices := []struct {
+		Lot   int
+		Buyer int
+		Price money.Money
+	}{
+		{Lot: l.ID, Buyer: first.ID, Price: rub(10)},
+		{Lot: l.ID, Buyer: second.ID, Price: rub(15)},
+		{Lot: other.ID, Buyer: first.ID, Price: rub(10)},
+		{Lot: l.ID, Buyer: first.ID, Price: rub(20)},
+	}
+	for _, p := range prices {
+		_, err := s.BuyLot(p.Lot, p.Buyer, p.Price, nil)
+		r.NoError(err)
+		// Bids are ordered by time, make it distinct
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	bids, err := s.GetBids(bid.Bid{LotID: l.ID}, 10, 0)
+	r.NoError(err)
+	r.Len(bids, 3)
+	r.Equal([]money.Money{rub(20), rub(15), rub(10)}, []money.Money{bids[0].Price, bids[1].Price, bids[2].Price})
+	r.Equal(first.ID, bids[0].BuyerID)
+	r.NotNil(bids[0].Buyer)
+	r.Equal(first.ID, bids[0].Buyer.ID)
+	r.True(bids[0].Buyer.IsShort)
+
+	page, err := s.GetBids(bid.Bid{LotID: l.ID}, 1, 1)
+	r.NoError(err)
+	r.Len(page, 1)
+	r.Equal(rub(15), page[0].Price)
+	page, err = s.GetBids(bid.Bid{LotID: l.ID}, 10, 10)
+	r.NoError(err)
+	r.Empty(page)
+
+	userBids, err := s.GetBids(bid.Bid{BuyerID: first.ID}, 10, 0)
+	r.NoError(err)
+	r.Len(userBids, 3)
+	r.Equal(l.ID, userBids[0].LotID)
+	r.Equal(other.ID, userBids[1].LotID)
+
+	manual := bid.Bid{LotID: other.ID, BuyerID: second.ID, Price: rub(50)}
+	r.NoError(s.AddBid(&manual))
+	r.NotZero(manual.ID)
+	r.False(manual.CreatedAt.IsZero())
+	r.Error(s.AddBid(&bid.Bid{LotID: other.ID + 100, BuyerID: second.ID, Price: rub(50)}))
+	otherBids, err := s.GetBids(bid.Bid{LotID: other.ID}, 10, 0)
+	r.NoError(err)
+	r.Len(otherBids, 2)
+	r.Equal(manual.ID, otherBids[0].ID)
+}
+
+func testMaxBid(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	first := addUser(t, s, "first@example.com")
+	second := addUser(t, s, "second@example.com")
+	l := addLot(t, s, seller.ID, lot.Active)
+	created := addLot(t, s, seller.ID, lot.Created)
+
+	_, err := s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: seller.ID, MaxPrice: rub(100)}, nil)
+	r.Error(err)
+	_, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: created.ID, UserID: first.ID, MaxPrice: rub(100)}, nil)
+	r.Error(err)
+	_, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: first.ID, MaxPrice: rub(5)}, nil)
+	r.Error(err)
+
+	proxy := proxybid.ProxyBid{LotID: l.ID, UserID: first.ID, MaxPrice: rub(40)}
+	result, err := s.SetMaxBid(&proxy, nil)
+	r.NoError(err)
+	r.NotZero(proxy.ID)
+	r.Equal(rub(10), *result.BuyPrice)
+	r.Equal(first.ID, *result.BuyerID)
+
+	// Manual bid is immediately outbid by the proxy
+	result, err = s.BuyLot(l.ID, second.ID, rub(20), nil)
+	r.NoError(err)
+	r.Equal(rub(25), *result.BuyPrice)
+	r.Equal(first.ID, *result.BuyerID)
+
+	// Competing proxy with a higher limit wins one step above the first limit
+	result, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: second.ID, MaxPrice: rub(100)}, nil)
+	r.NoError(err)
+	r.Equal(rub(45), *result.BuyPrice)
+	r.Equal(second.ID, *result.BuyerID)
+
+	// Raising the limit again restarts the competition
+	result, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: first.ID, MaxPrice: rub(200)}, nil)
+	r.NoError(err)
+	r.Equal(rub(105), *result.BuyPrice)
+	r.Equal(first.ID, *result.BuyerID)
+
+	bids, err := s.GetBids(bid.Bid{LotID: l.ID}, 100, 0)
+	r.NoError(err)
+	type step struct {
+		Buyer int
+		Price money.Money
+		Auto  bool
+	}
+	history := make([]step, 0, len(bids))
+	for i := len(bids) - 1; i >= 0; i-- {
+		history = append(history, step{Buyer: bids[i].BuyerID, Price: bids[i].Price, Auto: bids[i].Auto})
+	}
+	r.Equal([]step{
+		{Buyer: first.ID, Price: rub(10), Auto: true},
+		{Buyer: second.ID, Price: rub(20), Auto: false},
+		{Buyer: first.ID, Price: rub(25), Auto: true},
+		{Buyer: first.ID, Price: rub(40), Auto: true},
+		{Buyer: second.ID, Price: rub(45), Auto: true},
+		{Buyer: second.ID, Price: rub(100), Auto: true},
+		{Buyer: first.ID, Price: rub(105), Auto: true},
+	}, history)
+}
+
+func testMaxBidExtend(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	first := addUser(t, s, "first@example.com")
+	second := addUser(t, s, "second@example.com")
+	endAt := time.Now().Add(30 * time.Second)
+	l := lot.Lot{Title: "Soft close", MinPrice: rub(10), PriceStep: rub(5), Status: lot.Active.String(), CreatorID: seller.ID, EndAt: endAt,
+		ExtendWindow: 60, ExtendDuration: 120, MaxExtensions: 2}
+	r.NoError(s.AddLot(&l))
+
+	result, err := s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: first.ID, MaxPrice: rub(40)}, nil)
+	r.NoError(err)
+	r.True(result.Extended, "a proxy bid in the window extends the lot")
+	r.Equal(1, result.Extensions)
+	r.WithinDuration(endAt.Add(120*time.Second), result.EndAt, time.Second)
+
+	// The answer of the proxy to a manual bid is outside the window after the first extension.
+	result, err = s.BuyLot(l.ID, second.ID, rub(20), nil)
+	r.NoError(err)
+	r.Equal(first.ID, *result.BuyerID)
+	r.False(result.Extended)
+	found := lot.Lot{ID: l.ID}
+	r.NoError(s.GetLot(&found))
+	r.Equal(1, found.Extensions)
+	r.WithinDuration(endAt.Add(120*time.Second), found.EndAt, time.Second)
+}
+
+func testDutchAuction(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	first := addUser(t, s, "first@example.com")
+	second := addUser(t, s, "second@example.com")
+	start := rub(100)
+	r.Error(s.AddLot(&lot.Lot{Title: "No start price", AuctionType: lot.Dutch, MinPrice: rub(10), PriceStep: rub(10), DropInterval: 60,
+		CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}))
+	r.Error(s.AddLot(&lot.Lot{Title: "Unknown", AuctionType: "japanese", MinPrice: rub(10), PriceStep: rub(10),
+		CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}))
+	l := lot.Lot{Title: "Dutch", AuctionType: lot.Dutch, MinPrice: rub(10), PriceStep: rub(10), StartPrice: &start, DropInterval: 3600,
+		Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&l))
+	r.Equal(lot.Dutch, l.AuctionType)
+
+	_, err := s.BuyLot(l.ID, first.ID, rub(90), nil)
+	r.Error(err)
+	_, err = s.BuyLot(l.ID, seller.ID, rub(100), nil)
+	r.Error(err)
+	_, err = s.BuyNow(l.ID, first.ID, nil)
+	r.Error(err)
+	_, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: first.ID, MaxPrice: rub(100)}, nil)
+	r.Error(err)
+	bought, err := s.BuyLot(l.ID, first.ID, rub(150), nil)
+	r.NoError(err)
+	r.Equal(lot.Finished.String(), bought.Status)
+	r.Equal(lot.Sold, bought.Result)
+	r.Equal(rub(100), *bought.BuyPrice)
+	r.Equal(first.ID, *bought.BuyerID)
+	_, err = s.BuyLot(l.ID, second.ID, rub(100), nil)
+	r.Error(err)
+
+	bids, err := s.GetBids(bid.Bid{LotID: l.ID}, 10, 0)
+	r.NoError(err)
+	r.Len(bids, 1)
+	r.Equal(rub(100), bids[0].Price)
+}
+
+func testSealedAuction(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyers := []user.User{
+		addUser(t, s, "first@example.com"),
+		addUser(t, s, "second@example.com"),
+		addUser(t, s, "third@example.com"),
+	}
+	newLot := func(auctionType lot.AuctionType) lot.Lot {
+		l := lot.Lot{Title: string(auctionType), AuctionType: auctionType, MinPrice: rub(10), PriceStep: rub(10),
+			Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(300 * time.Millisecond)}
+		r.NoError(s.AddLot(&l))
+		return l
+	}
+	firstPrice := newLot(lot.SealedFirstPrice)
+	secondPrice := newLot(lot.SealedSecondPrice)
+	single := newLot(lot.SealedSecondPrice)
+	for _, l := range []lot.Lot{firstPrice, secondPrice} {
+		for i, price := range []money.Money{rub(50), rub(30), rub(40)} {
+			placed, err := s.BuyLot(l.ID, buyers[i].ID, price, nil)
+			r.NoError(err)
+			r.Nil(placed.BuyerID)
+			r.Nil(placed.BuyPrice)
+		}
+		_, err := s.BuyLot(l.ID, buyers[1].ID, rub(60), nil)
+		r.Error(err, "only one sealed bid per user")
+		_, err = s.BuyLot(l.ID, seller.ID, rub(60), nil)
+		r.Error(err)
+		_, err = s.BuyLot(l.ID, buyers[2].ID, rub(45), nil)
+		r.Error(err)
+	}
+	_, err := s.BuyLot(single.ID, buyers[0].ID, rub(70), nil)
+	r.NoError(err)
+	_, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: single.ID, UserID: buyers[1].ID, MaxPrice: rub(100)}, nil)
+	r.Error(err)
+
+	time.Sleep(400 * time.Millisecond)
+	closed, err := s.CloseLots()
+	r.NoError(err)
+	r.Len(closed, 3)
+	for _, expected := range []struct {
+		ID    int
+		Price money.Money
+	}{{ID: firstPrice.ID, Price: rub(50)}, {ID: secondPrice.ID, Price: rub(40)}, {ID: single.ID, Price: rub(10)}} {
+		found := lot.Lot{ID: expected.ID}
+		r.NoError(s.GetLot(&found))
+		r.Equal(lot.Finished.String(), found.Status)
+		r.Equal(lot.Sold, found.Result)
+		r.Equal(buyers[0].ID, *found.BuyerID, found.Title)
+		r.Equal(expected.Price, *found.BuyPrice, found.Title)
+	}
+}
+
+func testVisibleBids(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	newLot := func(auctionType lot.AuctionType) lot.Lot {
+		l := lot.Lot{Title: string(auctionType), AuctionType: auctionType, MinPrice: rub(10), PriceStep: rub(10),
+			Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+		r.NoError(s.AddLot(&l))
+		return l
+	}
+	english := newLot(lot.English)
+	sealed := newLot(lot.SealedFirstPrice)
+	_, err := s.BuyLot(english.ID, buyer.ID, rub(10), nil)
+	r.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = s.BuyLot(sealed.ID, buyer.ID, rub(20), nil)
+	r.NoError(err)
+
+	all, err := s.GetBids(bid.Bid{BuyerID: buyer.ID}, 1, 0)
+	r.NoError(err)
+	r.Len(all, 1)
+	r.Equal(sealed.ID, all[0].LotID)
+	visible, err := s.GetVisibleBids(buyer.ID, 1, 0)
+	r.NoError(err)
+	r.Len(visible, 1, "hidden bids don't shorten the page")
+	r.Equal(english.ID, visible[0].LotID)
+	r.Equal(buyer.ID, visible[0].Buyer.ID)
+	visible, err = s.GetVisibleBids(buyer.ID, 1, 1)
+	r.NoError(err)
+	r.Empty(visible)
+
+	_, err = s.FinishLot(sealed.ID)
+	r.NoError(err)
+	visible, err = s.GetVisibleBids(buyer.ID, 10, 0)
+	r.NoError(err)
+	r.Len(visible, 2, "bids are shown when the sealed lot is finished")
+	r.Equal(sealed.ID, visible[0].LotID)
+	visible, err = s.GetVisibleBids(seller.ID, 10, 0)
+	r.NoError(err)
+	r.Empty(visible)
+}
+
+func testCurrency(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	seller := addUser(t, s, "seller@example.com")
+	buyer := addUser(t, s, "buyer@example.com")
+	usd := func(v int64) money.Money { return money.FromMajor(v, money.USD) }
+	r.Error(s.AddLot(&lot.Lot{Title: "Mixed", Currency: money.USD, MinPrice: usd(10), PriceStep: rub(1),
+		CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}))
+	r.Error(s.AddLot(&lot.Lot{Title: "Bad code", Currency: "dollar", MinPrice: usd(10),
+		CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}))
+
+	l := lot.Lot{Title: "USD", Currency: money.USD, MinPrice: money.New(1000, ""), PriceStep: usd(1),
+		Status: lot.Active.String(), CreatorID: seller.ID, EndAt: time.Now().Add(time.Hour)}
+	r.NoError(s.AddLot(&l))
+	r.Equal(money.USD, l.Currency)
+	found := lot.Lot{ID: l.ID}
+	r.NoError(s.GetLot(&found))
+	r.Equal(usd(10), found.MinPrice)
+	r.Equal(usd(1), found.PriceStep)
+
+	_, err := s.BuyLot(l.ID, buyer.ID, rub(20), nil)
+	r.Error(err, "bid should be in the lot currency")
+	_, err = s.SetMaxBid(&proxybid.ProxyBid{LotID: l.ID, UserID: buyer.ID, MaxPrice: money.FromMajor(30, money.EUR)}, nil)
+	r.Error(err)
+	bought, err := s.BuyLot(l.ID, buyer.ID, money.New(2000, ""), nil)
+	r.NoError(err)
+	r.Equal(usd(20), *bought.BuyPrice)
+	bids, err := s.GetBids(bid.Bid{LotID: l.ID}, 10, 0)
+	r.NoError(err)
+	r.Len(bids, 1)
+	r.Equal(usd(20), bids[0].Price)
+
+	def := addLot(t, s, seller.ID, lot.Active)
+	r.Equal(money.DefaultCurrency, def.Currency)
+}
+
+func addWebhook(t *testing.T, s storage.Storage, owner int, events ...string) webhook.Webhook {
+	w := webhook.Webhook{UserID: owner, URL: "http://127.0.0.1/hook", Secret: "secret", Events: events, Active: true}
+	require.NoError(t, s.AddWebhook(&w))
+	require.NotZero(t, w.ID)
+	return w
+}
+
+func testWebhooks(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	owner := addUser(t, s, "owner@example.com")
+	other := addUser(t, s, "other@example.com")
+	first := addWebhook(t, s, owner.ID, "lot.finished", "bid.placed")
+	second := addWebhook(t, s, owner.ID, "lot.finished")
+	addWebhook(t, s, other.ID, "lot.finished")
+
+	found := webhook.Webhook{ID: first.ID, UserID: owner.ID}
+	r.NoError(s.GetWebhook(&found))
+	r.Equal([]string{"lot.finished", "bid.placed"}, found.Events)
+	r.Equal("secret", found.Secret)
+	r.True(found.Active)
+	r.Error(s.GetWebhook(&webhook.Webhook{ID: first.ID, UserID: other.ID}), "webhook of another user")
+
+	second.URL = "https://erp.example.com/hook"
+	second.Events = []string{"bid.placed"}
+	second.Active = false
+	r.NoError(s.UpdateWebhook(&second))
+	r.Equal("https://erp.example.com/hook", second.URL)
+	r.Equal([]string{"bid.placed"}, second.Events)
+	r.False(second.Active)
+	r.Error(s.UpdateWebhook(&webhook.Webhook{ID: second.ID, UserID: other.ID, URL: "http://evil"}))
+
+	hooks, err := s.GetWebhooks(webhook.Webhook{UserID: owner.ID})
+	r.NoError(err)
+	r.Len(hooks, 2)
+	hooks, err = s.GetWebhooks(webhook.Webhook{UserID: owner.ID, Active: true})
+	r.NoError(err)
+	r.Len(hooks, 1)
+	r.Equal(first.ID, hooks[0].ID)
+
+	updated, err := s.RecordWebhookResult(first.ID, false, 2)
+	r.NoError(err)
+	r.Equal(1, updated.Failures)
+	r.True(updated.Active)
+	updated, err = s.RecordWebhookResult(first.ID, true, 2)
+	r.NoError(err)
+	r.Equal(0, updated.Failures, "success resets failures")
+	for i := 0; i < 2; i++ {
+		updated, err = s.RecordWebhookResult(first.ID, false, 2)
+		r.NoError(err)
+	}
+	r.Equal(2, updated.Failures)
+	r.False(updated.Active)
+	r.NotNil(updated.DisabledAt)
+
+	r.Error(s.DeleteWebhook(&webhook.Webhook{ID: first.ID, UserID: other.ID}))
+	r.NoError(s.DeleteWebhook(&webhook.Webhook{ID: first.ID, UserID: owner.ID}))
+	r.Error(s.GetWebhook(&webhook.Webhook{ID: first.ID}))
+}
+
+func testDeliveries(t *testing.T, s storage.Storage) {
+	r := require.New(t)
+	owner := addUser(t, s, "owner@example.com")
+	w := addWebhook(t, s, owner.ID, "lot.finished")
+	other := addWebhook(t, s, owner.ID, "lot.finished")
+	now := time.Now()
+	deliveries := []webhook.Delivery{
+		{WebhookID: w.ID, Event: "lot.finished", Payload: `{"id":1}`, Status: webhook.Pending, NextAttemptAt: now.Add(-time.Minute)},
+		{WebhookID: w.ID, Event: "lot.finished", Payload: `{"id":2}`, Status: webhook.Pending, NextAttemptAt: now.Add(-2 * time.Minute)},
+		{WebhookID: w.ID, Event: "lot.finished", Payload: `{"id":3}`, Status: webhook.Pending, NextAttemptAt: now.Add(time.Minute)},
+		{WebhookID: other.ID, Event: "lot.finished", Payload: `{"id":4}`, Status: webhook.Pending, NextAttemptAt: now.Add(-time.Minute)},
+	}
+	for i := range deliveries {
+		r.NoError(s.AddDelivery(&deliveries[i]))
+		r.NotZero(deliveries[i].ID)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	claimed, err := s.ClaimDeliveries(now, time.Minute, 2)
+	r.NoError(err)
+	r.Len(claimed, 2)
+	r.Equal(deliveries[1].ID, claimed[0].ID, "the most overdue delivery goes first")
+	r.Equal(`{"id":2}`, claimed[0].Payload)
+	claimed, err = s.ClaimDeliveries(now, time.Minute, 10)
+	r.NoError(err)
+	r.Len(claimed, 1, "claimed deliveries are hidden by the lease")
+	r.Equal(deliveries[3].ID, claimed[0].ID)
+
+	delivered := deliveries[0]
+	delivered.Status = webhook.Delivered
+	delivered.Attempts = 1
+	delivered.ResponseCode = 200
+	delivered.DeliveredAt = &now
+	r.NoError(s.UpdateDelivery(&delivered))
+	claimed, err = s.ClaimDeliveries(now.Add(2*time.Minute), time.Minute, 10)
+	r.NoError(err)
+	r.Len(claimed, 3, "delivered deliveries are not claimed again")
+
+	log, err := s.GetDeliveries(webhook.Delivery{WebhookID: w.ID}, 10, 0)
+	r.NoError(err)
+	r.Len(log, 3)
+	r.Equal(deliveries[2].ID, log[0].ID, "the newest delivery goes first")
+	log, err = s.GetDeliveries(webhook.Delivery{WebhookID: w.ID, Status: webhook.Delivered}, 10, 0)
+	r.NoError(err)
+	r.Len(log, 1)
+	r.Equal(1, log[0].Attempts)
+	r.Equal(200, log[0].ResponseCode)
+	r.NotNil(log[0].DeliveredAt)
+	log, err = s.GetDeliveries(webhook.Delivery{WebhookID: w.ID}, 1, 1)
+	r.NoError(err)
+	r.Len(log, 1)
+	r.Equal(deliveries[1].ID, log[0].ID)
+
+	r.NoError(s.DeleteWebhook(&w))
+	log, err = s.GetDeliveries(webhook.Delivery{WebhookID: w.ID}, 10, 0)
+	r.NoError(err)
+	r.Empty(log, "deliveries are deleted with the webhook")
+}
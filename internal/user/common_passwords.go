@@ -0,0 +1,35 @@
+package user
+
+// commonPasswords are the most used passwords from public leaks, they are guessed first.
+var commonPasswords = map[string]bool{
+	"123456": true, "password": true, "12345678": true, "qwerty": true, "123456789": true, "12345": true,
+	"1234": true, "111111": true, "1234567": true, "dragon": true, "123123": true, "baseball": true,
+	"abc123": true, "football": true, "monkey": true, "letmein": true, "696969": true, "shadow": true,
+	"master": true, "666666": true, "qwertyuiop": true, "123321": true, "mustang": true, "1234567890": true,
+	"michael": true, "654321": true, "superman": true, "1qaz2wsx": true, "7777777": true,
+	"121212": true, "000000": true, "qazwsx": true, "123qwe": true, "killer": true, "trustno1": true,
+	"jordan": true, "jennifer": true, "zxcvbnm": true, "asdfgh": true, "hunter": true, "buster": true,
+	"soccer": true, "harley": true, "batman": true, "andrew": true, "tigger": true, "sunshine": true,
+	"iloveyou": true, "2000": true, "charlie": true, "robert": true, "thomas": true, "hockey": true,
+	"ranger": true, "daniel": true, "starwars": true, "klaster": true, "112233": true, "george": true,
+	"computer": true, "michelle": true, "jessica": true, "pepper": true, "1111": true, "zxcvbn": true,
+	"555555": true, "11111111": true, "131313": true, "freedom": true, "777777": true, "pass": true,
+	"maggie": true, "159753": true, "aaaaaa": true, "ginger": true, "princess": true, "joshua": true,
+	"cheese": true, "amanda": true, "summer": true, "love": true, "ashley": true, "nicole": true,
+	"chelsea": true, "matthew": true, "access": true, "yankees": true, "987654321": true,
+	"dallas": true, "austin": true, "thunder": true, "taylor": true, "matrix": true, "minecraft": true,
+	"password1": true, "password123": true, "passw0rd": true, "p@ssw0rd": true, "p@ssword": true,
+	"qwerty123": true, "qwerty1": true, "1q2w3e4r": true, "1q2w3e4r5t": true, "1q2w3e": true, "1qazxsw2": true,
+	"zaq12wsx": true, "q1w2e3r4": true, "q1w2e3r4t5": true, "welcome": true, "welcome1": true, "admin": true,
+	"admin123": true, "administrator": true, "root": true, "toor": true, "login": true, "abc12345": true,
+	"abcd1234": true, "aa123456": true, "123abc": true, "1234qwer": true, "qwer1234": true, "11223344": true,
+	"123654": true, "987654": true, "secret": true, "secret1": true, "changeme": true, "default": true,
+	"guest": true, "test": true, "test123": true, "testing": true, "letmein1": true, "iloveyou1": true,
+	"monkey1": true, "dragon1": true, "football1": true, "baseball1": true, "superman1": true, "batman1": true,
+	"sunshine1": true, "master1": true, "hello": true, "hello123": true, "123456a": true, "a123456": true,
+	"1234abcd": true, "qwe123": true, "zxc123": true, "asd123": true, "asdfghjkl": true, "asdf1234": true,
+	"qazwsxedc": true, "1qaz!qaz": true, "!qaz2wsx": true, "parol": true, "parol123": true, "ytrewq": true,
+	"qwertz": true, "azerty": true, "000000000": true, "1234512345": true, "0987654321": true, "88888888": true,
+	"12341234": true, "123123123": true, "999999999": true, "auction": true, "auction123": true,
+	"tinkoff": true, "fintech": true,
+}
@@ -0,0 +1,73 @@
+package user
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes acceptable passwords, the zero policy accepts any non-empty password.
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is the number of character classes (lowercase, uppercase, digits, other) a password should contain.
+	MinClasses   int
+	RejectCommon bool
+	RejectEmail  bool
+}
+
+// PolicyError is a rule of the policy the password breaks.
+type PolicyError string
+
+func (e PolicyError) Error() string {
+	return string(e)
+}
+
+// DefaultPasswordPolicy is used unless the policy is configured.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8, MinClasses: 2, RejectCommon: true, RejectEmail: true}
+
+// Check returns the first rule the password breaks, email is the email of the owner.
+func (p PasswordPolicy) Check(password string, email string) error {
+	if password == "" {
+		return PolicyError("password should not be blank")
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return PolicyError(fmt.Sprintf("password should be at least %d characters long", p.MinLength))
+	}
+	if classes(password) < p.MinClasses {
+		return PolicyError(fmt.Sprintf("password should contain at least %d of lowercase letters, uppercase letters, digits and other characters",
+			p.MinClasses))
+	}
+	lower := strings.ToLower(password)
+	if p.RejectCommon && commonPasswords[lower] {
+		return PolicyError("password is too common")
+	}
+	if p.RejectEmail && email != "" {
+		email = strings.ToLower(email)
+		local := email
+		if at := strings.LastIndex(email, "@"); at > 0 {
+			local = email[:at]
+		}
+		if lower == email || (len(local) >= 3 && strings.Contains(lower, local)) {
+			return PolicyError("password should not contain the email")
+		}
+	}
+	return nil
+}
+
+func classes(password string) int {
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
@@ -0,0 +1,44 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Policy   PasswordPolicy
+		Password string
+		Email    string
+		Error    bool
+	}{
+		{Name: "Zero policy", Policy: PasswordPolicy{}, Password: "qwerty"},
+		{Name: "Blank", Policy: PasswordPolicy{}, Password: "", Error: true},
+		{Name: "Valid", Policy: DefaultPasswordPolicy, Password: "correct horse 7", Email: "durov@telegram.org"},
+		{Name: "Short", Policy: DefaultPasswordPolicy, Password: "Ab1!", Error: true},
+		{Name: "Length in runes", Policy: PasswordPolicy{MinLength: 6}, Password: "пароль"},
+		{Name: "Single class", Policy: DefaultPasswordPolicy, Password: "correcthorse", Error: true},
+		{Name: "Cyrillic classes", Policy: DefaultPasswordPolicy, Password: "Конь-Батарея"},
+		{Name: "Common", Policy: DefaultPasswordPolicy, Password: "Password123", Error: true},
+		{Name: "Common allowed", Policy: PasswordPolicy{MinLength: 8, MinClasses: 2}, Password: "Password123"},
+		{Name: "Email", Policy: DefaultPasswordPolicy, Password: "Durov@Telegram.org", Email: "durov@telegram.org", Error: true},
+		{Name: "Email name", Policy: DefaultPasswordPolicy, Password: "durov1984", Email: "durov@telegram.org", Error: true},
+		{Name: "Short email name", Policy: DefaultPasswordPolicy, Password: "ab-secret-7", Email: "ab@example.com"},
+		{Name: "Email allowed", Policy: PasswordPolicy{MinLength: 8, MinClasses: 2}, Password: "durov1984", Email: "durov@telegram.org"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.Policy.Check(tc.Password, tc.Email)
+			if tc.Error {
+				require.Error(t, err)
+				_, ok := err.(PolicyError)
+				require.True(t, ok)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package user
+
+import "fmt"
+
+// Role grants powers to the user, every role grants the powers of lower roles.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleRanks = map[Role]int{RoleUser: 1, RoleModerator: 2, RoleAdmin: 3}
+
+func ParseRole(s string) (Role, error) {
+	r := Role(s)
+	if _, ok := roleRanks[r]; !ok {
+		return "", fmt.Errorf("role should be one of %s, %s, %s", RoleUser, RoleModerator, RoleAdmin)
+	}
+	return r, nil
+}
+
+// Has reports whether the role grants the powers of required, an unknown role grants nothing.
+func (r Role) Has(required Role) bool {
+	rank, ok := roleRanks[r]
+	return ok && rank >= roleRanks[required]
+}
+
+// HighestRole returns the highest known role of roles, RoleUser when there is none.
+func HighestRole(roles []string) Role {
+	result := RoleUser
+	for _, s := range roles {
+		if r := Role(s); roleRanks[r] > roleRanks[result] {
+			result = r
+		}
+	}
+	return result
+}
@@ -0,0 +1,41 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRole_Has(t *testing.T) {
+	testCases := []struct {
+		Role     Role
+		Required Role
+		Has      bool
+	}{
+		{Role: RoleUser, Required: RoleUser, Has: true},
+		{Role: RoleUser, Required: RoleModerator},
+		{Role: RoleModerator, Required: RoleUser, Has: true},
+		{Role: RoleModerator, Required: RoleAdmin},
+		{Role: RoleAdmin, Required: RoleModerator, Has: true},
+		{Role: "owner", Required: RoleUser},
+		{Role: "", Required: RoleUser},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(string(tc.Role)+"/"+string(tc.Required), func(t *testing.T) {
+			require.Equal(t, tc.Has, tc.Role.Has(tc.Required))
+		})
+	}
+}
+
+func TestHighestRole(t *testing.T) {
+	r := require.New(t)
+	r.Equal(RoleUser, HighestRole(nil))
+	r.Equal(RoleUser, HighestRole([]string{"owner"}))
+	r.Equal(RoleAdmin, HighestRole([]string{"user", "admin", "moderator"}))
+	_, err := ParseRole("owner")
+	r.Error(err)
+	role, err := ParseRole("moderator")
+	r.NoError(err)
+	r.Equal(RoleModerator, role)
+}
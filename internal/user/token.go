@@ -0,0 +1,59 @@
+package user
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/asciishell/tfs-go-auction/internal/session"
+)
+
+type Purpose string
+
+const (
+	PasswordReset     Purpose = "password_reset"
+	EmailVerification Purpose = "email_verification"
+	// SigninChallenge is given after the password when 2FA is enabled, it is exchanged for a session with a code.
+	SigninChallenge Purpose = "signin_challenge"
+	RecoveryCode    Purpose = "recovery_code"
+)
+
+const (
+	PasswordResetLifeTime     = time.Hour
+	EmailVerificationLifeTime = 48 * time.Hour
+	SigninChallengeLifeTime   = 5 * time.Minute
+	// RecoveryCodeLifeTime is long enough for codes to live until 2FA is disabled or codes are replaced.
+	RecoveryCodeLifeTime = 10 * 365 * 24 * time.Hour
+)
+
+// Token is a single-use token sent to the email of the user. Only the hash of the token is stored.
+type Token struct {
+	Hash      string    `gorm:"PRIMARY_KEY"`
+	UserID    int       `gorm:"NOT NULL;index"`
+	Purpose   Purpose   `gorm:"NOT NULL"`
+	ExpiresAt time.Time `gorm:"NOT NULL"`
+	UsedAt    *time.Time
+	// Attempts counts checks of a code against the token.
+	Attempts  int       `gorm:"NOT NULL;default:0"`
+	CreatedAt time.Time `gorm:"NOT NULL"`
+}
+
+func (Token) TableName() string {
+	return "user_tokens"
+}
+
+// NewToken returns the token to send and its record to store.
+func NewToken(userID int, purpose Purpose, lifeTime time.Duration) (string, Token, error) {
+	plain, err := session.GenerateToken()
+	if err != nil {
+		return "", Token{}, errors.Wrap(err, "can't generate token")
+	}
+	now := time.Now()
+	return plain, Token{Hash: TokenHash(plain), UserID: userID, Purpose: purpose, ExpiresAt: now.Add(lifeTime), CreatedAt: now}, nil
+}
+
+func TokenHash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,53 @@
+package user
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RecoveryCodeCount = 10
+	// MaxChallengeAttempts is the number of codes which can be checked against a signin challenge.
+	MaxChallengeAttempts = 5
+)
+
+var ErrCodeUsed = errors.New("code is already used")
+
+// recoveryAlphabet skips characters which are easy to confuse when a code is typed from paper.
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+const recoveryCodeLen = 10
+
+// NewRecoveryCodes returns codes to show to the user once and their records to store.
+func NewRecoveryCodes(userID int) ([]string, []Token, error) {
+	now := time.Now()
+	codes := make([]string, 0, RecoveryCodeCount)
+	tokens := make([]Token, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code := make([]byte, recoveryCodeLen)
+		for j := range code {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryAlphabet))))
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "can't generate recovery code")
+			}
+			code[j] = recoveryAlphabet[n.Int64()]
+		}
+		plain := string(code[:recoveryCodeLen/2]) + "-" + string(code[recoveryCodeLen/2:])
+		codes = append(codes, plain)
+		tokens = append(tokens, Token{Hash: RecoveryCodeHash(userID, plain), UserID: userID, Purpose: RecoveryCode,
+			ExpiresAt: now.Add(RecoveryCodeLifeTime), CreatedAt: now})
+	}
+	return codes, tokens, nil
+}
+
+// RecoveryCodeHash ignores case and separators of the code. Codes are short, so the hash depends on the
+// user and a code of one user is never found for another.
+func RecoveryCodeHash(userID int, code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return TokenHash(strconv.Itoa(userID) + ":" + code)
+}
@@ -18,6 +18,16 @@ type User struct {
 	CreatedAt time.Time `gorm:"NOT NULL"`
 	UpdatedAt time.Time `gorm:"NOT NULL"`
 	IsShort   bool      `sql:"-"`
+	// EmailVerifiedAt is set when the user proves the email with a token sent to it.
+	EmailVerifiedAt *time.Time
+	// TOTPSecret is set on 2FA enrollment, 2FA is enabled since the user confirms a code at TOTPEnabledAt.
+	TOTPSecret    string `gorm:"NOT NULL;default:''"`
+	TOTPEnabledAt *time.Time
+	// TOTPLastStep is the time step of the last accepted code, so every code is accepted once.
+	TOTPLastStep int64 `gorm:"NOT NULL;default:0"`
+	Role         Role  `gorm:"NOT NULL;default:'user'"`
+	// BannedAt is set when an admin bans the user, a banned user can't sign in.
+	BannedAt *time.Time
 }
 type userShort struct {
 	ID        int    `json:"id"`
@@ -25,12 +35,16 @@ type userShort struct {
 	LastName  string `json:"last_name"`
 }
 type userFull struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Birthday  string    `json:"birthday"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int        `json:"id"`
+	FirstName     string     `json:"first_name"`
+	LastName      string     `json:"last_name"`
+	Birthday      string     `json:"birthday"`
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
+	TwoFactor     bool       `json:"two_factor_enabled"`
+	Role          Role       `json:"role"`
+	BannedAt      *time.Time `json:"banned_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
 const BirthdayFormat = "2006-01-02"
@@ -66,8 +80,29 @@ func (u User) MarshalJSON() ([]byte, error) {
 	if u.IsShort {
 		return json.Marshal(userShort{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName})
 	}
-	return json.Marshal(userFull{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Birthday: u.Birthday.Format(BirthdayFormat), Email: u.Email, CreatedAt: u.CreatedAt})
+	return json.Marshal(userFull{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Birthday: u.Birthday.Format(BirthdayFormat), Email: u.Email,
+		EmailVerified: u.EmailVerified(), TwoFactor: u.TwoFactorEnabled(), Role: u.UserRole(), BannedAt: u.BannedAt, CreatedAt: u.CreatedAt})
 }
+func (u User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+func (u User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// UserRole returns the role of the user, users stored before roles have RoleUser.
+func (u User) UserRole() Role {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+func (u User) Banned() bool {
+	return u.BannedAt != nil
+}
+
 func HashPassword(password string) (string, error) {
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"net"
+	"net/url"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBlockedAddress is the result of a delivery to a loopback, private or link-local address. The address
+// itself is not reported, so the delivery log can't be used to probe the internal network.
+var ErrBlockedAddress = errors.New("webhook address is not allowed")
+
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// blockedIP reports whether webhooks can't be delivered to the ip.
+func blockedIP(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// controlDial rejects connections to blocked addresses. It runs after name resolution for every address
+// dialed, so a name which resolves to an internal address later is rejected too.
+func controlDial(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrapf(err, "can't parse address %s", address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || blockedIP(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+func blockedError(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	return err == ErrBlockedAddress
+}
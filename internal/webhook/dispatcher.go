@@ -0,0 +1,263 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+	"gitlab.com/asciishell/tfs-go-auction/internal/hub"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
+)
+
+const (
+	DefaultMaxAttempts = 8
+	DefaultMaxFailures = 20
+	DefaultBaseDelay   = 10 * time.Second
+	DefaultMaxDelay    = time.Hour
+	DefaultTimeout     = 10 * time.Second
+	DefaultWorkers     = 8
+)
+
+// Store is the part of storage.Storage used by webhooks.
+type Store interface {
+	GetWebhook(w *Webhook) error
+	GetWebhooks(condition Webhook) ([]Webhook, error)
+	RecordWebhookResult(id int, success bool, maxFailures int) (Webhook, error)
+	AddDelivery(d *Delivery) error
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]Delivery, error)
+	UpdateDelivery(d *Delivery) error
+}
+
+// Payload is the body of a delivery request.
+type Payload struct {
+	Event string          `json:"event"`
+	LotID int             `json:"lot_id,omitempty"`
+	Time  time.Time       `json:"time"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Dispatcher queues events for webhooks and delivers them with retries. A delivery is retried with
+// exponential backoff up to MaxAttempts times, a webhook is disabled after MaxFailures failed attempts in a row.
+type Dispatcher struct {
+	store       Store
+	client      *http.Client
+	logger      log.Logger
+	MaxAttempts int
+	MaxFailures int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Lease hides claimed deliveries from other instances. A request is sent only if it ends before
+	// the lease expires even on timeout, the rest of the batch is sent after the lease by any instance.
+	Lease     time.Duration
+	BatchSize int
+	// Workers is the number of webhooks served at once, deliveries of a webhook are sent in order.
+	Workers int
+	// AllowPrivate allows deliveries to loopback, private and link-local addresses.
+	AllowPrivate bool
+}
+
+func NewDispatcher(store Store, logger log.Logger) *Dispatcher {
+	d := &Dispatcher{
+		store:       store,
+		logger:      logger,
+		MaxAttempts: DefaultMaxAttempts,
+		MaxFailures: DefaultMaxFailures,
+		BaseDelay:   DefaultBaseDelay,
+		MaxDelay:    DefaultMaxDelay,
+		Lease:       6 * DefaultTimeout,
+		BatchSize:   50,
+		Workers:     DefaultWorkers,
+	}
+	dialer := &net.Dialer{
+		Timeout: DefaultTimeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			if d.AllowPrivate {
+				return nil
+			}
+			return controlDial(network, address, c)
+		},
+	}
+	d.client = &http.Client{
+		Timeout: DefaultTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: DefaultTimeout,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// Enqueue saves deliveries of the event for active webhooks of users the event is addressed to.
+func (d *Dispatcher) Enqueue(e event.Event) error {
+	name, ok := Events[e.Type]
+	if !ok {
+		return nil
+	}
+	var body []byte
+	for _, id := range users(e.Topics) {
+		hooks, err := d.store.GetWebhooks(Webhook{UserID: id, Active: true})
+		if err != nil {
+			return errors.Wrapf(err, "can't get webhooks of user %d", id)
+		}
+		for _, w := range hooks {
+			if !w.Subscribed(e.Type) {
+				continue
+			}
+			if body == nil {
+				if body, err = json.Marshal(Payload{Event: name, LotID: e.LotID, Time: e.Time, Data: e.Payload}); err != nil {
+					return errors.Wrap(err, "can't marshal webhook payload")
+				}
+			}
+			delivery := Delivery{WebhookID: w.ID, Event: name, Payload: string(body), Status: Pending, NextAttemptAt: e.Time}
+			if err = d.store.AddDelivery(&delivery); err != nil {
+				return errors.Wrapf(err, "can't queue %s for webhook %d", name, w.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func users(topics []hub.Topic) []int {
+	var result []int
+	for _, t := range topics {
+		if !strings.HasPrefix(string(t), "user:") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(string(t), "user:"))
+		if err == nil {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// Deliver claims due deliveries, sends them and returns how many of them were claimed. Webhooks are
+// served by Workers at once, so a slow endpoint delays only own deliveries.
+func (d *Dispatcher) Deliver(now time.Time) (int, error) {
+	deadline := time.Now().Add(d.Lease - d.client.Timeout)
+	deliveries, err := d.store.ClaimDeliveries(now, d.Lease, d.BatchSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't claim deliveries")
+	}
+	var order []int
+	batches := make(map[int][]*Delivery)
+	for i := range deliveries {
+		id := deliveries[i].WebhookID
+		if _, ok := batches[id]; !ok {
+			order = append(order, id)
+		}
+		batches[id] = append(batches[id], &deliveries[i])
+	}
+	queue := make(chan []*Delivery)
+	var wg sync.WaitGroup
+	for i := 0; i < d.Workers && i < len(order); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				d.deliverWebhook(batch, now, deadline)
+			}
+		}()
+	}
+	for _, id := range order {
+		queue <- batches[id]
+	}
+	close(queue)
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// deliverWebhook sends deliveries of a webhook in order. Deliveries left past the deadline stay claimed,
+// they are sent again after the lease.
+func (d *Dispatcher) deliverWebhook(batch []*Delivery, now time.Time, deadline time.Time) {
+	w := Webhook{ID: batch[0].WebhookID}
+	missing := d.store.GetWebhook(&w) != nil
+	for _, delivery := range batch {
+		switch {
+		case missing:
+			delivery.Status = Failed
+			delivery.LastError = "webhook not found"
+		case !w.Active:
+			delivery.Status = Failed
+			delivery.LastError = "webhook is disabled"
+		case time.Now().After(deadline):
+			return
+		default:
+			d.attempt(w, delivery, now)
+		}
+		if err := d.store.UpdateDelivery(delivery); err != nil {
+			d.logger.Errorf("can't save delivery %d: %+v", delivery.ID, err)
+		}
+	}
+}
+
+func (d *Dispatcher) attempt(w Webhook, delivery *Delivery, now time.Time) {
+	delivery.Attempts++
+	code, err := d.send(w, *delivery, now)
+	delivery.ResponseCode = code
+	if err == nil {
+		delivery.Status = Delivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= d.MaxAttempts {
+			delivery.Status = Failed
+		} else {
+			delivery.NextAttemptAt = now.Add(Backoff(delivery.Attempts, d.BaseDelay, d.MaxDelay))
+		}
+	}
+	updated, err2 := d.store.RecordWebhookResult(w.ID, err == nil, d.MaxFailures)
+	if err2 != nil {
+		d.logger.Errorf("can't record result of webhook %d: %+v", w.ID, err2)
+		return
+	}
+	if w.Active && !updated.Active {
+		d.logger.Infof("webhook %d is disabled after %d failures", w.ID, updated.Failures)
+	}
+}
+
+func (d *Dispatcher) send(w Webhook, delivery Delivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "can't create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tfs-go-auction-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(w.Secret, now, body))
+	resp, err := d.client.Do(req)
+	if blockedError(err) {
+		return 0, ErrBlockedAddress
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "can't send request")
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
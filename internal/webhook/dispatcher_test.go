@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/pkg/log"
+)
+
+type memStore struct {
+	mu         sync.Mutex
+	hooks      map[int]Webhook
+	deliveries []Delivery
+}
+
+func (m *memStore) GetWebhook(w *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*w = m.hooks[w.ID]
+	return nil
+}
+
+func (m *memStore) GetWebhooks(condition Webhook) ([]Webhook, error) {
+	return nil, nil
+}
+
+func (m *memStore) RecordWebhookResult(id int, success bool, maxFailures int) (Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hooks[id], nil
+}
+
+func (m *memStore) AddDelivery(d *Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d.ID = len(m.deliveries) + 1
+	m.deliveries = append(m.deliveries, *d)
+	return nil
+}
+
+func (m *memStore) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result []Delivery
+	for i, d := range m.deliveries {
+		if d.Status == Pending && !d.NextAttemptAt.After(now) && len(result) < limit {
+			m.deliveries[i].NextAttemptAt = now.Add(lease)
+			result = append(result, m.deliveries[i])
+		}
+	}
+	return result, nil
+}
+
+func (m *memStore) UpdateDelivery(d *Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries[d.ID-1] = *d
+	return nil
+}
+
+func TestDispatcher_Deliver(t *testing.T) {
+	r := require.New(t)
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	store := &memStore{hooks: map[int]Webhook{
+		1: {ID: 1, URL: hanging.URL, Active: true},
+		2: {ID: 2, URL: fast.URL, Active: true},
+	}}
+	now := time.Now()
+	for _, id := range []int{1, 1, 1, 2} {
+		r.NoError(store.AddDelivery(&Delivery{WebhookID: id, Status: Pending, Payload: "{}", NextAttemptAt: now}))
+	}
+	logger := log.New()
+	d := NewDispatcher(store, logger)
+	d.client.Timeout = 200 * time.Millisecond
+	d.Lease = 300 * time.Millisecond
+	d.Workers = 2
+	d.AllowPrivate = true
+
+	started := time.Now()
+	count, err := d.Deliver(now)
+	r.NoError(err)
+	r.Equal(4, count)
+	r.True(time.Since(started) < d.Lease, "requests are not started after the deadline")
+	r.Equal(Delivered, store.deliveries[3].Status, "a hanging endpoint does not hold other webhooks")
+	r.Equal(1, store.deliveries[0].Attempts)
+	r.Zero(store.deliveries[1].Attempts, "deliveries past the deadline stay claimed")
+	r.Zero(store.deliveries[2].Attempts)
+	r.Equal(now.Add(d.Lease), store.deliveries[1].NextAttemptAt)
+}
+
+func TestDispatcher_DeliverPrivate(t *testing.T) {
+	r := require.New(t)
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer receiver.Close()
+
+	store := &memStore{hooks: map[int]Webhook{1: {ID: 1, URL: receiver.URL, Active: true}}}
+	now := time.Now()
+	r.NoError(store.AddDelivery(&Delivery{WebhookID: 1, Status: Pending, Payload: "{}", NextAttemptAt: now}))
+	d := NewDispatcher(store, log.New())
+
+	count, err := d.Deliver(now)
+	r.NoError(err)
+	r.Equal(1, count)
+	r.False(called)
+	r.Equal(1, store.deliveries[0].Attempts)
+	r.Zero(store.deliveries[0].ResponseCode)
+	r.Equal(ErrBlockedAddress.Error(), store.deliveries[0].LastError)
+}
+
+func TestBlockedIP(t *testing.T) {
+	testCases := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.blocked, blockedIP(net.ParseIP(tc.ip)), tc.ip)
+	}
+}
@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+)
+
+// Headers of a delivery request. The signature is hex HMAC-SHA256 of "<timestamp>.<body>" with the secret
+// of the webhook, receivers should reject old timestamps to prevent replays.
+const (
+	SignatureHeader = "X-Auction-Signature"
+	TimestampHeader = "X-Auction-Timestamp"
+	EventHeader     = "X-Auction-Event"
+	DeliveryHeader  = "X-Auction-Delivery"
+)
+
+const secretLen = 32
+
+// Names of events webhooks subscribe to.
+var Events = map[event.Type]string{
+	event.BidPlaced:   "bid.placed",
+	event.LotUpdated:  "lot.updated",
+	event.LotExtended: "lot.extended",
+	event.LotFinished: "lot.finished",
+	event.LotDeleted:  "lot.deleted",
+}
+
+// Webhook is an endpoint of the user, it gets events of lots the user created or bought.
+type Webhook struct {
+	ID         int        `json:"id" gorm:"PRIMARY_KEY;AUTO_INCREMENT"`
+	UserID     int        `json:"-" gorm:"NOT NULL;index"`
+	URL        string     `json:"url" gorm:"NOT NULL"`
+	Secret     string     `json:"secret,omitempty" gorm:"NOT NULL"`
+	Events     []string   `json:"events" gorm:"-"`
+	EventList  string     `json:"-" gorm:"column:events;NOT NULL"`
+	Active     bool       `json:"active" gorm:"NOT NULL"`
+	Failures   int        `json:"failures" gorm:"NOT NULL;default:0"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"NOT NULL"`
+	UpdatedAt  time.Time  `json:"updated_at" gorm:"NOT NULL"`
+}
+
+// BeforeSave and AfterFind keep the list of events in a single column.
+func (w *Webhook) BeforeSave() error {
+	w.EventList = strings.Join(w.Events, ",")
+	return nil
+}
+
+func (w *Webhook) AfterFind() error {
+	w.Events = nil
+	if w.EventList != "" {
+		w.Events = strings.Split(w.EventList, ",")
+	}
+	return nil
+}
+
+func (w Webhook) Check() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return errors.Wrap(err, "url is invalid")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url should be an absolute http or https url")
+	}
+	if len(w.Events) == 0 {
+		return fmt.Errorf("events should not be empty")
+	}
+	for _, name := range w.Events {
+		if !validEvent(name) {
+			return fmt.Errorf("unknown event %s", name)
+		}
+	}
+	return nil
+}
+
+// Subscribed reports whether the webhook gets events of type t.
+func (w Webhook) Subscribed(t event.Type) bool {
+	name, ok := Events[t]
+	if !ok {
+		return false
+	}
+	for _, v := range w.Events {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validEvent(name string) bool {
+	for _, v := range Events {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func GenerateSecret() (string, error) {
+	result := make([]byte, secretLen)
+	if _, err := rand.Read(result); err != nil {
+		return "", errors.Wrap(err, "can't generate secret")
+	}
+	return hex.EncodeToString(result), nil
+}
+
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	_, _ = mac.Write([]byte("."))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and the timestamp headers of a delivery, it is what receivers should do.
+func Verify(secret string, signature string, timestamp string, body []byte, now time.Time, tolerance time.Duration) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("timestamp should be unix time")
+	}
+	t := time.Unix(unix, 0)
+	if t.Before(now.Add(-tolerance)) || t.After(now.Add(tolerance)) {
+		return fmt.Errorf("timestamp is out of tolerance")
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, t, body))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+type Status string
+
+const (
+	Pending   Status = "pending"
+	Delivered Status = "delivered"
+	Failed    Status = "failed"
+)
+
+// Delivery is an event queued for a webhook, it keeps the result of the last attempt.
+type Delivery struct {
+	ID            int        `json:"id" gorm:"PRIMARY_KEY;AUTO_INCREMENT"`
+	WebhookID     int        `json:"webhook_id" gorm:"NOT NULL;index"`
+	Event         string     `json:"event" gorm:"NOT NULL"`
+	Payload       string     `json:"payload" gorm:"NOT NULL;type:text"`
+	Status        Status     `json:"status" gorm:"NOT NULL;index"`
+	Attempts      int        `json:"attempts" gorm:"NOT NULL;default:0"`
+	ResponseCode  int        `json:"response_code,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"NOT NULL;index"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at" gorm:"NOT NULL"`
+}
+
+func (Delivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// Backoff returns the delay before the next attempt: base doubled after every failed attempt, up to max.
+func Backoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/asciishell/tfs-go-auction/internal/event"
+)
+
+func TestWebhook_Check(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Webhook Webhook
+		Error   bool
+	}{
+		{Name: "Valid", Webhook: Webhook{URL: "https://erp.example.com/hook", Events: []string{"lot.finished", "bid.placed"}}},
+		{Name: "Relative url", Webhook: Webhook{URL: "/hook", Events: []string{"lot.finished"}}, Error: true},
+		{Name: "Other scheme", Webhook: Webhook{URL: "ftp://erp.example.com", Events: []string{"lot.finished"}}, Error: true},
+		{Name: "No events", Webhook: Webhook{URL: "http://127.0.0.1:8080"}, Error: true},
+		{Name: "Unknown event", Webhook: Webhook{URL: "http://127.0.0.1:8080", Events: []string{"lot_finished"}}, Error: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.Webhook.Check()
+			if tc.Error {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestWebhook_Subscribed(t *testing.T) {
+	r := require.New(t)
+	w := Webhook{Events: []string{"lot.finished"}}
+	r.True(w.Subscribed(event.LotFinished))
+	r.False(w.Subscribed(event.BidPlaced))
+	r.False(w.Subscribed(event.Reset))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"event":"lot.finished"}`)
+	signature := Sign("secret", now, body)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	testCases := []struct {
+		Name      string
+		Secret    string
+		Signature string
+		Timestamp string
+		Body      []byte
+		Now       time.Time
+		Error     bool
+	}{
+		{Name: "Valid", Secret: "secret", Signature: signature, Timestamp: timestamp, Body: body, Now: now.Add(time.Minute)},
+		{Name: "Wrong secret", Secret: "other", Signature: signature, Timestamp: timestamp, Body: body, Now: now, Error: true},
+		{Name: "Changed body", Secret: "secret", Signature: signature, Timestamp: timestamp, Body: []byte(`{}`), Now: now, Error: true},
+		{Name: "Changed timestamp", Secret: "secret", Signature: signature, Timestamp: strconv.FormatInt(now.Unix()+1, 10), Body: body, Now: now, Error: true},
+		{Name: "Replay", Secret: "secret", Signature: signature, Timestamp: timestamp, Body: body, Now: now.Add(time.Hour), Error: true},
+		{Name: "Bad timestamp", Secret: "secret", Signature: signature, Timestamp: "yesterday", Body: body, Now: now, Error: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			err := Verify(tc.Secret, tc.Signature, tc.Timestamp, tc.Body, tc.Now, 5*time.Minute)
+			if tc.Error {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := require.New(t)
+	var delays []time.Duration
+	for attempts := 1; attempts <= 6; attempts++ {
+		delays = append(delays, Backoff(attempts, 10*time.Second, time.Minute))
+	}
+	r.Equal([]time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute, time.Minute}, delays)
+}
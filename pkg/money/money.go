@@ -0,0 +1,305 @@
+package money
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Currency is an ISO 4217 code.
+type Currency string
+
+const (
+	RUB Currency = "RUB"
+	USD Currency = "USD"
+	EUR Currency = "EUR"
+)
+
+const DefaultCurrency = RUB
+
+var symbols = map[Currency]string{
+	RUB: "₽",
+	USD: "$",
+	EUR: "€",
+}
+
+// exponents keeps the number of minor units digits, currencies not listed here use 2.
+var exponents = map[Currency]int{
+	"JPY": 0,
+	"KRW": 0,
+}
+
+// Valid checks the format of the code, it doesn't check that the currency exists.
+func (c Currency) Valid() bool {
+	if len(c) != 3 {
+		return false
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Symbol returns the currency sign or the code if the sign is unknown.
+func (c Currency) Symbol() string {
+	if s, ok := symbols[c]; ok {
+		return s
+	}
+	return string(c)
+}
+
+func (c Currency) Exponent() int {
+	if e, ok := exponents[c]; ok {
+		return e
+	}
+	return 2
+}
+
+func (c Currency) scale() int64 {
+	result := int64(1)
+	for i := 0; i < c.Exponent(); i++ {
+		result *= 10
+	}
+	return result
+}
+
+// Money is an exact amount in minor units of the currency, e.g. kopecks or cents.
+type Money struct {
+	Amount   int64
+	Currency Currency
+}
+
+func New(amount int64, c Currency) Money {
+	return Money{Amount: amount, Currency: c}
+}
+
+// FromMajor makes an amount from whole units of the currency, e.g. rubles or dollars.
+func FromMajor(units int64, c Currency) Money {
+	return Money{Amount: units * c.scale(), Currency: c}
+}
+
+// Parse reads a decimal string like "10", "10.5" or "-3.05". It fails if the string has more
+// fractional digits than the currency allows.
+func Parse(s string, c Currency) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	parts := strings.Split(digits, ".")
+	if len(parts) > 2 || parts[0] == "" && (len(parts) == 1 || parts[1] == "") {
+		return Money{}, fmt.Errorf("can't parse amount %q", s)
+	}
+	if len(parts) == 2 && len(parts[1]) > c.Exponent() {
+		return Money{}, fmt.Errorf("amount %q has more than %d fractional digits", s, c.Exponent())
+	}
+	var units, fraction int64
+	var err error
+	if parts[0] != "" {
+		if units, err = parseDigits(parts[0]); err != nil {
+			return Money{}, fmt.Errorf("can't parse amount %q", s)
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		frac := parts[1] + strings.Repeat("0", c.Exponent()-len(parts[1]))
+		if fraction, err = parseDigits(frac); err != nil {
+			return Money{}, fmt.Errorf("can't parse amount %q", s)
+		}
+	}
+	amount := units*c.scale() + fraction
+	if amount/c.scale() != units {
+		return Money{}, fmt.Errorf("amount %q is too large", s)
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: c}, nil
+}
+
+func parseDigits(s string) (int64, error) {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("unexpected symbol %q", r)
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Decimal returns the amount in major units with all minor digits, e.g. "10.50".
+func (m Money) Decimal() string {
+	exp := m.Currency.Exponent()
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	scale := m.Currency.scale()
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, exp, amount%scale)
+}
+
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + string(m.Currency)
+}
+
+// Display formats the amount with the currency symbol for people, e.g. "10.50 ₽".
+func (m Money) Display() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.Currency.Symbol()
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) SameCurrency(o Money) bool {
+	return m.Currency == o.Currency
+}
+
+// Resolve returns the amount in currency c. Amounts given without currency get c,
+// amounts in another currency are rejected: Resolve never converts.
+func (m Money) Resolve(c Currency) (Money, error) {
+	if m.Currency == c {
+		return m, nil
+	}
+	if m.Currency != "" {
+		return Money{}, fmt.Errorf("amount %s should be in %s", m, c)
+	}
+	from, to := m.Currency.scale(), c.scale()
+	if from > to && m.Amount%(from/to) != 0 {
+		return Money{}, fmt.Errorf("amount %s has more than %d fractional digits for %s", m.Decimal(), c.Exponent(), c)
+	}
+	amount := m.Amount
+	if from > to {
+		amount /= from / to
+	} else {
+		amount *= to / from
+	}
+	return Money{Amount: amount, Currency: c}, nil
+}
+
+// Add, Sub and Mul keep the currency of m, callers check SameCurrency when it matters.
+func (m Money) Add(o Money) Money {
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}
+}
+
+func (m Money) Sub(o Money) Money {
+	return Money{Amount: m.Amount - o.Amount, Currency: m.Currency}
+}
+
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Cmp returns -1, 0 or +1 comparing amounts.
+func (m Money) Cmp(o Money) int {
+	switch {
+	case m.Amount < o.Amount:
+		return -1
+	case m.Amount > o.Amount:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (m Money) Less(o Money) bool {
+	return m.Amount < o.Amount
+}
+
+func Max(a Money, b Money) Money {
+	if a.Less(b) {
+		return b
+	}
+	return a
+}
+
+func Min(a Money, b Money) Money {
+	if b.Less(a) {
+		return b
+	}
+	return a
+}
+
+type jsonMoney struct {
+	Amount   string   `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+// MarshalJSON writes the amount as a decimal string to keep it exact for any client.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMoney{Amount: m.Decimal(), Currency: m.Currency})
+}
+
+// UnmarshalJSON accepts {"amount": "10.50", "currency": "RUB"}, a bare number or a decimal string.
+// Without the currency the amount stays unbound, the owner of the field resolves it with Resolve.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var v struct {
+			Amount   json.Number `json:"amount"`
+			Currency Currency    `json:"currency"`
+		}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		return m.set(v.Amount.String(), v.Currency)
+	}
+	var n json.Number
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&n); err != nil {
+		return fmt.Errorf("can't parse money %s", data)
+	}
+	return m.set(n.String(), "")
+}
+
+func (m *Money) set(amount string, c Currency) error {
+	result, err := Parse(amount, Currency(strings.ToUpper(string(c))))
+	if err != nil {
+		return err
+	}
+	*m = result
+	return nil
+}
+
+// Value stores only minor units, the currency is kept in a separate column by the owner of the field.
+func (m Money) Value() (driver.Value, error) {
+	return m.Amount, nil
+}
+
+// Scan reads minor units, the currency is set to DefaultCurrency until the owner applies its own.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		*m = Money{Amount: v, Currency: DefaultCurrency}
+	case []byte:
+		amount, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("can't scan money %s", v)
+		}
+		*m = Money{Amount: amount, Currency: DefaultCurrency}
+	case string:
+		amount, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("can't scan money %s", v)
+		}
+		*m = Money{Amount: amount, Currency: DefaultCurrency}
+	default:
+		return fmt.Errorf("can't scan money from %T", src)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	type testCase struct {
+		Name     string
+		Value    string
+		Currency Currency
+		Expected int64
+		Error    bool
+	}
+	testCases := []testCase{
+		{Name: "Integer", Value: "10", Currency: RUB, Expected: 1000},
+		{Name: "One digit", Value: "10.5", Currency: RUB, Expected: 1050},
+		{Name: "Two digits", Value: "10.05", Currency: USD, Expected: 1005},
+		{Name: "Only fraction", Value: ".5", Currency: EUR, Expected: 50},
+		{Name: "Negative", Value: "-3.05", Currency: RUB, Expected: -305},
+		{Name: "No minor units", Value: "150", Currency: "JPY", Expected: 150},
+		{Name: "Too many digits", Value: "10.005", Currency: RUB, Error: true},
+		{Name: "Fraction for JPY", Value: "1.5", Currency: "JPY", Error: true},
+		{Name: "Exponent", Value: "1e3", Currency: RUB, Error: true},
+		{Name: "Empty", Value: "", Currency: RUB, Error: true},
+		{Name: "Dot", Value: ".", Currency: RUB, Error: true},
+		{Name: "Overflow", Value: "922337203685477580", Currency: RUB, Error: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			m, err := Parse(tc.Value, tc.Currency)
+			if tc.Error {
+				r.Error(err)
+				return
+			}
+			r.NoError(err)
+			r.Equal(New(tc.Expected, tc.Currency), m)
+		})
+	}
+}
+
+func TestMoney_Decimal(t *testing.T) {
+	r := require.New(t)
+	r.Equal("10.50", New(1050, RUB).Decimal())
+	r.Equal("0.05", New(5, USD).Decimal())
+	r.Equal("-3.05", New(-305, RUB).Decimal())
+	r.Equal("150", New(150, "JPY").Decimal())
+	r.Equal("10.50 RUB", New(1050, RUB).String())
+}
+
+func TestMoney_JSON(t *testing.T) {
+	r := require.New(t)
+	data, err := json.Marshal(New(1050, USD))
+	r.NoError(err)
+	r.JSONEq(`{"amount": "10.50", "currency": "USD"}`, string(data))
+
+	for input, expected := range map[string]Money{
+		`{"amount": "10.50", "currency": "usd"}`: New(1050, USD),
+		`{"amount": 10.5, "currency": "EUR"}`:    New(1050, EUR),
+		`{"amount": "7"}`:                        New(700, ""),
+		`10.1`:                                   New(1010, ""),
+		`"0.3"`:                                  New(30, ""),
+	} {
+		var m Money
+		r.NoError(json.Unmarshal([]byte(input), &m), input)
+		r.Equal(expected, m, input)
+	}
+	var m Money
+	r.Error(json.Unmarshal([]byte(`0.001`), &m))
+	r.Error(json.Unmarshal([]byte(`true`), &m))
+}
+
+func TestMoney_Resolve(t *testing.T) {
+	r := require.New(t)
+	m, err := New(1050, "").Resolve(USD)
+	r.NoError(err)
+	r.Equal(New(1050, USD), m)
+	m, err = New(1200, "").Resolve("JPY")
+	r.NoError(err)
+	r.Equal(New(12, "JPY"), m)
+	_, err = New(1250, "").Resolve("JPY")
+	r.Error(err)
+	_, err = New(1050, EUR).Resolve(USD)
+	r.Error(err)
+	m, err = New(1050, EUR).Resolve(EUR)
+	r.NoError(err)
+	r.Equal(New(1050, EUR), m)
+	r.Equal("10.50 ₽", New(1050, RUB).Display())
+	r.Equal("1.00 CHF", New(100, "CHF").Display())
+}
+
+func TestMoney_Scan(t *testing.T) {
+	r := require.New(t)
+	var m Money
+	r.NoError(m.Scan(int64(1050)))
+	r.Equal(New(1050, DefaultCurrency), m)
+	r.NoError(m.Scan([]byte("42")))
+	r.Equal(New(42, DefaultCurrency), m)
+	r.Error(m.Scan(1.5))
+	v, err := New(1050, USD).Value()
+	r.NoError(err)
+	r.Equal(int64(1050), v)
+}
@@ -0,0 +1,137 @@
+package money
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rates keeps exchange rates to the base currency: one unit of a currency costs rate units of the base.
+// It is safe for concurrent use, the table is replaced as a whole.
+type Rates struct {
+	mu        sync.RWMutex
+	base      Currency
+	rates     map[Currency]*big.Rat
+	updatedAt time.Time
+}
+
+// RatesTable is the JSON form of Rates, e.g. {"base": "RUB", "rates": {"USD": "92.5", "EUR": "100.25"}}.
+type RatesTable struct {
+	Base      Currency            `json:"base"`
+	Rates     map[Currency]string `json:"rates"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+// RateDigits is the maximum number of fractional digits of a rate.
+const RateDigits = 12
+
+var rateFormat = regexp.MustCompile(fmt.Sprintf(`^[0-9]+(\.[0-9]{1,%d})?$`, RateDigits))
+
+func NewRates(base Currency) *Rates {
+	return &Rates{base: base, rates: map[Currency]*big.Rat{}}
+}
+
+// Set replaces the table. Rates are decimal strings with at most RateDigits fractional digits to keep them exact.
+func (r *Rates) Set(t RatesTable) error {
+	if !t.Base.Valid() {
+		return fmt.Errorf("invalid base currency %q", t.Base)
+	}
+	rates := make(map[Currency]*big.Rat, len(t.Rates))
+	for c, v := range t.Rates {
+		if !c.Valid() {
+			return fmt.Errorf("invalid currency %q", c)
+		}
+		if !rateFormat.MatchString(v) {
+			return fmt.Errorf("rate %q for %s should be a decimal with at most %d fractional digits", v, c, RateDigits)
+		}
+		rate, ok := new(big.Rat).SetString(v)
+		if !ok || rate.Sign() <= 0 {
+			return fmt.Errorf("invalid rate %q for %s", v, c)
+		}
+		rates[c] = rate
+	}
+	rates[t.Base] = big.NewRat(1, 1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.base = t.Base
+	r.rates = rates
+	r.updatedAt = time.Now()
+	return nil
+}
+
+func (r *Rates) Load(reader io.Reader) error {
+	var t RatesTable
+	if err := json.NewDecoder(reader).Decode(&t); err != nil {
+		return fmt.Errorf("can't decode rates: %s", err)
+	}
+	return r.Set(t)
+}
+
+func (r *Rates) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("can't open rates file: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return r.Load(f)
+}
+
+func (r *Rates) Table() RatesTable {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t := RatesTable{Base: r.base, Rates: make(map[Currency]string, len(r.rates)), UpdatedAt: r.updatedAt}
+	for c, v := range r.rates {
+		if c != r.base {
+			t.Rates[c] = formatRate(v)
+		}
+	}
+	return t
+}
+
+// formatRate returns the exact decimal form of a rate accepted by Set without trailing zeros.
+func formatRate(v *big.Rat) string {
+	s := v.FloatString(RateDigits)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// Convert returns an indicative amount in currency to, rounded half away from zero to its minor units.
+func (r *Rates) Convert(m Money, to Currency) (Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	r.mu.RLock()
+	from, okFrom := r.rates[m.Currency]
+	target, okTo := r.rates[to]
+	r.mu.RUnlock()
+	if !okFrom {
+		return Money{}, fmt.Errorf("no exchange rate for %s", m.Currency)
+	}
+	if !okTo {
+		return Money{}, fmt.Errorf("no exchange rate for %s", to)
+	}
+	v := new(big.Rat).SetFrac64(m.Amount, m.Currency.scale())
+	v.Mul(v, from)
+	v.Quo(v, target)
+	v.Mul(v, new(big.Rat).SetInt64(to.scale()))
+	return Money{Amount: round(v), Currency: to}, nil
+}
+
+func round(v *big.Rat) int64 {
+	num := new(big.Int).Abs(v.Num())
+	q, rem := new(big.Int).QuoRem(num, v.Denom(), new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(v.Denom()) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if v.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q.Int64()
+}
@@ -0,0 +1,64 @@
+package money
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRates_Convert(t *testing.T) {
+	r := require.New(t)
+	rates := NewRates(RUB)
+	r.NoError(rates.Load(strings.NewReader(`{"base": "RUB", "rates": {"USD": "90", "EUR": "100", "JPY": "0.6"}}`)))
+	type testCase struct {
+		Name     string
+		From     Money
+		To       Currency
+		Expected Money
+		Error    bool
+	}
+	testCases := []testCase{
+		{Name: "Same currency", From: New(1050, USD), To: USD, Expected: New(1050, USD)},
+		{Name: "To base", From: New(1050, USD), To: RUB, Expected: New(94500, RUB)},
+		{Name: "From base rounded down", From: New(10000, RUB), To: USD, Expected: New(111, USD)},
+		{Name: "From base rounded up", From: New(100050, RUB), To: USD, Expected: New(1112, USD)},
+		{Name: "Cross rate", From: New(9000, EUR), To: USD, Expected: New(10000, USD)},
+		{Name: "No minor units", From: New(100, RUB), To: "JPY", Expected: New(2, "JPY")},
+		{Name: "Unknown target", From: New(100, RUB), To: "GBP", Error: true},
+		{Name: "Unknown source", From: New(100, "GBP"), To: RUB, Error: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r := require.New(t)
+			m, err := rates.Convert(tc.From, tc.To)
+			if tc.Error {
+				r.Error(err)
+				return
+			}
+			r.NoError(err)
+			r.Equal(tc.Expected, m)
+		})
+	}
+}
+
+func TestRates_Set(t *testing.T) {
+	r := require.New(t)
+	rates := NewRates(RUB)
+	r.Error(rates.Set(RatesTable{Base: "rub"}))
+	r.Error(rates.Set(RatesTable{Base: RUB, Rates: map[Currency]string{USD: "-1"}}))
+	r.Error(rates.Set(RatesTable{Base: RUB, Rates: map[Currency]string{USD: "abc"}}))
+	r.Error(rates.Set(RatesTable{Base: RUB, Rates: map[Currency]string{USD: "0"}}))
+	r.Error(rates.Set(RatesTable{Base: RUB, Rates: map[Currency]string{USD: "1/3"}}))
+	r.Error(rates.Set(RatesTable{Base: RUB, Rates: map[Currency]string{USD: "1e2"}}))
+	r.Error(rates.Set(RatesTable{Base: RUB, Rates: map[Currency]string{USD: "0.0000000000001"}}), "too precise")
+	set := map[Currency]string{USD: "92.5", EUR: "100", "JPY": "0.0000123456", "GBP": "0.000000000001"}
+	r.NoError(rates.Set(RatesTable{Base: RUB, Rates: set}))
+	table := rates.Table()
+	r.Equal(RUB, table.Base)
+	r.Equal(set, table.Rates)
+	r.False(table.UpdatedAt.IsZero())
+	r.NoError(rates.Set(table), "the table round-trips")
+	r.Equal(set, rates.Table().Rates)
+}
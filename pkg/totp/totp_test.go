@@ -0,0 +1,75 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 6238.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	testCases := []struct {
+		Time     int64
+		Expected string
+	}{
+		{Time: 59, Expected: "287082"},
+		{Time: 1111111109, Expected: "081804"},
+		{Time: 1111111111, Expected: "050471"},
+		{Time: 1234567890, Expected: "005924"},
+		{Time: 2000000000, Expected: "279037"},
+		{Time: 20000000000, Expected: "353130"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Expected, func(t *testing.T) {
+			result, err := Code(rfcSecret, time.Unix(tc.Time, 0))
+			require.NoError(t, err)
+			require.Equal(t, tc.Expected, result)
+		})
+	}
+	_, err := Code("not base32!", time.Now())
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	r := require.New(t)
+	secret, err := GenerateSecret()
+	r.NoError(err)
+	r.Len(secret, 32)
+	now := time.Unix(1234567890, 0)
+	current, err := Code(secret, now)
+	r.NoError(err)
+	previous, err := Code(secret, now.Add(-Period))
+	r.NoError(err)
+	old, err := Code(secret, now.Add(-2*Period))
+	r.NoError(err)
+
+	step, ok := Validate(secret, current, now)
+	r.True(ok)
+	r.Equal(Step(now), step)
+	step, ok = Validate(secret, previous, now)
+	r.True(ok, "previous code is accepted")
+	r.Equal(Step(now)-1, step)
+	_, ok = Validate(secret, old, now)
+	r.False(ok)
+	_, ok = Validate(secret, current[:Digits-1], now)
+	r.False(ok)
+	_, ok = Validate("not base32!", current, now)
+	r.False(ok)
+}
+
+func TestURI(t *testing.T) {
+	r := require.New(t)
+	u, err := url.Parse(URI("TFS Auction", "durov@telegram.org", rfcSecret))
+	r.NoError(err)
+	r.Equal("otpauth", u.Scheme)
+	r.Equal("totp", u.Host)
+	r.Equal("/TFS Auction:durov@telegram.org", u.Path)
+	r.Equal(rfcSecret, u.Query().Get("secret"))
+	r.Equal("TFS Auction", u.Query().Get("issuer"))
+	r.Equal("6", u.Query().Get("digits"))
+}